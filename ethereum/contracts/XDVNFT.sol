@@ -9,6 +9,7 @@ import "@openzeppelin/contracts/token/ERC721/extensions/ERC721Burnable.sol";
 import "@openzeppelin/contracts/token/ERC721/extensions/ERC721Pausable.sol";
 import "@openzeppelin/contracts/token/ERC721/extensions/ERC721URIStorage.sol";
 import "@openzeppelin/contracts/utils/Counters.sol";
+import "@openzeppelin/contracts/utils/Strings.sol";
 import "./ancon/TrustedOffchainHelper.sol";
 
 //  a NFT secure document
@@ -27,6 +28,21 @@ contract XDVNFT is
     uint256 public serviceFeeForPaymentAddress = 0;
     uint256 public serviceFeeForContract = 0;
 
+    bytes32 public constant TRANSFER_URI_TYPEHASH =
+        keccak256(
+            "TransferURI(string metadataCid,string fromOwner,string resultCid,string toOwner,string toAddress,string tokenId,uint256 nonce,uint256 deadline)"
+        );
+
+    struct TransferProof {
+        string metadataCid;
+        string fromOwner;
+        string resultCid;
+        string toOwner;
+        uint256 nonce;
+        uint256 deadline;
+        bytes signature;
+    }
+
     event Withdrawn(address indexed paymentAddress, uint256 amount);
 
     event ServiceFeePaid(
@@ -55,106 +71,112 @@ contract XDVNFT is
     }
 
     /**
-     * @dev Requests a DAG contract offchain execution
+     * @dev Requests a DAG contract offchain execution, the gateway answers
+     * transferURI(metadataCid, fromOwner, toOwner, toAddress, tokenId, prefix,
+     * ownerSignature) with the EIP-712 proof for transferURIWithProofCallback.
+     * ownerSignature is the EIP-712 TransferURIRequest(string metadataCid,
+     * string toOwner,string toAddress,string tokenId) signed by the token owner
      */
-    function transferURI(address toAddress, uint256 tokenId)
-        external
-        returns (bytes32)
-    {
+    function transferURI(
+        address toAddress,
+        uint256 tokenId,
+        bytes calldata ownerSignature
+    ) external view returns (uint256) {
+        string memory to = Strings.toHexString(uint256(uint160(toAddress)), 20);
+        string memory id = Strings.toString(tokenId);
         revert OffchainLookup(
-            url,
+            address(this),
+            gatewayUrls(),
             abi.encodeWithSignature(
-                "transferURIWithProof(address toAddress, uint256 tokenId, bytes memory proof)",
-                toAddress,
-                tokenId
-            )
+                "transferURI(string,string,string,string,string,string,bytes)",
+                tokenURI(tokenId),
+                Strings.toHexString(uint256(uint160(ownerOf(tokenId))), 20),
+                to,
+                to,
+                id,
+                Strings.toHexString(uint256(uint160(address(this))), 20),
+                ownerSignature
+            ),
+            this.transferURIWithProofCallback.selector,
+            abi.encode(to, tokenId)
         );
     }
 
     /**
-     * @dev Transfer a XDV Data Token URI with proof
+     * @dev CCIP-read callback of transferURI
+     */
+    function transferURIWithProofCallback(
+        bytes calldata response,
+        bytes calldata extraData
+    ) external returns (uint256) {
+        (string memory toAddress, uint256 tokenId) = abi.decode(
+            extraData,
+            (string, uint256)
+        );
+        return transferURIWithProof(toAddress, tokenId, response);
+    }
+
+    /**
+     * @dev Transfer a XDV Data Token URI with proof, the proof is the gateway
+     * transferURI response. The proof must transfer the current token URI
      */
     function transferURIWithProof(
         string memory toAddress,
-        string memory tokenId,
+        uint256 tokenId,
         bytes memory proof
     ) public returns (uint256) {
-        bool proofRef = _requestWithProof(toAddress, tokenId, proof);
-                                    
-        require(proofRef, "Invalid proof");
+        string memory id = Strings.toString(tokenId);
+        TransferProof memory p;
         (
-            bytes memory metadataCid,
-            bytes memory fromOwner,
-            bytes memory resultCid,
-            bytes memory toOwner,
-            ,
-            ,
-            bytes memory prefix,
-            bytes memory signature
+            p.metadataCid,
+            p.fromOwner,
+            p.resultCid,
+            p.toOwner,
+            p.nonce,
+            p.deadline,
+            p.signature
         ) = abi.decode(
-                proof,
-                (bytes, bytes, bytes, bytes, bytes, bytes, bytes, bytes)
-            );
-        uint256 newItemId = _tokenIds.current();
-        _setTokenURI(newItemId, string(metadataCid));
-        //       _transfer()
-        //send the method name
-        //make set token uri work
-        return newItemId;
+            proof,
+            (string, string, string, string, uint256, uint256, bytes)
+        );
+        require(
+            keccak256(bytes(p.metadataCid)) ==
+                keccak256(bytes(tokenURI(tokenId))),
+            "XDV: proof is not for the current token URI"
+        );
+        _useProof(
+            _hashTransferProof(p, toAddress, id),
+            keccak256(bytes(id)),
+            p.nonce,
+            p.deadline,
+            p.signature
+        );
+        _setTokenURI(tokenId, p.resultCid);
+        return tokenId;
     }
 
     /**
-     * @dev Requests a DAG contract offchain execution with proof
+     * @dev EIP-712 struct hash of a TransferURI proof
      */
-    function _requestWithProof(
+    function _hashTransferProof(
+        TransferProof memory p,
         string memory toAddress,
-        string memory tokenId,
-        bytes memory proof
-    ) internal returns (bool) {
-        (
-            bytes memory metadataCid,
-            bytes memory fromOwner,
-            bytes memory resultCid,
-            bytes memory toOwner,
-            ,
-            ,
-            bytes memory prefix,
-            bytes memory signature
-        ) = abi.decode(
-                proof,
-                (bytes, bytes, bytes, bytes, bytes, bytes, bytes, bytes)
-            );
-
-        if (executed[bytes32(signature)]) {
-            revert("metadata dag transfer:  invalid proof");
-        } else {
-            bytes32 digest = keccak256(
-                abi.encodePacked(
-                    "\x19Ethereum Signed Message:\n32",
-                    keccak256(
-                        abi.encodePacked(
-                            metadataCid,
-                            fromOwner,
-                            resultCid,
-                            toOwner,
-                            toAddress,
-                            tokenId,
-                            prefix
-                        )
-                    )
+        string memory tokenId
+    ) internal pure returns (bytes32) {
+        return
+            keccak256(
+                abi.encode(
+                    TRANSFER_URI_TYPEHASH,
+                    keccak256(bytes(p.metadataCid)),
+                    keccak256(bytes(p.fromOwner)),
+                    keccak256(bytes(p.resultCid)),
+                    keccak256(bytes(p.toOwner)),
+                    keccak256(bytes(toAddress)),
+                    keccak256(bytes(tokenId)),
+                    p.nonce,
+                    p.deadline
                 )
             );
-
-            require(
-                isValidProof(digest, signature),
-                "Signer is not the signer of the token"
-            );
-            {
-                executed[bytes32(signature)] = true;
-                emit ProofAccepted(msg.sender, bytes32(signature));
-            }
-            return (true);
-        }
     }
 
     /**
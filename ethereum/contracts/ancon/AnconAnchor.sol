@@ -0,0 +1,17 @@
+//SPDX-License-Identifier: Unlicense
+pragma solidity ^0.8.4;
+
+// AnconAnchor records the root hashes of the node authenticated index, the block of the
+// Anchored log proves the index version existed at the block time
+contract AnconAnchor {
+    event Anchored(
+        address indexed sender,
+        bytes32 indexed root,
+        uint256 version,
+        uint256 timestamp
+    );
+
+    function anchor(bytes32 root, uint256 version) external {
+        emit Anchored(msg.sender, root, version, block.timestamp);
+    }
+}
@@ -3,19 +3,29 @@ pragma solidity ^0.8.4;
 
 import "@openzeppelin/contracts/access/Ownable.sol";
 import "@openzeppelin/contracts/utils/cryptography/ECDSA.sol";
+import "@openzeppelin/contracts/utils/cryptography/draft-EIP712.sol";
 import "@openzeppelin/contracts/utils/Address.sol";
 
-abstract contract TrustedOffchainHelper is Ownable {
+abstract contract TrustedOffchainHelper is Ownable, EIP712 {
     using ECDSA for bytes32;
     using Address for address;
     string public url;
     address private _signer;
     mapping(bytes32 => bool) executed;
-    error OffchainLookup(string url, bytes prefix);
+    // next nonce of a nonce key, the gateway scopes nonces by token id or owner
+    mapping(bytes32 => uint256) public nonces;
+    // EIP-3668 CCIP-read
+    error OffchainLookup(
+        address sender,
+        string[] urls,
+        bytes callData,
+        bytes4 callbackFunction,
+        bytes extraData
+    );
 
-    event ProofAccepted(address sender, bytes32 signatureHash);
+    event ProofAccepted(address sender, bytes32 digest);
 
-    constructor() {}
+    constructor() EIP712("Ancon Protocol", "1") {}
 
     function setUrl(string memory url_) external onlyOwner {
         url = url_;
@@ -29,21 +39,36 @@ abstract contract TrustedOffchainHelper is Ownable {
         return _signer;
     }
 
-    function isValidProof(bytes32 digest, bytes memory signature)
-        internal
-        returns (bool           )
-    {
-        bytes32 r;
-        bytes32 s;
-        uint8 v;
-        // ecrecover takes the signature parameters, and the only way to get them
-        // currently is to use assembly.
-        assembly {
-            r := mload(add(signature, 0x20))
-            s := mload(add(signature, 0x40))
-            v := byte(0, mload(add(signature, 0x60)))
-        }
-
-        return digest.recover((v + 27), r, s) == _signer;
+    /**
+     * @dev Gateway urls, the gateway serves {sender}/{data}.json
+     */
+    function gatewayUrls() internal view returns (string[] memory) {
+        string[] memory urls = new string[](1);
+        urls[0] = url;
+        return urls;
+    }
+
+    /**
+     * @dev Verifies an EIP-712 proof signed by the gateway and consumes it, a proof
+     * is accepted once, before its deadline and with the next nonce of nonceKey
+     */
+    function _useProof(
+        bytes32 structHash,
+        bytes32 nonceKey,
+        uint256 nonce,
+        uint256 deadline,
+        bytes memory signature
+    ) internal {
+        require(block.timestamp <= deadline, "proof expired");
+        require(nonces[nonceKey] == nonce, "invalid nonce");
+        bytes32 digest = _hashTypedDataV4(structHash);
+        require(!executed[digest], "proof already used");
+        require(
+            digest.recover(signature) == _signer,
+            "Signer is not the signer of the token"
+        );
+        executed[digest] = true;
+        nonces[nonceKey] = nonce + 1;
+        emit ProofAccepted(msg.sender, digest);
     }
 }
@@ -20,6 +20,34 @@ console.log({
   CHAIN_A,
 })
 
+// signs the TransferURIRequest the gateway checks before transferring the metadata
+async function signTransferRequest(xdvnft, owner, toAddress, tokenId) {
+  const { chainId } = await provider.getNetwork()
+  const to = toAddress.toLowerCase()
+  return provider.getSigner(owner)._signTypedData(
+    {
+      name: 'Ancon Protocol',
+      version: '1',
+      chainId,
+      verifyingContract: xdvnft.address,
+    },
+    {
+      TransferURIRequest: [
+        { name: 'metadataCid', type: 'string' },
+        { name: 'toOwner', type: 'string' },
+        { name: 'toAddress', type: 'string' },
+        { name: 'tokenId', type: 'string' },
+      ],
+    },
+    {
+      metadataCid: await xdvnft.tokenURI(tokenId),
+      toOwner: to,
+      toAddress: to,
+      tokenId: String(tokenId),
+    },
+  )
+}
+
 function parseEthError(ethErr, iface) {
   try {
     const keys = Object.keys(ethErr.data)
@@ -54,7 +82,7 @@ contract(
     describe('when requesting a transfer ownership', () => {
       it('should revert', async () => {
         try {
-          await xdvnft.transferURI(xdvnft.address, 1)
+          await xdvnft.transferURI(xdvnft.address, 1, '0x')
         } catch (e) {
           if (e.message.match(/OffchainLookup/)) {
             assert.equal(e.message.match(/OffchainLookup/), true)
@@ -68,60 +96,26 @@ contract(
 
     describe('when requesting a transfer ownership with proof', () => {
       it('should succeed', async () => {
-        const toAddress = xdvnft.address
-        const tokenId = "1"
         const iface = new ethers.utils.Interface(xdvnft.abi)
-        const metadataCid = "baguqeeramhau4x5j5zihi6ffksrl7wv7qnfd2urmut2e6c7oqdbu4jj7zljq"
         try 
         {
-          await xdvnft.transferURI(xdvnft.address, 1)
+          const ownerSignature = await signTransferRequest(xdvnft, accounts[0], accounts[0], 1)
+          await xdvnft.transferURI(accounts[0], 1, ownerSignature)
         } catch (e) {
           const response = parseEthError(e, iface)
           if (response) {
-            const url = response.url;
-
-            const fromAddress = accounts[0]
-            const inputdata ={
-              toAddress,
-              tokenId,
-              metadataCid: metadataCid,
-              fromOwner: accounts[1],
-              toOwner: accounts[0],
-              prefix: response.prefix,
-            };
+            // EIP-3668, the gateway url template takes the sender and calldata
+            const url = response.urls[0]
+              .replace('{sender}', response.sender.toLowerCase())
+              .replace('{data}', response.callData)
 
-            const body = {
-              jsonrpc: '2.0',
-              method: 'durin_call',
-              params: [
-                xdvnft.address,
-                fromAddress,
-                inputdata,
-                [iface.getFunction('transferURIWithProof')],
-              ],
-              id: 1,
-            }
-
-            const result = await fetchJson(
-              {
-                url,
-              },
-              JSON.stringify(body),
-            )
+            const result = await fetchJson({ url })
             console.log(result)
-            const resParse = JSON.parse(Web3.utils.hexToString(result.result))
-            
-            let txDataDecoded = ethers.utils.defaultAbiCoder.decode(['bytes', 'bytes', 'bytes', 'bytes', 'bytes', 'bytes', 'bytes'], ethers.utils.arrayify(resParse.txdata))
-            
-            console.log("RESULT CID DECODED", resParse.txdata )
-            
-            const resTransfer = await xdvnft.transferURIWithProof(toAddress, tokenId, ethers.utils.arrayify(resParse.txdata),{
+
+            const resTransfer = await xdvnft.transferURIWithProofCallback(result.data, response.extraData, {
               from: accounts[0]
             })
             console.log("TRANSFER RESULT", JSON.stringify(resTransfer))
-            
-            
-            console.log(result)
           } else {
             console.log({ e })
           }
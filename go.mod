@@ -22,6 +22,7 @@ require (
 	github.com/anconprotocol/contracts v0.0.0-20211208185347-8e34268b1ba0
 	github.com/buger/jsonparser v1.1.1
 	github.com/confio/ics23-iavl v0.6.0
+	github.com/confio/ics23/go v0.6.6
 	github.com/cosmos/iavl v0.17.3
 	github.com/ethereum/go-ethereum v1.10.13
 	github.com/gin-gonic/gin v1.7.4
@@ -32,13 +33,16 @@ require (
 	github.com/multiformats/go-multibase v0.0.3
 	github.com/multiformats/go-multicodec v0.3.0
 	github.com/multiformats/go-multihash v0.1.0
+	github.com/multiformats/go-varint v0.0.6
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cast v1.4.1
+	github.com/square/go-jose/v3 v3.0.0-20200630053402-0a67ce9b0693
 	github.com/swaggo/files v0.0.0-20210815190702-a29dd2bc99b2
 	github.com/swaggo/gin-swagger v1.3.3
 	github.com/swaggo/swag v1.7.6
 	github.com/tendermint/tendermint v0.35.0
 	github.com/tendermint/tm-db v0.6.6
+	golang.org/x/crypto v0.0.0-20211202192323-5770296d904e
 	google.golang.org/grpc v1.42.0
 	google.golang.org/protobuf v1.27.1
 )
@@ -4,23 +4,31 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	gqlgenh "github.com/99designs/gqlgen/graphql/handler"
 	"github.com/99designs/gqlgen/graphql/playground"
 	"github.com/anconprotocol/contracts/adapters/ethereum/erc721/transfer"
-	graphqlclient "github.com/anconprotocol/contracts/graphql/client"
-	"github.com/anconprotocol/contracts/graphql/server/graph"
 	"github.com/anconprotocol/contracts/graphql/server/graph/generated"
 	"github.com/anconprotocol/node/docs"
+	"github.com/anconprotocol/node/subgraphs"
 	dagcosmos "github.com/anconprotocol/node/subgraphs/cosmos"
+	dageth "github.com/anconprotocol/node/subgraphs/evm"
 	"github.com/anconprotocol/node/x/anconsync"
 	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/anconprotocol/node/x/anconsync/handler/graph"
+	"github.com/anconprotocol/node/x/anconsync/handler/proofsignature"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cast"
+	dbm "github.com/tendermint/tm-db"
 
 	"github.com/anconprotocol/node/x/anconsync/handler/durin"
 	"github.com/anconprotocol/node/x/anconsync/impl"
@@ -30,11 +38,13 @@ import (
 
 type SubgraphConfig struct {
 	CosmosMoniker        string
+	CosmosChainID        string
 	CosmosAppHash        string
 	CosmosProxyAddress   string
 	CosmosPrimaryAddress string
 	CosmosWitnessAddress string
 	CosmosHeight         int
+	CosmosStateQueries   string
 	EnableDagcosmos      bool
 
 	EvmAddress   string
@@ -43,21 +53,18 @@ type SubgraphConfig struct {
 }
 
 // Defining the dageth RPC handler
-func dagethRPCHandler(anconCtx handler.AnconSyncContext) gin.HandlerFunc {
+func dagethRPCHandler(anconCtx *handler.AnconSyncContext) gin.HandlerFunc {
 
-	gqlcli := graphqlclient.NewClient(http.DefaultClient, "http://localhost:7788/v0/query")
-	durin := durin.NewDurinAPI(transfer.NewOnchainAdapter(anconCtx.PrivateKey), gqlcli)
+	durin := durin.NewDurinAPI(transfer.NewOnchainAdapter(anconCtx.PrivateKey), anconCtx)
 	server := rpc.NewServer()
 
-	err := server.RegisterName(durin.Namespace, durin.Service)
+	err := server.RegisterName(durin.Namespace, durin.RPC)
 	if err != nil {
 		panic(err)
 	}
 
 	return func(c *gin.Context) {
-		ctx := context.WithValue(c.Request.Context(), "dag", anconCtx)
-		rq := c.Request.WithContext(ctx)
-		server.ServeHTTP(c.Writer, rq)
+		server.ServeHTTP(c.Writer, c.Request)
 	}
 }
 
@@ -91,49 +98,165 @@ func dagethRPCHandler(anconCtx handler.AnconSyncContext) gin.HandlerFunc {
 // }
 
 // Defining the JSON RPC handler
-func jsonRPCHandler(anconCtx handler.AnconSyncContext) gin.HandlerFunc {
+func jsonRPCHandler(gateway *durin.DurinAPI, iavlAPI *proofsignature.IavlProofAPI) gin.HandlerFunc {
 
-	gqlcli := graphqlclient.NewClient(http.DefaultClient, "http://localhost:7788/v0/query")
-	durin := durin.NewDurinAPI(transfer.NewOnchainAdapter(anconCtx.PrivateKey), gqlcli)
 	server := rpc.NewServer()
 
-	err := server.RegisterName(durin.Namespace, durin.Service)
+	err := server.RegisterName(gateway.Namespace, gateway.RPC)
+	if err != nil {
+		panic(err)
+	}
+
+	// the tree is only read and proven here, it is changed on the admin endpoint
+	err = server.RegisterName(iavlAPI.Namespace, iavlAPI.Query)
 	if err != nil {
 		panic(err)
 	}
 
 	return func(c *gin.Context) {
-		ctx := context.WithValue(c.Request.Context(), "dag", anconCtx)
-		rq := c.Request.WithContext(ctx)
-		server.ServeHTTP(c.Writer, rq)
+		// relays are counted in the quota of the authenticated caller
+		server.ServeHTTP(c.Writer, c.Request.WithContext(durin.WithCaller(c.Request.Context(), handler.Caller(c))))
 	}
 }
 
-// Defining the Graphql handler
-func graphqlHandler(s anconsync.Storage) gin.HandlerFunc {
-	h := gqlgenh.NewDefaultServer(generated.NewExecutableSchema(generated.Config{Resolvers: &graph.Resolver{}}))
+// Defining the admin JSON RPC handler, it serves all methods of the iavl namespace
+func adminRPCHandler(iavlAPI *proofsignature.IavlProofAPI) gin.HandlerFunc {
+
+	server := rpc.NewServer()
+
+	err := server.RegisterName(iavlAPI.Namespace, iavlAPI.Service)
+	if err != nil {
+		panic(err)
+	}
 
 	return func(c *gin.Context) {
-		ctx := context.WithValue(c.Request.Context(), "dag", &handler.AnconSyncContext{
-			Store: s,
-		})
-		rq := c.Request.WithContext(ctx)
+		server.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// subgraphRoute serves a route with the handler route returns for the subgraph named by
+// the name param, subgraphs added at runtime are served too
+func subgraphRoute(manager *subgraphs.Manager, route func(sg subgraphs.Subgraph) gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var h gin.HandlerFunc
+		if sg, ok := manager.Get(c.Param("name")); ok {
+			h = route(sg)
+		}
+		if h == nil {
+			c.JSON(404, gin.H{
+				"error": fmt.Errorf("subgraph %s does not serve this route", c.Param("name")).Error(),
+			})
+			return
+		}
+		h(c)
+	}
+}
+
+// Defining the Graphql handler
+func graphqlHandler(dag *handler.AnconSyncContext) gin.HandlerFunc {
+	h := gqlgenh.NewDefaultServer(generated.NewExecutableSchema(generated.Config{Resolvers: graph.NewResolver(dag)}))
 
-		h.ServeHTTP(c.Writer, rq)
+	return func(c *gin.Context) {
+		h.ServeHTTP(c.Writer, c.Request)
 	}
 }
 
 // Defining the Playground handler
-func playgroundHandler(s anconsync.Storage) gin.HandlerFunc {
+func playgroundHandler() gin.HandlerFunc {
 	h := playground.Handler("GraphQL", "/query")
 
 	return func(c *gin.Context) {
-		ctx := context.WithValue(c.Request.Context(), "dag", &handler.AnconSyncContext{
-			Store: s,
-		})
-		rq := c.Request.WithContext(ctx)
+		h.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// evmArchiveCommand ingests a block range from an EVM node as dag-eth blocks
+//
+//	node evm archive -evm-node-address http://localhost:8545 -from 1 -to 100
+func evmArchiveCommand(args []string) {
+	cmd := flag.NewFlagSet("evm archive", flag.ExitOnError)
+	evmAddress := cmd.String("evm-node-address", "", "remote node address")
+	from := cmd.Uint64("from", 0, "first block to archive")
+	to := cmd.Uint64("to", 0, "last block to archive")
+	dataFolder := cmd.String("data", ".ancon", "Data directory")
+	cmd.Parse(args)
+
+	client, err := ethclient.Dial(*evmAddress)
+	if err != nil {
+		panic(fmt.Errorf("invalid evm-node-address %v", err))
+	}
+	s := anconsync.NewStorage(*dataFolder)
+	if err := dageth.Archive(context.Background(), client, s, *from, *to); err != nil {
+		panic(err)
+	}
+}
+
+// cosmosSubgraph creates Cosmos indexers. Subgraphs other than the one named cosmos keep
+// their blocks under their own namespace, headers are verified from the trustedHeight
+// and trustedHash options when set.
+func cosmosSubgraph(dag *handler.AnconSyncContext, dataFolder string) subgraphs.Factory {
+	return func(cfg subgraphs.Config) (subgraphs.Subgraph, error) {
+		indexer := dagcosmos.New(dag, cfg.Endpoint, "/websocket")
+		indexer.StartHeight = cfg.Cursor
+		lightDB := "cosmos-light"
+		if cfg.Name != dagcosmos.DefaultNamespace {
+			indexer.Namespace = strings.Join([]string{dagcosmos.DefaultNamespace, cfg.Name}, ":")
+			lightDB = strings.Join([]string{lightDB, cfg.Name}, "-")
+		}
+		queries, err := dagcosmos.ParseStateQueries(cfg.Options["stateQueries"])
+		if err != nil {
+			return nil, err
+		}
+		indexer.Queries = queries
+		if cfg.Options["trustedHash"] == "" {
+			return indexer, nil
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		db, err := dbm.NewGoLevelDB(lightDB, filepath.Join(home, dataFolder))
+		if err != nil {
+			return nil, err
+		}
+		witnesses := []string{}
+		if cfg.Options["witnesses"] != "" {
+			witnesses = strings.Split(cfg.Options["witnesses"], ",")
+		}
+		indexer.Light, err = dagcosmos.NewLightClient(context.Background(), cfg.Options["chainId"], cfg.Endpoint, witnesses,
+			cast.ToInt64(cfg.Options["trustedHeight"]), cfg.Options["trustedHash"], db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cosmos light client options %v", err)
+		}
+		return indexer, nil
+	}
+}
 
-		h.ServeHTTP(c.Writer, rq)
+// evmSubgraph creates EVM indexers, subgraphs other than the one named evm keep their
+// cursor under their own name. The logs of accepted Durin proofs are consumed by the
+// gateway.
+func evmSubgraph(dag *handler.AnconSyncContext, gateway *durin.DurinAPI) subgraphs.Factory {
+	return func(cfg subgraphs.Config) (subgraphs.Subgraph, error) {
+		client, err := ethclient.Dial(cfg.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid evm-node-address %v", err)
+		}
+		indexer := dageth.New(dag, client, cast.ToInt64(cfg.Options["chainId"]))
+		indexer.Name = cfg.Name
+		if v, ok := cfg.Options["confirmations"]; ok {
+			indexer.Confirmations = cast.ToUint64(v)
+		}
+		if v := cfg.Options["addresses"]; v != "" {
+			for _, address := range strings.Split(v, ",") {
+				if !common.IsHexAddress(address) {
+					return nil, fmt.Errorf("invalid contract address %s", address)
+				}
+				indexer.Addresses = append(indexer.Addresses, common.HexToAddress(address))
+			}
+		}
+		indexer.StartBlock = uint64(cfg.Cursor)
+		indexer.OnLog(durin.ProofAcceptedEvent().ID, gateway.Service.ProofAccepted)
+		return indexer, nil
 	}
 }
 
@@ -147,6 +270,10 @@ func playgroundHandler(s anconsync.Storage) gin.HandlerFunc {
 // @host      api.ancon.did.pa
 // @BasePath  /v0
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "evm" && os.Args[2] == "archive" {
+		evmArchiveCommand(os.Args[3:])
+		return
+	}
 	pk, has := os.LookupEnv("ETHEREUM_ADAPTER_KEY")
 	if !has {
 		panic(fmt.Errorf("environment key ETHEREUM_ADAPTER_KEY not found"))
@@ -175,20 +302,64 @@ func main() {
 	addr := flag.String("addr", "/ip4/0.0.0.0/tcp/7702", "Host multiaddr")
 	apiAddr := flag.String("apiaddr", "0.0.0.0:7788", "API address")
 	dataFolder := flag.String("data", ".ancon", "Data directory")
+	publicURL := flag.String("public-url", "", "base URL of the API in issued documents, defaults to http://<apiaddr>")
 
 	subgraph := SubgraphConfig{}
 	init := flag.Bool("init", false, "genesis")
-	subgraph.EnableDageth = *flag.Bool("enable-dageth", false, "enable EVM subgraph")
-	subgraph.EnableDagcosmos = *flag.Bool("enable-dagcosmos", false, "enable Cosmos subgraph")
-	subgraph.CosmosAppHash = *flag.String("cosmos-app-hash", "", "app hash")
-	subgraph.CosmosHeight = *flag.Int("cosmos-height", 1, "height")
-	subgraph.CosmosPrimaryAddress = *flag.String("cosmos-primary", "", "primary")
-	subgraph.EvmAddress = *flag.String("evm-node-address", "", "remote node address")
-	subgraph.EvmChainId = *flag.String("evm-chain-id", "", "chain idd")
-	subgraph.CosmosMoniker = *flag.String("cosmos-moniker", "my-graph", "cosmos-moniker")
+	flag.Bool("enable-dageth", false, "enable EVM subgraph")
+	flag.Bool("enable-dagcosmos", false, "enable Cosmos subgraph")
+	flag.String("cosmos-app-hash", "", "trusted header hash, enables light client verification")
+	flag.Int("cosmos-height", 1, "trusted header height")
+	flag.String("cosmos-primary", "", "primary")
+	flag.String("cosmos-witnesses", "", "comma separated light client witnesses")
+	flag.String("cosmos-chain-id", "", "cosmos chain id")
+	flag.String("cosmos-state-queries", "", "comma separated store:hexkey pairs proven on each block")
+	flag.String("evm-node-address", "", "remote node address")
+	flag.String("evm-chain-id", "", "chain idd")
+	evmConfirmations := flag.Uint64("evm-confirmations", dageth.DefaultConfirmations, "blocks to wait before indexing EVM logs")
+	evmAddresses := flag.String("evm-addresses", "", "comma separated contracts indexed by the EVM subgraph, all contracts when empty")
+	evmStartBlock := flag.Uint64("evm-start-block", 0, "first block indexed by the EVM subgraph")
+	subgraphsConfig := flag.String("subgraphs", "", "JSON file listing the subgraphs to run")
+	enableRelay := flag.Bool("enable-relay", false, "relay adapter-signed transactions to evm-node-address")
+	relayGasBump := flag.Int64("relay-gas-bump", durin.DefaultGasBump, "gas price increase in percent of stuck relayed transactions")
+	relayStuckAfter := flag.Duration("relay-stuck-after", durin.DefaultStuckAfter, "time before a pending relayed transaction is replaced")
+	relayTargets := flag.String("relay-targets", "", "comma separated contract:selector calls clients may relay, e.g. the CCIP-read callbacks")
+	relayQuota := flag.Int64("relay-quota", durin.DefaultRelayQuota, "relays a caller may request per hour, 0 is unlimited")
+	flag.String("cosmos-moniker", "my-graph", "cosmos-moniker")
 	moniker := flag.String("moniker", "my-graph", "moniker")
+	signedWrites := flag.String("signed-writes", "", "comma separated write routes that require a signature (dagjson,dagcbor,file)")
+	siweRoles := flag.String("siwe-roles", handler.RoleReader, "comma separated roles granted to Sign-In with Ethereum sessions when access control is enabled")
+	siweRateLimit := flag.Int64("siwe-rate-limit", 60, "requests per minute of a Sign-In with Ethereum session address, 0 is unlimited")
+	indexBatchSize := flag.Int("index-batch-size", handler.DefaultIndexBatchSize, "index writes saved as one authenticated index version, 0 disables the authenticated index")
+	indexCheckpointInterval := flag.Duration("index-checkpoint-interval", time.Minute, "time between authenticated index checkpoints of pending writes")
+	anchorContract := flag.String("anchor-contract", "", "AnconAnchor contract on evm-node-address, enables anchoring the authenticated index checkpoints")
+	anchorInterval := flag.Duration("anchor-interval", dageth.DefaultAnchorInterval, "time between on-chain anchors")
+	anchorWrites := flag.Int64("anchor-writes", 0, "index writes that trigger an on-chain anchor before anchor-interval, 0 anchors on anchor-interval only")
+	iavlCacheSize := flag.Int64("iavl-cache-size", 10000, "node cache size of the IAVL tree served on the iavl JSON-RPC namespace")
 	flag.Parse()
 
+	// flags given on the command line take precedence over the environment
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	setting := func(name, env string) string {
+		if v, ok := os.LookupEnv(env); ok && !set[name] {
+			return v
+		}
+		return flag.Lookup(name).Value.String()
+	}
+	subgraph.EnableDageth = cast.ToBool(setting("enable-dageth", "ENABLE_DAGETH"))
+	subgraph.EvmAddress = setting("evm-node-address", "EVM_NODE_ADDRESS")
+	subgraph.EvmChainId = setting("evm-chain-id", "EVM_CHAIN_ID")
+	subgraph.EnableDagcosmos = cast.ToBool(setting("enable-dagcosmos", "ENABLE_DAGCOSMOS"))
+	subgraph.CosmosMoniker = setting("cosmos-moniker", "COSMOS_MONIKER")
+	subgraph.CosmosAppHash = setting("cosmos-app-hash", "COSMOS_APP_HASH")
+	subgraph.CosmosHeight = cast.ToInt(setting("cosmos-height", "COSMOS_HEIGHT"))
+	subgraph.CosmosPrimaryAddress = setting("cosmos-primary", "COSMOS_PRIMARY_ADDRESS")
+	subgraph.CosmosWitnessAddress = setting("cosmos-witnesses", "COSMOS_WITNESS_ADDRESS")
+	subgraph.CosmosChainID = setting("cosmos-chain-id", "COSMOS_CHAIN_ID")
+	subgraph.CosmosStateQueries = setting("cosmos-state-queries", "COSMOS_STATE_QUERIES")
+	subgraph.CosmosProxyAddress = os.Getenv("COSMOS_PROXY_ADDRESS")
+
 	s := anconsync.NewStorage(*dataFolder)
 
 	if *init {
@@ -196,13 +367,6 @@ func main() {
 		return
 	} else {
 		root := os.Getenv("ROOTHASH")
-		subgraph.CosmosMoniker = os.Getenv("COSMOS_MONIKER")
-		subgraph.CosmosAppHash = os.Getenv("COSMOS_APP_HASH")
-		subgraph.CosmosHeight = cast.ToInt(os.Getenv("COSMOS_HEIGHT"))
-		subgraph.CosmosPrimaryAddress = os.Getenv("COSMOS_PRIMARY_ADDRESS")
-		subgraph.CosmosProxyAddress = os.Getenv("COSMOS_PROXY_ADDRESS")
-		subgraph.EnableDagcosmos = cast.ToBool(os.Getenv("ENABLE_DAGCOSMOS"))
-
 		s.LoadGenesis(root)
 	}
 	ctx := context.Background()
@@ -214,30 +378,240 @@ func main() {
 	docs.SwaggerInfo.BasePath = "/v0"
 
 	dagHandler := handler.NewAnconSyncContext(s, exchange, ipfspeer, privateKey)
+	dagHandler.PublicURL = *publicURL
+	if dagHandler.PublicURL == "" {
+		dagHandler.PublicURL = "http://" + *apiAddr
+	}
+	if *signedWrites != "" {
+		dagHandler.SignedWrites = strings.Split(*signedWrites, ",")
+	}
+	// the bootstrap node-admin key enables API key access control
+	if key := os.Getenv("ANCON_ADMIN_API_KEY"); key != "" {
+		dagHandler.Access.SetAdminKey(key)
+	}
+	if err := dagHandler.Access.SetSessionRoles(strings.Split(*siweRoles, ",")); err != nil {
+		panic(fmt.Errorf("invalid siwe-roles %v", err))
+	}
+	dagHandler.Access.SessionRateLimit = *siweRateLimit
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+	if *indexBatchSize > 0 {
+		indexDB, err := dbm.NewGoLevelDB("index", filepath.Join(home, *dataFolder))
+		if err != nil {
+			panic(err)
+		}
+		indexTree, err := proofsignature.NewIavlAPI(indexDB, *iavlCacheSize, 0)
+		if err != nil {
+			panic(err)
+		}
+		dagHandler.Index = handler.NewAuthenticatedIndex(indexTree.Service)
+		dagHandler.Index.BatchSize = *indexBatchSize
+		// writes after the last checkpoint are journaled, replay them into the tree
+		if _, err := dagHandler.RecoverIndex(ctx); err != nil {
+			panic(fmt.Errorf("index recovery failed %v", err))
+		}
+		dagHandler.RunIndex(ctx, *indexCheckpointInterval)
+	}
+	reader := dagHandler.Authorize(handler.RoleReader)
+	writer := dagHandler.Authorize(handler.RoleWriter)
+	didAdmin := dagHandler.Authorize(handler.RoleDidAdmin)
+	nodeAdmin := dagHandler.Authorize(handler.RoleNodeAdmin)
 	api := r.Group("/v0")
 	{
-		api.POST("/file", dagHandler.FileWrite)
-		api.POST("/query", graphqlHandler(s))
-		api.GET("/query", playgroundHandler(s))
-		api.GET("/file/:cid/*path", dagHandler.FileRead)
-		api.GET("/dagjson/:cid/*path", dagHandler.DagJsonRead)
-		api.GET("/dagcbor/:cid/*path", dagHandler.DagCborRead)
-		api.POST("/dagjson", dagHandler.DagJsonWrite)
-		api.POST("/dagcbor", dagHandler.DagCborWrite)
-		api.POST("/did/key", dagHandler.CreateDidKey)
-		api.POST("/did/web", dagHandler.CreateDidWeb)
-		api.GET("/did/:did", dagHandler.ReadDid)
+		api.POST("/file", writer, dagHandler.FileWrite)
+		api.POST("/query", writer, graphqlHandler(dagHandler))
+		api.GET("/query", reader, playgroundHandler())
+		api.GET("/file/:cid/*path", reader, dagHandler.FileRead)
+		api.GET("/dagjson/:cid/*path", reader, dagHandler.DagJsonRead)
+		api.GET("/dagcbor/:cid/*path", reader, dagHandler.DagCborRead)
+		api.POST("/dagjson", writer, dagHandler.DagJsonWrite)
+		api.POST("/dagcbor", writer, dagHandler.DagCborWrite)
+		api.POST("/did/key", didAdmin, dagHandler.CreateDidKey)
+		api.POST("/did/web", didAdmin, dagHandler.CreateDidWeb)
+		api.POST("/signers", didAdmin, dagHandler.CreateSigner)
+		api.GET("/did/:did", reader, dagHandler.ReadDid)
+		api.GET("/index/:key", reader, dagHandler.IndexRead)
+		api.POST("/timestamp", writer, dagHandler.TimestampWrite)
+		api.POST("/timestamp/verify", reader, dagHandler.TimestampVerify)
+		api.POST("/credentials/:id/status", didAdmin, dagHandler.CreateCredentialStatus)
+		api.GET("/credentials/:id/status", reader, dagHandler.ReadCredentialStatus)
+		api.POST("/credentials/:id/revoke", didAdmin, dagHandler.RevokeCredentialStatus)
+		api.GET("/statuslist/:issuer", reader, dagHandler.ReadStatusList)
+		api.GET("/statuslist/:issuer/history", reader, dagHandler.ReadStatusListHistory)
+		api.POST("/dagjose/sign", writer, dagHandler.DagJoseSign)
+		api.POST("/dagjose/encrypt", writer, dagHandler.DagJoseEncrypt)
+		api.GET("/dagjose/:cid", reader, dagHandler.DagJoseRead)
+		api.GET("/auth/nonce", dagHandler.AuthNonce)
+		api.POST("/auth/verify", dagHandler.AuthVerify)
+		api.PATCH("/dagjson/:cid", dagHandler.SiweAuth(), dagHandler.RequireOwner(), dagHandler.DagJsonPatch)
+		api.GET("/evm/tx/:hash", reader, dagHandler.EvmTransactionRead)
+		api.POST("/evm/registry", writer, dagHandler.EvmRegistryWrite)
+		api.GET("/evm/registry", reader, dagHandler.EvmRegistryRead)
+		api.POST("/evm/proof/verify", reader, dagHandler.EvmReceiptProofVerify)
+		api.POST("/admin/apikeys", nodeAdmin, dagHandler.CreateAPIKeyHandler)
+		api.GET("/admin/apikeys/:id", nodeAdmin, dagHandler.ReadAPIKeyHandler)
+		api.DELETE("/admin/apikeys/:id", nodeAdmin, dagHandler.RevokeAPIKeyHandler)
+	}
+	gateway := durin.NewDurinAPI(transfer.NewOnchainAdapter(privateKey), dagHandler)
+	if subgraph.EvmChainId != "" {
+		gateway.Service.ChainID = cast.ToInt64(subgraph.EvmChainId)
+	}
+	api.GET("/durin/proofs/:contract", reader, gateway.Service.ProofsRead)
+	manager := subgraphs.NewManager()
+	manager.Register("cosmos", cosmosSubgraph(dagHandler, *dataFolder))
+	manager.Register("evm", evmSubgraph(dagHandler, gateway))
+	configs := []subgraphs.Config{}
+	if *subgraphsConfig != "" {
+		configs, err = subgraphs.LoadConfig(*subgraphsConfig)
+		if err != nil {
+			panic(err)
+		}
 	}
 	if subgraph.EnableDagcosmos {
-
-		ctx := context.WithValue(context.Background(), "dag", dagHandler)
-		indexer := dagcosmos.New(ctx, subgraph.CosmosPrimaryAddress, "/websocket")
-		r.GET("/indexer/cosmos/tip", indexer.TipEvent)
-		indexer.Subscribe(ctx, dagcosmos.NewBlock)
-
+		configs = append(configs, subgraphs.Config{
+			Name:     "cosmos",
+			Type:     "cosmos",
+			Endpoint: subgraph.CosmosPrimaryAddress,
+			Enabled:  true,
+			Options: map[string]string{
+				"chainId":       subgraph.CosmosChainID,
+				"trustedHash":   subgraph.CosmosAppHash,
+				"trustedHeight": fmt.Sprint(subgraph.CosmosHeight),
+				"witnesses":     subgraph.CosmosWitnessAddress,
+				"stateQueries":  subgraph.CosmosStateQueries,
+			},
+		})
+	}
+	if subgraph.EnableDageth {
+		configs = append(configs, subgraphs.Config{
+			Name:     dageth.DefaultName,
+			Type:     "evm",
+			Endpoint: subgraph.EvmAddress,
+			Cursor:   int64(*evmStartBlock),
+			Enabled:  true,
+			Options: map[string]string{
+				"chainId":       subgraph.EvmChainId,
+				"confirmations": fmt.Sprint(*evmConfirmations),
+				"addresses":     *evmAddresses,
+			},
+		})
+	}
+	for _, cfg := range configs {
+		if err := manager.Add(cfg); err != nil {
+			fmt.Printf("subgraphs: %v\n", err)
+		}
+	}
+	// every subgraph serves the indexer routes of its type under its name
+	r.GET("/indexer/:name/tip", reader, subgraphRoute(manager, func(sg subgraphs.Subgraph) gin.HandlerFunc {
+		switch indexer := sg.(type) {
+		case *dagcosmos.CosmosIndexer:
+			return indexer.TipEvent
+		case *dageth.EvmIndexer:
+			return indexer.TipEvent
+		}
+		return nil
+	}))
+	api.GET("/indexer/:name/block/:height", reader, subgraphRoute(manager, func(sg subgraphs.Subgraph) gin.HandlerFunc {
+		if indexer, ok := sg.(*dagcosmos.CosmosIndexer); ok {
+			return indexer.BlockRead
+		}
+		return nil
+	}))
+	api.GET("/indexer/:name/state/:store/:key", reader, subgraphRoute(manager, func(sg subgraphs.Subgraph) gin.HandlerFunc {
+		if indexer, ok := sg.(*dagcosmos.CosmosIndexer); ok {
+			return indexer.StateRead
+		}
+		return nil
+	}))
+	receiptProof := func(sg subgraphs.Subgraph) gin.HandlerFunc {
+		if indexer, ok := sg.(*dageth.EvmIndexer); ok {
+			if client, ok := indexer.Client.(dageth.ArchiveBackend); ok {
+				return dageth.NewProver(dagHandler, client).ReceiptProofRead
+			}
+		}
+		return nil
 	}
+	api.GET("/indexer/:name/proof/receipt/:txhash", reader, subgraphRoute(manager, receiptProof))
+	// receipt proofs of the evm subgraph
+	api.GET("/evm/proof/receipt/:txhash", reader, func(c *gin.Context) {
+		c.Params = append(c.Params, gin.Param{Key: "name", Value: dageth.DefaultName})
+		subgraphRoute(manager, receiptProof)(c)
+	})
+	manager.StartEnabled(ctx)
+	api.GET("/subgraphs", reader, manager.StatusRead)
+	api.GET("/subgraphs/:name", reader, manager.StatusRead)
+	api.POST("/subgraphs", nodeAdmin, manager.ControlWrite)
+	if *enableRelay {
+		client, err := ethclient.Dial(subgraph.EvmAddress)
+		if err != nil {
+			panic(fmt.Errorf("invalid evm-node-address %v", err))
+		}
+		chainID, err := client.ChainID(ctx)
+		if err != nil {
+			panic(fmt.Errorf("relay chain id %v", err))
+		}
+		relayer := durin.NewRelayer(client, s, privateKey, chainID)
+		relayer.GasBump = *relayGasBump
+		relayer.StuckAfter = *relayStuckAfter
+		relayer.Quota = *relayQuota
+		if *relayTargets != "" {
+			for _, target := range strings.Split(*relayTargets, ",") {
+				parts := strings.Split(target, ":")
+				if len(parts) != 2 || !common.IsHexAddress(parts[0]) {
+					panic(fmt.Errorf("invalid relay target %s", target))
+				}
+				selector, err := hexutil.Decode(parts[1])
+				if err != nil || len(selector) != 4 {
+					panic(fmt.Errorf("invalid relay target selector %s", parts[1]))
+				}
+				relayer.AllowTarget(common.HexToAddress(parts[0]), selector)
+			}
+		}
+		relayer.Start(ctx)
+		gateway.Service.Relayer = relayer
+	}
+	if *anchorContract != "" {
+		if dagHandler.Index == nil {
+			panic(fmt.Errorf("anchor-contract requires the authenticated index"))
+		}
+		client, err := ethclient.Dial(subgraph.EvmAddress)
+		if err != nil {
+			panic(fmt.Errorf("invalid evm-node-address %v", err))
+		}
+		chainID, err := client.ChainID(ctx)
+		if err != nil {
+			panic(fmt.Errorf("anchor chain id %v", err))
+		}
+		// anchors share the nonces of the relayed transactions when relaying is enabled
+		relayer := gateway.Service.Relayer
+		if relayer == nil {
+			relayer = durin.NewRelayer(client, s, privateKey, chainID)
+		}
+		anchorer := dageth.NewAnchorer(dagHandler, relayer, client, common.HexToAddress(*anchorContract), chainID.Int64())
+		anchorer.Interval = *anchorInterval
+		anchorer.Writes = *anchorWrites
+		anchorer.Start(ctx)
+		api.GET("/anchors", reader, anchorer.AnchorsRead)
+		api.GET("/anchors/:cid/proof", reader, anchorer.AnchorProofRead)
+	}
+	api.POST("/relay", writer, gateway.Service.RelayWrite)
+	api.GET("/relay/:id", reader, gateway.Service.RelayRead)
+	r.GET("/gateway/:sender/:data", gateway.Service.Gateway)
+	r.POST("/gateway/:sender/:data", gateway.Service.Gateway)
+	r.POST("/gateway", gateway.Service.Gateway)
 	r.GET("/user/:did/did.json", dagHandler.ReadDidWebUrl)
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerfiles.Handler))
-	r.POST("/rpc", jsonRPCHandler(*dagHandler))
+	iavlDB, err := dbm.NewGoLevelDB("iavl", filepath.Join(home, *dataFolder))
+	if err != nil {
+		panic(err)
+	}
+	iavlAPI, err := proofsignature.NewIavlAPI(iavlDB, *iavlCacheSize, 0)
+	if err != nil {
+		panic(err)
+	}
+	r.POST("/rpc", writer, jsonRPCHandler(gateway, iavlAPI))
+	r.POST("/admin/rpc", nodeAdmin, adminRPCHandler(iavlAPI))
 	r.Run(*apiAddr) // listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
 }
@@ -0,0 +1,298 @@
+package dagcosmos
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/rpc/coretypes"
+	"github.com/tendermint/tendermint/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DefaultNamespace prefixes the index keys of an indexer
+const DefaultNamespace = "cosmos"
+
+func (i *CosmosIndexer) key(parts ...string) string {
+	namespace := i.Namespace
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return strings.Join(append([]string{namespace}, parts...), ":")
+}
+
+// TipKey is the index key of the last indexed header block
+func (i *CosmosIndexer) TipKey() string {
+	return i.key("tip")
+}
+
+// BlockKey is the index key of the header block at height
+func (i *CosmosIndexer) BlockKey(height int64) string {
+	return i.key("block", fmt.Sprint(height))
+}
+
+// TxKey is the index key of a tx block by tx hash
+func (i *CosmosIndexer) TxKey(hash string) string {
+	return i.key("tx", strings.ToUpper(hash))
+}
+
+// blockData is a block with its ABCI results, assembled from the NewBlock and Tx events
+// of a height
+type blockData struct {
+	Block      *types.Block
+	BlockID    types.BlockID
+	BeginBlock abci.ResponseBeginBlock
+	EndBlock   abci.ResponseEndBlock
+	// TxResults is indexed as Block.Txs, nil when the Tx event was not received
+	TxResults []*abci.ResponseDeliverTx
+}
+
+// fetchedBlock assembles a block from the /block and /block_results RPC responses
+func fetchedBlock(block *coretypes.ResultBlock, results *coretypes.ResultBlockResults) *blockData {
+	b := &blockData{
+		Block:      block.Block,
+		BlockID:    block.BlockID,
+		BeginBlock: abci.ResponseBeginBlock{Events: results.BeginBlockEvents},
+		EndBlock:   abci.ResponseEndBlock{Events: results.EndBlockEvents, ValidatorUpdates: results.ValidatorUpdates},
+		TxResults:  make([]*abci.ResponseDeliverTx, len(block.Block.Txs)),
+	}
+	copy(b.TxResults, results.TxsResults)
+	return b
+}
+
+// TxMessage is a message of a Cosmos SDK transaction, the value is the protobuf encoding
+// of the type
+type TxMessage struct {
+	TypeURL string
+	Value   []byte
+}
+
+// fields calls fn with each length delimited field of a protobuf message and skips the
+// others
+func fields(b []byte, fn func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err := fn(num, v); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// DecodeTx reads the messages and memo of a Cosmos SDK Tx, Tx.body is field 1 and
+// TxBody holds the messages as Any (field 1) and the memo (field 2)
+func DecodeTx(tx []byte) ([]TxMessage, string, error) {
+	var body []byte
+	err := fields(tx, func(num protowire.Number, v []byte) error {
+		if num == 1 {
+			body = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if body == nil {
+		return nil, "", fmt.Errorf("missing tx body")
+	}
+	msgs := []TxMessage{}
+	memo := ""
+	err = fields(body, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1:
+			msg := TxMessage{}
+			err := fields(v, func(num protowire.Number, v []byte) error {
+				switch num {
+				case 1:
+					msg.TypeURL = string(v)
+				case 2:
+					msg.Value = v
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if msg.TypeURL == "" {
+				return fmt.Errorf("message without type url")
+			}
+			msgs = append(msgs, msg)
+		case 2:
+			memo = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return msgs, memo, nil
+}
+
+func assignEvents(na fluent.NodeAssembler, events []abci.Event) {
+	na.CreateList(int64(len(events)), func(la fluent.ListAssembler) {
+		for _, e := range events {
+			la.AssembleValue().CreateMap(2, func(ma fluent.MapAssembler) {
+				ma.AssembleEntry("type").AssignString(e.Type)
+				ma.AssembleEntry("attributes").CreateList(int64(len(e.Attributes)), func(la fluent.ListAssembler) {
+					for _, a := range e.Attributes {
+						la.AssembleValue().CreateMap(3, func(ma fluent.MapAssembler) {
+							ma.AssembleEntry("key").AssignString(a.Key)
+							ma.AssembleEntry("value").AssignString(a.Value)
+							ma.AssembleEntry("index").AssignBool(a.Index)
+						})
+					}
+				})
+			})
+		}
+	})
+}
+
+// txNode builds the block of the tx at index of a block, with the decoded messages and
+// the ABCI result when known
+func txNode(height int64, index int, tx types.Tx, result *abci.ResponseDeliverTx) datamodel.Node {
+	msgs, memo, err := DecodeTx(tx)
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 13, func(na fluent.MapAssembler) {
+		na.AssembleEntry("height").AssignInt(height)
+		na.AssembleEntry("index").AssignInt(int64(index))
+		na.AssembleEntry("hash").AssignString(fmt.Sprintf("%X", tx.Hash()))
+		na.AssembleEntry("tx").AssignString(base64.StdEncoding.EncodeToString(tx))
+		na.AssembleEntry("messages").CreateList(int64(len(msgs)), func(la fluent.ListAssembler) {
+			for _, m := range msgs {
+				la.AssembleValue().CreateMap(2, func(ma fluent.MapAssembler) {
+					ma.AssembleEntry("typeUrl").AssignString(m.TypeURL)
+					ma.AssembleEntry("value").AssignString(base64.StdEncoding.EncodeToString(m.Value))
+				})
+			}
+		})
+		na.AssembleEntry("memo").AssignString(memo)
+		if err != nil {
+			na.AssembleEntry("decodeError").AssignString(err.Error())
+		} else {
+			na.AssembleEntry("decodeError").AssignNull()
+		}
+		if result == nil {
+			na.AssembleEntry("result").AssignNull()
+			return
+		}
+		na.AssembleEntry("result").CreateMap(6, func(ma fluent.MapAssembler) {
+			ma.AssembleEntry("code").AssignInt(int64(result.Code))
+			ma.AssembleEntry("codespace").AssignString(result.Codespace)
+			ma.AssembleEntry("log").AssignString(result.Log)
+			ma.AssembleEntry("gasWanted").AssignInt(result.GasWanted)
+			ma.AssembleEntry("gasUsed").AssignInt(result.GasUsed)
+			assignEvents(ma.AssembleEntry("events"), result.Events)
+		})
+	})
+}
+
+// assignMetadata records whether the header and txs were verified and the signatures of
+// the commit that verified them. The ABCI results are only committed to by the
+// LastResultsHash of the next header, they are always recorded as unverified.
+func assignMetadata(na fluent.NodeAssembler, commit *types.Commit) {
+	na.CreateMap(3, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("verified").AssignBool(commit != nil)
+		ma.AssembleEntry("resultsVerified").AssignBool(false)
+		if commit == nil {
+			ma.AssembleEntry("commit").AssignNull()
+			return
+		}
+		ma.AssembleEntry("commit").CreateMap(4, func(ma fluent.MapAssembler) {
+			ma.AssembleEntry("height").AssignInt(commit.Height)
+			ma.AssembleEntry("round").AssignInt(int64(commit.Round))
+			ma.AssembleEntry("blockId").AssignString(commit.BlockID.Hash.String())
+			ma.AssembleEntry("signatures").CreateList(int64(len(commit.Signatures)), func(la fluent.ListAssembler) {
+				for _, sig := range commit.Signatures {
+					la.AssembleValue().CreateMap(4, func(ma fluent.MapAssembler) {
+						ma.AssembleEntry("blockIdFlag").AssignInt(int64(sig.BlockIDFlag))
+						ma.AssembleEntry("validatorAddress").AssignString(sig.ValidatorAddress.String())
+						ma.AssembleEntry("timestamp").AssignString(sig.Timestamp.UTC().Format(time.RFC3339Nano))
+						ma.AssembleEntry("signature").AssignString(base64.StdEncoding.EncodeToString(sig.Signature))
+					})
+				}
+			})
+		})
+	})
+}
+
+// headerNode builds the header block of b linking its tx blocks and the header block of
+// the previous height, parent is nil when that height is not indexed. commit is the
+// commit that verified the header, nil when it was not verified.
+func headerNode(b *blockData, txs []datamodel.Link, parent datamodel.Link, commit *types.Commit) datamodel.Node {
+	h := b.Block.Header
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 18, func(na fluent.MapAssembler) {
+		if parent != nil {
+			na.AssembleEntry("parent").AssignLink(parent)
+		} else {
+			na.AssembleEntry("parent").AssignNull()
+		}
+		na.AssembleEntry("chainId").AssignString(h.ChainID)
+		na.AssembleEntry("height").AssignInt(h.Height)
+		na.AssembleEntry("time").AssignString(h.Time.UTC().Format(time.RFC3339Nano))
+		na.AssembleEntry("hash").AssignString(b.BlockID.Hash.String())
+		na.AssembleEntry("lastBlockHash").AssignString(h.LastBlockID.Hash.String())
+		na.AssembleEntry("appHash").AssignString(h.AppHash.String())
+		na.AssembleEntry("dataHash").AssignString(h.DataHash.String())
+		na.AssembleEntry("validatorsHash").AssignString(h.ValidatorsHash.String())
+		na.AssembleEntry("nextValidatorsHash").AssignString(h.NextValidatorsHash.String())
+		na.AssembleEntry("lastResultsHash").AssignString(h.LastResultsHash.String())
+		na.AssembleEntry("proposerAddress").AssignString(h.ProposerAddress.String())
+		na.AssembleEntry("txs").CreateList(int64(len(txs)), func(la fluent.ListAssembler) {
+			for _, l := range txs {
+				la.AssembleValue().AssignLink(l)
+			}
+		})
+		assignMetadata(na.AssembleEntry("metadata"), commit)
+		assignEvents(na.AssembleEntry("beginBlockEvents"), b.BeginBlock.Events)
+		assignEvents(na.AssembleEntry("endBlockEvents"), b.EndBlock.Events)
+		na.AssembleEntry("validatorUpdates").CreateList(int64(len(b.EndBlock.ValidatorUpdates)), func(la fluent.ListAssembler) {
+			for _, v := range b.EndBlock.ValidatorUpdates {
+				la.AssembleValue().CreateMap(2, func(ma fluent.MapAssembler) {
+					ma.AssembleEntry("pubKey").AssignString(fmt.Sprintf("%X", append(v.PubKey.GetEd25519(), v.PubKey.GetSecp256K1()...)))
+					ma.AssembleEntry("power").AssignInt(v.Power)
+				})
+			}
+		})
+	})
+}
+
+// validatorSetNode builds the block of a ValidatorSetUpdates event
+func validatorSetNode(height int64, validators []*types.Validator) datamodel.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("height").AssignInt(height)
+		na.AssembleEntry("validators").CreateList(int64(len(validators)), func(la fluent.ListAssembler) {
+			for _, v := range validators {
+				la.AssembleValue().CreateMap(3, func(ma fluent.MapAssembler) {
+					ma.AssembleEntry("address").AssignString(v.Address.String())
+					pubKey := ""
+					if v.PubKey != nil {
+						pubKey = fmt.Sprintf("%X", v.PubKey.Bytes())
+					}
+					ma.AssembleEntry("pubKey").AssignString(pubKey)
+					ma.AssembleEntry("votingPower").AssignInt(v.VotingPower)
+				})
+			}
+		})
+	})
+}
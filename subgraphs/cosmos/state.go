@@ -0,0 +1,309 @@
+package dagcosmos
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler/proofsignature"
+	ics23 "github.com/confio/ics23/go"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/spf13/cast"
+	tmbytes "github.com/tendermint/tendermint/libs/bytes"
+	tmclient "github.com/tendermint/tendermint/rpc/client"
+	"github.com/tendermint/tendermint/rpc/coretypes"
+)
+
+// StateClient queries the application state, it is implemented by the Tendermint HTTP
+// client
+type StateClient interface {
+	ABCIQueryWithOptions(ctx context.Context, path string, data tmbytes.HexBytes, opts tmclient.ABCIQueryOptions) (*coretypes.ResultABCIQuery, error)
+}
+
+// StateQuery is a key of a module store proven on every indexed block, eg. a bank balance
+type StateQuery struct {
+	Store string
+	Key   []byte
+}
+
+// ParseStateQueries reads comma separated store:hexkey pairs
+func ParseStateQueries(s string) ([]StateQuery, error) {
+	queries := []StateQuery{}
+	for _, q := range strings.Split(s, ",") {
+		if q == "" {
+			continue
+		}
+		parts := strings.SplitN(q, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid state query %s", q)
+		}
+		key, err := hex.DecodeString(strings.TrimPrefix(parts[1], "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid state query key %s", parts[1])
+		}
+		queries = append(queries, StateQuery{Store: parts[0], Key: key})
+	}
+	return queries, nil
+}
+
+// StateKey is the index key of the state of a store key at height, the latest state when
+// height is 0
+func (i *CosmosIndexer) StateKey(store string, key []byte, height int64) string {
+	parts := []string{"state", store, fmt.Sprintf("%X", key)}
+	if height > 0 {
+		parts = append(parts, fmt.Sprint(height))
+	}
+	return i.key(parts...)
+}
+
+func proofNode(proofs []*ics23.CommitmentProof) (datamodel.Node, error) {
+	encoded := make([]string, len(proofs))
+	for i, p := range proofs {
+		b, err := p.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = base64.StdEncoding.EncodeToString(b)
+	}
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("proofs").CreateList(int64(len(encoded)), func(la fluent.ListAssembler) {
+			for _, p := range encoded {
+				la.AssembleValue().AssignString(p)
+			}
+		})
+	}), nil
+}
+
+// IndexState proves the configured store keys at the height before the block linked by
+// header, whose app hash commits that state. An absent key is stored with an empty value
+// and its non-existence proof.
+func (i *CosmosIndexer) IndexState(ctx context.Context, height int64, header datamodel.Link) error {
+	if height < 2 {
+		return nil
+	}
+	s := i.AnconSyncContext.Store
+	for _, q := range i.Queries {
+		res, err := i.State.ABCIQueryWithOptions(ctx, "/store/"+q.Store+"/key", q.Key, tmclient.ABCIQueryOptions{
+			Height: height - 1,
+			Prove:  true,
+		})
+		if err != nil {
+			return err
+		}
+		if res.Response.Code != 0 {
+			return fmt.Errorf("query %s %X failed %s", q.Store, q.Key, res.Response.Log)
+		}
+		if res.Response.ProofOps == nil {
+			return fmt.Errorf("query %s %X returned no proof", q.Store, q.Key)
+		}
+		proofs, err := proofsignature.ConvertProofOps(res.Response.ProofOps.Ops, res.Response.Value)
+		if err != nil {
+			return err
+		}
+		n, err := proofNode(proofs)
+		if err != nil {
+			return err
+		}
+		proof := s.Store(ipld.LinkContext{}, n)
+		lnk := s.Store(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 7, func(na fluent.MapAssembler) {
+			na.AssembleEntry("store").AssignString(q.Store)
+			na.AssembleEntry("key").AssignString(fmt.Sprintf("%X", q.Key))
+			na.AssembleEntry("value").AssignString(base64.StdEncoding.EncodeToString(res.Response.Value))
+			na.AssembleEntry("exists").AssignBool(len(res.Response.Value) > 0)
+			na.AssembleEntry("height").AssignInt(height - 1)
+			na.AssembleEntry("header").AssignLink(header)
+			na.AssembleEntry("proof").AssignLink(proof)
+		}))
+		for _, key := range []string{i.StateKey(q.Store, q.Key, height-1), i.StateKey(q.Store, q.Key, 0)} {
+			if err := s.DataStore.Put(ctx, key, []byte(lnk.String())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (i *CosmosIndexer) loadLinked(n datamodel.Node, name string) (datamodel.Node, error) {
+	v, err := n.LookupByString(name)
+	if err != nil {
+		return nil, err
+	}
+	lnk, err := v.AsLink()
+	if err != nil {
+		return nil, err
+	}
+	return i.AnconSyncContext.Store.Load(ipld.LinkContext{}, lnk)
+}
+
+func lookupString(n datamodel.Node, name string) (string, error) {
+	v, err := n.LookupByString(name)
+	if err != nil {
+		return "", err
+	}
+	return v.AsString()
+}
+
+// HeaderVerified returns whether the header block linked by a state block was verified by
+// the light client
+func (i *CosmosIndexer) HeaderVerified(n datamodel.Node) bool {
+	header, err := i.loadLinked(n, "header")
+	if err != nil {
+		return false
+	}
+	metadata, err := header.LookupByString("metadata")
+	if err != nil {
+		return false
+	}
+	v, err := metadata.LookupByString("verified")
+	if err != nil {
+		return false
+	}
+	verified, _ := v.AsBool()
+	return verified
+}
+
+// VerifyState checks the proof of a state block against the app hash of the header block
+// it links
+func (i *CosmosIndexer) VerifyState(n datamodel.Node) error {
+	header, err := i.loadLinked(n, "header")
+	if err != nil {
+		return err
+	}
+	appHash, err := lookupString(header, "appHash")
+	if err != nil {
+		return err
+	}
+	root, err := hex.DecodeString(appHash)
+	if err != nil {
+		return err
+	}
+	proof, err := i.loadLinked(n, "proof")
+	if err != nil {
+		return err
+	}
+	list, err := proof.LookupByString("proofs")
+	if err != nil {
+		return err
+	}
+	proofs := []*ics23.CommitmentProof{}
+	it := list.ListIterator()
+	for !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return err
+		}
+		encoded, err := v.AsString()
+		if err != nil {
+			return err
+		}
+		b, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		p := &ics23.CommitmentProof{}
+		if err := p.Unmarshal(b); err != nil {
+			return err
+		}
+		proofs = append(proofs, p)
+	}
+	store, err := lookupString(n, "store")
+	if err != nil {
+		return err
+	}
+	key, err := lookupString(n, "key")
+	if err != nil {
+		return err
+	}
+	k, err := hex.DecodeString(key)
+	if err != nil {
+		return err
+	}
+	value, err := lookupString(n, "value")
+	if err != nil {
+		return err
+	}
+	v, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	return proofsignature.VerifyStateProof(proofs, root, store, k, v)
+}
+
+// @BasePath /v0
+// StateRead godoc
+// @Summary Reads a proven Cosmos store value
+// @Schemes
+// @Description Returns the value of a store key with its ICS23 proof, or non-existence proof when exists is false. proofVerified tells whether the proof checks against the app hash of the indexed header, headerVerified whether the light client verified that header, verified requires both. The latest indexed value is returned without height.
+// @Tags indexer
+// @Produce json
+// @Success 200 {object} []string
+// @Router /v0/indexer/{name}/state/{store}/{key} [get]
+func (i *CosmosIndexer) StateRead(c *gin.Context) {
+	key, err := hex.DecodeString(strings.TrimPrefix(c.Param("key"), "0x"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid key %s", c.Param("key")).Error(),
+		})
+		return
+	}
+	height := int64(0)
+	if c.Query("height") != "" {
+		height, err = cast.ToInt64E(c.Query("height"))
+	}
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid height %s", c.Query("height")).Error(),
+		})
+		return
+	}
+	value, err := i.AnconSyncContext.Store.DataStore.Get(c.Request.Context(), i.StateKey(c.Param("store"), key, height))
+	if err != nil || len(value) == 0 {
+		c.JSON(404, gin.H{
+			"error": fmt.Errorf("state not indexed").Error(),
+		})
+		return
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	n, err := i.AnconSyncContext.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	js, err := anconsync.Encode(n)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	proofVerified := true
+	headerVerified := i.HeaderVerified(n)
+	res := gin.H{
+		"cid":            lnk.String(),
+		"state":          json.RawMessage(js),
+		"headerVerified": headerVerified,
+	}
+	if err := i.VerifyState(n); err != nil {
+		proofVerified = false
+		res["error"] = err.Error()
+	}
+	res["proofVerified"] = proofVerified
+	res["verified"] = proofVerified && headerVerified
+	c.JSON(200, res)
+}
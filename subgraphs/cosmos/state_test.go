@@ -0,0 +1,184 @@
+package dagcosmos
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anconprotocol/node/x/anconsync/handler/proofsignature"
+	ics23 "github.com/confio/ics23/go"
+	"github.com/cosmos/iavl"
+	"github.com/gin-gonic/gin"
+	abci "github.com/tendermint/tendermint/abci/types"
+	tmbytes "github.com/tendermint/tendermint/libs/bytes"
+	tmcrypto "github.com/tendermint/tendermint/proto/tendermint/crypto"
+	tmclient "github.com/tendermint/tendermint/rpc/client"
+	"github.com/tendermint/tendermint/rpc/coretypes"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// fakeState answers store queries with the proofs of a bank store committed next to an
+// acc store, values maps query heights to the returned value
+type fakeState struct {
+	ops    []tmcrypto.ProofOp
+	values map[int64][]byte
+}
+
+func (s *fakeState) ABCIQueryWithOptions(ctx context.Context, path string, data tmbytes.HexBytes, opts tmclient.ABCIQueryOptions) (*coretypes.ResultABCIQuery, error) {
+	res := abci.ResponseQuery{Value: s.values[opts.Height], Height: opts.Height}
+	if opts.Prove {
+		res.ProofOps = &tmcrypto.ProofOps{Ops: s.ops}
+	}
+	return &coretypes.ResultABCIQuery{Response: res}, nil
+}
+
+// newTestState returns the proof ops of key in the bank store and the app hash committing
+// them, the non-existence proof of key when value is nil
+func newTestState(t *testing.T, key, value []byte) ([]tmcrypto.ProofOp, []byte) {
+	tree, err := iavl.NewMutableTree(dbm.NewMemDB(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Set([]byte{0x01}, []byte("1"))
+	tree.Set([]byte("other"), []byte("1"))
+	if value != nil {
+		tree.Set(key, value)
+	}
+	if _, _, err := tree.SaveVersion(); err != nil {
+		t.Fatal(err)
+	}
+	var store *ics23.CommitmentProof
+	if value != nil {
+		store, err = tree.GetMembershipProof(key)
+	} else {
+		store, err = tree.GetNonMembershipProof(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, err := ics23.TendermintSpec.LeafSpec.Apply([]byte("acc"), []byte("acc root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Exist{Exist: &ics23.ExistenceProof{
+		Key:   []byte("bank"),
+		Value: tree.Hash(),
+		Leaf:  ics23.TendermintSpec.LeafSpec,
+		Path:  []*ics23.InnerOp{{Hash: ics23.HashOp_SHA256, Prefix: append([]byte{1}, acc...)}},
+	}}}
+	appHash, err := commit.Calculate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeData, _ := store.Marshal()
+	commitData, _ := commit.Marshal()
+	return []tmcrypto.ProofOp{
+		{Type: proofsignature.ProofOpIAVLCommitment, Key: key, Data: storeData},
+		{Type: proofsignature.ProofOpSimpleMerkleCommitment, Key: []byte("bank"), Data: commitData},
+	}, appHash
+}
+
+func readState(t *testing.T, i *CosmosIndexer, key, height string) (int, map[string]interface{}) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/v0/indexer/cosmos/state/bank/"+key+"?height="+height, nil)
+	c.Params = gin.Params{{Key: "store", Value: "bank"}, {Key: "key", Value: key}}
+	i.StateRead(c)
+	var res map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res
+}
+
+func TestStateProofs(t *testing.T) {
+	ctx := context.Background()
+	key, value := []byte{0x02, 0x01}, []byte("100stake")
+	ops, appHash := newTestState(t, key, value)
+	state := &fakeState{ops: ops, values: map[int64][]byte{2: value, 3: []byte("forged")}}
+	i := &CosmosIndexer{AnconSyncContext: newTestContext(t), State: state, Queries: []StateQuery{{Store: "bank", Key: key}}}
+
+	for _, h := range []int64{3, 4} {
+		b := newTestBlock(h, nil)
+		b.Block.Header.AppHash = appHash
+		if _, err := i.IndexBlock(ctx, &blockData{Block: b.Block, BlockID: b.BlockID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, res := readState(t, i, "0201", "2")
+	if code != 200 || res["proofVerified"] != true {
+		t.Fatalf("state proof was not verified %v", res)
+	}
+	// the headers were not verified by a light client
+	if res["headerVerified"] != false || res["verified"] != false {
+		t.Fatalf("state of an unverified header is reported verified %v", res)
+	}
+	if v := res["state"].(map[string]interface{})["value"]; v != base64.StdEncoding.EncodeToString(value) {
+		t.Fatalf("unexpected value %v", v)
+	}
+
+	// the value returned at height 3 is not the proven one
+	code, res = readState(t, i, "0201", "")
+	if code != 200 || res["proofVerified"] != false || res["verified"] != false || res["state"].(map[string]interface{})["height"].(float64) != 3 {
+		t.Fatalf("forged state was verified %v", res)
+	}
+	if code, _ := readState(t, i, "0202", ""); code != 404 {
+		t.Fatal("unknown key was found")
+	}
+}
+
+func TestAbsentStateProofs(t *testing.T) {
+	ctx := context.Background()
+	key := []byte{0x02, 0x01}
+	ops, appHash := newTestState(t, key, nil)
+	state := &fakeState{ops: ops, values: map[int64][]byte{3: []byte("forged")}}
+	i := &CosmosIndexer{AnconSyncContext: newTestContext(t), State: state, Queries: []StateQuery{{Store: "bank", Key: key}}}
+	for _, h := range []int64{3, 4} {
+		b := newTestBlock(h, nil)
+		b.Block.Header.AppHash = appHash
+		if _, err := i.IndexBlock(ctx, &blockData{Block: b.Block, BlockID: b.BlockID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, res := readState(t, i, "0201", "2")
+	if code != 200 || res["proofVerified"] != true || res["state"].(map[string]interface{})["exists"] != false {
+		t.Fatalf("absent key was not proven %v", res)
+	}
+	// a value claimed for the absent key does not verify
+	if code, res := readState(t, i, "0201", "3"); code != 200 || res["proofVerified"] != false {
+		t.Fatalf("value of an absent key was verified %v", res)
+	}
+
+	proofs, err := proofsignature.ConvertProofOps(ops, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proofsignature.VerifyStateProof(proofs, appHash, "bank", []byte{0x01}, nil); err == nil {
+		t.Fatal("non-existence proof verified for another key")
+	}
+}
+
+func TestLegacyProofOps(t *testing.T) {
+	tree, _ := iavl.NewMutableTree(dbm.NewMemDB(), 0)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	tree.SaveVersion()
+	value, proof, err := tree.GetWithProof([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := iavl.NewValueOp([]byte("b"), proof).ProofOp()
+	proofs, err := proofsignature.ConvertProofOps([]tmcrypto.ProofOp{op}, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ics23.VerifyMembership(ics23.IavlSpec, tree.Hash(), proofs[0], []byte("b"), value) {
+		t.Fatal("converted range proof does not verify")
+	}
+	if _, err := proofsignature.ConvertProofOps([]tmcrypto.ProofOp{{Type: "multistore"}}, value); err == nil {
+		t.Fatal("unsupported proof op was converted")
+	}
+}
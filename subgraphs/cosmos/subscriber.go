@@ -2,15 +2,25 @@ package dagcosmos
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"sync"
 
 	"github.com/anconprotocol/node/x/anconsync"
 	"github.com/anconprotocol/node/x/anconsync/handler"
 	"github.com/gin-gonic/gin"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
-	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/spf13/cast"
+	abci "github.com/tendermint/tendermint/abci/types"
+	tmjson "github.com/tendermint/tendermint/libs/json"
+	"github.com/tendermint/tendermint/light"
+	rpchttp "github.com/tendermint/tendermint/rpc/client/http"
+	"github.com/tendermint/tendermint/rpc/coretypes"
 	rpcclient "github.com/tendermint/tendermint/rpc/jsonrpc/client"
+	rpctypes "github.com/tendermint/tendermint/rpc/jsonrpc/types"
+	"github.com/tendermint/tendermint/types"
 )
 
 type SubscriptionType string
@@ -22,65 +32,416 @@ const (
 	BankModule          SubscriptionType = "message.module='bank'"
 )
 
+// BlockClient reads blocks missed by the websocket, it is implemented by the Tendermint
+// HTTP client
+type BlockClient interface {
+	Block(ctx context.Context, height *int64) (*coretypes.ResultBlock, error)
+	BlockResults(ctx context.Context, height *int64) (*coretypes.ResultBlockResults, error)
+}
+
+// CosmosIndexer stores the blocks of a Tendermint chain from its websocket events. A block
+// is stored once its NewBlock event and the Tx events of its txs are received, as a header
+// block linking one block per tx and the header block of its parent.
 type CosmosIndexer struct {
 	AnconSyncContext *handler.AnconSyncContext
 	Client           *rpcclient.WSClient
-	LastLinkNode     datamodel.Node
-	LastLink         datamodel.Link
+	Blocks           BlockClient
+	// Light verifies headers before they are stored, blocks are stored unverified when nil
+	Light *light.Client
+	// State proves Queries after each indexed block
+	State   StateClient
+	Queries []StateQuery
+	// Namespace prefixes the index keys, indexers of different chains need their own
+	Namespace string
+	// StartHeight is the first height backfilled when nothing is indexed yet, indexing
+	// starts from the first received block when 0
+	StartHeight int64
+	LastLink    datamodel.Link
+	LastHeight  int64
+
+	lock     sync.Mutex
+	address  string
+	endpoint string
+	head     int64
+	pending  *blockData
+	received int
 }
 
 func (i *CosmosIndexer) Subscribe(ctx context.Context, subscriptionType SubscriptionType) {
-	i.Client.Subscribe(ctx, string(subscriptionType))
+	if err := i.Client.Subscribe(ctx, string(subscriptionType)); err != nil {
+		fmt.Printf("dagcosmos: subscribe %s failed %v\n", subscriptionType, err)
+	}
 }
 
-// @BasePath /v0
-// DagJsonWrite godoc
-// @Summary Stores JSON as dag-json
-// @Schemes
-// @Description Writes a dag-json block which syncs with IPFS. Returns a CID.
-// @Tags dag-json
-// @Accept json
-// @Produce json
-// @Success 201 {string} cid
-// @Router /v0/dagjson [post]
-func (i *CosmosIndexer) TipEvent(c *gin.Context) {
-	c.JSON(201, gin.H{
-		"cid": i.LastLink,
-	})
+// New returns an indexer of the Tendermint node at tmRPCAddr, Start connects to its
+// websocket endpoint
+func New(dag *handler.AnconSyncContext, tmRPCAddr, tmEndpoint string) *CosmosIndexer {
+	blocks, err := rpchttp.New(tmRPCAddr)
+	if err != nil {
+		panic(err)
+	}
+	i := &CosmosIndexer{
+		AnconSyncContext: dag,
+		Namespace:        DefaultNamespace,
+		Blocks:           blocks,
+		State:            blocks,
+		address:          tmRPCAddr,
+		endpoint:         tmEndpoint,
+	}
+	return i
 }
 
-func New(ctx context.Context, tmRPCAddr, tmEndpoint string) *CosmosIndexer {
-	tmWsClient, err := rpcclient.NewWS(tmRPCAddr, tmEndpoint)
-	dag := ctx.Value("dag").(*handler.AnconSyncContext)
+// Start resumes from the stored tip, subscribes to the NewBlock, Tx and
+// ValidatorSetUpdates events and indexes them until ctx is done. The returned channel is
+// closed once indexing stopped.
+func (i *CosmosIndexer) Start(ctx context.Context) (<-chan struct{}, error) {
+	i.lock.Lock()
+	err := i.loadTip(ctx)
+	i.lock.Unlock()
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("tip not loaded %v", err)
 	}
-	err = tmWsClient.Start()
+	client, err := rpcclient.NewWS(i.address, i.endpoint)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	i := &CosmosIndexer{Client: tmWsClient, AnconSyncContext: dag}
+	if err := client.Start(); err != nil {
+		return nil, err
+	}
+	for _, s := range []SubscriptionType{NewBlock, Tx, ValidatorSetUpdates} {
+		if err := client.Subscribe(ctx, string(s)); err != nil {
+			client.Stop()
+			return nil, fmt.Errorf("subscribe %s failed %v", s, err)
+		}
+	}
+	i.lock.Lock()
+	i.Client = client
+	i.lock.Unlock()
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+		defer client.Stop()
 		for {
 			select {
-			case <-i.Client.Quit():
+			case <-ctx.Done():
 				return
-			case res, ok := <-i.Client.ResponsesCh:
-				if ok {
-					block, err := anconsync.Decode(basicnode.Prototype.Any, string(res.Result))
-					if err != nil {
-						fmt.Errorf("invalid json %v", err)
-					}
-
-					i.LastLink = i.AnconSyncContext.Store.Store(ipld.LinkContext{
-						LinkNode: i.LastLinkNode,
-					}, block)
-					i.LastLinkNode = block
-					// PushBlock(c.Request.Context(), dagctx, cid)
-
+			case <-client.Quit():
+				return
+			case res, ok := <-client.ResponsesCh:
+				if !ok {
+					return
+				}
+				if err := i.handle(ctx, res); err != nil {
+					fmt.Printf("dagcosmos: %v\n", err)
 				}
 			}
 		}
 	}()
-	return i
+	return done, nil
+}
+
+// Progress returns the last indexed height and the last height received from the node
+func (i *CosmosIndexer) Progress(ctx context.Context) (int64, int64, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.Client != nil && !i.Client.IsRunning() {
+		return i.LastHeight, i.head, fmt.Errorf("websocket disconnected")
+	}
+	return i.LastHeight, i.head, nil
+}
+
+// handle decodes a websocket response, subscription acks carry no event data
+func (i *CosmosIndexer) handle(ctx context.Context, res rpctypes.RPCResponse) error {
+	if res.Error != nil {
+		return fmt.Errorf("rpc error %v", res.Error)
+	}
+	var event coretypes.ResultEvent
+	if err := tmjson.Unmarshal(res.Result, &event); err != nil {
+		return fmt.Errorf("invalid event %v", err)
+	}
+	if event.Data == nil {
+		return nil
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	switch data := event.Data.(type) {
+	case types.EventDataNewBlock:
+		return i.onNewBlock(ctx, data)
+	case types.EventDataTx:
+		return i.onTx(ctx, data)
+	case types.EventDataValidatorSetUpdates:
+		return i.onValidatorSetUpdates(ctx, data)
+	default:
+		return fmt.Errorf("unsupported event %T", data)
+	}
+}
+
+func (i *CosmosIndexer) onNewBlock(ctx context.Context, data types.EventDataNewBlock) error {
+	if data.Block == nil {
+		return fmt.Errorf("NewBlock event without block")
+	}
+	// Tx events of the previous height that never arrived are stored without results
+	if i.pending != nil {
+		if _, err := i.flush(ctx); err != nil {
+			return err
+		}
+	}
+	if data.Block.Height > i.head {
+		i.head = data.Block.Height
+	}
+	// blocks produced while the indexer was down are read from the RPC, the chain
+	// continues from the stored tip. When the backfill fails the block is dropped so the
+	// tip stays before the gap, the next block retries the backfill.
+	if data.Block.Height > i.next() {
+		if err := i.Backfill(ctx, data.Block.Height-1); err != nil {
+			return fmt.Errorf("backfill to %d failed %v", data.Block.Height-1, err)
+		}
+	}
+	i.pending = &blockData{
+		Block:      data.Block,
+		BlockID:    data.BlockID,
+		BeginBlock: data.ResultBeginBlock,
+		EndBlock:   data.ResultEndBlock,
+		TxResults:  make([]*abci.ResponseDeliverTx, len(data.Block.Txs)),
+	}
+	i.received = 0
+	if len(data.Block.Txs) == 0 {
+		_, err := i.flush(ctx)
+		return err
+	}
+	return nil
+}
+
+func (i *CosmosIndexer) onTx(ctx context.Context, data types.EventDataTx) error {
+	if i.pending == nil || data.Height != i.pending.Block.Height {
+		return fmt.Errorf("Tx event at height %d without its block", data.Height)
+	}
+	if int(data.Index) >= len(i.pending.TxResults) {
+		return fmt.Errorf("Tx event index %d out of range", data.Index)
+	}
+	if i.pending.TxResults[data.Index] == nil {
+		i.received++
+	}
+	result := data.Result
+	i.pending.TxResults[data.Index] = &result
+	if i.received == len(i.pending.TxResults) {
+		_, err := i.flush(ctx)
+		return err
+	}
+	return nil
+}
+
+func (i *CosmosIndexer) onValidatorSetUpdates(ctx context.Context, data types.EventDataValidatorSetUpdates) error {
+	height := i.LastHeight
+	if i.pending != nil {
+		height = i.pending.Block.Height
+	}
+	lnk := i.AnconSyncContext.Store.Store(ipld.LinkContext{}, validatorSetNode(height, data.ValidatorUpdates))
+	key := i.key("validators", fmt.Sprint(height))
+	return i.AnconSyncContext.Store.DataStore.Put(ctx, key, []byte(lnk.String()))
+}
+
+// flush stores the pending block
+func (i *CosmosIndexer) flush(ctx context.Context) (datamodel.Link, error) {
+	b := i.pending
+	i.pending = nil
+	return i.IndexBlock(ctx, b)
+}
+
+// loadTip restores the last indexed header block from the store
+func (i *CosmosIndexer) loadTip(ctx context.Context) error {
+	value, err := i.AnconSyncContext.Store.DataStore.Get(ctx, i.TipKey())
+	if err != nil || len(value) == 0 {
+		return nil
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return err
+	}
+	n, err := i.AnconSyncContext.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return err
+	}
+	height, err := n.LookupByString("height")
+	if err != nil {
+		return err
+	}
+	i.LastHeight, err = height.AsInt()
+	if err != nil {
+		return err
+	}
+	i.LastLink = lnk
+	return nil
+}
+
+// next is the height after the tip, the block received first is not backfilled when
+// nothing is indexed and no start height is set
+func (i *CosmosIndexer) next() int64 {
+	if i.LastLink != nil {
+		return i.LastHeight + 1
+	}
+	if i.StartHeight > 0 {
+		return i.StartHeight
+	}
+	return math.MaxInt64
+}
+
+// Backfill indexes the heights after the tip up to height through the block RPC
+func (i *CosmosIndexer) Backfill(ctx context.Context, height int64) error {
+	if i.Blocks == nil {
+		return fmt.Errorf("no block client")
+	}
+	for h := i.next(); h <= height; h++ {
+		block, err := i.Blocks.Block(ctx, &h)
+		if err != nil {
+			return err
+		}
+		results, err := i.Blocks.BlockResults(ctx, &h)
+		if err != nil {
+			return err
+		}
+		if _, err := i.IndexBlock(ctx, fetchedBlock(block, results)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parent returns the header block of the height before height
+func (i *CosmosIndexer) parent(ctx context.Context, height int64) datamodel.Link {
+	if i.LastLink != nil && i.LastHeight == height-1 {
+		return i.LastLink
+	}
+	value, err := i.AnconSyncContext.Store.DataStore.Get(ctx, i.BlockKey(height-1))
+	if err != nil || len(value) == 0 {
+		return nil
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil
+	}
+	return lnk
+}
+
+// IndexBlock verifies b, stores its tx blocks and header block and indexes them by height
+// and tx hash, the tip moves forward to b
+func (i *CosmosIndexer) IndexBlock(ctx context.Context, b *blockData) (datamodel.Link, error) {
+	s := i.AnconSyncContext.Store
+	height := b.Block.Height
+	commit, err := i.verify(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	txs := []datamodel.Link{}
+	for index, tx := range b.Block.Txs {
+		var result *abci.ResponseDeliverTx
+		if index < len(b.TxResults) {
+			result = b.TxResults[index]
+		}
+		lnk := s.Store(ipld.LinkContext{}, txNode(height, index, tx, result))
+		if err := s.DataStore.Put(ctx, i.TxKey(fmt.Sprintf("%X", tx.Hash())), []byte(lnk.String())); err != nil {
+			return nil, err
+		}
+		txs = append(txs, lnk)
+	}
+	lnk := s.Store(ipld.LinkContext{}, headerNode(b, txs, i.parent(ctx, height), commit))
+	if err := s.DataStore.Put(ctx, i.BlockKey(height), []byte(lnk.String())); err != nil {
+		return nil, err
+	}
+	if err := i.AnconSyncContext.IndexKey(ctx, i.BlockKey(height), lnk); err != nil {
+		return nil, err
+	}
+	if i.State != nil {
+		if err := i.IndexState(ctx, height, lnk); err != nil {
+			fmt.Printf("dagcosmos: state at %d not indexed %v\n", height-1, err)
+		}
+	}
+	if i.LastLink != nil && height <= i.LastHeight {
+		return lnk, nil
+	}
+	if err := s.DataStore.Put(ctx, i.TipKey(), []byte(lnk.String())); err != nil {
+		return nil, err
+	}
+	i.LastLink = lnk
+	i.LastHeight = height
+	return lnk, nil
+}
+
+// LoadBlock returns the header block at height
+func (i *CosmosIndexer) LoadBlock(ctx context.Context, height int64) (datamodel.Node, datamodel.Link, error) {
+	value, err := i.AnconSyncContext.Store.DataStore.Get(ctx, i.BlockKey(height))
+	if err != nil || len(value) == 0 {
+		return nil, nil, fmt.Errorf("block %d not indexed", height)
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := i.AnconSyncContext.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return n, lnk, nil
+}
+
+// @BasePath /v0
+// TipEvent godoc
+// @Summary Reads the Cosmos indexer tip
+// @Schemes
+// @Description Returns the last indexed height and its header block CID
+// @Tags indexer
+// @Produce json
+// @Success 200 {string} cid
+// @Router /indexer/{name}/tip [get]
+func (i *CosmosIndexer) TipEvent(c *gin.Context) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.LastLink == nil {
+		c.JSON(404, gin.H{
+			"error": fmt.Errorf("no blocks indexed").Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"cid":    i.LastLink,
+		"height": i.LastHeight,
+	})
+}
+
+// @BasePath /v0
+// BlockRead godoc
+// @Summary Reads an indexed Cosmos block
+// @Schemes
+// @Description Returns the header block at a height, it links a block per tx with the decoded messages and ABCI events
+// @Tags indexer
+// @Produce json
+// @Success 200 {object} []string
+// @Router /v0/indexer/{name}/block/{height} [get]
+func (i *CosmosIndexer) BlockRead(c *gin.Context) {
+	height, err := cast.ToInt64E(c.Param("height"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid height %s", c.Param("height")).Error(),
+		})
+		return
+	}
+	n, lnk, err := i.LoadBlock(c.Request.Context(), height)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	js, err := anconsync.Encode(n)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"cid":   lnk.String(),
+		"block": json.RawMessage(js),
+	})
 }
@@ -0,0 +1,368 @@
+package dagcosmos
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/ipld/go-ipld-prime"
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	"github.com/tendermint/tendermint/rpc/coretypes"
+	rpctypes "github.com/tendermint/tendermint/rpc/jsonrpc/types"
+	"github.com/tendermint/tendermint/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeTendermint is a Tendermint websocket endpoint that acks subscriptions and writes
+// the responses sent on events
+type fakeTendermint struct {
+	*httptest.Server
+	events     chan rpctypes.RPCResponse
+	subscribed chan string
+}
+
+func newFakeTendermint(t *testing.T) *fakeTendermint {
+	f := &fakeTendermint{events: make(chan rpctypes.RPCResponse), subscribed: make(chan string, 8)}
+	upgrader := websocket.Upgrader{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		acks := make(chan rpctypes.RPCResponse)
+		go func() {
+			for {
+				var req rpctypes.RPCRequest
+				if err := conn.ReadJSON(&req); err != nil {
+					close(acks)
+					return
+				}
+				var params struct {
+					Query string `json:"query"`
+				}
+				json.Unmarshal(req.Params, &params)
+				f.subscribed <- params.Query
+				acks <- rpctypes.NewRPCSuccessResponse(req.ID, &coretypes.ResultSubscribe{})
+			}
+		}()
+		for {
+			select {
+			case res, ok := <-acks:
+				if !ok {
+					return
+				}
+				conn.WriteJSON(res)
+			case res := <-f.events:
+				conn.WriteJSON(res)
+			}
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeTendermint) send(data types.TMEventData) {
+	f.events <- rpctypes.NewRPCSuccessResponse(rpctypes.JSONRPCIntID(0), &coretypes.ResultEvent{Query: "tm.event", Data: data})
+}
+
+// fakeBlocks serves the blocks and results of the heights it holds
+type fakeBlocks map[int64]*blockData
+
+func (b fakeBlocks) Block(ctx context.Context, height *int64) (*coretypes.ResultBlock, error) {
+	block, ok := b[*height]
+	if !ok {
+		return nil, fmt.Errorf("height %d is not available", *height)
+	}
+	return &coretypes.ResultBlock{Block: block.Block, BlockID: block.BlockID}, nil
+}
+
+func (b fakeBlocks) BlockResults(ctx context.Context, height *int64) (*coretypes.ResultBlockResults, error) {
+	block, ok := b[*height]
+	if !ok {
+		return nil, fmt.Errorf("height %d is not available", *height)
+	}
+	return &coretypes.ResultBlockResults{Height: *height, TxsResults: block.TxResults, EndBlockEvents: block.EndBlock.Events}, nil
+}
+
+func newTestContext(t *testing.T) *handler.AnconSyncContext {
+	key, _ := crypto.GenerateKey()
+	return handler.NewAnconSyncContext(anconsync.OpenStorage(t.TempDir()), nil, nil, key)
+}
+
+func newTestIndexer(t *testing.T, f *fakeTendermint, dag *handler.AnconSyncContext) (*CosmosIndexer, context.CancelFunc) {
+	i := New(dag, f.URL, "/websocket")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if _, err := i.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []SubscriptionType{NewBlock, Tx, ValidatorSetUpdates} {
+		if q := <-f.subscribed; q != string(s) {
+			t.Fatalf("unexpected subscription %s", q)
+		}
+	}
+	return i, cancel
+}
+
+// cosmosTx encodes a Cosmos SDK Tx with a single message
+func cosmosTx(typeURL string, value []byte, memo string) types.Tx {
+	var msg, body, tx []byte
+	msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+	msg = protowire.AppendString(msg, typeURL)
+	msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, value)
+	body = protowire.AppendTag(body, 1, protowire.BytesType)
+	body = protowire.AppendBytes(body, msg)
+	body = protowire.AppendTag(body, 2, protowire.BytesType)
+	body = protowire.AppendString(body, memo)
+	tx = protowire.AppendTag(tx, 1, protowire.BytesType)
+	tx = protowire.AppendBytes(tx, body)
+	return types.Tx(tx)
+}
+
+func newTestBlock(height int64, txs []types.Tx) types.EventDataNewBlock {
+	block := types.MakeBlock(height, txs, &types.Commit{}, nil)
+	block.Header.ChainID = "test-chain"
+	block.Header.Time = time.Unix(1600000000+height, 0)
+	return types.EventDataNewBlock{
+		Block:   block,
+		BlockID: types.BlockID{Hash: block.Hash()},
+		ResultEndBlock: abci.ResponseEndBlock{
+			Events: []abci.Event{{Type: "end", Attributes: []abci.EventAttribute{{Key: "k", Value: "v", Index: true}}}},
+		},
+	}
+}
+
+func waitBlock(t *testing.T, i *CosmosIndexer, height int64) map[string]interface{} {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		n, _, err := i.LoadBlock(context.Background(), height)
+		if err != nil {
+			continue
+		}
+		js, _ := anconsync.Encode(n)
+		var block map[string]interface{}
+		json.Unmarshal([]byte(js), &block)
+		return block
+	}
+	t.Fatalf("block %d was not indexed", height)
+	return nil
+}
+
+func TestTypedBlocks(t *testing.T) {
+	f := newFakeTendermint(t)
+	i, _ := newTestIndexer(t, f, newTestContext(t))
+
+	// errors and unknown responses are not stored
+	f.events <- rpctypes.RPCInternalError(rpctypes.JSONRPCIntID(0), fmt.Errorf("subscription cancelled"))
+
+	txs := []types.Tx{cosmosTx("/cosmos.bank.v1beta1.MsgSend", []byte{0x01}, "hello"), types.Tx("not a cosmos tx")}
+	f.send(newTestBlock(2, txs))
+	for index, tx := range txs {
+		f.send(types.EventDataTx{TxResult: abci.TxResult{Height: 2, Index: uint32(index), Tx: tx, Result: abci.ResponseDeliverTx{
+			GasUsed: 10,
+			Events:  []abci.Event{{Type: "transfer", Attributes: []abci.EventAttribute{{Key: "amount", Value: "1stake"}}}},
+		}}})
+	}
+	block := waitBlock(t, i, 2)
+	if block["chainId"] != "test-chain" || block["height"].(float64) != 2 || len(block["txs"].([]interface{})) != 2 {
+		t.Fatalf("unexpected header block %v", block)
+	}
+	if len(block["endBlockEvents"].([]interface{})) != 1 {
+		t.Fatalf("end block events were not stored %v", block)
+	}
+	if metadata := block["metadata"].(map[string]interface{}); metadata["verified"] != false || metadata["commit"] != nil {
+		t.Fatalf("block without light client is marked verified %v", metadata)
+	}
+
+	n, _, _ := i.LoadBlock(context.Background(), 2)
+	list, _ := n.LookupByString("txs")
+	first, _ := list.LookupByIndex(0)
+	lnk, _ := first.AsLink()
+	tx, err := i.AnconSyncContext.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, _ := anconsync.Encode(tx)
+	var v struct {
+		Messages []struct {
+			TypeURL string `json:"typeUrl"`
+			Value   string `json:"value"`
+		} `json:"messages"`
+		Memo   string `json:"memo"`
+		Result struct {
+			GasUsed int64 `json:"gasUsed"`
+			Events  []struct {
+				Type string `json:"type"`
+			} `json:"events"`
+		} `json:"result"`
+	}
+	json.Unmarshal([]byte(js), &v)
+	if len(v.Messages) != 1 || v.Messages[0].TypeURL != "/cosmos.bank.v1beta1.MsgSend" || v.Messages[0].Value != base64.StdEncoding.EncodeToString([]byte{0x01}) {
+		t.Fatalf("messages were not decoded %s", js)
+	}
+	if v.Memo != "hello" || v.Result.GasUsed != 10 || v.Result.Events[0].Type != "transfer" {
+		t.Fatalf("unexpected tx block %s", js)
+	}
+	if value, err := i.AnconSyncContext.Store.DataStore.Get(context.Background(), i.TxKey(fmt.Sprintf("%X", txs[1].Hash()))); err != nil || len(value) == 0 {
+		t.Fatal("tx is not indexed by hash")
+	}
+
+	// empty blocks do not wait for Tx events
+	f.send(newTestBlock(3, nil))
+	waitBlock(t, i, 3)
+
+	f.send(types.EventDataValidatorSetUpdates{ValidatorUpdates: []*types.Validator{types.NewValidator(ed25519.GenPrivKey().PubKey(), 10)}})
+	f.send(newTestBlock(4, nil))
+	waitBlock(t, i, 4)
+	if value, err := i.AnconSyncContext.Store.DataStore.Get(context.Background(), "cosmos:validators:3"); err != nil || len(value) == 0 {
+		t.Fatal("validator set updates were not stored")
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/v0/indexer/cosmos/block/2", nil)
+	c.Params = gin.Params{{Key: "height", Value: "2"}}
+	i.BlockRead(c)
+	if w.Code != 200 {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMissingTxEvents(t *testing.T) {
+	f := newFakeTendermint(t)
+	i, _ := newTestIndexer(t, f, newTestContext(t))
+
+	f.send(newTestBlock(5, []types.Tx{cosmosTx("/a", nil, "")}))
+	// the next block stores the previous one without the missing results
+	f.send(newTestBlock(6, nil))
+	block := waitBlock(t, i, 5)
+	if len(block["txs"].([]interface{})) != 1 {
+		t.Fatalf("unexpected block %v", block)
+	}
+	waitBlock(t, i, 6)
+}
+
+func parentOf(t *testing.T, i *CosmosIndexer, height int64) string {
+	block := waitBlock(t, i, height)
+	parent, ok := block["parent"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	return parent["/"].(string)
+}
+
+func TestParentLinksAndBackfill(t *testing.T) {
+	dag := newTestContext(t)
+	f := newFakeTendermint(t)
+	i, stop := newTestIndexer(t, f, dag)
+
+	f.send(newTestBlock(2, nil))
+	waitBlock(t, i, 2)
+	f.send(newTestBlock(3, nil))
+	waitBlock(t, i, 3)
+	if parentOf(t, i, 2) != "" {
+		t.Fatal("first indexed block links a parent")
+	}
+	_, second, _ := i.LoadBlock(context.Background(), 2)
+	if parentOf(t, i, 3) != second.String() {
+		t.Fatal("block does not link its parent")
+	}
+	stop()
+
+	// the restarted indexer resumes from the stored tip and reads heights 4 and 5 from
+	// the block RPC
+	f = newFakeTendermint(t)
+	restarted, _ := newTestIndexer(t, f, dag)
+	if restarted.LastHeight != 3 || restarted.LastLink.String() != i.LastLink.String() {
+		t.Fatalf("tip was not reloaded %d", restarted.LastHeight)
+	}
+	missed := newTestBlock(5, []types.Tx{cosmosTx("/a", nil, "missed")})
+	blocks := fakeBlocks{
+		4: {Block: newTestBlock(4, nil).Block},
+		5: {Block: missed.Block, BlockID: missed.BlockID, TxResults: []*abci.ResponseDeliverTx{{GasUsed: 7}}},
+	}
+	restarted.lock.Lock()
+	restarted.Blocks = blocks
+	restarted.lock.Unlock()
+	f.send(newTestBlock(6, nil))
+	waitBlock(t, restarted, 6)
+	for h := int64(6); h > 2; h-- {
+		_, parent, err := restarted.LoadBlock(context.Background(), h-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parentOf(t, restarted, h) != parent.String() {
+			t.Fatalf("block %d does not link block %d", h, h-1)
+		}
+	}
+	if height, head, _ := restarted.Progress(context.Background()); height != 6 || head != 6 {
+		t.Fatalf("unexpected progress %d %d", height, head)
+	}
+	block := waitBlock(t, restarted, 5)
+	if len(block["txs"].([]interface{})) != 1 {
+		t.Fatalf("backfilled block has no txs %v", block)
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/indexer/cosmos/tip", nil)
+	restarted.TipEvent(c)
+	var tip struct {
+		Height int64 `json:"height"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &tip)
+	if w.Code != 200 || tip.Height != 6 {
+		t.Fatalf("unexpected tip %s", w.Body.String())
+	}
+}
+
+func TestBackfillRetry(t *testing.T) {
+	f := newFakeTendermint(t)
+	i, _ := newTestIndexer(t, f, newTestContext(t))
+	f.send(newTestBlock(2, nil))
+	waitBlock(t, i, 2)
+
+	// height 4 is not available yet, block 5 is dropped and the tip stays at 3
+	blocks := fakeBlocks{3: {Block: newTestBlock(3, nil).Block}}
+	i.lock.Lock()
+	i.Blocks = blocks
+	i.lock.Unlock()
+	f.send(newTestBlock(5, nil))
+	waitBlock(t, i, 3)
+	i.lock.Lock()
+	if i.LastHeight != 3 {
+		t.Fatalf("tip moved past the gap to %d", i.LastHeight)
+	}
+	if _, _, err := i.LoadBlock(context.Background(), 5); err == nil {
+		t.Fatal("stored a block after a failed backfill")
+	}
+	blocks[4] = &blockData{Block: newTestBlock(4, nil).Block}
+	blocks[5] = &blockData{Block: newTestBlock(5, nil).Block}
+	i.lock.Unlock()
+
+	f.send(newTestBlock(6, nil))
+	waitBlock(t, i, 6)
+	for h := int64(6); h > 2; h-- {
+		_, parent, err := i.LoadBlock(context.Background(), h-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parentOf(t, i, h) != parent.String() {
+			t.Fatalf("block %d does not link block %d", h, h-1)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package dagcosmos
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/tendermint/tendermint/light"
+	dbs "github.com/tendermint/tendermint/light/store/db"
+	"github.com/tendermint/tendermint/types"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// DefaultTrustingPeriod is the time a verified header stays trusted, it has to be shorter
+// than the unbonding period of the chain
+const DefaultTrustingPeriod = 168 * time.Hour
+
+// NewLightClient returns a light client verifying headers from primary against witnesses,
+// starting from the header of trustedHeight with hash trustedHash. Verified headers are
+// kept in db so later runs start from the last one.
+func NewLightClient(ctx context.Context, chainID, primary string, witnesses []string, trustedHeight int64, trustedHash string, db dbm.DB) (*light.Client, error) {
+	hash, err := hex.DecodeString(trustedHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted hash %v", err)
+	}
+	return light.NewHTTPClient(ctx, chainID, light.TrustOptions{
+		Period: DefaultTrustingPeriod,
+		Height: trustedHeight,
+		Hash:   hash,
+	}, primary, witnesses, dbs.New(db))
+}
+
+// verify checks the header of b with the light client and the txs of b against its data
+// hash, and returns the commit that signed the header. The commit is nil when the indexer
+// has no light client.
+func (i *CosmosIndexer) verify(ctx context.Context, b *blockData) (*types.Commit, error) {
+	if i.Light == nil {
+		return nil, nil
+	}
+	height := b.Block.Height
+	lb, err := i.Light.VerifyLightBlockAtHeight(ctx, height, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("block %d failed verification %v", height, err)
+	}
+	if !bytes.Equal(lb.Hash(), b.Block.Hash()) {
+		return nil, fmt.Errorf("block %d hash %X does not match the verified header %X", height, b.Block.Hash(), lb.Hash())
+	}
+	// the header hash does not cover the txs, only their data hash does
+	if !bytes.Equal(b.Block.Data.Hash(), lb.DataHash) {
+		return nil, fmt.Errorf("block %d txs do not match the data hash of the verified header", height)
+	}
+	return lb.Commit, nil
+}
@@ -0,0 +1,132 @@
+package dagcosmos
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	"github.com/tendermint/tendermint/light"
+	"github.com/tendermint/tendermint/light/provider"
+	dbs "github.com/tendermint/tendermint/light/store/db"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
+	"github.com/tendermint/tendermint/types"
+	"github.com/tendermint/tendermint/version"
+	dbm "github.com/tendermint/tm-db"
+)
+
+const testChainID = "test-chain"
+
+// mockProvider serves the light blocks of a test chain
+type mockProvider map[int64]*types.LightBlock
+
+func (p mockProvider) LightBlock(ctx context.Context, height int64) (*types.LightBlock, error) {
+	if height == 0 {
+		height = int64(len(p))
+	}
+	lb, ok := p[height]
+	if !ok {
+		return nil, provider.ErrLightBlockNotFound
+	}
+	return lb, nil
+}
+
+func (p mockProvider) ReportEvidence(ctx context.Context, ev types.Evidence) error {
+	return nil
+}
+
+// newTestChain returns n blocks signed by a single validator and the provider serving them
+func newTestChain(t *testing.T, n int64) ([]*types.Block, mockProvider) {
+	ctx := context.Background()
+	pv := types.NewMockPV()
+	pub, _ := pv.GetPubKey(ctx)
+	vals := types.NewValidatorSet([]*types.Validator{types.NewValidator(pub, 10)})
+	base := time.Now().Add(-time.Hour)
+
+	blocks := []*types.Block{}
+	p := mockProvider{}
+	last := types.BlockID{}
+	for h := int64(1); h <= n; h++ {
+		block := types.MakeBlock(h, nil, &types.Commit{}, nil)
+		block.Header.Version = version.Consensus{Block: version.BlockProtocol}
+		block.Header.ChainID = testChainID
+		block.Header.Time = base.Add(time.Duration(h) * time.Minute)
+		block.Header.LastBlockID = last
+		block.Header.ValidatorsHash = vals.Hash()
+		block.Header.NextValidatorsHash = vals.Hash()
+		block.Header.ProposerAddress = pub.Address()
+		id := types.BlockID{Hash: block.Hash(), PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum(block.Hash())}}
+
+		voteSet := types.NewVoteSet(testChainID, h, 0, tmproto.PrecommitType, vals)
+		vote := &types.Vote{
+			ValidatorAddress: pub.Address(),
+			Height:           h,
+			Type:             tmproto.PrecommitType,
+			BlockID:          id,
+			Timestamp:        block.Header.Time,
+		}
+		v := vote.ToProto()
+		if err := pv.SignVote(ctx, testChainID, v); err != nil {
+			t.Fatal(err)
+		}
+		vote.Signature = v.Signature
+		if _, err := voteSet.AddVote(vote); err != nil {
+			t.Fatal(err)
+		}
+		p[h] = &types.LightBlock{
+			SignedHeader: &types.SignedHeader{Header: &block.Header, Commit: voteSet.MakeCommit()},
+			ValidatorSet: vals,
+		}
+		blocks = append(blocks, block)
+		last = id
+	}
+	return blocks, p
+}
+
+func TestLightClientVerification(t *testing.T) {
+	ctx := context.Background()
+	blocks, p := newTestChain(t, 5)
+	lc, err := light.NewClient(ctx, testChainID, light.TrustOptions{
+		Period: DefaultTrustingPeriod,
+		Height: 1,
+		Hash:   p[1].Hash(),
+	}, p, []provider.Provider{p}, dbs.New(dbm.NewMemDB()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &CosmosIndexer{AnconSyncContext: newTestContext(t), Light: lc}
+
+	for _, b := range blocks[1:4] {
+		if _, err := i.IndexBlock(ctx, &blockData{Block: b, BlockID: p[b.Height].Commit.BlockID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block := waitBlock(t, i, 4)
+	metadata := block["metadata"].(map[string]interface{})
+	commit := metadata["commit"].(map[string]interface{})
+	signatures := commit["signatures"].([]interface{})
+	if metadata["verified"] != true || metadata["resultsVerified"] != false || commit["height"].(float64) != 4 || len(signatures) != 1 {
+		t.Fatalf("unexpected metadata %v", metadata)
+	}
+	if signatures[0].(map[string]interface{})["signature"] == "" {
+		t.Fatal("commit signature was not recorded")
+	}
+
+	// txs that are not the ones of the verified header are not stored
+	tampered := types.MakeBlock(5, []types.Tx{types.Tx("forged")}, &types.Commit{}, nil)
+	tampered.Header = blocks[4].Header
+	if _, err := i.IndexBlock(ctx, &blockData{Block: tampered, BlockID: p[5].Commit.BlockID}); err == nil {
+		t.Fatal("block with forged txs was stored")
+	}
+
+	// a header the validators did not sign is not stored
+	forged := types.MakeBlock(5, nil, &types.Commit{}, nil)
+	forged.Header = blocks[4].Header
+	forged.Header.AppHash = tmhash.Sum([]byte("forged"))
+	if _, err := i.IndexBlock(ctx, &blockData{Block: forged}); err == nil {
+		t.Fatal("forged header was stored")
+	}
+	if _, _, err := i.LoadBlock(ctx, 5); err == nil || i.LastHeight != 4 {
+		t.Fatal("forged header was indexed")
+	}
+}
@@ -0,0 +1,646 @@
+package dageth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/anconprotocol/node/x/anconsync/handler/durin"
+	"github.com/anconprotocol/node/x/anconsync/impl"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/spf13/cast"
+)
+
+const (
+	DefaultAnchorInterval     = time.Hour
+	DefaultAnchorPollInterval = 15 * time.Second
+	// DefaultAnchorProofDepth is the number of latest anchors searched for a key proof
+	DefaultAnchorProofDepth = 1000
+)
+
+func anchorArguments(fields ...string) abi.Arguments {
+	args := abi.Arguments{}
+	for _, field := range fields {
+		parts := strings.SplitN(field, " ", 3)
+		t, err := abi.NewType(parts[0], "", nil)
+		if err != nil {
+			panic(err)
+		}
+		arg := abi.Argument{Type: t, Name: parts[len(parts)-1]}
+		arg.Indexed = len(parts) == 3 && parts[1] == "indexed"
+		args = append(args, arg)
+	}
+	return args
+}
+
+// AnchorMethod is anchor(bytes32 root, uint256 version) of the AnconAnchor contract
+func AnchorMethod() abi.Method {
+	return abi.NewMethod("anchor", "anchor", abi.Function, "nonpayable", false, false,
+		anchorArguments("bytes32 root", "uint256 version"), abi.Arguments{})
+}
+
+// AnchoredEvent is emitted by the AnconAnchor contract for each anchored root
+func AnchoredEvent() abi.Event {
+	return abi.NewEvent("Anchored", "Anchored", false,
+		anchorArguments("address indexed sender", "bytes32 indexed root", "uint256 version", "uint256 timestamp"))
+}
+
+// Anchor is an index checkpoint whose root hash was mined in an AnconAnchor transaction,
+// it links the checkpoint, the final relay record and the receipt inclusion proof
+type Anchor struct {
+	Checkpoint      datamodel.Link
+	Version         int64
+	RootHash        []byte
+	Contract        common.Address
+	ChainID         int64
+	Sender          common.Address
+	Relay           datamodel.Link
+	ReceiptProof    datamodel.Link
+	TransactionHash common.Hash
+	BlockNumber     uint64
+	BlockHash       common.Hash
+	// Timestamp is the time of the block including the anchor transaction
+	Timestamp uint64
+	Previous  datamodel.Link
+	Link      datamodel.Link
+}
+
+func (a *Anchor) node() datamodel.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 14, func(na fluent.MapAssembler) {
+		na.AssembleEntry("checkpoint").AssignLink(a.Checkpoint)
+		na.AssembleEntry("version").AssignInt(a.Version)
+		na.AssembleEntry("rootHash").AssignString(hexutil.Encode(a.RootHash))
+		na.AssembleEntry("contract").AssignString(a.Contract.Hex())
+		na.AssembleEntry("chainId").AssignInt(a.ChainID)
+		na.AssembleEntry("sender").AssignString(a.Sender.Hex())
+		na.AssembleEntry("relay").AssignLink(a.Relay)
+		na.AssembleEntry("receiptProof").AssignLink(a.ReceiptProof)
+		na.AssembleEntry("transactionHash").AssignString(a.TransactionHash.Hex())
+		na.AssembleEntry("blockNumber").AssignInt(int64(a.BlockNumber))
+		na.AssembleEntry("blockHash").AssignString(a.BlockHash.Hex())
+		na.AssembleEntry("timestamp").AssignInt(int64(a.Timestamp))
+		if a.Previous != nil {
+			na.AssembleEntry("previous").AssignLink(a.Previous)
+		} else {
+			na.AssembleEntry("previous").AssignNull()
+		}
+	})
+}
+
+func anchorFromNode(n datamodel.Node, lnk datamodel.Link) (*Anchor, error) {
+	a := &Anchor{Link: lnk}
+	links := map[string]*datamodel.Link{"checkpoint": &a.Checkpoint, "relay": &a.Relay, "receiptProof": &a.ReceiptProof, "previous": &a.Previous}
+	for name, l := range links {
+		v, err := n.LookupByString(name)
+		if err != nil {
+			return nil, fmt.Errorf("anchor has no %s", name)
+		}
+		if !v.IsNull() {
+			*l, _ = v.AsLink()
+		}
+	}
+	var blockNumber, timestamp int64
+	ints := map[string]*int64{"version": &a.Version, "chainId": &a.ChainID, "blockNumber": &blockNumber, "timestamp": &timestamp}
+	for name, i := range ints {
+		v, err := n.LookupByString(name)
+		if err != nil {
+			return nil, fmt.Errorf("anchor has no %s", name)
+		}
+		*i, _ = v.AsInt()
+	}
+	a.BlockNumber, a.Timestamp = uint64(blockNumber), uint64(timestamp)
+	str := func(name string) string {
+		v, err := n.LookupByString(name)
+		if err != nil {
+			return ""
+		}
+		s, _ := v.AsString()
+		return s
+	}
+	a.RootHash = common.FromHex(str("rootHash"))
+	a.Contract = common.HexToAddress(str("contract"))
+	a.Sender = common.HexToAddress(str("sender"))
+	a.TransactionHash = common.HexToHash(str("transactionHash"))
+	a.BlockHash = common.HexToHash(str("blockHash"))
+	return a, nil
+}
+
+func anchorKey(checkpoint string) string {
+	return strings.Join([]string{"anchor", checkpoint}, ":")
+}
+
+func anchorsKey() string {
+	return "anchors"
+}
+
+// anchorPendingKey is the list of the submitted checkpoints not anchored yet
+func anchorPendingKey() string {
+	return strings.Join([]string{"anchor", "pending"}, ":")
+}
+
+// Anchorer submits the root hash of the latest index checkpoint to an AnconAnchor
+// contract through the relayer, on a schedule or after a number of index writes, and
+// records each mined anchor
+type Anchorer struct {
+	AnconSyncContext *handler.AnconSyncContext
+	Relayer          *durin.Relayer
+	Prover           *Prover
+	Contract         common.Address
+	ChainID          int64
+	// Interval is the time between anchors
+	Interval time.Duration
+	// Writes anchors once that many index writes happened since the last anchor, 0
+	// anchors on Interval only
+	Writes       int64
+	PollInterval time.Duration
+	// ProofDepth is the number of latest anchors searched for the earliest one proving a
+	// key
+	ProofDepth int
+
+	lock sync.Mutex
+	// pending checkpoints by relay id
+	pending        map[string]*handler.IndexCheckpoint
+	anchoredAt     time.Time
+	anchoredWrites int64
+	version        int64
+}
+
+func NewAnchorer(dag *handler.AnconSyncContext, relayer *durin.Relayer, client ArchiveBackend, contract common.Address, chainID int64) *Anchorer {
+	return &Anchorer{
+		AnconSyncContext: dag,
+		Relayer:          relayer,
+		Prover:           NewProver(dag, client),
+		Contract:         contract,
+		ChainID:          chainID,
+		Interval:         DefaultAnchorInterval,
+		PollInterval:     DefaultAnchorPollInterval,
+		ProofDepth:       DefaultAnchorProofDepth,
+		pending:          map[string]*handler.IndexCheckpoint{},
+		anchoredAt:       time.Now(),
+	}
+}
+
+// latestVersion returns the last anchored or submitted checkpoint version
+func (a *Anchorer) latestVersion(ctx context.Context) int64 {
+	if a.version == 0 {
+		if tip, err := a.Load(ctx, ""); err == nil {
+			a.version = tip.Version
+		}
+	}
+	return a.version
+}
+
+// Anchor commits the pending index writes and submits the root hash of the latest
+// checkpoint, it returns nil when the checkpoint is already anchored
+func (a *Anchorer) Anchor(ctx context.Context) (*durin.Relay, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	dag := a.AnconSyncContext
+	if _, err := dag.CommitIndex(ctx); err != nil {
+		return nil, err
+	}
+	cp, err := dag.LoadIndexCheckpoint(ctx, 0)
+	if err != nil {
+		return nil, nil
+	}
+	if cp.Version <= a.latestVersion(ctx) {
+		return nil, nil
+	}
+	data, err := AnchorMethod().Inputs.Pack(common.BytesToHash(cp.RootHash), big.NewInt(cp.Version))
+	if err != nil {
+		return nil, err
+	}
+	relay, err := a.Relayer.Submit(ctx, a.Contract, append(AnchorMethod().ID, data...), cp.Link)
+	if err != nil {
+		return nil, err
+	}
+	a.pending[relay.ID] = cp
+	a.version = cp.Version
+	a.anchoredAt = time.Now()
+	a.anchoredWrites = dag.Index.Writes()
+	if err := a.storePending(ctx); err != nil {
+		return relay, err
+	}
+	return relay, nil
+}
+
+// storePending stores the relay ids and checkpoint versions of the pending anchors
+func (a *Anchorer) storePending(ctx context.Context) error {
+	ids := []string{}
+	for id := range a.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("anchors").CreateList(int64(len(ids)), func(la fluent.ListAssembler) {
+			for _, id := range ids {
+				la.AssembleValue().CreateMap(2, func(ma fluent.MapAssembler) {
+					ma.AssembleEntry("relay").AssignString(id)
+					ma.AssembleEntry("version").AssignInt(a.pending[id].Version)
+				})
+			}
+		})
+	})
+	lnk := a.AnconSyncContext.Store.Store(ipld.LinkContext{}, n)
+	return a.AnconSyncContext.Store.DataStore.Put(ctx, anchorPendingKey(), []byte(lnk.String()))
+}
+
+// Reload restores the anchors that were pending when the node stopped, so they are
+// recorded once mined. Anchors whose checkpoint can not be loaded are skipped.
+func (a *Anchorer) Reload(ctx context.Context) error {
+	// the relays of the pending anchors must be checked again too
+	if err := a.Relayer.Reload(ctx); err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	value, err := a.AnconSyncContext.Store.DataStore.Get(ctx, anchorPendingKey())
+	if err != nil || len(value) == 0 {
+		return nil
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return err
+	}
+	n, err := a.AnconSyncContext.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return err
+	}
+	list, err := n.LookupByString("anchors")
+	if err != nil {
+		return err
+	}
+	it := list.ListIterator()
+	for it != nil && !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return err
+		}
+		var id string
+		var version int64
+		if f, err := v.LookupByString("relay"); err == nil {
+			id, _ = f.AsString()
+		}
+		if f, err := v.LookupByString("version"); err == nil {
+			version, _ = f.AsInt()
+		}
+		if version == 0 {
+			fmt.Printf("anchor: skipping pending anchor %s without version\n", id)
+			continue
+		}
+		cp, err := a.AnconSyncContext.LoadIndexCheckpoint(ctx, version)
+		if err != nil {
+			fmt.Printf("anchor: skipping pending anchor %s %v\n", id, err)
+			continue
+		}
+		a.pending[id] = cp
+		if cp.Version > a.version {
+			a.version = cp.Version
+		}
+	}
+	return nil
+}
+
+// due returns true when Interval elapsed or Writes index writes happened since the last
+// anchor
+func (a *Anchorer) due() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.Writes > 0 && a.AnconSyncContext.Index.Writes()-a.anchoredWrites >= a.Writes {
+		return true
+	}
+	return time.Since(a.anchoredAt) >= a.Interval
+}
+
+// relayOutcome reads the status and transaction hash of the latest record of a relay
+func (a *Anchorer) relayOutcome(ctx context.Context, id string) (string, common.Hash, datamodel.Link, error) {
+	n, lnk, err := a.Relayer.Load(ctx, id)
+	if err != nil {
+		return "", common.Hash{}, nil, err
+	}
+	status, err := n.LookupByString("status")
+	if err != nil {
+		return "", common.Hash{}, nil, err
+	}
+	s, _ := status.AsString()
+	if s != durin.RelayMined {
+		return s, common.Hash{}, lnk, nil
+	}
+	hash, err := n.LookupByString("transactionHash")
+	if err != nil {
+		return "", common.Hash{}, nil, err
+	}
+	h, _ := hash.AsString()
+	return s, common.HexToHash(h), lnk, nil
+}
+
+// Check records the anchors of mined relays, reverted anchors are submitted again on the
+// next Anchor
+func (a *Anchorer) Check(ctx context.Context) ([]*Anchor, error) {
+	if err := a.Relayer.Check(ctx); err != nil {
+		return nil, err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	anchors := []*Anchor{}
+	for id, cp := range a.pending {
+		status, txHash, relay, err := a.relayOutcome(ctx, id)
+		if err != nil {
+			return anchors, err
+		}
+		switch status {
+		case durin.RelayPending:
+			continue
+		case durin.RelayReverted:
+			fmt.Printf("anchor: checkpoint %d reverted\n", cp.Version)
+			delete(a.pending, id)
+			if a.version >= cp.Version {
+				a.version = cp.Version - 1
+			}
+			continue
+		}
+		anchor, err := a.record(ctx, cp, relay, txHash)
+		if err != nil {
+			return anchors, err
+		}
+		delete(a.pending, id)
+		anchors = append(anchors, anchor)
+	}
+	if err := a.storePending(ctx); err != nil {
+		return anchors, err
+	}
+	return anchors, nil
+}
+
+// record proves the anchor receipt against its block, checks the Anchored log and stores
+// the anchor
+func (a *Anchorer) record(ctx context.Context, cp *handler.IndexCheckpoint, relay datamodel.Link, txHash common.Hash) (*Anchor, error) {
+	proof, proofLink, err := a.Prover.ReceiptProof(ctx, txHash)
+	if err != nil {
+		return nil, err
+	}
+	block, err := a.Prover.Client.BlockByNumber(ctx, new(big.Int).SetUint64(proof.BlockNumber))
+	if err != nil {
+		return nil, err
+	}
+	if proof.TransactionHash != txHash {
+		return nil, fmt.Errorf("proof is for transaction %s, not %s", proof.TransactionHash.Hex(), txHash.Hex())
+	}
+	receipt, err := impl.VerifyReceiptProof(block.Header(), proof)
+	if err != nil {
+		return nil, err
+	}
+	if !a.anchored(receipt, cp.RootHash) {
+		return nil, fmt.Errorf("transaction %s has no Anchored log of %x", txHash.Hex(), cp.RootHash)
+	}
+
+	anchor := &Anchor{
+		Checkpoint:      cp.Link,
+		Version:         cp.Version,
+		RootHash:        cp.RootHash,
+		Contract:        a.Contract,
+		ChainID:         a.ChainID,
+		Sender:          a.Relayer.From(),
+		Relay:           relay,
+		ReceiptProof:    proofLink,
+		TransactionHash: txHash,
+		BlockNumber:     proof.BlockNumber,
+		BlockHash:       proof.BlockHash,
+		Timestamp:       block.Time(),
+	}
+	s := a.AnconSyncContext.Store
+	if value, err := s.DataStore.Get(ctx, anchorsKey()); err == nil && len(value) > 0 {
+		anchor.Previous, _ = anconsync.ParseCidLink(string(value))
+	}
+	anchor.Link = s.Store(ipld.LinkContext{}, anchor.node())
+	if err := s.DataStore.Put(ctx, anchorKey(cp.Link.String()), []byte(anchor.Link.String())); err != nil {
+		return nil, err
+	}
+	if err := s.DataStore.Put(ctx, anchorsKey(), []byte(anchor.Link.String())); err != nil {
+		return nil, err
+	}
+	return anchor, nil
+}
+
+// anchored returns true when receipt has an Anchored log of the contract for root sent
+// by the relayer
+func (a *Anchorer) anchored(receipt *types.Receipt, root []byte) bool {
+	for _, l := range receipt.Logs {
+		if l.Address != a.Contract || len(l.Topics) != 3 || l.Topics[0] != AnchoredEvent().ID {
+			continue
+		}
+		if common.BytesToAddress(l.Topics[1].Bytes()) == a.Relayer.From() && bytes.Equal(l.Topics[2].Bytes(), common.BytesToHash(root).Bytes()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start reloads the stored pending anchors, then checks them and anchors when due every
+// PollInterval
+func (a *Anchorer) Start(ctx context.Context) {
+	if err := a.Reload(ctx); err != nil {
+		fmt.Printf("anchor: reload error %v\n", err)
+	}
+	ticker := time.NewTicker(a.PollInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := a.Check(ctx); err != nil {
+					fmt.Printf("anchor: check error %v\n", err)
+				}
+				if !a.due() {
+					continue
+				}
+				if _, err := a.Anchor(ctx); err != nil {
+					fmt.Printf("anchor: submit error %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// Load returns the anchor of a checkpoint CID, the latest anchor when empty
+func (a *Anchorer) Load(ctx context.Context, checkpoint string) (*Anchor, error) {
+	key := anchorsKey()
+	if checkpoint != "" {
+		key = anchorKey(checkpoint)
+	}
+	value, err := a.AnconSyncContext.Store.DataStore.Get(ctx, key)
+	if err != nil || len(value) == 0 {
+		return nil, fmt.Errorf("anchor %s not found", checkpoint)
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil, err
+	}
+	return a.loadLink(lnk)
+}
+
+func (a *Anchorer) loadLink(lnk datamodel.Link) (*Anchor, error) {
+	n, err := a.AnconSyncContext.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, err
+	}
+	return anchorFromNode(n, lnk)
+}
+
+// Anchors returns up to limit anchors, the latest first
+func (a *Anchorer) Anchors(ctx context.Context, limit int) ([]*Anchor, error) {
+	anchors := []*Anchor{}
+	anchor, err := a.Load(ctx, "")
+	if err != nil {
+		return anchors, nil
+	}
+	for len(anchors) < limit {
+		anchors = append(anchors, anchor)
+		if anchor.Previous == nil {
+			break
+		}
+		if anchor, err = a.loadLink(anchor.Previous); err != nil {
+			return anchors, err
+		}
+	}
+	return anchors, nil
+}
+
+func (anchor *Anchor) json() gin.H {
+	return gin.H{
+		"cid":             anchor.Link.String(),
+		"checkpoint":      anchor.Checkpoint.String(),
+		"version":         anchor.Version,
+		"rootHash":        hexutil.Encode(anchor.RootHash),
+		"contract":        anchor.Contract.Hex(),
+		"chainId":         anchor.ChainID,
+		"sender":          anchor.Sender.Hex(),
+		"transactionHash": anchor.TransactionHash.Hex(),
+		"blockNumber":     anchor.BlockNumber,
+		"blockHash":       anchor.BlockHash.Hex(),
+		"timestamp":       anchor.Timestamp,
+	}
+}
+
+// @BasePath /v0
+// AnchorsRead godoc
+// @Summary Lists the on-chain anchors
+// @Schemes
+// @Description Returns the anchored index checkpoints, the latest first, with the anchor transaction and the time of its block
+// @Tags anchors
+// @Produce json
+// @Success 200
+// @Router /v0/anchors [get]
+func (a *Anchorer) AnchorsRead(c *gin.Context) {
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		limit = cast.ToInt(v)
+	}
+	anchors, err := a.Anchors(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	res := []gin.H{}
+	for _, anchor := range anchors {
+		res = append(res, anchor.json())
+	}
+	c.JSON(200, gin.H{
+		"anchors": res,
+	})
+}
+
+// proveKey returns the earliest anchor whose index version maps key to cid, with the
+// membership proof of key at that version. Only the ProofDepth latest anchors are
+// searched, and the search ends at the first older anchor mapping key to another value.
+func (a *Anchorer) proveKey(ctx context.Context, key string, cid string) (*Anchor, gin.H, error) {
+	tree := a.AnconSyncContext.Index.Tree
+	var earliest *Anchor
+	anchor, err := a.Load(ctx, "")
+	for depth := 0; err == nil && depth < a.ProofDepth; depth++ {
+		if res, err := tree.GetVersioned(anchor.Version, []byte(key)); err == nil && string(res.Value) == cid {
+			earliest = anchor
+		} else if earliest != nil {
+			break
+		}
+		if anchor.Previous == nil {
+			break
+		}
+		anchor, err = a.loadLink(anchor.Previous)
+	}
+	if earliest == nil {
+		return nil, nil, fmt.Errorf("%s is not anchored under %s", cid, key)
+	}
+	proof, err := tree.GetVersionedWithProof(earliest.Version, []byte(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	return earliest, gin.H{
+		"key":      key,
+		"rootHash": proof.RootHash,
+		"proof":    proof.Proof,
+	}, nil
+}
+
+// @BasePath /v0
+// AnchorProofRead godoc
+// @Summary Proves a block existed at a chain time
+// @Schemes
+// @Description With key, proves that the block cid is indexed under key in the earliest anchored checkpoint, otherwise cid is a checkpoint CID. Returns the anchor, the index membership proof and the receipt inclusion proof of the anchor transaction.
+// @Tags anchors
+// @Produce json
+// @Success 200
+// @Router /v0/anchors/{cid}/proof [get]
+func (a *Anchorer) AnchorProofRead(c *gin.Context) {
+	ctx := c.Request.Context()
+	cid := c.Param("cid")
+	var anchor *Anchor
+	var membership gin.H
+	var err error
+	if key := c.Query("key"); key != "" {
+		anchor, membership, err = a.proveKey(ctx, key, cid)
+	} else {
+		anchor, err = a.Load(ctx, cid)
+	}
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	receipt, err := impl.LoadReceiptProof(a.AnconSyncContext.Store, anchor.ReceiptProof)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("receipt proof not found %v", err).Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"cid":          cid,
+		"anchor":       anchor.json(),
+		"membership":   membership,
+		"receiptProof": receipt,
+	})
+}
@@ -0,0 +1,175 @@
+package dageth
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/anconprotocol/node/x/anconsync/handler/durin"
+	"github.com/anconprotocol/node/x/anconsync/handler/proofsignature"
+	"github.com/anconprotocol/node/x/anconsync/handler/proofsignature/verify"
+	"github.com/anconprotocol/node/x/anconsync/impl"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// anchorCode deploys the AnconAnchor contract, the runtime code reverts unless the
+// selector is anchor(bytes32,uint256) and emits Anchored(caller, root, version, timestamp)
+func anchorCode() []byte {
+	return common.FromHex("604980600b6000396000f3" +
+		"60003560e01c63" + common.Bytes2Hex(AnchorMethod().ID) +
+		"14601357600080fd5b60243560005242602052600435337f" + common.Bytes2Hex(AnchoredEvent().ID.Bytes()) +
+		"60406000a300")
+}
+
+func newTestAnchorer(t *testing.T, tc *testChain) *Anchorer {
+	tx := tc.send(t, nil, anchorCode())
+	tc.backend.Commit()
+	receipt, err := tc.backend.TransactionReceipt(context.Background(), tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dag := newTestIndexer(t, tc).AnconSyncContext
+	tree, err := proofsignature.NewIavlAPI(dbm.NewMemDB(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dag.Index = handler.NewAuthenticatedIndex(tree.Service)
+	dag.Index.BatchSize = 0
+	relayer := durin.NewRelayer(tc.backend, dag.Store, tc.key, big.NewInt(1337))
+	return NewAnchorer(dag, relayer, tc.backend, receipt.ContractAddress, 1337)
+}
+
+type anchorProof struct {
+	Cid    string `json:"cid"`
+	Anchor struct {
+		Cid        string `json:"cid"`
+		Checkpoint string `json:"checkpoint"`
+		Version    int64  `json:"version"`
+		Timestamp  uint64 `json:"timestamp"`
+	} `json:"anchor"`
+	Membership *struct {
+		Key      string        `json:"key"`
+		RootHash hexutil.Bytes `json:"rootHash"`
+		Proof    hexutil.Bytes `json:"proof"`
+	} `json:"membership"`
+	ReceiptProof *impl.ReceiptProof `json:"receiptProof"`
+}
+
+func readAnchorProof(a *Anchorer, cid string, key string) (int, *anchorProof) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/v0/anchors/"+cid+"/proof?key="+key, nil)
+	c.Params = gin.Params{{Key: "cid", Value: cid}}
+	a.AnchorProofRead(c)
+	res := &anchorProof{}
+	json.Unmarshal(w.Body.Bytes(), res)
+	return w.Code, res
+}
+
+func TestAnchorer(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestChain(t)
+	a := newTestAnchorer(t, tc)
+	a.Writes = 2
+	dag := a.AnconSyncContext
+	doc := func(name string) ipld.Link {
+		return dag.Store.Store(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("name").AssignString(name)
+		}))
+	}
+
+	if relay, err := a.Anchor(ctx); relay != nil || err != nil {
+		t.Fatalf("anchored an empty index %v %v", relay, err)
+	}
+	alice := doc("alice")
+	dag.IndexKey(ctx, "did:web:ipfs:user:alice", alice)
+	if a.due() {
+		t.Fatal("anchor due before Writes index writes")
+	}
+	dag.IndexKey(ctx, "did:web:ipfs:user:bob", doc("bob"))
+	if !a.due() {
+		t.Fatal("anchor not due after Writes index writes")
+	}
+	if relay, err := a.Anchor(ctx); relay == nil || err != nil {
+		t.Fatalf("checkpoint was not submitted %v", err)
+	}
+	if relay, _ := a.Anchor(ctx); relay != nil {
+		t.Fatal("submitted a checkpoint twice")
+	}
+	if anchors, _ := a.Check(ctx); len(anchors) != 0 {
+		t.Fatal("recorded an anchor before it was mined")
+	}
+
+	tc.backend.Commit()
+	anchors, err := a.Check(ctx)
+	if err != nil || len(anchors) != 1 {
+		t.Fatalf("anchor was not recorded %v %v", anchors, err)
+	}
+	first := anchors[0]
+	block, _ := tc.backend.BlockByNumber(ctx, nil)
+	if first.Version != 1 || first.Sender != tc.from || first.BlockHash != block.Hash() || first.Timestamp != block.Time() || first.Previous != nil {
+		t.Fatalf("unexpected anchor %+v", first)
+	}
+
+	// a later anchor links the first one and alice stays proven by the earliest anchor
+	dag.IndexKey(ctx, "did:web:ipfs:user:carol", doc("carol"))
+	a.Anchor(ctx)
+	// the node restarts before the anchor is mined
+	a = NewAnchorer(dag, durin.NewRelayer(tc.backend, dag.Store, tc.key, big.NewInt(1337)), tc.backend, a.Contract, 1337)
+	if err := a.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if relay, _ := a.Anchor(ctx); relay != nil {
+		t.Fatal("submitted a pending checkpoint again")
+	}
+	tc.backend.Commit()
+	tc.backend.Commit()
+	if anchors, err := a.Check(ctx); err != nil || len(anchors) != 1 || anchors[0].Previous.String() != first.Link.String() {
+		t.Fatalf("unexpected second anchor %v %v", anchors, err)
+	}
+	if list, _ := a.Anchors(ctx, 10); len(list) != 2 || list[0].Version != 2 || list[1].Version != 1 {
+		t.Fatalf("unexpected anchors %v", list)
+	}
+
+	code, res := readAnchorProof(a, alice.String(), "did:web:ipfs:user:alice")
+	if code != 200 || res.Anchor.Version != 1 || res.Anchor.Cid != first.Link.String() || res.Membership == nil {
+		t.Fatalf("unexpected anchor proof %d %+v", code, res)
+	}
+	cp, err := dag.LoadIndexCheckpoint(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify.VerifyMembership(cp.RootHash, res.Membership.Proof, []byte(res.Membership.Key), []byte(alice.String())); err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := impl.VerifyReceiptProof(block.Header(), res.ReceiptProof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.anchored(receipt, cp.RootHash) {
+		t.Fatal("proven receipt has no Anchored log of the checkpoint")
+	}
+
+	code, res = readAnchorProof(a, cp.Link.String(), "")
+	if code != 200 || res.Anchor.Checkpoint != cp.Link.String() || res.Membership != nil || res.ReceiptProof == nil {
+		t.Fatalf("unexpected checkpoint anchor proof %d %+v", code, res)
+	}
+	if code, _ := readAnchorProof(a, alice.String(), "did:web:ipfs:user:bob"); code != 404 {
+		t.Fatal("proved a cid under another key")
+	}
+	// only the latest anchor is searched
+	a.ProofDepth = 1
+	if code, res := readAnchorProof(a, alice.String(), "did:web:ipfs:user:alice"); code != 200 || res.Anchor.Version != 2 {
+		t.Fatalf("unexpected anchor proof %d %+v", code, res)
+	}
+}
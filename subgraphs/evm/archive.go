@@ -0,0 +1,148 @@
+package dageth
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ipld/go-ipld-prime/datamodel"
+)
+
+// ArchiveBackend is the subset of an Ethereum client the archiver needs
+type ArchiveBackend interface {
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// EvmBlockKey is the index key of an archived block header
+func EvmBlockKey(number uint64) string {
+	return strings.Join([]string{"evm", "block", fmt.Sprint(number)}, ":")
+}
+
+// trieNodes collects the nodes a StackTrie commits
+type trieNodes struct {
+	nodes [][]byte
+}
+
+func (t *trieNodes) Put(key []byte, value []byte) error {
+	t.nodes = append(t.nodes, common.CopyBytes(value))
+	return nil
+}
+
+func (t *trieNodes) Delete(key []byte) error {
+	return nil
+}
+
+// committingTrie keeps the node collector across the Reset done by types.DeriveSha,
+// StackTrie.Reset drops its database
+type committingTrie struct {
+	*trie.StackTrie
+	nodes *trieNodes
+}
+
+func (t *committingTrie) Reset() {
+	t.StackTrie = trie.NewStackTrie(t.nodes)
+}
+
+// storeTrie stores the trie nodes of list with codec and checks the root matches
+func storeTrie(s anconsync.Storage, codec string, list types.DerivableList, root common.Hash) error {
+	nodes := &trieNodes{}
+	st := &committingTrie{nodes: nodes}
+	if h := types.DeriveSha(list, st); h != root {
+		return fmt.Errorf("%s root mismatch %s != %s", codec, h.Hex(), root.Hex())
+	}
+	if list.Len() == 0 {
+		return nil
+	}
+	if _, err := st.Commit(); err != nil {
+		return err
+	}
+	for _, node := range nodes.nodes {
+		if _, err := s.StoreDagEthRaw(codec, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReceiptsByBlock fetches the receipts of every transaction of block
+func ReceiptsByBlock(ctx context.Context, client ArchiveBackend, block *types.Block) (types.Receipts, error) {
+	receipts := types.Receipts{}
+	for _, tx := range block.Transactions() {
+		receipt, err := client.TransactionReceipt(ctx, tx.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("receipt %s: %v", tx.Hash().Hex(), err)
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
+
+// ArchiveBlock stores the header, transactions, receipts and both tries of a block as
+// dag-eth and returns the header link
+func ArchiveBlock(ctx context.Context, client ArchiveBackend, s anconsync.Storage, number uint64) (datamodel.Link, error) {
+	block, err := client.BlockByNumber(ctx, new(big.Int).SetUint64(number))
+	if err != nil {
+		return nil, err
+	}
+	receipts, err := ReceiptsByBlock(ctx, client, block)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range block.Transactions() {
+		raw, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.StoreDagEthRaw("eth-tx", raw); err != nil {
+			return nil, err
+		}
+	}
+	for _, receipt := range receipts {
+		raw, err := receipt.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.StoreDagEthRaw("eth-tx-receipt", raw); err != nil {
+			return nil, err
+		}
+	}
+	if err := storeTrie(s, "eth-tx-trie", block.Transactions(), block.TxHash()); err != nil {
+		return nil, err
+	}
+	if err := storeTrie(s, "eth-tx-receipt-trie", receipts, block.ReceiptHash()); err != nil {
+		return nil, err
+	}
+
+	raw, err := rlp.EncodeToBytes(block.Header())
+	if err != nil {
+		return nil, err
+	}
+	lnk, err := s.StoreDagEthRaw("eth-block", raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.DataStore.Put(ctx, EvmBlockKey(number), []byte(lnk.String())); err != nil {
+		return nil, err
+	}
+	return lnk, nil
+}
+
+// Archive stores the blocks from..to, both included, as dag-eth
+func Archive(ctx context.Context, client ArchiveBackend, s anconsync.Storage, from, to uint64) error {
+	for number := from; number <= to; number++ {
+		lnk, err := ArchiveBlock(ctx, client, s, number)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", number, err)
+		}
+		fmt.Printf("archived block %d %s\n", number, lnk)
+	}
+	return nil
+}
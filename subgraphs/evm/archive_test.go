@@ -0,0 +1,59 @@
+package dageth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ipld/go-ipld-prime"
+)
+
+func TestArchiveBlock(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestChain(t)
+	tc.emitDagJson(t, `{"name":"first"}`)
+	tc.emitDagJson(t, `{"name":"second"}`)
+	tc.backend.Commit()
+	block, err := tc.backend.BlockByNumber(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions()) != 2 {
+		t.Fatalf("%d transactions", len(block.Transactions()))
+	}
+
+	s := anconsync.OpenStorage(t.TempDir())
+	lnk, err := ArchiveBlock(ctx, tc.backend, s, block.NumberU64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := anconsync.EthHash(lnk); h != block.Hash() {
+		t.Fatalf("header link %s is not the block hash %s", lnk, block.Hash().Hex())
+	}
+	if v, err := s.DataStore.Get(ctx, EvmBlockKey(block.NumberU64())); err != nil || string(v) != lnk.String() {
+		t.Fatalf("block key %s %v", v, err)
+	}
+
+	header, err := s.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"txRoot", "receiptRoot"} {
+		root, err := header.LookupByString(field)
+		if err != nil {
+			t.Fatalf("missing %s: %v", field, err)
+		}
+		rootLink, _ := root.AsLink()
+		if _, err := s.Load(ipld.LinkContext{}, rootLink); err != nil {
+			t.Fatalf("%s root is not stored: %v", field, err)
+		}
+	}
+	for _, tx := range block.Transactions() {
+		if _, err := s.Load(ipld.LinkContext{}, anconsync.EthLink(anconsync.EthTx, tx.Hash())); err != nil {
+			t.Fatalf("tx %s is not stored: %v", tx.Hash().Hex(), err)
+		}
+	}
+	if uncles, _ := header.LookupByString("uncles"); uncles != nil {
+		t.Fatal("header links uncles that are not stored")
+	}
+}
@@ -0,0 +1,410 @@
+package dageth
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/anconprotocol/node/x/anconsync/impl"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+const (
+	DefaultConfirmations = 12
+	DefaultBatchSize     = 1000
+	DefaultPollInterval  = 15 * time.Second
+	// DefaultName is the name of the subgraph started with -enable-dageth
+	DefaultName = "evm"
+)
+
+// Backend is the subset of an Ethereum client the indexer needs, both ethclient.Client
+// and backends.SimulatedBackend implement it
+type Backend interface {
+	ethereum.LogFilterer
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+}
+
+// Checkpoint is the persisted cursor of the indexer, one is stored per indexed range with
+// the provenance envelopes of the range and links the previous one so the cursor can be
+// rolled back on reorgs
+type Checkpoint struct {
+	Number   uint64
+	Hash     common.Hash
+	Links    []datamodel.Link
+	Previous datamodel.Link
+	Link     datamodel.Link
+}
+
+func (cp *Checkpoint) node() datamodel.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 4, func(na fluent.MapAssembler) {
+		na.AssembleEntry("number").AssignInt(int64(cp.Number))
+		na.AssembleEntry("hash").AssignString(cp.Hash.Hex())
+		na.AssembleEntry("links").CreateList(int64(len(cp.Links)), func(la fluent.ListAssembler) {
+			for _, l := range cp.Links {
+				la.AssembleValue().AssignLink(l)
+			}
+		})
+		if cp.Previous != nil {
+			na.AssembleEntry("previous").AssignLink(cp.Previous)
+		} else {
+			na.AssembleEntry("previous").AssignNull()
+		}
+	})
+}
+
+func checkpointFromNode(n datamodel.Node, lnk datamodel.Link) (*Checkpoint, error) {
+	cp := &Checkpoint{Link: lnk}
+	number, err := n.LookupByString("number")
+	if err != nil {
+		return nil, err
+	}
+	num, _ := number.AsInt()
+	cp.Number = uint64(num)
+	hash, err := n.LookupByString("hash")
+	if err != nil {
+		return nil, err
+	}
+	h, _ := hash.AsString()
+	cp.Hash = common.HexToHash(h)
+	links, err := n.LookupByString("links")
+	if err != nil {
+		return nil, err
+	}
+	it := links.ListIterator()
+	for it != nil && !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		l, err := v.AsLink()
+		if err != nil {
+			return nil, err
+		}
+		cp.Links = append(cp.Links, l)
+	}
+	previous, err := n.LookupByString("previous")
+	if err == nil && !previous.IsNull() {
+		cp.Previous, _ = previous.AsLink()
+	}
+	return cp, nil
+}
+
+// LogHandler handles the logs of a topic registered with OnLog
+type LogHandler func(ctx context.Context, log types.Log) error
+
+// EvmIndexer indexes Ancon events and the events of the registry from an EVM chain into
+// the store
+type EvmIndexer struct {
+	AnconSyncContext *handler.AnconSyncContext
+	Client           Backend
+	ChainID          int64
+	// Name namespaces the cursor, indexers of the same chain need their own. The indexer
+	// named DefaultName keeps the cursor of the chain.
+	Name string
+	// Addresses limits the indexed contracts, all contracts are indexed when empty
+	Addresses     []common.Address
+	Confirmations uint64
+	StartBlock    uint64
+	BatchSize     uint64
+	PollInterval  time.Duration
+
+	lock       sync.Mutex
+	cursor     *Checkpoint
+	handlers   map[common.Hash]LogHandler
+	registries impl.EventRegistryCache
+}
+
+func New(dag *handler.AnconSyncContext, client Backend, chainID int64) *EvmIndexer {
+	return &EvmIndexer{
+		AnconSyncContext: dag,
+		Client:           client,
+		ChainID:          chainID,
+		Confirmations:    DefaultConfirmations,
+		BatchSize:        DefaultBatchSize,
+		PollInterval:     DefaultPollInterval,
+		handlers:         map[common.Hash]LogHandler{},
+	}
+}
+
+// OnLog indexes the logs of topic with h instead of the event registry
+func (i *EvmIndexer) OnLog(topic common.Hash, h LogHandler) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.handlers[topic] = h
+}
+
+func (i *EvmIndexer) topics(registry *impl.EventRegistry) []common.Hash {
+	topics := append(impl.AnconEventTopics(), registry.Topics()...)
+	for topic := range i.handlers {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (i *EvmIndexer) cursorKey() string {
+	if i.Name == "" || i.Name == DefaultName {
+		return strings.Join([]string{"dageth", fmt.Sprint(i.ChainID), "cursor"}, ":")
+	}
+	return strings.Join([]string{"dageth", fmt.Sprint(i.ChainID), i.Name, "cursor"}, ":")
+}
+
+func (i *EvmIndexer) loadCheckpoint(lnk datamodel.Link) (*Checkpoint, error) {
+	n, err := i.AnconSyncContext.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, err
+	}
+	return checkpointFromNode(n, lnk)
+}
+
+// Cursor returns the last indexed checkpoint, loading it from the store on first use
+func (i *EvmIndexer) Cursor(ctx context.Context) (*Checkpoint, error) {
+	if i.cursor != nil {
+		return i.cursor, nil
+	}
+	value, err := i.AnconSyncContext.Store.DataStore.Get(ctx, i.cursorKey())
+	if err != nil || len(value) == 0 {
+		return nil, nil
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil, err
+	}
+	i.cursor, err = i.loadCheckpoint(lnk)
+	return i.cursor, err
+}
+
+func (i *EvmIndexer) setCursor(ctx context.Context, cp *Checkpoint) error {
+	i.cursor = cp
+	value := []byte{}
+	if cp != nil {
+		value = []byte(cp.Link.String())
+	}
+	return i.AnconSyncContext.Store.DataStore.Put(ctx, i.cursorKey(), value)
+}
+
+// rollback moves the cursor back to the newest checkpoint still on the canonical chain
+func (i *EvmIndexer) rollback(ctx context.Context, cp *Checkpoint) (*Checkpoint, error) {
+	for cp != nil {
+		header, err := i.Client.HeaderByNumber(ctx, new(big.Int).SetUint64(cp.Number))
+		if err != nil {
+			return nil, err
+		}
+		if header.Hash() == cp.Hash {
+			return cp, nil
+		}
+		fmt.Printf("dageth: reorg at block %d, dropping %d blocks\n", cp.Number, len(cp.Links))
+		// the transactions of dropped blocks no longer resolve to their envelopes, the
+		// canonical ones are indexed again
+		for _, envelope := range cp.Links {
+			if err := impl.RemoveProvenance(ctx, i.AnconSyncContext.Store, envelope); err != nil {
+				return nil, err
+			}
+		}
+		if cp.Previous == nil {
+			return nil, nil
+		}
+		cp, err = i.loadCheckpoint(cp.Previous)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// Sync indexes confirmed blocks after the cursor, rolling the cursor back first when the
+// chain reorganized past it
+func (i *EvmIndexer) Sync(ctx context.Context) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	cp, err := i.Cursor(ctx)
+	if err != nil {
+		return err
+	}
+	if cp != nil {
+		canonical, err := i.rollback(ctx, cp)
+		if err != nil {
+			return err
+		}
+		if canonical != cp {
+			if err := i.setCursor(ctx, canonical); err != nil {
+				return err
+			}
+			cp = canonical
+		}
+	}
+
+	head, err := i.Client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if head.Number.Uint64() < i.Confirmations {
+		return nil
+	}
+	safe := head.Number.Uint64() - i.Confirmations
+
+	from := i.StartBlock
+	if cp != nil {
+		from = cp.Number + 1
+	}
+	registry, err := i.registries.Load(ctx, i.AnconSyncContext.Store)
+	if err != nil {
+		return err
+	}
+	for from <= safe {
+		to := from + i.BatchSize - 1
+		if to > safe {
+			to = safe
+		}
+		next, err := i.indexRange(ctx, registry, from, to, cp)
+		if err != nil {
+			return err
+		}
+		if err := i.setCursor(ctx, next); err != nil {
+			return err
+		}
+		cp = next
+		from = to + 1
+	}
+	return nil
+}
+
+func (i *EvmIndexer) indexRange(ctx context.Context, registry *impl.EventRegistry, from, to uint64, previous *Checkpoint) (*Checkpoint, error) {
+	logs, err := i.Client.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(from),
+		ToBlock:   new(big.Int).SetUint64(to),
+		Addresses: i.Addresses,
+		Topics:    [][]common.Hash{i.topics(registry)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	header, err := i.Client.HeaderByNumber(ctx, new(big.Int).SetUint64(to))
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &Checkpoint{Number: to, Hash: header.Hash()}
+	if previous != nil {
+		cp.Previous = previous.Link
+	}
+	for _, log := range logs {
+		if log.Removed {
+			continue
+		}
+		if len(log.Topics) > 0 && i.handlers[log.Topics[0]] != nil {
+			if err := i.handlers[log.Topics[0]](ctx, log); err != nil {
+				fmt.Printf("dageth: skipping log %s:%d %v\n", log.TxHash.Hex(), log.Index, err)
+			}
+			continue
+		}
+		_, lnk, envelope, err := impl.DecodeLog(ctx, i.AnconSyncContext.Store, registry, log.Topics, log.Data, impl.Provenance{
+			TransactionHash: log.TxHash,
+			BlockHash:       log.BlockHash,
+			BlockNumber:     log.BlockNumber,
+			LogIndex:        log.Index,
+			ContractAddress: log.Address,
+			ChainID:         i.ChainID,
+		})
+		if err != nil {
+			fmt.Printf("dageth: skipping log %s:%d %v\n", log.TxHash.Hex(), log.Index, err)
+			continue
+		}
+		cp.Links = append(cp.Links, envelope)
+		if i.AnconSyncContext.Exchange != nil {
+			impl.PushBlock(ctx, i.AnconSyncContext.Exchange, i.AnconSyncContext.IPFSPeer, lnk)
+			impl.PushBlock(ctx, i.AnconSyncContext.Exchange, i.AnconSyncContext.IPFSPeer, envelope)
+		}
+	}
+	cp.Link = i.AnconSyncContext.Store.Store(ipld.LinkContext{}, cp.node())
+	return cp, nil
+}
+
+// Start syncs on every new head until ctx is done, falling back to polling when the
+// endpoint does not support subscriptions. The returned channel is closed once syncing
+// stopped.
+func (i *EvmIndexer) Start(ctx context.Context) (<-chan struct{}, error) {
+	heads := make(chan *types.Header)
+	sub, err := i.Client.SubscribeNewHead(ctx, heads)
+	if err != nil {
+		sub = nil
+	}
+	ticker := time.NewTicker(i.PollInterval)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		if sub != nil {
+			defer sub.Unsubscribe()
+		}
+		for {
+			if err := i.Sync(ctx); err != nil {
+				fmt.Printf("dageth: sync error %v\n", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-heads:
+			case <-ticker.C:
+			}
+		}
+	}()
+	return done, nil
+}
+
+// Progress returns the last indexed block number and the chain head
+func (i *EvmIndexer) Progress(ctx context.Context) (int64, int64, error) {
+	head, err := i.Client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	cp, err := i.Cursor(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if cp == nil {
+		return 0, head.Number.Int64(), nil
+	}
+	return int64(cp.Number), head.Number.Int64(), nil
+}
+
+// @BasePath /v0
+// TipEvent godoc
+// @Summary Reads the EVM indexer cursor
+// @Schemes
+// @Description Returns the last indexed block number, hash and checkpoint CID
+// @Tags indexer
+// @Produce json
+// @Success 200 {string} cid
+// @Router /indexer/{name}/tip [get]
+func (i *EvmIndexer) TipEvent(c *gin.Context) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	cp, err := i.Cursor(c.Request.Context())
+	if err != nil || cp == nil {
+		c.JSON(404, gin.H{
+			"error": fmt.Errorf("no blocks indexed").Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"cid":    cp.Link,
+		"number": cp.Number,
+		"hash":   cp.Hash,
+	})
+}
@@ -0,0 +1,291 @@
+package dageth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/anconprotocol/node/x/anconsync/impl"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// emitterCode deploys a contract that emits LOG1 with the first 32 bytes of calldata as
+// topic and the rest as data
+var emitterCode = common.FromHex("6012600c60003960126000f3" + "60203603806020600037600035906000a100")
+
+type testChain struct {
+	backend  *backends.SimulatedBackend
+	key      *ecdsa.PrivateKey
+	from     common.Address
+	contract common.Address
+	signer   types.Signer
+}
+
+func newTestChain(t *testing.T) *testChain {
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	backend := backends.NewSimulatedBackend(core.GenesisAlloc{
+		from: {Balance: new(big.Int).Mul(big.NewInt(100), big.NewInt(params.Ether))},
+	}, 10000000)
+	tc := &testChain{backend: backend, key: key, from: from, signer: types.HomesteadSigner{}}
+	tx := tc.send(t, nil, emitterCode)
+	backend.Commit()
+	receipt, err := backend.TransactionReceipt(context.Background(), tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.contract = receipt.ContractAddress
+	return tc
+}
+
+func (tc *testChain) send(t *testing.T, to *common.Address, data []byte) *types.Transaction {
+	ctx := context.Background()
+	nonce, err := tc.backend.PendingNonceAt(ctx, tc.from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tx *types.Transaction
+	if to == nil {
+		tx = types.NewContractCreation(nonce, big.NewInt(0), 1000000, big.NewInt(10*params.GWei), data)
+	} else {
+		tx = types.NewTransaction(nonce, *to, big.NewInt(0), 1000000, big.NewInt(10*params.GWei), data)
+	}
+	tx, err = types.SignTx(tx, tc.signer, tc.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.backend.SendTransaction(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// emitDagJson emits an EncodeDagJson event carrying js
+func (tc *testChain) emitDagJson(t *testing.T, js string) {
+	data, err := impl.EncodeDagJsonEvent().Inputs.Pack("/", common.Bytes2Hex([]byte(`"`+hexutil.Encode([]byte(js))+`"`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.send(t, &tc.contract, append(impl.EncodeDagJsonEvent().ID.Bytes(), data...))
+}
+
+// emitEvent emits event with the packed path and hex data inputs
+func (tc *testChain) emitEvent(t *testing.T, event abi.Event, hexdata string) {
+	data, err := event.Inputs.Pack("/", hexdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.send(t, &tc.contract, append(event.ID.Bytes(), data...))
+}
+
+func newTestIndexer(t *testing.T, tc *testChain) *EvmIndexer {
+	key, _ := crypto.GenerateKey()
+	dag := handler.NewAnconSyncContext(anconsync.OpenStorage(t.TempDir()), nil, nil, key)
+	i := New(dag, tc.backend, 1337)
+	i.Confirmations = 2
+	return i
+}
+
+func TestIndexerConfirmationsAndCursor(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestChain(t)
+	i := newTestIndexer(t, tc)
+
+	tc.emitDagJson(t, `{"name":"first"}`)
+	tc.backend.Commit()
+	if err := i.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if cp, _ := i.Cursor(ctx); cp == nil || cp.Number != 0 {
+		t.Fatalf("indexed unconfirmed block %+v", cp)
+	}
+
+	tc.backend.Commit()
+	tc.backend.Commit()
+	if err := i.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cp, _ := i.Cursor(ctx)
+	if cp == nil || cp.Number != 2 || len(cp.Links) != 1 {
+		t.Fatalf("unexpected cursor %+v", cp)
+	}
+	envelope, err := i.AnconSyncContext.Store.Load(ipld.LinkContext{}, cp.Links[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := envelope.LookupByString("data")
+	lnk, _ := data.AsLink()
+	n, err := i.AnconSyncContext.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := n.LookupByString("name"); name == nil {
+		t.Fatal("missing name in indexed block")
+	}
+	txHash, _ := envelope.LookupByString("transactionHash")
+	hash, _ := txHash.AsString()
+	envelopes, _, err := impl.LoadTxProvenance(ctx, i.AnconSyncContext.Store, common.HexToHash(hash))
+	if err != nil || len(envelopes) != 1 || envelopes[0].String() != cp.Links[0].String() {
+		t.Fatalf("envelope not indexed by transaction %v", err)
+	}
+
+	// a new indexer resumes from the persisted cursor
+	resumed := New(i.AnconSyncContext, tc.backend, 1337)
+	resumed.Confirmations = 2
+	rcp, err := resumed.Cursor(ctx)
+	if err != nil || rcp == nil || rcp.Link.String() != cp.Link.String() {
+		t.Fatalf("cursor not persisted %+v %v", rcp, err)
+	}
+	// another subgraph of the same chain has its own cursor
+	other := New(i.AnconSyncContext, tc.backend, 1337)
+	other.Name = "goerli"
+	if ocp, err := other.Cursor(ctx); err != nil || ocp != nil {
+		t.Fatalf("subgraphs of the same chain share the cursor %+v %v", ocp, err)
+	}
+}
+
+func TestIndexerReorgRollback(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestChain(t)
+	i := newTestIndexer(t, tc)
+	i.Confirmations = 0
+	i.BatchSize = 1
+
+	forkPoint, _ := tc.backend.HeaderByNumber(ctx, nil)
+	tc.emitDagJson(t, `{"name":"orphan"}`)
+	tc.backend.Commit()
+	if err := i.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cp, _ := i.Cursor(ctx)
+	if cp == nil || len(cp.Links) != 1 {
+		t.Fatalf("unexpected cursor %+v", cp)
+	}
+	orphan := cp.Hash
+	envelope, _ := i.AnconSyncContext.Store.Load(ipld.LinkContext{}, cp.Links[0])
+	txHash, _ := envelope.LookupByString("transactionHash")
+	hash, _ := txHash.AsString()
+
+	// replace block 2 with a longer side chain without the event
+	if err := tc.backend.Fork(ctx, forkPoint.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	tc.backend.Commit()
+	tc.backend.Commit()
+	if err := i.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cp, _ = i.Cursor(ctx)
+	if cp == nil || cp.Number != 3 || cp.Hash == orphan {
+		t.Fatalf("unexpected cursor after reorg %+v", cp)
+	}
+	for cp != nil {
+		if len(cp.Links) != 0 {
+			t.Fatalf("orphaned log still indexed at %d", cp.Number)
+		}
+		if cp.Previous == nil {
+			break
+		}
+		cp, _ = i.loadCheckpoint(cp.Previous)
+	}
+	if envelopes, index, _ := impl.LoadTxProvenance(ctx, i.AnconSyncContext.Store, common.HexToHash(hash)); index != nil || len(envelopes) != 0 {
+		t.Fatalf("orphaned transaction still resolves to %v", envelopes)
+	}
+}
+
+func TestIndexerEventRegistry(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestChain(t)
+	i := newTestIndexer(t, tc)
+	i.Confirmations = 0
+
+	doc, err := anconsync.Decode(basicnode.Prototype.Any, `{
+		"name": "minter",
+		"abi": [{"type": "event", "name": "Minted", "anonymous": false, "inputs": [
+			{"name": "tokenId", "type": "uint256", "indexed": false},
+			{"name": "uri", "type": "string", "indexed": false},
+			{"name": "supply", "type": "uint64", "indexed": false}]}],
+		"events": [{"event": "Minted", "codec": "dag-cbor", "fields": {"id": "tokenId", "tokenURI": "uri", "supply": "supply"}}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := impl.RegisterEventMappings(ctx, i.AnconSyncContext.Store, doc); err != nil {
+		t.Fatal(err)
+	}
+	registry, _, _ := impl.LoadEventRegistry(ctx, i.AnconSyncContext.Store)
+	minted := registry.Topics()[0]
+
+	args := impl.EncodeDagJsonEvent().Inputs
+	unknown, _ := args.Pack("/", "")
+	tc.send(t, &tc.contract, append(crypto.Keccak256([]byte("Unknown(string,string)")), unknown...))
+	tc.backend.Commit()
+	uint256, _ := abi.NewType("uint256", "", nil)
+	str, _ := abi.NewType("string", "", nil)
+	uint64Type, _ := abi.NewType("uint64", "", nil)
+	data, _ := abi.Arguments{{Type: uint256}, {Type: str}, {Type: uint64Type}}.Pack(big.NewInt(7), "ipfs://token", uint64(math.MaxUint64))
+	tc.send(t, &tc.contract, append(minted.Bytes(), data...))
+	tc.backend.Commit()
+
+	if err := i.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cp, _ := i.Cursor(ctx)
+	if cp == nil || len(cp.Links) != 1 {
+		t.Fatalf("unexpected cursor %+v", cp)
+	}
+	envelope, _ := i.AnconSyncContext.Store.Load(ipld.LinkContext{}, cp.Links[0])
+	dataNode, _ := envelope.LookupByString("data")
+	lnk, _ := dataNode.AsLink()
+	n, err := i.AnconSyncContext.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := n.LookupByString("id")
+	uri, _ := n.LookupByString("tokenURI")
+	if v, _ := id.AsInt(); v != 7 {
+		t.Fatalf("unexpected id %d", v)
+	}
+	if v, _ := uri.AsString(); v != "ipfs://token" {
+		t.Fatalf("unexpected tokenURI %s", v)
+	}
+	// uint64 values above int64 are decimal strings
+	supply, _ := n.LookupByString("supply")
+	if v, _ := supply.AsString(); v != "18446744073709551615" {
+		t.Fatalf("unexpected supply %v", supply)
+	}
+}
+
+func TestIndexerMalformedLog(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestChain(t)
+	i := newTestIndexer(t, tc)
+	i.Confirmations = 0
+
+	// any contract may emit the dag events, bad payloads are skipped
+	tc.emitEvent(t, impl.EncodeDagJsonEvent(), "zz")
+	tc.emitEvent(t, impl.EncodeDagJsonEvent(), common.Bytes2Hex([]byte(`"`+hexutil.Encode([]byte("{not json"))+`"`)))
+	tc.emitEvent(t, impl.EncodeDagCborEvent(), "ff00ff")
+	tc.emitDagJson(t, `{"name":"valid"}`)
+	tc.backend.Commit()
+	if err := i.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cp, _ := i.Cursor(ctx)
+	if cp == nil || len(cp.Links) != 1 {
+		t.Fatalf("unexpected cursor %+v", cp)
+	}
+}
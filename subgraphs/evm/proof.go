@@ -0,0 +1,116 @@
+package dageth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/anconprotocol/node/x/anconsync/impl"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime/datamodel"
+)
+
+// Prover builds receipt inclusion proofs from an EVM node
+type Prover struct {
+	AnconSyncContext *handler.AnconSyncContext
+	Client           ArchiveBackend
+}
+
+func NewProver(dag *handler.AnconSyncContext, client ArchiveBackend) *Prover {
+	return &Prover{
+		AnconSyncContext: dag,
+		Client:           client,
+	}
+}
+
+// ReceiptProofKey is the store key of the proof link of a transaction receipt
+func ReceiptProofKey(txHash common.Hash) string {
+	return strings.Join([]string{"evm", "proof", "receipt", txHash.Hex()}, ":")
+}
+
+// cached returns the stored proof of txHash when it is still for blockHash
+func (p *Prover) cached(ctx context.Context, txHash common.Hash, blockHash common.Hash) (*impl.ReceiptProof, datamodel.Link) {
+	value, err := p.AnconSyncContext.Store.DataStore.Get(ctx, ReceiptProofKey(txHash))
+	if err != nil {
+		return nil, nil
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil, nil
+	}
+	proof, err := impl.LoadReceiptProof(p.AnconSyncContext.Store, lnk)
+	if err != nil || proof.BlockHash != blockHash {
+		return nil, nil
+	}
+	return proof, lnk
+}
+
+// ReceiptProof builds the transaction and receipt tries of the block including txHash,
+// proves the transaction and its receipt against the block roots and stores the proof.
+// A stored proof is returned while its block is still canonical.
+func (p *Prover) ReceiptProof(ctx context.Context, txHash common.Hash) (*impl.ReceiptProof, datamodel.Link, error) {
+	receipt, err := p.Client.TransactionReceipt(ctx, txHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proof, lnk := p.cached(ctx, txHash, receipt.BlockHash); proof != nil {
+		return proof, lnk, nil
+	}
+	block, err := p.Client.BlockByNumber(ctx, receipt.BlockNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+	if block.Hash() != receipt.BlockHash {
+		return nil, nil, fmt.Errorf("block %d was reorganized", receipt.BlockNumber)
+	}
+	receipts, err := ReceiptsByBlock(ctx, p.Client, block)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof, err := impl.ProveReceipt(block.Header(), block.Transactions(), receipts, receipt.TransactionIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	lnk, err := impl.StoreReceiptProof(p.AnconSyncContext.Store, proof)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := p.AnconSyncContext.Store.DataStore.Put(ctx, ReceiptProofKey(txHash), []byte(lnk.String())); err != nil {
+		return nil, nil, err
+	}
+	return proof, lnk, nil
+}
+
+// @BasePath /v0
+// ReceiptProofRead godoc
+// @Summary Proves a transaction receipt
+// @Schemes
+// @Description Returns Merkle-Patricia inclusion proofs of the transaction and its receipt against the transactionsRoot and receiptsRoot of its block. The proof is stored once per transaction and its CID returned
+// @Tags evm
+// @Produce json
+// @Success 200 {object} impl.ReceiptProof
+// @Router /v0/indexer/{name}/proof/receipt/{txhash} [get]
+// @Router /v0/evm/proof/receipt/{txhash} [get]
+func (p *Prover) ReceiptProofRead(c *gin.Context) {
+	hash := c.Param("txhash")
+	if len(common.FromHex(hash)) != common.HashLength {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid transaction hash %s", hash).Error(),
+		})
+		return
+	}
+	proof, lnk, err := p.ReceiptProof(c.Request.Context(), common.HexToHash(hash))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"cid":   lnk,
+		"proof": proof,
+	})
+}
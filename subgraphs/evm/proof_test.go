@@ -0,0 +1,121 @@
+package dageth
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/anconprotocol/node/x/anconsync/impl"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestReceiptProof(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestChain(t)
+	i := newTestIndexer(t, tc)
+	txs := []*types.Transaction{}
+	for k := 0; k < 5; k++ {
+		txs = append(txs, tc.send(t, &tc.contract, common.BigToHash(big.NewInt(int64(k))).Bytes()))
+	}
+	tc.backend.Commit()
+
+	p := &Prover{AnconSyncContext: i.AnconSyncContext, Client: tc.backend}
+	proof, lnk, err := p.ReceiptProof(ctx, txs[3].Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := tc.backend.BlockByNumber(ctx, nil)
+	receipt, err := impl.VerifyReceiptProof(block.Header(), proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipt.Logs) != 1 || receipt.Logs[0].Topics[0] != common.BigToHash(common.Big3) {
+		t.Fatalf("unexpected receipt logs %+v", receipt.Logs)
+	}
+
+	stored, err := impl.LoadReceiptProof(i.AnconSyncContext.Store, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := impl.VerifyReceiptProof(block.Header(), stored); err != nil {
+		t.Fatal(err)
+	}
+
+	parent, _ := tc.backend.BlockByNumber(ctx, common.Big1)
+	if _, err := impl.VerifyReceiptProof(parent.Header(), proof); err == nil {
+		t.Fatal("verified a proof against another block")
+	}
+	proof.BlockHash = common.Hash{}
+	proof.Proof[len(proof.Proof)-1][10]++
+	if _, err := impl.VerifyReceiptProof(block.Header(), proof); err == nil {
+		t.Fatal("verified a tampered proof")
+	}
+}
+
+func TestReceiptProofBindsTransaction(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestChain(t)
+	i := newTestIndexer(t, tc)
+	txs := []*types.Transaction{}
+	for k := 0; k < 3; k++ {
+		txs = append(txs, tc.send(t, &tc.contract, common.BigToHash(big.NewInt(int64(k))).Bytes()))
+	}
+	tc.backend.Commit()
+	block, _ := tc.backend.BlockByNumber(ctx, nil)
+
+	p := &Prover{AnconSyncContext: i.AnconSyncContext, Client: tc.backend}
+	proof, lnk, err := p.ReceiptProof(ctx, txs[1].Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.TransactionHash != txs[1].Hash() || len(proof.TransactionProof) == 0 {
+		t.Fatalf("missing transaction proof %+v", proof)
+	}
+	receipt, err := impl.VerifyReceiptProof(block.Header(), proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.TxHash != txs[1].Hash() {
+		t.Fatalf("unexpected receipt transaction %s", receipt.TxHash.Hex())
+	}
+
+	// the receipt proof of index 1 claimed for another transaction of the block
+	forged := *proof
+	forged.TransactionHash = txs[2].Hash()
+	if _, err := impl.VerifyReceiptProof(block.Header(), &forged); err == nil {
+		t.Fatal("verified a receipt for another transaction")
+	}
+	other, _ := impl.ProveReceipt(block.Header(), block.Transactions(), mustReceipts(t, tc, block), 2)
+	forged = *proof
+	forged.TransactionProof = other.TransactionProof
+	forged.Transaction = nil
+	if _, err := impl.VerifyReceiptProof(block.Header(), &forged); err == nil {
+		t.Fatal("verified a transaction proof of another index")
+	}
+	forged = *proof
+	forged.TransactionProof = nil
+	if _, err := impl.VerifyReceiptProof(block.Header(), &forged); err == nil {
+		t.Fatal("verified a proof without transaction proof")
+	}
+
+	// the second request loads the stored proof
+	again, cached, err := p.ReceiptProof(ctx, txs[1].Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.String() != lnk.String() || again.TransactionHash != proof.TransactionHash {
+		t.Fatalf("proof was not cached %s %s", cached, lnk)
+	}
+	if _, err := impl.VerifyReceiptProof(block.Header(), again); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustReceipts(t *testing.T, tc *testChain, block *types.Block) types.Receipts {
+	receipts, err := ReceiptsByBlock(context.Background(), tc.backend, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receipts
+}
@@ -0,0 +1,348 @@
+package subgraphs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultStallAfter is the time without indexing progress after which a lagging subgraph
+// is reported unhealthy
+const DefaultStallAfter = 5 * time.Minute
+
+// Subgraph is a chain indexer run by the manager
+type Subgraph interface {
+	// Start indexes until ctx is done, the returned channel is closed once indexing
+	// stopped
+	Start(ctx context.Context) (<-chan struct{}, error)
+	// Progress returns the last indexed height and the chain head
+	Progress(ctx context.Context) (int64, int64, error)
+}
+
+// Config configures a subgraph, Cursor is the height indexing starts from when nothing
+// is indexed yet and Options holds the settings of its type
+type Config struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Endpoint string            `json:"endpoint"`
+	Cursor   int64             `json:"cursor"`
+	Enabled  bool              `json:"enabled"`
+	Options  map[string]string `json:"options"`
+}
+
+// Factory creates the subgraph of a config
+type Factory func(cfg Config) (Subgraph, error)
+
+// LoadConfig reads a JSON file of the form {"subgraphs": [...]}
+func LoadConfig(path string) ([]Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Subgraphs []Config `json:"subgraphs"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("invalid subgraphs config %v", err)
+	}
+	return file.Subgraphs, nil
+}
+
+// Status reports the state of a subgraph
+type Status struct {
+	Name         string    `json:"name"`
+	Type         string    `json:"type"`
+	Endpoint     string    `json:"endpoint"`
+	Enabled      bool      `json:"enabled"`
+	Running      bool      `json:"running"`
+	Healthy      bool      `json:"healthy"`
+	Height       int64     `json:"height"`
+	Head         int64     `json:"head"`
+	Lag          int64     `json:"lag"`
+	StartedAt    time.Time `json:"startedAt,omitempty"`
+	LastProgress time.Time `json:"lastProgress,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type entry struct {
+	config       Config
+	subgraph     Subgraph
+	cancel       context.CancelFunc
+	done         <-chan struct{}
+	startedAt    time.Time
+	height       int64
+	lastProgress time.Time
+	err          error
+}
+
+// Manager runs subgraphs concurrently, each one is created by the factory of its type
+// and can be stopped and started again
+type Manager struct {
+	StallAfter time.Duration
+
+	lock      sync.Mutex
+	factories map[string]Factory
+	entries   map[string]*entry
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		StallAfter: DefaultStallAfter,
+		factories:  map[string]Factory{},
+		entries:    map[string]*entry{},
+	}
+}
+
+// Register sets the factory of a subgraph type
+func (m *Manager) Register(typ string, f Factory) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.factories[typ] = f
+}
+
+// Add creates the subgraph of cfg, it is not started
+func (m *Manager) Add(cfg Config) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if cfg.Name == "" {
+		return fmt.Errorf("subgraph without name")
+	}
+	if _, ok := m.entries[cfg.Name]; ok {
+		return fmt.Errorf("subgraph %s already exists", cfg.Name)
+	}
+	f, ok := m.factories[cfg.Type]
+	if !ok {
+		return fmt.Errorf("unsupported subgraph type %s", cfg.Type)
+	}
+	sg, err := f(cfg)
+	if err != nil {
+		return fmt.Errorf("subgraph %s %v", cfg.Name, err)
+	}
+	m.entries[cfg.Name] = &entry{config: cfg, subgraph: sg}
+	return nil
+}
+
+// Get returns the subgraph of name
+func (m *Manager) Get(name string) (Subgraph, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, ok := m.entries[name]
+	if !ok {
+		return nil, false
+	}
+	return e.subgraph, true
+}
+
+// Start runs the subgraph of name until it is stopped or ctx is done
+func (m *Manager) Start(ctx context.Context, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, ok := m.entries[name]
+	if !ok {
+		return fmt.Errorf("subgraph %s not found", name)
+	}
+	if e.cancel != nil {
+		return fmt.Errorf("subgraph %s is running", name)
+	}
+	if e.done != nil {
+		select {
+		case <-e.done:
+		default:
+			return fmt.Errorf("subgraph %s is stopping", name)
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done, err := e.subgraph.Start(ctx)
+	if err != nil {
+		cancel()
+		e.err = err
+		return err
+	}
+	e.cancel = cancel
+	e.done = done
+	e.err = nil
+	e.startedAt = time.Now()
+	e.lastProgress = e.startedAt
+	return nil
+}
+
+// StartEnabled starts the enabled subgraphs, a subgraph failing to start does not stop
+// the others
+func (m *Manager) StartEnabled(ctx context.Context) {
+	for _, name := range m.names() {
+		m.lock.Lock()
+		enabled := m.entries[name].config.Enabled
+		m.lock.Unlock()
+		if !enabled {
+			continue
+		}
+		if err := m.Start(ctx, name); err != nil {
+			fmt.Printf("subgraphs: %s not started %v\n", name, err)
+		}
+	}
+}
+
+// Stop stops the subgraph of name and waits until its indexing stopped
+func (m *Manager) Stop(name string) error {
+	m.lock.Lock()
+	e, ok := m.entries[name]
+	if !ok {
+		m.lock.Unlock()
+		return fmt.Errorf("subgraph %s not found", name)
+	}
+	if e.cancel == nil {
+		m.lock.Unlock()
+		return fmt.Errorf("subgraph %s is not running", name)
+	}
+	e.cancel()
+	e.cancel = nil
+	done := e.done
+	m.lock.Unlock()
+	// the manager stays available while the indexer finishes its current step
+	<-done
+	return nil
+}
+
+func (m *Manager) names() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := make([]string, 0, len(m.entries))
+	for name := range m.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Status reports the subgraph of name, a running subgraph is healthy while it reports
+// progress and keeps up with the chain or indexed a new height within StallAfter
+func (m *Manager) Status(ctx context.Context, name string) (*Status, error) {
+	m.lock.Lock()
+	e, ok := m.entries[name]
+	m.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("subgraph %s not found", name)
+	}
+	// progress is read without the manager lock, it can wait on the indexer
+	height, head, err := e.subgraph.Progress(ctx)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	if err == nil && height != e.height {
+		e.height = height
+		e.lastProgress = now
+	}
+	status := &Status{
+		Name:         e.config.Name,
+		Type:         e.config.Type,
+		Endpoint:     e.config.Endpoint,
+		Enabled:      e.config.Enabled,
+		Running:      e.cancel != nil,
+		Height:       height,
+		Head:         head,
+		StartedAt:    e.startedAt,
+		LastProgress: e.lastProgress,
+	}
+	if head > height {
+		status.Lag = head - height
+	}
+	switch {
+	case err != nil:
+		status.Error = err.Error()
+	case e.err != nil:
+		status.Error = e.err.Error()
+	}
+	status.Healthy = status.Running && status.Error == "" && (status.Lag == 0 || now.Sub(e.lastProgress) < m.StallAfter)
+	return status, nil
+}
+
+// Statuses reports all subgraphs ordered by name
+func (m *Manager) Statuses(ctx context.Context) []*Status {
+	statuses := []*Status{}
+	for _, name := range m.names() {
+		if status, err := m.Status(ctx, name); err == nil {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// @BasePath /v0
+// StatusRead godoc
+// @Summary Lists subgraphs
+// @Schemes
+// @Description Returns the status, health and lag of each subgraph
+// @Tags subgraphs
+// @Produce json
+// @Success 200 {object} []Status
+// @Router /v0/subgraphs [get]
+func (m *Manager) StatusRead(c *gin.Context) {
+	if name := c.Param("name"); name != "" {
+		status, err := m.Status(c.Request.Context(), name)
+		if err != nil {
+			c.JSON(404, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(200, status)
+		return
+	}
+	c.JSON(200, gin.H{
+		"subgraphs": m.Statuses(c.Request.Context()),
+	})
+}
+
+// @BasePath /v0
+// ControlWrite godoc
+// @Summary Starts or stops a subgraph
+// @Schemes
+// @Description Takes {"name", "action"} where action is start or stop, returns the subgraph status
+// @Tags subgraphs
+// @Accept json
+// @Produce json
+// @Success 200 {object} Status
+// @Router /v0/subgraphs [post]
+func (m *Manager) ControlWrite(c *gin.Context) {
+	var v struct {
+		Name   string `json:"name"`
+		Action string `json:"action"`
+	}
+	if err := c.BindJSON(&v); err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid request %v", err).Error(),
+		})
+		return
+	}
+	var err error
+	switch v.Action {
+	case "start":
+		// subgraphs outlive the request
+		err = m.Start(context.Background(), v.Name)
+	case "stop":
+		err = m.Stop(v.Name)
+	default:
+		err = fmt.Errorf("unknown action %s", v.Action)
+	}
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	status, err := m.Status(c.Request.Context(), v.Name)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, status)
+}
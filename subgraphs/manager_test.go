@@ -0,0 +1,175 @@
+package subgraphs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeSubgraph reports the progress set by the test and counts its runs
+type fakeSubgraph struct {
+	lock     sync.Mutex
+	height   int64
+	head     int64
+	running  int
+	startErr error
+}
+
+func (s *fakeSubgraph) Start(ctx context.Context) (<-chan struct{}, error) {
+	if s.startErr != nil {
+		return nil, s.startErr
+	}
+	s.lock.Lock()
+	s.running++
+	s.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		s.lock.Lock()
+		s.running--
+		s.lock.Unlock()
+	}()
+	return done, nil
+}
+
+func (s *fakeSubgraph) Progress(ctx context.Context) (int64, int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.height, s.head, nil
+}
+
+func (s *fakeSubgraph) runs() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.running
+}
+
+func newTestManager(t *testing.T) (*Manager, map[string]*fakeSubgraph) {
+	created := map[string]*fakeSubgraph{}
+	m := NewManager()
+	m.Register("fake", func(cfg Config) (Subgraph, error) {
+		if cfg.Endpoint == "" {
+			return nil, fmt.Errorf("missing endpoint")
+		}
+		s := &fakeSubgraph{height: cfg.Cursor}
+		created[cfg.Name] = s
+		return s, nil
+	})
+	return m, created
+}
+
+func control(m *Manager, name, action string) (int, *Status) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	body, _ := json.Marshal(map[string]string{"name": name, "action": action})
+	c.Request = httptest.NewRequest("POST", "/v0/subgraphs", bytes.NewReader(body))
+	m.ControlWrite(c)
+	status := &Status{}
+	json.Unmarshal(w.Body.Bytes(), status)
+	return w.Code, status
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	m, created := newTestManager(t)
+	path := filepath.Join(t.TempDir(), "subgraphs.json")
+	os.WriteFile(path, []byte(`{"subgraphs": [
+		{"name": "hub", "type": "fake", "endpoint": "tcp://hub:26657", "cursor": 10, "enabled": true},
+		{"name": "osmosis", "type": "fake", "endpoint": "tcp://osmosis:26657", "enabled": false},
+		{"name": "flow", "type": "flow", "endpoint": "access.mainnet.nodes.onflow.org:9000", "enabled": true},
+		{"name": "broken", "type": "fake", "enabled": true}
+	]}`), 0644)
+	configs, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := 0
+	for _, cfg := range configs {
+		if err := m.Add(cfg); err == nil {
+			added++
+		}
+	}
+	if added != 2 {
+		t.Fatalf("added %d subgraphs", added)
+	}
+	if err := m.Add(configs[0]); err == nil {
+		t.Fatal("added a subgraph twice")
+	}
+
+	m.StartEnabled(ctx)
+	if created["hub"].runs() != 1 || created["osmosis"].runs() != 0 {
+		t.Fatal("enabled subgraphs were not started")
+	}
+	statuses := m.Statuses(ctx)
+	if len(statuses) != 2 || statuses[0].Name != "hub" || !statuses[0].Running || statuses[1].Running {
+		t.Fatalf("unexpected statuses %v", statuses)
+	}
+
+	created["hub"].lock.Lock()
+	created["hub"].head = 15
+	created["hub"].lock.Unlock()
+	status, _ := m.Status(ctx, "hub")
+	if status.Height != 10 || status.Lag != 5 || !status.Healthy {
+		t.Fatalf("unexpected status %v", status)
+	}
+	// no new height within StallAfter while lagging
+	m.StallAfter = 0
+	if status, _ := m.Status(ctx, "hub"); status.Healthy {
+		t.Fatal("stalled subgraph is healthy")
+	}
+
+	if code, status := control(m, "hub", "stop"); code != 200 || status.Running || status.Healthy {
+		t.Fatalf("subgraph was not stopped %v", status)
+	}
+	// stop returns once the indexer stopped
+	if created["hub"].runs() != 0 {
+		t.Fatal("stopped subgraph is still running")
+	}
+	if code, _ := control(m, "hub", "stop"); code != 400 {
+		t.Fatal("stopped a subgraph twice")
+	}
+	if code, status := control(m, "osmosis", "start"); code != 200 || !status.Running || created["osmosis"].runs() != 1 {
+		t.Fatalf("subgraph was not started %v", status)
+	}
+	if code, _ := control(m, "unknown", "start"); code != 400 {
+		t.Fatal("started an unknown subgraph")
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/v0/subgraphs/hub", nil)
+	c.Params = gin.Params{{Key: "name", Value: "hub"}}
+	m.StatusRead(c)
+	if w.Code != 200 || !bytes.Contains(w.Body.Bytes(), []byte(`"lag":5`)) {
+		t.Fatalf("unexpected status %s", w.Body.String())
+	}
+}
+
+func TestStartError(t *testing.T) {
+	m := NewManager()
+	s := &fakeSubgraph{startErr: fmt.Errorf("connection refused")}
+	m.Register("fake", func(cfg Config) (Subgraph, error) { return s, nil })
+	m.Add(Config{Name: "hub", Type: "fake", Enabled: true})
+	m.StartEnabled(context.Background())
+	status, _ := m.Status(context.Background(), "hub")
+	if status.Running || status.Healthy || status.Error != "connection refused" {
+		t.Fatalf("unexpected status %v", status)
+	}
+	s.startErr = nil
+	if err := m.Start(context.Background(), "hub"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := m.Status(context.Background(), "hub"); !status.Healthy || status.Error != "" {
+		t.Fatalf("restarted subgraph is not healthy %v", status)
+	}
+}
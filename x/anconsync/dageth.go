@@ -0,0 +1,569 @@
+package anconsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multihash"
+)
+
+// dag-eth multicodecs
+const (
+	EthBlock         uint64 = 0x90
+	EthBlockList     uint64 = 0x91
+	EthTxTrie        uint64 = 0x92
+	EthTx            uint64 = 0x93
+	EthTxReceiptTrie uint64 = 0x94
+	EthTxReceipt     uint64 = 0x95
+	EthStateTrie     uint64 = 0x96
+)
+
+func init() {
+	DagEthCodecs["eth-block"] = EthBlock
+	DagEthCodecs["eth-tx-trie"] = EthTxTrie
+	DagEthCodecs["eth-tx"] = EthTx
+	DagEthCodecs["eth-tx-receipt-trie"] = EthTxReceiptTrie
+	DagEthCodecs["eth-tx-receipt"] = EthTxReceipt
+
+	multicodec.RegisterEncoder(EthBlock, EncodeEthBlock)
+	multicodec.RegisterDecoder(EthBlock, DecodeEthBlock)
+	multicodec.RegisterEncoder(EthTx, EncodeEthTx)
+	multicodec.RegisterDecoder(EthTx, DecodeEthTx)
+	multicodec.RegisterEncoder(EthTxReceipt, EncodeEthTxReceipt)
+	multicodec.RegisterDecoder(EthTxReceipt, DecodeEthTxReceipt)
+	multicodec.RegisterEncoder(EthTxTrie, EncodeEthTrieNode)
+	multicodec.RegisterDecoder(EthTxTrie, trieNodeDecoder(EthTx))
+	multicodec.RegisterEncoder(EthTxReceiptTrie, EncodeEthTrieNode)
+	multicodec.RegisterDecoder(EthTxReceiptTrie, trieNodeDecoder(EthTxReceipt))
+}
+
+// EthLink returns the dag-eth link of a keccak-256 hash, dag-eth blocks are addressed by
+// the same hash Ethereum uses for them
+func EthLink(codec uint64, hash common.Hash) datamodel.Link {
+	mh, _ := multihash.Encode(hash.Bytes(), multihash.KECCAK_256)
+	return cidlink.Link{Cid: cid.NewCidV1(codec, mh)}
+}
+
+// EthHash returns the keccak-256 hash of a dag-eth link
+func EthHash(lnk datamodel.Link) (common.Hash, error) {
+	cl, ok := lnk.(cidlink.Link)
+	if !ok {
+		return common.Hash{}, fmt.Errorf("not a cid link %s", lnk)
+	}
+	decoded, err := multihash.Decode(cl.Cid.Hash())
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if decoded.Code != multihash.KECCAK_256 {
+		return common.Hash{}, fmt.Errorf("not a keccak-256 link %s", lnk)
+	}
+	return common.BytesToHash(decoded.Digest), nil
+}
+
+func assignBig(na fluent.NodeAssembler, b *big.Int) {
+	if b == nil {
+		na.AssignNull()
+		return
+	}
+	na.AssignBytes(b.Bytes())
+}
+
+func assignAccessList(na fluent.NodeAssembler, al types.AccessList) {
+	na.CreateList(int64(len(al)), func(la fluent.ListAssembler) {
+		for _, tuple := range al {
+			la.AssembleValue().CreateMap(2, func(ma fluent.MapAssembler) {
+				ma.AssembleEntry("address").AssignBytes(tuple.Address.Bytes())
+				ma.AssembleEntry("storageKeys").CreateList(int64(len(tuple.StorageKeys)), func(la fluent.ListAssembler) {
+					for _, k := range tuple.StorageKeys {
+						la.AssembleValue().AssignBytes(k.Bytes())
+					}
+				})
+			})
+		}
+	})
+}
+
+// ethNode reads fields from a dag-eth node, the first error is kept
+type ethNode struct {
+	n   datamodel.Node
+	err error
+}
+
+func (e *ethNode) fail(name string, err error) {
+	if e.err == nil {
+		e.err = fmt.Errorf("field %s: %v", name, err)
+	}
+}
+
+func (e *ethNode) field(n datamodel.Node, name string) datamodel.Node {
+	if e.err != nil {
+		return nil
+	}
+	v, err := n.LookupByString(name)
+	if err != nil {
+		e.fail(name, err)
+		return nil
+	}
+	return v
+}
+
+func (e *ethNode) bytesOf(v datamodel.Node, name string) []byte {
+	if v == nil || v.IsNull() {
+		return nil
+	}
+	bz, err := v.AsBytes()
+	if err != nil {
+		e.fail(name, err)
+	}
+	return bz
+}
+
+func (e *ethNode) bytes(name string) []byte {
+	return e.bytesOf(e.field(e.n, name), name)
+}
+
+func (e *ethNode) big(name string) *big.Int {
+	v := e.field(e.n, name)
+	if v == nil || v.IsNull() {
+		return nil
+	}
+	return new(big.Int).SetBytes(e.bytesOf(v, name))
+}
+
+func (e *ethNode) uint(name string) uint64 {
+	v := e.field(e.n, name)
+	if v == nil {
+		return 0
+	}
+	i, err := v.AsInt()
+	if err != nil {
+		e.fail(name, err)
+	}
+	return uint64(i)
+}
+
+func (e *ethNode) hash(name string) common.Hash {
+	v := e.field(e.n, name)
+	if v == nil {
+		return common.Hash{}
+	}
+	lnk, err := v.AsLink()
+	if err != nil {
+		e.fail(name, err)
+		return common.Hash{}
+	}
+	h, err := EthHash(lnk)
+	if err != nil {
+		e.fail(name, err)
+	}
+	return h
+}
+
+func (e *ethNode) address(name string) *common.Address {
+	bz := e.bytes(name)
+	if bz == nil {
+		return nil
+	}
+	a := common.BytesToAddress(bz)
+	return &a
+}
+
+func (e *ethNode) list(n datamodel.Node, name string, fn func(datamodel.Node)) {
+	v := e.field(n, name)
+	if v == nil {
+		return
+	}
+	it := v.ListIterator()
+	if it == nil {
+		e.fail(name, fmt.Errorf("not a list"))
+		return
+	}
+	for !it.Done() && e.err == nil {
+		_, item, err := it.Next()
+		if err != nil {
+			e.fail(name, err)
+			return
+		}
+		fn(item)
+	}
+}
+
+func (e *ethNode) accessList() types.AccessList {
+	al := types.AccessList{}
+	e.list(e.n, "accessList", func(tuple datamodel.Node) {
+		t := types.AccessTuple{
+			Address:     common.BytesToAddress(e.bytesOf(e.field(tuple, "address"), "address")),
+			StorageKeys: []common.Hash{},
+		}
+		e.list(tuple, "storageKeys", func(k datamodel.Node) {
+			t.StorageKeys = append(t.StorageKeys, common.BytesToHash(e.bytesOf(k, "storageKeys")))
+		})
+		al = append(al, t)
+	})
+	return al
+}
+
+// DecodeEthBlock decodes an RLP header into an eth-block node, the hashes of other
+// dag-eth objects become links. Uncle headers are not stored, their hash stays bytes.
+func DecodeEthBlock(na datamodel.NodeAssembler, r io.Reader) error {
+	var h types.Header
+	if err := rlp.Decode(r, &h); err != nil {
+		return err
+	}
+	return fluent.Recover(func() {
+		fluent.WrapAssembler(na).CreateMap(16, func(ma fluent.MapAssembler) {
+			ma.AssembleEntry("parent").AssignLink(EthLink(EthBlock, h.ParentHash))
+			ma.AssembleEntry("uncleHash").AssignBytes(h.UncleHash.Bytes())
+			ma.AssembleEntry("coinbase").AssignBytes(h.Coinbase.Bytes())
+			ma.AssembleEntry("stateRoot").AssignLink(EthLink(EthStateTrie, h.Root))
+			ma.AssembleEntry("txRoot").AssignLink(EthLink(EthTxTrie, h.TxHash))
+			ma.AssembleEntry("receiptRoot").AssignLink(EthLink(EthTxReceiptTrie, h.ReceiptHash))
+			ma.AssembleEntry("bloom").AssignBytes(h.Bloom.Bytes())
+			assignBig(ma.AssembleEntry("difficulty"), h.Difficulty)
+			ma.AssembleEntry("number").AssignInt(h.Number.Int64())
+			ma.AssembleEntry("gasLimit").AssignInt(int64(h.GasLimit))
+			ma.AssembleEntry("gasUsed").AssignInt(int64(h.GasUsed))
+			ma.AssembleEntry("time").AssignInt(int64(h.Time))
+			ma.AssembleEntry("extra").AssignBytes(h.Extra)
+			ma.AssembleEntry("mixDigest").AssignBytes(h.MixDigest.Bytes())
+			ma.AssembleEntry("nonce").AssignBytes(h.Nonce[:])
+			assignBig(ma.AssembleEntry("baseFee"), h.BaseFee)
+		})
+	})
+}
+
+// EncodeEthBlock encodes an eth-block node as an RLP header
+func EncodeEthBlock(n datamodel.Node, w io.Writer) error {
+	e := &ethNode{n: n}
+	h := &types.Header{
+		ParentHash:  e.hash("parent"),
+		UncleHash:   common.BytesToHash(e.bytes("uncleHash")),
+		Coinbase:    common.BytesToAddress(e.bytes("coinbase")),
+		Root:        e.hash("stateRoot"),
+		TxHash:      e.hash("txRoot"),
+		ReceiptHash: e.hash("receiptRoot"),
+		Bloom:       types.BytesToBloom(e.bytes("bloom")),
+		Difficulty:  e.big("difficulty"),
+		Number:      new(big.Int).SetUint64(e.uint("number")),
+		GasLimit:    e.uint("gasLimit"),
+		GasUsed:     e.uint("gasUsed"),
+		Time:        e.uint("time"),
+		Extra:       e.bytes("extra"),
+		MixDigest:   common.BytesToHash(e.bytes("mixDigest")),
+		Nonce:       types.EncodeNonce(new(big.Int).SetBytes(e.bytes("nonce")).Uint64()),
+		BaseFee:     e.big("baseFee"),
+	}
+	if e.err != nil {
+		return e.err
+	}
+	return rlp.Encode(w, h)
+}
+
+// DecodeEthTx decodes a transaction in its MarshalBinary form into an eth-tx node
+func DecodeEthTx(na datamodel.NodeAssembler, r io.Reader) error {
+	bz, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(bz); err != nil {
+		return err
+	}
+	v, rr, s := tx.RawSignatureValues()
+	return fluent.Recover(func() {
+		fluent.WrapAssembler(na).CreateMap(14, func(ma fluent.MapAssembler) {
+			ma.AssembleEntry("type").AssignInt(int64(tx.Type()))
+			if tx.Type() != types.LegacyTxType {
+				assignBig(ma.AssembleEntry("chainId"), tx.ChainId())
+				assignAccessList(ma.AssembleEntry("accessList"), tx.AccessList())
+			}
+			ma.AssembleEntry("nonce").AssignInt(int64(tx.Nonce()))
+			if tx.Type() == types.DynamicFeeTxType {
+				assignBig(ma.AssembleEntry("gasTipCap"), tx.GasTipCap())
+				assignBig(ma.AssembleEntry("gasFeeCap"), tx.GasFeeCap())
+			} else {
+				assignBig(ma.AssembleEntry("gasPrice"), tx.GasPrice())
+			}
+			ma.AssembleEntry("gas").AssignInt(int64(tx.Gas()))
+			if tx.To() != nil {
+				ma.AssembleEntry("to").AssignBytes(tx.To().Bytes())
+			} else {
+				ma.AssembleEntry("to").AssignNull()
+			}
+			assignBig(ma.AssembleEntry("value"), tx.Value())
+			ma.AssembleEntry("data").AssignBytes(tx.Data())
+			assignBig(ma.AssembleEntry("v"), v)
+			assignBig(ma.AssembleEntry("r"), rr)
+			assignBig(ma.AssembleEntry("s"), s)
+		})
+	})
+}
+
+// EncodeEthTx encodes an eth-tx node in the transaction MarshalBinary form
+func EncodeEthTx(n datamodel.Node, w io.Writer) error {
+	e := &ethNode{n: n}
+	var inner types.TxData
+	switch e.uint("type") {
+	case types.LegacyTxType:
+		inner = &types.LegacyTx{
+			Nonce: e.uint("nonce"), GasPrice: e.big("gasPrice"), Gas: e.uint("gas"),
+			To: e.address("to"), Value: e.big("value"), Data: e.bytes("data"),
+			V: e.big("v"), R: e.big("r"), S: e.big("s"),
+		}
+	case types.AccessListTxType:
+		inner = &types.AccessListTx{
+			ChainID: e.big("chainId"), Nonce: e.uint("nonce"), GasPrice: e.big("gasPrice"), Gas: e.uint("gas"),
+			To: e.address("to"), Value: e.big("value"), Data: e.bytes("data"), AccessList: e.accessList(),
+			V: e.big("v"), R: e.big("r"), S: e.big("s"),
+		}
+	case types.DynamicFeeTxType:
+		inner = &types.DynamicFeeTx{
+			ChainID: e.big("chainId"), Nonce: e.uint("nonce"), GasTipCap: e.big("gasTipCap"), GasFeeCap: e.big("gasFeeCap"),
+			Gas: e.uint("gas"), To: e.address("to"), Value: e.big("value"), Data: e.bytes("data"), AccessList: e.accessList(),
+			V: e.big("v"), R: e.big("r"), S: e.big("s"),
+		}
+	default:
+		return fmt.Errorf("unsupported transaction type")
+	}
+	if e.err != nil {
+		return e.err
+	}
+	bz, err := types.NewTx(inner).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bz)
+	return err
+}
+
+// DecodeEthTxReceipt decodes a receipt in its consensus encoding into an eth-tx-receipt node
+func DecodeEthTxReceipt(na datamodel.NodeAssembler, r io.Reader) error {
+	bz, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	receipt := new(types.Receipt)
+	if err := receipt.UnmarshalBinary(bz); err != nil {
+		return err
+	}
+	return fluent.Recover(func() {
+		fluent.WrapAssembler(na).CreateMap(6, func(ma fluent.MapAssembler) {
+			ma.AssembleEntry("type").AssignInt(int64(receipt.Type))
+			if len(receipt.PostState) > 0 {
+				ma.AssembleEntry("postState").AssignBytes(receipt.PostState)
+			} else {
+				ma.AssembleEntry("postState").AssignNull()
+			}
+			ma.AssembleEntry("status").AssignInt(int64(receipt.Status))
+			ma.AssembleEntry("cumulativeGasUsed").AssignInt(int64(receipt.CumulativeGasUsed))
+			ma.AssembleEntry("logsBloom").AssignBytes(receipt.Bloom.Bytes())
+			ma.AssembleEntry("logs").CreateList(int64(len(receipt.Logs)), func(la fluent.ListAssembler) {
+				for _, log := range receipt.Logs {
+					la.AssembleValue().CreateMap(3, func(ma fluent.MapAssembler) {
+						ma.AssembleEntry("address").AssignBytes(log.Address.Bytes())
+						ma.AssembleEntry("topics").CreateList(int64(len(log.Topics)), func(la fluent.ListAssembler) {
+							for _, t := range log.Topics {
+								la.AssembleValue().AssignBytes(t.Bytes())
+							}
+						})
+						ma.AssembleEntry("data").AssignBytes(log.Data)
+					})
+				}
+			})
+		})
+	})
+}
+
+// EncodeEthTxReceipt encodes an eth-tx-receipt node in the receipt consensus encoding
+func EncodeEthTxReceipt(n datamodel.Node, w io.Writer) error {
+	e := &ethNode{n: n}
+	receipt := &types.Receipt{
+		Type:              uint8(e.uint("type")),
+		PostState:         e.bytes("postState"),
+		Status:            e.uint("status"),
+		CumulativeGasUsed: e.uint("cumulativeGasUsed"),
+		Bloom:             types.BytesToBloom(e.bytes("logsBloom")),
+		Logs:              []*types.Log{},
+	}
+	e.list(n, "logs", func(l datamodel.Node) {
+		log := &types.Log{
+			Address: common.BytesToAddress(e.bytesOf(e.field(l, "address"), "address")),
+			Topics:  []common.Hash{},
+			Data:    e.bytesOf(e.field(l, "data"), "data"),
+		}
+		e.list(l, "topics", func(t datamodel.Node) {
+			log.Topics = append(log.Topics, common.BytesToHash(e.bytesOf(t, "topics")))
+		})
+		receipt.Logs = append(receipt.Logs, log)
+	})
+	if e.err != nil {
+		return e.err
+	}
+	bz, err := receipt.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bz)
+	return err
+}
+
+// trieNodeDecoder decodes Merkle-Patricia trie nodes. Branch nodes become
+// {"type": "branch", "children": [...16], "value"}, extension nodes
+// {"type": "extension", "path", "child"} and leaf nodes {"type": "leaf", "path", "value", "link"}.
+// Children are links to hashed nodes or the raw RLP of nodes embedded in their parent,
+// the leaf link points to the transaction or receipt stored in the leaf value.
+func trieNodeDecoder(leafCodec uint64) func(datamodel.NodeAssembler, io.Reader) error {
+	return func(na datamodel.NodeAssembler, r io.Reader) error {
+		bz, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		elems, err := splitTrieNode(bz)
+		if err != nil {
+			return err
+		}
+		codec := EthTxTrie
+		if leafCodec == EthTxReceipt {
+			codec = EthTxReceiptTrie
+		}
+		assignChild := func(na fluent.NodeAssembler, child rlp.RawValue) {
+			kind, content, _, _ := rlp.Split(child)
+			switch {
+			case kind == rlp.String && len(content) == 0:
+				na.AssignNull()
+			case kind == rlp.String && len(content) == common.HashLength:
+				na.AssignLink(EthLink(codec, common.BytesToHash(content)))
+			default:
+				na.AssignBytes(child)
+			}
+		}
+		return fluent.Recover(func() {
+			fluent.WrapAssembler(na).CreateMap(4, func(ma fluent.MapAssembler) {
+				switch len(elems) {
+				case 17:
+					ma.AssembleEntry("type").AssignString("branch")
+					ma.AssembleEntry("children").CreateList(16, func(la fluent.ListAssembler) {
+						for _, child := range elems[:16] {
+							assignChild(la.AssembleValue(), child)
+						}
+					})
+					_, value, _, _ := rlp.Split(elems[16])
+					ma.AssembleEntry("value").AssignBytes(value)
+				case 2:
+					_, path, _, _ := rlp.Split(elems[0])
+					if len(path) > 0 && path[0]>>4 >= 2 {
+						_, value, _, _ := rlp.Split(elems[1])
+						ma.AssembleEntry("type").AssignString("leaf")
+						ma.AssembleEntry("path").AssignBytes(path)
+						ma.AssembleEntry("value").AssignBytes(value)
+						ma.AssembleEntry("link").AssignLink(EthLink(leafCodec, crypto.Keccak256Hash(value)))
+					} else {
+						ma.AssembleEntry("type").AssignString("extension")
+						ma.AssembleEntry("path").AssignBytes(path)
+						assignChild(ma.AssembleEntry("child"), elems[1])
+					}
+				default:
+					panic(fluent.Error{Err: fmt.Errorf("invalid trie node with %d elements", len(elems))})
+				}
+			})
+		})
+	}
+}
+
+func splitTrieNode(bz []byte) ([]rlp.RawValue, error) {
+	content, _, err := rlp.SplitList(bz)
+	if err != nil {
+		return nil, err
+	}
+	elems := []rlp.RawValue{}
+	for len(content) > 0 {
+		_, _, rest, err := rlp.Split(content)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, rlp.RawValue(content[:len(content)-len(rest)]))
+		content = rest
+	}
+	return elems, nil
+}
+
+// EncodeEthTrieNode encodes a trie node as RLP
+func EncodeEthTrieNode(n datamodel.Node, w io.Writer) error {
+	e := &ethNode{n: n}
+	child := func(c datamodel.Node, name string) interface{} {
+		switch {
+		case c == nil || c.IsNull():
+			return []byte{}
+		case c.Kind() == datamodel.Kind_Link:
+			lnk, _ := c.AsLink()
+			h, err := EthHash(lnk)
+			if err != nil {
+				e.fail(name, err)
+			}
+			return h.Bytes()
+		default:
+			return rlp.RawValue(e.bytesOf(c, name))
+		}
+	}
+	t := e.field(n, "type")
+	if t == nil {
+		return e.err
+	}
+	nodeType, _ := t.AsString()
+	var elems []interface{}
+	switch nodeType {
+	case "branch":
+		e.list(n, "children", func(c datamodel.Node) {
+			elems = append(elems, child(c, "children"))
+		})
+		if len(elems) != 16 && e.err == nil {
+			return fmt.Errorf("branch node must have 16 children")
+		}
+		elems = append(elems, e.bytes("value"))
+	case "extension":
+		elems = []interface{}{e.bytes("path"), child(e.field(n, "child"), "child")}
+	case "leaf":
+		elems = []interface{}{e.bytes("path"), e.bytes("value")}
+	default:
+		return fmt.Errorf("unknown trie node type %s", nodeType)
+	}
+	if e.err != nil {
+		return e.err
+	}
+	return rlp.Encode(w, elems)
+}
+
+// StoreDagEthRaw stores the raw encoding of a dag-eth object, the stored block must hash
+// to the keccak-256 of raw so the link matches the Ethereum hash
+func (k *Storage) StoreDagEthRaw(codec string, raw []byte) (datamodel.Link, error) {
+	decoder, err := multicodec.LookupDecoder(DagEthCodecs[codec])
+	if err != nil {
+		return nil, err
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := decoder(nb, bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("decode %s: %v", codec, err)
+	}
+	lnk, err := k.LinkSystem.Store(ipld.LinkContext{}, GetDagEthereumLinkPrototype(codec), nb.Build())
+	if err != nil {
+		return nil, err
+	}
+	if h, _ := EthHash(lnk); h != crypto.Keccak256Hash(raw) {
+		return nil, fmt.Errorf("%s does not round trip, %s != %s", codec, h.Hex(), crypto.Keccak256Hash(raw).Hex())
+	}
+	return lnk, nil
+}
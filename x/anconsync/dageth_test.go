@@ -0,0 +1,123 @@
+package anconsync
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/multicodec"
+)
+
+// roundTrip stores raw as codec, checks the link is the keccak-256 of raw and that the
+// loaded node encodes back to raw
+func roundTrip(t *testing.T, s Storage, codec string, raw []byte) {
+	lnk, err := s.StoreDagEthRaw(codec, raw)
+	if err != nil {
+		t.Fatalf("%s: %v", codec, err)
+	}
+	h, err := EthHash(lnk)
+	if err != nil || h != crypto.Keccak256Hash(raw) {
+		t.Fatalf("%s: link %s is not the keccak-256 of the object", codec, lnk)
+	}
+	n, err := s.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatalf("%s: %v", codec, err)
+	}
+	encoder, _ := multicodec.LookupEncoder(DagEthCodecs[codec])
+	var buf bytes.Buffer
+	if err := encoder(n, &buf); err != nil {
+		t.Fatalf("%s: %v", codec, err)
+	}
+	if !bytes.Equal(buf.Bytes(), raw) {
+		t.Fatalf("%s does not round trip", codec)
+	}
+}
+
+func TestDagEthCodecs(t *testing.T) {
+	s := OpenStorage(t.TempDir())
+
+	header := &types.Header{
+		ParentHash:  common.HexToHash("0x01"),
+		UncleHash:   types.EmptyUncleHash,
+		Coinbase:    common.HexToAddress("0x02"),
+		Root:        common.HexToHash("0x03"),
+		TxHash:      types.EmptyRootHash,
+		ReceiptHash: types.EmptyRootHash,
+		Difficulty:  big.NewInt(131072),
+		Number:      big.NewInt(42),
+		GasLimit:    8000000,
+		GasUsed:     21000,
+		Time:        1600000000,
+		Extra:       []byte("ancon"),
+		BaseFee:     big.NewInt(7),
+	}
+	raw, err := rlp.EncodeToBytes(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, s, "eth-block", raw)
+	if lnk, _ := s.StoreDagEthRaw("eth-block", raw); lnk.String() != EthLink(EthBlock, header.Hash()).String() {
+		t.Fatalf("block link %s is not the block hash", lnk)
+	}
+
+	key, _ := crypto.GenerateKey()
+	to := common.HexToAddress("0x04")
+	signer := types.NewLondonSigner(big.NewInt(1))
+	for _, inner := range []types.TxData{
+		&types.LegacyTx{Nonce: 1, GasPrice: big.NewInt(10), Gas: 21000, To: &to, Value: big.NewInt(1)},
+		&types.LegacyTx{Nonce: 2, GasPrice: big.NewInt(10), Gas: 100000, Data: []byte{0x60, 0x00}},
+		&types.AccessListTx{ChainID: big.NewInt(1), Nonce: 3, GasPrice: big.NewInt(10), Gas: 30000, To: &to,
+			AccessList: types.AccessList{{Address: to, StorageKeys: []common.Hash{common.HexToHash("0x05")}}}},
+		&types.DynamicFeeTx{ChainID: big.NewInt(1), Nonce: 4, GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(20), Gas: 21000, To: &to,
+			Data: []byte("data"), AccessList: types.AccessList{}},
+	} {
+		tx, err := types.SignNewTx(key, signer, inner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := tx.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, s, "eth-tx", raw)
+		if lnk, _ := s.StoreDagEthRaw("eth-tx", raw); lnk.String() != EthLink(EthTx, tx.Hash()).String() {
+			t.Fatalf("tx link %s is not the tx hash", lnk)
+		}
+	}
+
+	for _, receipt := range []*types.Receipt{
+		{Type: types.LegacyTxType, Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: 21000, Logs: []*types.Log{}},
+		{Type: types.DynamicFeeTxType, Status: types.ReceiptStatusFailed, CumulativeGasUsed: 50000, Logs: []*types.Log{
+			{Address: to, Topics: []common.Hash{common.HexToHash("0x06"), common.HexToHash("0x07")}, Data: []byte("log")},
+			{Address: to, Topics: []common.Hash{}, Data: []byte{}},
+		}},
+	} {
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+		raw, err := receipt.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, s, "eth-tx-receipt", raw)
+	}
+
+	// a leaf with an odd path and an extension to a hashed child
+	leaf, _ := rlp.EncodeToBytes([]interface{}{[]byte{0x31, 0x23}, []byte("value")})
+	roundTrip(t, s, "eth-tx-trie", leaf)
+	extension, _ := rlp.EncodeToBytes([]interface{}{[]byte{0x00, 0x12}, crypto.Keccak256(leaf)})
+	roundTrip(t, s, "eth-tx-trie", extension)
+	lnk, _ := s.StoreDagEthRaw("eth-tx-trie", leaf)
+	n, _ := s.Load(ipld.LinkContext{}, lnk)
+	if v, _ := n.LookupByString("type"); v == nil {
+		t.Fatal("missing trie node type")
+	} else if typ, _ := v.AsString(); typ != "leaf" {
+		t.Fatalf("unexpected trie node type %s", typ)
+	}
+	if _, err := s.StoreDagEthRaw("eth-tx-trie", []byte{0xc1, 0x80}); err == nil {
+		t.Fatal("stored a trie node with one element")
+	}
+}
@@ -0,0 +1,447 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// Roles granted to API keys
+const (
+	RoleReader    = "reader"
+	RoleWriter    = "writer"
+	RoleDidAdmin  = "did-admin"
+	RoleNodeAdmin = "node-admin"
+
+	APIKeyHeader = "X-API-Key"
+
+	// AuthRolesKey is the gin context key holding the roles of the caller
+	AuthRolesKey = "roles"
+	// AuthCallerKey is the gin context key identifying the caller, the API key id or the
+	// session address
+	AuthCallerKey = "caller"
+)
+
+// roleGrants lists the roles each role also satisfies, node-admin satisfies every role
+var roleGrants = map[string][]string{
+	RoleReader:   {RoleReader},
+	RoleWriter:   {RoleWriter, RoleReader},
+	RoleDidAdmin: {RoleDidAdmin, RoleReader},
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == RoleNodeAdmin {
+			return true
+		}
+		for _, g := range roleGrants[r] {
+			if g == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func apiKeyIndex(id string) string {
+	return strings.Join([]string{"apikey", id}, ":")
+}
+
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// APIKey is the stored record of an API key, only the key hash is kept
+type APIKey struct {
+	ID        string   `json:"id"`
+	Hash      string   `json:"hash"`
+	Roles     []string `json:"roles"`
+	Scope     string   `json:"scope,omitempty"`
+	RateLimit int64    `json:"rateLimit,omitempty"`
+	ExpiresAt int64    `json:"expiresAt,omitempty"`
+	Revoked   bool     `json:"revoked"`
+}
+
+func (k *APIKey) node(previous datamodel.Link) datamodel.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 8, func(na fluent.MapAssembler) {
+		na.AssembleEntry("id").AssignString(k.ID)
+		na.AssembleEntry("hash").AssignString(k.Hash)
+		na.AssembleEntry("roles").CreateList(int64(len(k.Roles)), func(la fluent.ListAssembler) {
+			for _, r := range k.Roles {
+				la.AssembleValue().AssignString(r)
+			}
+		})
+		na.AssembleEntry("scope").AssignString(k.Scope)
+		na.AssembleEntry("rateLimit").AssignInt(k.RateLimit)
+		na.AssembleEntry("expiresAt").AssignInt(k.ExpiresAt)
+		na.AssembleEntry("revoked").AssignBool(k.Revoked)
+		if previous != nil {
+			na.AssembleEntry("previous").AssignLink(previous)
+		} else {
+			na.AssembleEntry("previous").AssignNull()
+		}
+	})
+}
+
+func apiKeyFromNode(n datamodel.Node) (*APIKey, error) {
+	k := &APIKey{}
+	var err error
+	get := func(name string) datamodel.Node {
+		if err != nil {
+			return nil
+		}
+		var v datamodel.Node
+		v, err = n.LookupByString(name)
+		return v
+	}
+	id, hash, roles, scope := get("id"), get("hash"), get("roles"), get("scope")
+	rateLimit, expiresAt, revoked := get("rateLimit"), get("expiresAt"), get("revoked")
+	if err != nil {
+		return nil, fmt.Errorf("invalid api key record %v", err)
+	}
+	k.ID, _ = id.AsString()
+	k.Hash, _ = hash.AsString()
+	k.Scope, _ = scope.AsString()
+	k.RateLimit, _ = rateLimit.AsInt()
+	k.ExpiresAt, _ = expiresAt.AsInt()
+	k.Revoked, _ = revoked.AsBool()
+	it := roles.ListIterator()
+	for it != nil && !it.Done() {
+		_, r, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		role, _ := r.AsString()
+		k.Roles = append(k.Roles, role)
+	}
+	return k, nil
+}
+
+// AccessControl enforces API key roles, it is disabled until an admin key is configured
+type AccessControl struct {
+	Enabled bool
+	// SessionRoles are granted to callers holding a Sign-In with Ethereum session
+	SessionRoles []string
+	// SessionRateLimit is the per minute request limit of a session address, 0 is unlimited
+	SessionRateLimit int64
+
+	adminHash string
+	lock      sync.Mutex
+	windows   map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int64
+}
+
+func NewAccessControl() *AccessControl {
+	return &AccessControl{
+		SessionRoles: []string{RoleReader},
+		windows:      make(map[string]*rateWindow),
+	}
+}
+
+// SetAdminKey enables access control with a bootstrap node-admin key that is not stored
+func (ac *AccessControl) SetAdminKey(key string) {
+	ac.adminHash = hashAPIKey(key)
+	ac.Enabled = true
+}
+
+// SetSessionRoles sets the roles granted to Sign-In with Ethereum sessions. Any wallet can
+// sign in, so node-admin is refused.
+func (ac *AccessControl) SetSessionRoles(roles []string) error {
+	granted := []string{}
+	for _, r := range roles {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if r == RoleNodeAdmin {
+			return fmt.Errorf("%s can't be granted to sessions", r)
+		}
+		if roleGrants[r] == nil {
+			return fmt.Errorf("unknown role %s", r)
+		}
+		granted = append(granted, r)
+	}
+	ac.SessionRoles = granted
+	return nil
+}
+
+// allow counts a request against the per minute limit of a key
+func (ac *AccessControl) allow(id string, limit int64) bool {
+	if limit <= 0 {
+		return true
+	}
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	now := time.Now()
+	w, ok := ac.windows[id]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		w = &rateWindow{start: now}
+		ac.windows[id] = w
+	}
+	w.count++
+	return w.count <= limit
+}
+
+// CreateAPIKey stores a new API key and returns the key in clear, it is only shown once
+func (dagctx *AnconSyncContext) CreateAPIKey(ctx context.Context, roles []string, scope string, rateLimit int64, expiresAt int64) (string, *APIKey, error) {
+	for _, r := range roles {
+		if r != RoleNodeAdmin && roleGrants[r] == nil {
+			return "", nil, fmt.Errorf("unknown role %s", r)
+		}
+	}
+	if len(roles) == 0 {
+		return "", nil, fmt.Errorf("missing roles")
+	}
+	id := make([]byte, 8)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	record := &APIKey{
+		ID:        hex.EncodeToString(id),
+		Roles:     roles,
+		Scope:     scope,
+		RateLimit: rateLimit,
+		ExpiresAt: expiresAt,
+	}
+	key := strings.Join([]string{"ancon", record.ID, hex.EncodeToString(secret)}, "_")
+	record.Hash = hashAPIKey(key)
+
+	lnk := dagctx.Store.Store(ipld.LinkContext{}, record.node(nil))
+	if err := dagctx.Store.DataStore.Put(ctx, apiKeyIndex(record.ID), []byte(lnk.String())); err != nil {
+		return "", nil, err
+	}
+	return key, record, nil
+}
+
+// GetAPIKey loads the current record of an API key
+func (dagctx *AnconSyncContext) GetAPIKey(ctx context.Context, id string) (*APIKey, datamodel.Link, error) {
+	value, err := dagctx.Store.DataStore.Get(ctx, apiKeyIndex(id))
+	if err != nil {
+		return nil, nil, fmt.Errorf("api key %s not found", id)
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, nil, err
+	}
+	record, err := apiKeyFromNode(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, lnk, nil
+}
+
+// RevokeAPIKey stores a revoked record linking the previous one
+func (dagctx *AnconSyncContext) RevokeAPIKey(ctx context.Context, id string) (datamodel.Link, error) {
+	record, previous, err := dagctx.GetAPIKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	record.Revoked = true
+	lnk := dagctx.Store.Store(ipld.LinkContext{}, record.node(previous))
+	if err := dagctx.Store.DataStore.Put(ctx, apiKeyIndex(id), []byte(lnk.String())); err != nil {
+		return nil, err
+	}
+	return lnk, nil
+}
+
+// AuthenticateAPIKey returns the record of a valid, unrevoked and unexpired key
+func (dagctx *AnconSyncContext) AuthenticateAPIKey(ctx context.Context, key string) (*APIKey, error) {
+	ac := dagctx.Access
+	if ac.adminHash != "" && subtle.ConstantTimeCompare([]byte(hashAPIKey(key)), []byte(ac.adminHash)) == 1 {
+		return &APIKey{ID: "admin", Roles: []string{RoleNodeAdmin}}, nil
+	}
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 || parts[0] != "ancon" {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	record, _, err := dagctx.GetAPIKey(ctx, parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(key)), []byte(record.Hash)) != 1 {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	if record.Revoked {
+		return nil, fmt.Errorf("api key %s is revoked", record.ID)
+	}
+	if record.ExpiresAt != 0 && time.Now().Unix() > record.ExpiresAt {
+		return nil, fmt.Errorf("api key %s is expired", record.ID)
+	}
+	return record, nil
+}
+
+// Authorize requires the caller to hold role, either with an API key or a Sign-In with
+// Ethereum session granted SessionRoles. Keys scoped to a CID prefix can only reach
+// routes whose cid param starts with it.
+func (dagctx *AnconSyncContext) Authorize(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ac := dagctx.Access
+		if !ac.Enabled {
+			c.Next()
+			return
+		}
+		key := c.GetHeader(APIKeyHeader)
+		if key == "" {
+			claims, err := dagctx.Sessions.Parse(bearerToken(c))
+			if err != nil || !hasRole(ac.SessionRoles, role) {
+				c.AbortWithStatusJSON(401, gin.H{
+					"error": fmt.Errorf("missing %s header", APIKeyHeader).Error(),
+				})
+				return
+			}
+			if !ac.allow(strings.Join([]string{"siwe", strings.ToLower(claims.Subject)}, ":"), ac.SessionRateLimit) {
+				c.AbortWithStatusJSON(429, gin.H{
+					"error": fmt.Errorf("session %s rate limit exceeded", claims.Subject).Error(),
+				})
+				return
+			}
+			c.Set(AuthAddressKey, claims.Subject)
+			c.Set(AuthRolesKey, ac.SessionRoles)
+			c.Set(AuthCallerKey, strings.Join([]string{"siwe", strings.ToLower(claims.Subject)}, ":"))
+			c.Next()
+			return
+		}
+
+		record, err := dagctx.AuthenticateAPIKey(c.Request.Context(), key)
+		if err != nil {
+			c.AbortWithStatusJSON(401, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		if !hasRole(record.Roles, role) {
+			c.AbortWithStatusJSON(403, gin.H{
+				"error": fmt.Errorf("api key %s requires role %s", record.ID, role).Error(),
+			})
+			return
+		}
+		// scoped keys only reach routes of a CID under their scope
+		if record.Scope != "" && !strings.HasPrefix(c.Param("cid"), record.Scope) {
+			c.AbortWithStatusJSON(403, gin.H{
+				"error": fmt.Errorf("api key %s is scoped to %s", record.ID, record.Scope).Error(),
+			})
+			return
+		}
+		if !ac.allow(record.ID, record.RateLimit) {
+			c.AbortWithStatusJSON(429, gin.H{
+				"error": fmt.Errorf("api key %s rate limit exceeded", record.ID).Error(),
+			})
+			return
+		}
+		c.Set(AuthRolesKey, record.Roles)
+		c.Set(AuthCallerKey, strings.Join([]string{"apikey", record.ID}, ":"))
+		c.Next()
+	}
+}
+
+// Caller returns the identity Authorize set on the context, or the client IP when access
+// control is disabled
+func Caller(c *gin.Context) string {
+	if caller := c.GetString(AuthCallerKey); caller != "" {
+		return caller
+	}
+	return strings.Join([]string{"ip", c.ClientIP()}, ":")
+}
+
+// @BasePath /v0
+// CreateAPIKeyHandler godoc
+// @Summary Creates an API key
+// @Schemes
+// @Description Creates an API key with roles (reader, writer, did-admin, node-admin), an optional expiry (unix seconds), CID prefix scope and rate limit (requests per minute). The key is only returned once.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Success 201 {string} key
+// @Router /v0/admin/apikeys [post]
+func (dagctx *AnconSyncContext) CreateAPIKeyHandler(c *gin.Context) {
+	var v struct {
+		Roles     []string `json:"roles"`
+		Scope     string   `json:"scope"`
+		RateLimit int64    `json:"rateLimit"`
+		ExpiresAt int64    `json:"expiresAt"`
+	}
+
+	c.BindJSON(&v)
+	key, record, err := dagctx.CreateAPIKey(c.Request.Context(), v.Roles, v.Scope, v.RateLimit, v.ExpiresAt)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(201, gin.H{
+		"key":    key,
+		"apiKey": record,
+	})
+}
+
+// @BasePath /v0
+// ReadAPIKeyHandler godoc
+// @Summary Reads an API key
+// @Schemes
+// @Description Returns the stored record of an API key
+// @Tags admin
+// @Produce json
+// @Success 200 {object} APIKey
+// @Router /v0/admin/apikeys/{id} [get]
+func (dagctx *AnconSyncContext) ReadAPIKeyHandler(c *gin.Context) {
+	record, lnk, err := dagctx.GetAPIKey(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"cid":    lnk,
+		"apiKey": record,
+	})
+}
+
+// @BasePath /v0
+// RevokeAPIKeyHandler godoc
+// @Summary Revokes an API key
+// @Schemes
+// @Description Revokes an API key, the revoked record links the previous one
+// @Tags admin
+// @Produce json
+// @Success 200 {string} cid
+// @Router /v0/admin/apikeys/{id} [delete]
+func (dagctx *AnconSyncContext) RevokeAPIKeyHandler(c *gin.Context) {
+	lnk, err := dagctx.RevokeAPIKey(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"cid": lnk,
+	})
+}
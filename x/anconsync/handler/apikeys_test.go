@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/square/go-jose/v3/jwt"
+)
+
+func TestAuthorize(t *testing.T) {
+	dagctx := newTestIndex(t)
+	dagctx.Access.SetAdminKey("admin")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	caller := ""
+	ok := func(c *gin.Context) {
+		caller = Caller(c)
+		c.Status(200)
+	}
+	r.POST("/v0/dagjson", dagctx.Authorize(RoleWriter), ok)
+	r.GET("/v0/dagjson/:cid/*path", dagctx.Authorize(RoleReader), ok)
+	do := func(method, path string, headers map[string]string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// scoped keys only reach routes of a CID under their scope
+	key, _, err := dagctx.CreateAPIKey(context.Background(), []string{RoleWriter}, "bafyscope", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scoped := map[string]string{APIKeyHeader: key}
+	if code := do("GET", "/v0/dagjson/bafyscope1/", scoped); code != 200 {
+		t.Fatalf("scoped key denied on its scope %d", code)
+	}
+	if record, _ := dagctx.AuthenticateAPIKey(context.Background(), key); caller != "apikey:"+record.ID {
+		t.Fatalf("unexpected caller %s", caller)
+	}
+	if code := do("GET", "/v0/dagjson/bafyother/", scoped); code != 403 {
+		t.Fatalf("scoped key reached another cid %d", code)
+	}
+	if code := do("POST", "/v0/dagjson", scoped); code != 403 {
+		t.Fatalf("scoped key reached a route without cid %d", code)
+	}
+
+	// sessions are readers by default and rate limited
+	token, err := dagctx.Sessions.Sign(&SessionClaims{Claims: jwt.Claims{Issuer: dagctx.Sessions.issuer, Subject: "0xAaaa"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := map[string]string{"Authorization": "Bearer " + token}
+	if code := do("POST", "/v0/dagjson", session); code != 401 {
+		t.Fatalf("session wrote with the default roles %d", code)
+	}
+	dagctx.Access.SessionRateLimit = 1
+	if code := do("GET", "/v0/dagjson/bafy/", session); code != 200 || caller != "siwe:0xaaaa" {
+		t.Fatalf("session denied read %d %s", code, caller)
+	}
+	if code := do("GET", "/v0/dagjson/bafy/", session); code != 429 {
+		t.Fatalf("session was not rate limited %d", code)
+	}
+	for _, roles := range [][]string{{RoleNodeAdmin}, {RoleReader, "wrtier"}} {
+		if err := dagctx.Access.SetSessionRoles(roles); err == nil {
+			t.Fatalf("granted %v to sessions", roles)
+		}
+	}
+	if err := dagctx.Access.SetSessionRoles([]string{RoleWriter}); err != nil {
+		t.Fatal(err)
+	}
+	dagctx.Access.SessionRateLimit = 0
+	if code := do("POST", "/v0/dagjson", session); code != 200 {
+		t.Fatalf("session denied write with the writer role %d", code)
+	}
+}
@@ -0,0 +1,443 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	jose "github.com/square/go-jose/v3"
+	"github.com/square/go-jose/v3/jwt"
+)
+
+const (
+	siweNonceTTL   = 5 * time.Minute
+	siweSessionTTL = 15 * time.Minute
+	// siweMaxNonces bounds the outstanding nonces, the oldest are evicted first
+	siweMaxNonces = 10000
+
+	// AuthAddressKey is the gin context key holding the session address
+	AuthAddressKey = "address"
+)
+
+// SiweMessage is a parsed EIP-4361 Sign-In with Ethereum message
+type SiweMessage struct {
+	Domain         string
+	Address        string
+	Statement      string
+	URI            string
+	Version        string
+	ChainID        string
+	Nonce          string
+	IssuedAt       string
+	ExpirationTime string
+	NotBefore      string
+	RequestID      string
+	Resources      []string
+}
+
+// ParseSiweMessage parses the EIP-4361 plain text format
+func ParseSiweMessage(message string) (*SiweMessage, error) {
+	lines := strings.Split(strings.ReplaceAll(message, "\r\n", "\n"), "\n")
+	if len(lines) < 2 || !strings.HasSuffix(lines[0], " wants you to sign in with your Ethereum account:") {
+		return nil, fmt.Errorf("invalid EIP-4361 message")
+	}
+	msg := &SiweMessage{
+		Domain:  strings.TrimSuffix(lines[0], " wants you to sign in with your Ethereum account:"),
+		Address: strings.TrimSpace(lines[1]),
+	}
+	if !common.IsHexAddress(msg.Address) {
+		return nil, fmt.Errorf("invalid address %s", msg.Address)
+	}
+
+	fields := map[string]*string{
+		"URI: ":             &msg.URI,
+		"Version: ":         &msg.Version,
+		"Chain ID: ":        &msg.ChainID,
+		"Nonce: ":           &msg.Nonce,
+		"Issued At: ":       &msg.IssuedAt,
+		"Expiration Time: ": &msg.ExpirationTime,
+		"Not Before: ":      &msg.NotBefore,
+		"Request ID: ":      &msg.RequestID,
+	}
+	inResources := false
+	statement := []string{}
+	for _, line := range lines[2:] {
+		matched := false
+		for prefix, field := range fields {
+			if strings.HasPrefix(line, prefix) {
+				*field = strings.TrimPrefix(line, prefix)
+				matched = true
+				inResources = false
+			}
+		}
+		switch {
+		case matched:
+		case line == "Resources:":
+			inResources = true
+		case inResources && strings.HasPrefix(line, "- "):
+			msg.Resources = append(msg.Resources, strings.TrimPrefix(line, "- "))
+		case msg.URI == "" && line != "":
+			statement = append(statement, line)
+		}
+	}
+	msg.Statement = strings.Join(statement, "\n")
+
+	if msg.URI == "" || msg.Version != "1" || msg.Nonce == "" || msg.IssuedAt == "" {
+		return nil, fmt.Errorf("missing EIP-4361 fields")
+	}
+	return msg, nil
+}
+
+// SessionClaims are the JWT claims of a SIWE session
+type SessionClaims struct {
+	jwt.Claims
+	ChainID string `json:"chainId,omitempty"`
+	Role    string `json:"role,omitempty"`
+}
+
+// SiweSessions issues nonces and session tokens for Sign-In with Ethereum
+type SiweSessions struct {
+	lock   sync.Mutex
+	nonces map[string]time.Time
+	// issued lists nonces oldest first, consumed ones are dropped when they reach the front
+	issued []string
+	secret []byte
+	issuer string
+}
+
+func NewSiweSessions(privateKey *ecdsa.PrivateKey) *SiweSessions {
+	return &SiweSessions{
+		nonces: make(map[string]time.Time),
+		secret: crypto.Keccak256([]byte("siwe-session"), crypto.FromECDSA(privateKey)),
+		issuer: Secp256k1DidKey(&privateKey.PublicKey),
+	}
+}
+
+// Nonce returns a new single use nonce
+func (s *SiweSessions) Nonce() (string, error) {
+	bz := make([]byte, 16)
+	if _, err := rand.Read(bz); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(bz)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	// nonces expire in issue order, evict expired ones and the oldest over the limit
+	for len(s.issued) > 0 {
+		oldest := s.issued[0]
+		exp, ok := s.nonces[oldest]
+		if ok && now.Before(exp) && len(s.issued) < siweMaxNonces {
+			break
+		}
+		delete(s.nonces, oldest)
+		s.issued = s.issued[1:]
+	}
+	s.nonces[nonce] = now.Add(siweNonceTTL)
+	s.issued = append(s.issued, nonce)
+	return nonce, nil
+}
+
+func (s *SiweSessions) consumeNonce(nonce string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	exp, ok := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	return ok && time.Now().Before(exp)
+}
+
+// Verify checks a signed EIP-4361 message for domain and returns a session token
+func (s *SiweSessions) Verify(domain string, message string, signature string) (string, *SessionClaims, error) {
+	msg, err := ParseSiweMessage(message)
+	if err != nil {
+		return "", nil, err
+	}
+	if domain != "" && msg.Domain != domain {
+		return "", nil, fmt.Errorf("domain mismatch %s", msg.Domain)
+	}
+	now := time.Now()
+	if msg.ExpirationTime != "" {
+		exp, err := time.Parse(time.RFC3339, msg.ExpirationTime)
+		if err != nil || now.After(exp) {
+			return "", nil, fmt.Errorf("message expired")
+		}
+	}
+	if msg.NotBefore != "" {
+		nbf, err := time.Parse(time.RFC3339, msg.NotBefore)
+		if err != nil || now.Before(nbf) {
+			return "", nil, fmt.Errorf("message not yet valid")
+		}
+	}
+	address, err := RecoverPersonalSign([]byte(message), signature)
+	if err != nil {
+		return "", nil, err
+	}
+	if !strings.EqualFold(address.Hex(), msg.Address) {
+		return "", nil, fmt.Errorf("signature does not match %s", msg.Address)
+	}
+	if !s.consumeNonce(msg.Nonce) {
+		return "", nil, fmt.Errorf("invalid nonce")
+	}
+
+	claims := &SessionClaims{
+		Claims: jwt.Claims{
+			Issuer:   s.issuer,
+			Subject:  address.Hex(),
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(siweSessionTTL)),
+		},
+		ChainID: msg.ChainID,
+	}
+	token, err := s.Sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
+
+// Sign returns a compact HS256 JWT for claims
+func (s *SiweSessions) Sign(claims *SessionClaims) (string, error) {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: s.secret}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// Parse validates a session token and returns its claims
+func (s *SiweSessions) Parse(token string) (*SessionClaims, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token %v", err)
+	}
+	claims := &SessionClaims{}
+	if err := tok.Claims(s.secret, claims); err != nil {
+		return nil, fmt.Errorf("invalid token %v", err)
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Issuer: s.issuer, Time: time.Now()}, 0); err != nil {
+		return nil, fmt.Errorf("invalid token %v", err)
+	}
+	return claims, nil
+}
+
+// @BasePath /v0
+// AuthNonce godoc
+// @Summary Issues a Sign-In with Ethereum nonce
+// @Schemes
+// @Description Returns a single use nonce to embed in an EIP-4361 message
+// @Tags auth
+// @Produce json
+// @Success 200 {string} nonce
+// @Router /v0/auth/nonce [get]
+func (dagctx *AnconSyncContext) AuthNonce(c *gin.Context) {
+	nonce, err := dagctx.Sessions.Nonce()
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"nonce": nonce,
+	})
+}
+
+// @BasePath /v0
+// AuthVerify godoc
+// @Summary Verifies a Sign-In with Ethereum message
+// @Schemes
+// @Description Verifies a signed EIP-4361 message and returns a short-lived JWT bound to the address
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Success 201 {string} token
+// @Router /v0/auth/verify [post]
+func (dagctx *AnconSyncContext) AuthVerify(c *gin.Context) {
+	var v map[string]string
+
+	c.BindJSON(&v)
+	if v["message"] == "" || v["signature"] == "" {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("missing message or signature").Error(),
+		})
+		return
+	}
+
+	token, claims, err := dagctx.Sessions.Verify(c.Request.Host, v["message"], v["signature"])
+	if err != nil {
+		c.JSON(401, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(201, gin.H{
+		"token":     token,
+		"address":   claims.Subject,
+		"expiresAt": claims.Expiry.Time().Unix(),
+	})
+}
+
+func bearerToken(c *gin.Context) string {
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+// SiweAuth requires a valid session token and sets the session address on the context
+func (dagctx *AnconSyncContext) SiweAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := dagctx.Sessions.Parse(bearerToken(c))
+		if err != nil {
+			c.AbortWithStatusJSON(401, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.Set(AuthAddressKey, claims.Subject)
+		c.Next()
+	}
+}
+
+// RequireOwner only lets the session address through when it is the owner of the block
+// referenced by the cid param, as used by Ancon721 metadata
+func (dagctx *AnconSyncContext) RequireOwner() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		lnk, err := anconsync.ParseCidLink(c.Param("cid"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+		if err != nil {
+			c.AbortWithStatusJSON(404, gin.H{
+				"error": fmt.Errorf("block not found %v", err).Error(),
+			})
+			return
+		}
+		owner, err := n.LookupByString("owner")
+		if err != nil {
+			c.AbortWithStatusJSON(403, gin.H{
+				"error": fmt.Errorf("block has no owner").Error(),
+			})
+			return
+		}
+		ownerStr, _ := owner.AsString()
+		if !strings.EqualFold(ownerStr, c.GetString(AuthAddressKey)) {
+			c.AbortWithStatusJSON(403, gin.H{
+				"error": fmt.Errorf("only the owner may modify %s", lnk).Error(),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// FieldPath returns the path of a top level field of a patch. The key is a single path
+// segment, so "a/b" or "/owner" can't reach nested fields or the root.
+func FieldPath(key string) (datamodel.Path, error) {
+	if key == "" || strings.Contains(key, "/") {
+		return datamodel.Path{}, fmt.Errorf("invalid field %q, only top level fields can be patched", key)
+	}
+	return datamodel.NewPath([]datamodel.PathSegment{datamodel.PathSegmentOfString(key)}), nil
+}
+
+// @BasePath /v0
+// DagJsonPatch godoc
+// @Summary Patches a dag-json block
+// @Schemes
+// @Description Sets the given top level fields on a block and links the previous version as parent. Returns the new CID.
+// @Tags dag-json
+// @Accept json
+// @Produce json
+// @Success 201 {string} cid
+// @Router /v0/dagjson/{cid} [patch]
+func (dagctx *AnconSyncContext) DagJsonPatch(c *gin.Context) {
+	var v map[string]interface{}
+
+	if err := c.BindJSON(&v); err != nil || len(v) == 0 {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("missing payload data source").Error(),
+		})
+		return
+	}
+	lnk, err := anconsync.ParseCidLink(c.Param("cid"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("block not found %v", err).Error(),
+		})
+		return
+	}
+
+	for key, value := range v {
+		path, err := FieldPath(key)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		if key == "owner" || key == "parent" {
+			continue
+		}
+		js, err := json.Marshal(value)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		field, err := anconsync.Decode(basicnode.Prototype.Any, string(js))
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("decode Error %v", err).Error(),
+			})
+			return
+		}
+		n, err = traversal.FocusedTransform(n, path, func(_ traversal.Progress, _ datamodel.Node) (datamodel.Node, error) {
+			return field, nil
+		}, true)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+	// link the previous version
+	n, err = traversal.FocusedTransform(n, datamodel.ParsePath("parent"), func(_ traversal.Progress, _ datamodel.Node) (datamodel.Node, error) {
+		return basicnode.NewLink(cidlink.Link{Cid: lnk.Cid}), nil
+	}, true)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	cid := dagctx.Store.Store(ipld.LinkContext{}, n)
+	c.JSON(201, gin.H{
+		"cid": cid,
+	})
+}
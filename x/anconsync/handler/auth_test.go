@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+func siweMessage(domain, address, nonce string, expiration time.Time) string {
+	return strings.Join([]string{
+		domain + " wants you to sign in with your Ethereum account:",
+		address,
+		"",
+		"Sign in to Ancon",
+		"",
+		"URI: https://" + domain,
+		"Version: 1",
+		"Chain ID: 1",
+		"Nonce: " + nonce,
+		"Issued At: " + time.Now().UTC().Format(time.RFC3339),
+		"Expiration Time: " + expiration.UTC().Format(time.RFC3339),
+		"Resources:",
+		"- ipfs://bafy",
+	}, "\n")
+}
+
+func TestParseSiweMessage(t *testing.T) {
+	message := siweMessage("ancon.example", "0x000000000000000000000000000000000000dEaD", "abc", time.Now().Add(time.Hour))
+	msg, err := ParseSiweMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Domain != "ancon.example" || msg.Statement != "Sign in to Ancon" || msg.Nonce != "abc" ||
+		msg.ChainID != "1" || len(msg.Resources) != 1 || msg.Resources[0] != "ipfs://bafy" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	for _, invalid := range []string{
+		"",
+		strings.Replace(message, "0x000000000000000000000000000000000000dEaD", "0xnotanaddress", 1),
+		strings.Replace(message, "Version: 1", "Version: 2", 1),
+		strings.Replace(message, "Nonce: abc", "", 1),
+	} {
+		if _, err := ParseSiweMessage(invalid); err == nil {
+			t.Fatalf("parsed an invalid message %q", invalid)
+		}
+	}
+}
+
+func TestSiweVerify(t *testing.T) {
+	dagctx := newTestIndex(t)
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	sign := func(message string) string {
+		sig, err := crypto.Sign(accounts.TextHash([]byte(message)), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hexutil.Encode(sig)
+	}
+
+	nonce, _ := dagctx.Sessions.Nonce()
+	message := siweMessage("ancon.example", address, nonce, time.Now().Add(time.Hour))
+	if _, _, err := dagctx.Sessions.Verify("other.example", message, sign(message)); err == nil {
+		t.Fatal("verified a message for another domain")
+	}
+	other, _ := crypto.GenerateKey()
+	forged, _ := crypto.Sign(accounts.TextHash([]byte(message)), other)
+	if _, _, err := dagctx.Sessions.Verify("ancon.example", message, hexutil.Encode(forged)); err == nil {
+		t.Fatal("verified a message signed by another key")
+	}
+	token, claims, err := dagctx.Sessions.Verify("ancon.example", message, sign(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != address {
+		t.Fatalf("unexpected subject %s", claims.Subject)
+	}
+	if _, _, err := dagctx.Sessions.Verify("ancon.example", message, sign(message)); err == nil {
+		t.Fatal("nonce was used twice")
+	}
+
+	expired := siweMessage("ancon.example", address, nonce, time.Now().Add(-time.Minute))
+	if _, _, err := dagctx.Sessions.Verify("ancon.example", expired, sign(expired)); err == nil {
+		t.Fatal("verified an expired message")
+	}
+	unknown := siweMessage("ancon.example", address, "unknown", time.Now().Add(time.Hour))
+	if _, _, err := dagctx.Sessions.Verify("ancon.example", unknown, sign(unknown)); err == nil {
+		t.Fatal("verified a nonce the node did not issue")
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/me", dagctx.SiweAuth(), func(c *gin.Context) {
+		c.String(200, c.GetString(AuthAddressKey))
+	})
+	for bearer, code := range map[string]int{token: 200, token + "x": 401, "": 401} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		r.ServeHTTP(w, req)
+		if w.Code != code || (code == 200 && w.Body.String() != address) {
+			t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSiweNonceEviction(t *testing.T) {
+	sessions := NewSiweSessions(newTestIndex(t).PrivateKey)
+	first, _ := sessions.Nonce()
+	for i := 0; i < siweMaxNonces; i++ {
+		if _, err := sessions.Nonce(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sessions.nonces) > siweMaxNonces || len(sessions.issued) > siweMaxNonces {
+		t.Fatalf("%d nonces outstanding", len(sessions.nonces))
+	}
+	if sessions.consumeNonce(first) {
+		t.Fatal("oldest nonce was not evicted")
+	}
+
+	sessions.nonces[sessions.issued[0]] = time.Now().Add(-time.Second)
+	expired := sessions.issued[0]
+	sessions.Nonce()
+	if _, ok := sessions.nonces[expired]; ok {
+		t.Fatal("expired nonce was kept")
+	}
+}
+
+func TestDagJsonPatch(t *testing.T) {
+	dagctx := newTestIndex(t)
+	lnk := dagctx.Store.Store(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("name").AssignString("doc")
+		na.AssembleEntry("owner").AssignString("0xAaaa")
+	}))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.PATCH("/v0/dagjson/:cid", dagctx.DagJsonPatch)
+	patch := func(body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("PATCH", fmt.Sprintf("/v0/dagjson/%s", lnk), strings.NewReader(body)))
+		var res map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+
+	for _, body := range []string{
+		`{"/owner": "0xBbbb"}`,
+		`{"owner/": "0xBbbb"}`,
+		`{"parent/": "bafy"}`,
+		`{"": {"owner": "0xBbbb"}}`,
+		`{"/": {"owner": "0xBbbb"}}`,
+		`{"a": 1, "a/b": 2}`,
+	} {
+		if code, _ := patch(body); code != 400 {
+			t.Fatalf("patched %s %d", body, code)
+		}
+	}
+
+	code, res := patch(`{"name": "renamed", "owner": "0xBbbb"}`)
+	if code != 201 {
+		t.Fatalf("unexpected status %d %v", code, res)
+	}
+	data, err := anconsync.ReadFromStore(dagctx.Store, res["cid"].(map[string]interface{})["/"].(string), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result["name"] != "renamed" || result["owner"] != "0xAaaa" {
+		t.Fatalf("unexpected patch result %v", result)
+	}
+	if parent := result["parent"].(map[string]interface{}); parent["/"] != lnk.String() {
+		t.Fatalf("unexpected parent %v", parent)
+	}
+}
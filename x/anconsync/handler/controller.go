@@ -13,6 +13,16 @@ type AnconSyncContext struct {
 	Exchange   graphsync.GraphExchange
 	IPFSPeer   *peer.AddrInfo
 	PrivateKey *ecdsa.PrivateKey
+	// SignedWrites lists the write routes that require a signature
+	SignedWrites []string
+	// Sessions issues Sign-In with Ethereum session tokens
+	Sessions *SiweSessions
+	// Access enforces API key roles on routes
+	Access *AccessControl
+	// Index commits key → CID writes to an IAVL tree, nil when disabled
+	Index *AuthenticatedIndex
+	// PublicURL is the base URL the node API is reachable at, used in issued documents
+	PublicURL string
 }
 
 func NewAnconSyncContext(s anconsync.Storage, exchange graphsync.GraphExchange, ipfspeer *peer.AddrInfo, privateKey *ecdsa.PrivateKey) *AnconSyncContext {
@@ -21,5 +31,7 @@ func NewAnconSyncContext(s anconsync.Storage, exchange graphsync.GraphExchange,
 		Exchange:   exchange,
 		IPFSPeer:   ipfspeer,
 		PrivateKey: privateKey,
+		Sessions:   NewSiweSessions(privateKey),
+		Access:     NewAccessControl(),
 	}
 }
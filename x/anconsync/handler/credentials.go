@@ -0,0 +1,515 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/impl"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/spf13/cast"
+)
+
+const (
+	StatusPurposeRevocation = "revocation"
+	statusListProofType     = "EcdsaSecp256k1RecoverySignature2020"
+)
+
+// serializes index allocation and bit flips per node
+var statusListLock sync.Mutex
+
+// CredentialStatus is the StatusList2021Entry assigned to a credential
+type CredentialStatus struct {
+	ID                   string `json:"id"`
+	Type                 string `json:"type"`
+	StatusPurpose        string `json:"statusPurpose"`
+	StatusListIndex      string `json:"statusListIndex"`
+	StatusListCredential string `json:"statusListCredential"`
+	Issuer               string `json:"issuer"`
+}
+
+func statusListKey(issuer string) string {
+	return strings.Join([]string{"statuslist", issuer}, ":")
+}
+
+func statusListHistoryKey(issuer string) string {
+	return strings.Join([]string{"statuslist", issuer, "history"}, ":")
+}
+
+func statusListNextIndexKey(issuer string) string {
+	return strings.Join([]string{"statuslist", issuer, "next"}, ":")
+}
+
+// statusListURL is where the status list of issuer is served, credentials embed it as
+// statusListCredential
+func (dagctx *AnconSyncContext) statusListURL(issuer string) string {
+	return strings.TrimRight(dagctx.PublicURL, "/") + "/v0/statuslist/" + url.PathEscape(issuer)
+}
+
+// nodeVerificationMethod is the did:key verification method of the node signing key
+func (dagctx *AnconSyncContext) nodeVerificationMethod() string {
+	did := dagctx.NodeDid()
+	return did + "#" + strings.TrimPrefix(did, "did:key:")
+}
+
+func credentialStatusKey(id string) string {
+	return strings.Join([]string{"credential", id, "status"}, ":")
+}
+
+// BuildStatusListCredential returns a signed StatusList2021Credential for issuer
+func (dagctx *AnconSyncContext) BuildStatusListCredential(issuer string, list StatusList) (map[string]interface{}, error) {
+	encoded, err := list.Encode()
+	if err != nil {
+		return nil, err
+	}
+	credential := map[string]interface{}{
+		"@context": []string{
+			"https://www.w3.org/2018/credentials/v1",
+			"https://w3id.org/vc/status-list/2021/v1",
+		},
+		"id":           dagctx.statusListURL(issuer),
+		"type":         []string{"VerifiableCredential", "StatusList2021Credential"},
+		"issuer":       issuer,
+		"issuanceDate": time.Now().UTC().Format(time.RFC3339),
+		"credentialSubject": map[string]interface{}{
+			"id":            dagctx.statusListURL(issuer) + "#list",
+			"type":          "StatusList2021",
+			"statusPurpose": StatusPurposeRevocation,
+			"encodedList":   encoded,
+		},
+	}
+
+	payload, err := json.Marshal(credential)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := crypto.Sign(crypto.Keccak256(payload), dagctx.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing failed %v", err)
+	}
+	credential["proof"] = map[string]interface{}{
+		"type":               statusListProofType,
+		"created":            credential["issuanceDate"],
+		"proofPurpose":       "assertionMethod",
+		"verificationMethod": dagctx.nodeVerificationMethod(),
+		"ethereumAddress":    crypto.PubkeyToAddress(dagctx.PrivateKey.PublicKey).Hex(),
+		"proofValue":         hexutil.Encode(signature),
+	}
+	return credential, nil
+}
+
+// VerifyStatusListCredential checks that a status list credential of issuer is signed by
+// the node key and returns its bitstring
+func (dagctx *AnconSyncContext) VerifyStatusListCredential(n datamodel.Node, issuer string) (StatusList, error) {
+	data, err := anconsync.Encode(n)
+	if err != nil {
+		return nil, err
+	}
+	var credential map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &credential); err != nil {
+		return nil, err
+	}
+	proof, ok := credential["proof"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("missing status list proof")
+	}
+	delete(credential, "proof")
+
+	payload, err := json.Marshal(credential)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := hexutil.Decode(cast.ToString(proof["proofValue"]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid proof value %v", err)
+	}
+	pub, err := crypto.SigToPub(crypto.Keccak256(payload), signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature %v", err)
+	}
+	// the proof carries the signer address, only the node key is trusted
+	if crypto.PubkeyToAddress(*pub) != crypto.PubkeyToAddress(dagctx.PrivateKey.PublicKey) {
+		return nil, fmt.Errorf("status list is not signed by the node")
+	}
+	if cast.ToString(credential["issuer"]) != issuer {
+		return nil, fmt.Errorf("status list is not issued by %s", issuer)
+	}
+
+	subject, ok := credential["credentialSubject"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("missing credential subject")
+	}
+	return DecodeStatusList(cast.ToString(subject["encodedList"]))
+}
+
+// loadStatusList returns the latest status list for issuer, or an empty list when the
+// issuer has none yet
+func (dagctx *AnconSyncContext) loadStatusList(ctx context.Context, issuer string) (StatusList, datamodel.Link, error) {
+	value, err := dagctx.Store.DataStore.Get(ctx, statusListKey(issuer))
+	if os.IsNotExist(err) {
+		return NewStatusList(), nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read status list %v", err)
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, err := dagctx.VerifyStatusListCredential(n, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return list, lnk, nil
+}
+
+// publishStatusList stores a signed status list and appends it to the issuer history
+func (dagctx *AnconSyncContext) publishStatusList(ctx context.Context, issuer string, list StatusList, reason string) (datamodel.Link, error) {
+	credential, err := dagctx.BuildStatusListCredential(issuer, list)
+	if err != nil {
+		return nil, err
+	}
+	bz, err := json.Marshal(credential)
+	if err != nil {
+		return nil, err
+	}
+	n, err := anconsync.Decode(basicnode.Prototype.Any, string(bz))
+	if err != nil {
+		return nil, err
+	}
+	lnk := dagctx.Store.Store(ipld.LinkContext{}, n)
+
+	var previous datamodel.Link
+	value, err := dagctx.Store.DataStore.Get(ctx, statusListHistoryKey(issuer))
+	if err == nil {
+		previous, err = anconsync.ParseCidLink(string(value))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read status list history %v", err)
+	}
+	entry := fluent.MustBuildMap(basicnode.Prototype.Map, 5, func(na fluent.MapAssembler) {
+		na.AssembleEntry("issuer").AssignString(issuer)
+		na.AssembleEntry("statusListCredential").AssignLink(lnk)
+		na.AssembleEntry("reason").AssignString(reason)
+		na.AssembleEntry("timestamp").AssignInt(time.Now().Unix())
+		if previous != nil {
+			na.AssembleEntry("previous").AssignLink(previous)
+		} else {
+			na.AssembleEntry("previous").AssignNull()
+		}
+	})
+	history := dagctx.Store.Store(ipld.LinkContext{}, entry)
+
+	if err := dagctx.Store.DataStore.Put(ctx, statusListKey(issuer), []byte(lnk.String())); err != nil {
+		return nil, err
+	}
+	if err := dagctx.Store.DataStore.Put(ctx, statusListHistoryKey(issuer), []byte(history.String())); err != nil {
+		return nil, err
+	}
+	return lnk, nil
+}
+
+// AllocateCredentialStatus reserves a status list index for credential id, the returned
+// entry is embedded as credentialStatus by the issuer
+func (dagctx *AnconSyncContext) AllocateCredentialStatus(ctx context.Context, issuer string, id string) (*CredentialStatus, error) {
+	statusListLock.Lock()
+	defer statusListLock.Unlock()
+
+	exists, err := dagctx.Store.DataStore.Has(ctx, credentialStatusKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("credential status already allocated for %s", id)
+	}
+
+	_, lnk, err := dagctx.loadStatusList(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if lnk == nil {
+		lnk, err = dagctx.publishStatusList(ctx, issuer, NewStatusList(), "genesis")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	index := 0
+	value, err := dagctx.Store.DataStore.Get(ctx, statusListNextIndexKey(issuer))
+	if err == nil {
+		index = cast.ToInt(string(value))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read status list index %v", err)
+	}
+	if index >= StatusListLength {
+		return nil, fmt.Errorf("status list for %s is full", issuer)
+	}
+
+	status := &CredentialStatus{
+		ID:                   fmt.Sprintf("%s#%d", dagctx.statusListURL(issuer), index),
+		Type:                 "StatusList2021Entry",
+		StatusPurpose:        StatusPurposeRevocation,
+		StatusListIndex:      cast.ToString(index),
+		StatusListCredential: dagctx.statusListURL(issuer),
+		Issuer:               issuer,
+	}
+	bz, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	if err := dagctx.Store.DataStore.Put(ctx, credentialStatusKey(id), bz); err != nil {
+		return nil, err
+	}
+	if err := dagctx.Store.DataStore.Put(ctx, statusListNextIndexKey(issuer), []byte(cast.ToString(index+1))); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (dagctx *AnconSyncContext) readCredentialStatus(ctx context.Context, id string) (*CredentialStatus, error) {
+	value, err := dagctx.Store.DataStore.Get(ctx, credentialStatusKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("credential status not found for %s", id)
+	}
+	var status CredentialStatus
+	if err := json.Unmarshal(value, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// RevokeCredential flips the status bit of credential id and publishes a new status list
+func (dagctx *AnconSyncContext) RevokeCredential(ctx context.Context, id string) (datamodel.Link, error) {
+	statusListLock.Lock()
+	defer statusListLock.Unlock()
+
+	status, err := dagctx.readCredentialStatus(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	list, _, err := dagctx.loadStatusList(ctx, status.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	if err := list.Set(cast.ToInt(status.StatusListIndex), true); err != nil {
+		return nil, err
+	}
+	return dagctx.publishStatusList(ctx, status.Issuer, list, id)
+}
+
+// IsCredentialRevoked checks credential id against a status list, the latest known list is
+// used when listCid is empty. Lists missing from the store are fetched with graphsync.
+func (dagctx *AnconSyncContext) IsCredentialRevoked(ctx context.Context, id string, listCid string) (bool, datamodel.Link, error) {
+	status, err := dagctx.readCredentialStatus(ctx, id)
+	if err != nil {
+		return false, nil, err
+	}
+	if listCid == "" {
+		value, err := dagctx.Store.DataStore.Get(ctx, statusListKey(status.Issuer))
+		if err != nil {
+			return false, nil, fmt.Errorf("status list not found for %s", status.Issuer)
+		}
+		listCid = string(value)
+	}
+	lnk, err := anconsync.ParseCidLink(listCid)
+	if err != nil {
+		return false, nil, err
+	}
+	n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		if err := impl.FetchBlock(ctx, dagctx.Exchange, dagctx.IPFSPeer, lnk); err != nil {
+			return false, nil, fmt.Errorf("status list not available %v", err)
+		}
+		n, err = dagctx.Store.Load(ipld.LinkContext{}, lnk)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+	list, err := dagctx.VerifyStatusListCredential(n, status.Issuer)
+	if err != nil {
+		return false, nil, err
+	}
+	revoked, err := list.Get(cast.ToInt(status.StatusListIndex))
+	return revoked, lnk, err
+}
+
+// @BasePath /v0
+// CreateCredentialStatus godoc
+// @Summary Allocates a credential status entry
+// @Schemes
+// @Description Reserves a StatusList2021 index for a credential issued by issuer. Returns the credentialStatus entry.
+// @Tags credentials
+// @Accept json
+// @Produce json
+// @Success 201 {object} CredentialStatus
+// @Router /v0/credentials/{id}/status [post]
+func (dagctx *AnconSyncContext) CreateCredentialStatus(c *gin.Context) {
+	var v map[string]string
+
+	c.BindJSON(&v)
+	if v["issuer"] == "" {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("missing issuer").Error(),
+		})
+		return
+	}
+
+	status, err := dagctx.AllocateCredentialStatus(c.Request.Context(), v["issuer"], c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(201, status)
+}
+
+// @BasePath /v0
+// RevokeCredentialStatus godoc
+// @Summary Revokes a credential
+// @Schemes
+// @Description Flips the credential bit in the issuer StatusList2021 and publishes a new signed status list. Returns the status list CID.
+// @Tags credentials
+// @Accept json
+// @Produce json
+// @Success 201 {string} cid
+// @Router /v0/credentials/{id}/revoke [post]
+func (dagctx *AnconSyncContext) RevokeCredentialStatus(c *gin.Context) {
+	lnk, err := dagctx.RevokeCredential(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(201, gin.H{
+		"cid": lnk,
+	})
+	impl.PushBlock(c.Request.Context(), dagctx.Exchange, dagctx.IPFSPeer, lnk)
+}
+
+// @BasePath /v0
+// ReadCredentialStatus godoc
+// @Summary Verifies a credential status
+// @Schemes
+// @Description Checks a credential against the latest status list, or the one given by the list query param.
+// @Tags credentials
+// @Accept json
+// @Produce json
+// @Success 200
+// @Router /v0/credentials/{id}/status [get]
+func (dagctx *AnconSyncContext) ReadCredentialStatus(c *gin.Context) {
+	revoked, lnk, err := dagctx.IsCredentialRevoked(c.Request.Context(), c.Param("id"), c.Query("list"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"revoked":              revoked,
+		"statusListCredential": lnk,
+	})
+}
+
+// @BasePath /v0
+// ReadStatusList godoc
+// @Summary Reads the latest status list of an issuer
+// @Schemes
+// @Description Returns the StatusList2021Credential as JSON
+// @Tags credentials
+// @Accept json
+// @Produce json
+// @Success 200
+// @Router /v0/statuslist/{issuer} [get]
+func (dagctx *AnconSyncContext) ReadStatusList(c *gin.Context) {
+	value, err := dagctx.Store.DataStore.Get(c.Request.Context(), statusListKey(c.Param("issuer")))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("status list not found %v", err).Error(),
+		})
+		return
+	}
+
+	data, err := anconsync.ReadFromStore(dagctx.Store, string(value), "")
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("block not found %v", err).Error(),
+		})
+		return
+	}
+	c.JSON(200, data)
+}
+
+// @BasePath /v0
+// ReadStatusListHistory godoc
+// @Summary Reads the status list history of an issuer
+// @Schemes
+// @Description Returns prior status list CIDs, newest first
+// @Tags credentials
+// @Accept json
+// @Produce json
+// @Success 200
+// @Router /v0/statuslist/{issuer}/history [get]
+func (dagctx *AnconSyncContext) ReadStatusListHistory(c *gin.Context) {
+	value, err := dagctx.Store.DataStore.Get(c.Request.Context(), statusListHistoryKey(c.Param("issuer")))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("status list not found %v", err).Error(),
+		})
+		return
+	}
+
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid hash %v", err).Error(),
+		})
+		return
+	}
+
+	history := []gin.H{}
+	var next datamodel.Link = lnk
+	for next != nil {
+		n, err := dagctx.Store.Load(ipld.LinkContext{}, next)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("block not found %v", err).Error(),
+			})
+			return
+		}
+		list, _ := n.LookupByString("statusListCredential")
+		reason, _ := n.LookupByString("reason")
+		timestamp, _ := n.LookupByString("timestamp")
+		listLnk, _ := list.AsLink()
+		reasonStr, _ := reason.AsString()
+		ts, _ := timestamp.AsInt()
+		history = append(history, gin.H{
+			"cid":       listLnk.String(),
+			"reason":    reasonStr,
+			"timestamp": ts,
+		})
+
+		next = nil
+		if previous, err := n.LookupByString("previous"); err == nil && !previous.IsNull() {
+			next, _ = previous.AsLink()
+		}
+	}
+	c.JSON(200, history)
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+func TestStatusListSigner(t *testing.T) {
+	ctx := context.Background()
+	dagctx := newTestIndex(t)
+	if _, err := dagctx.AllocateCredentialStatus(ctx, "did:web:issuer", "urn:credential:1"); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _, err := dagctx.IsCredentialRevoked(ctx, "urn:credential:1", ""); err != nil || revoked {
+		t.Fatalf("unexpected status %v %v", revoked, err)
+	}
+
+	store := func(issuer *AnconSyncContext, name string) string {
+		list := NewStatusList()
+		list.Set(0, true)
+		credential, err := issuer.BuildStatusListCredential(name, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bz, _ := json.Marshal(credential)
+		n, err := anconsync.Decode(basicnode.Prototype.Any, string(bz))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dagctx.Store.Store(ipld.LinkContext{}, n).String()
+	}
+
+	// a self-signed list passed as ?list= is rejected
+	key, _ := crypto.GenerateKey()
+	other := NewAnconSyncContext(dagctx.Store, nil, nil, key)
+	if _, _, err := dagctx.IsCredentialRevoked(ctx, "urn:credential:1", store(other, "did:web:issuer")); err == nil {
+		t.Fatal("accepted a status list signed by another key")
+	}
+	// so is a list of another issuer signed by the node
+	if _, _, err := dagctx.IsCredentialRevoked(ctx, "urn:credential:1", store(dagctx, "did:web:other")); err == nil {
+		t.Fatal("accepted the status list of another issuer")
+	}
+
+	if _, err := dagctx.RevokeCredential(ctx, "urn:credential:1"); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _, err := dagctx.IsCredentialRevoked(ctx, "urn:credential:1", ""); err != nil || !revoked {
+		t.Fatalf("credential was not revoked %v", err)
+	}
+}
+
+func TestCredentialStatusURL(t *testing.T) {
+	ctx := context.Background()
+	dagctx := newTestIndex(t)
+	dagctx.PublicURL = "https://ancon.example/"
+	status, err := dagctx.AllocateCredentialStatus(ctx, "did:web:issuer", "urn:credential:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.StatusListCredential != "https://ancon.example/v0/statuslist/did:web:issuer" {
+		t.Fatalf("unexpected status list credential %s", status.StatusListCredential)
+	}
+	if status.ID != status.StatusListCredential+"#0" {
+		t.Fatalf("unexpected status id %s", status.ID)
+	}
+
+	credential, err := dagctx.BuildStatusListCredential("did:web:issuer", NewStatusList())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := credential["proof"].(map[string]interface{})
+	method := proof["verificationMethod"].(string)
+	_, pub, err := DecodeDidKey(method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub, crypto.CompressPubkey(&dagctx.PrivateKey.PublicKey)) {
+		t.Fatalf("verification method %s does not name the node key", method)
+	}
+}
@@ -21,7 +21,7 @@ import (
 // DagCborWrite godoc
 // @Summary Stores CBOR as dag-json
 // @Schemes
-// @Description Writes a dag-cbor block which syncs with IPFS. Returns a CID.
+// @Description Writes a dag-cbor block which syncs with IPFS. Returns a CID. Signed writes carry the X-Ancon-Signature headers and also return the authorship envelope CID.
 // @Tags dag-cbor
 // @Accept json
 // @Produce json
@@ -53,10 +53,22 @@ func (dagctx *AnconSyncContext) DagCborWrite(c *gin.Context) {
 		})
 		return
 	}
+	_, signer, err := dagctx.signedWrite(c, WriteRouteDagCbor, n)
+	if err != nil {
+		c.JSON(401, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 	cid := dagctx.Store.Store(ipld.LinkContext{LinkPath: ipld.ParsePath(v["path"])}, n)
-	c.JSON(201, gin.H{
-		"cid": cid,
-	})
+	res, err := dagctx.storeSignedWrite(c, cid, signer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(201, res)
 	impl.PushBlock(c.Request.Context(), dagctx.Exchange, dagctx.IPFSPeer, cid)
 }
 
@@ -64,7 +76,7 @@ func (dagctx *AnconSyncContext) DagCborWrite(c *gin.Context) {
 // DagCborRead godoc
 // @Summary Reads CBOR from a dag-cbor block
 // @Schemes
-// @Description Returns CBOR
+// @Description Returns CBOR, or the authorship envelope with envelope=true
 // @Tags dag-cbor
 // @Accept json
 // @Produce json
@@ -78,6 +90,9 @@ func (dagctx *AnconSyncContext) DagCborRead(c *gin.Context) {
 		})
 		return
 	}
+	if dagctx.readEnvelope(c, cidlink.Link{Cid: lnk}) {
+		return
+	}
 	n, err := dagctx.Store.Load(ipld.LinkContext{LinkPath: ipld.ParsePath(c.Param("path"))}, cidlink.Link{Cid: lnk})
 	if err != nil {
 		c.JSON(400, gin.H{
@@ -0,0 +1,450 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/impl"
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/aries-framework-go/pkg/doc/did"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multicodec"
+)
+
+const (
+	x25519KeyAgreementKey2019    = "X25519KeyAgreementKey2019"
+	secp256k1VerificationKey2018 = "Secp256k1VerificationKey2018"
+)
+
+func b64Bytes(s string) []byte {
+	bz, _ := b64.DecodeString(s)
+	return bz
+}
+
+func lookupB64(n datamodel.Node, key string) string {
+	v, err := n.LookupByString(key)
+	if err != nil {
+		return ""
+	}
+	bz, err := v.AsBytes()
+	if err != nil {
+		return ""
+	}
+	return b64.EncodeToString(bz)
+}
+
+// JWSToNode converts a JWS to the dag-jose encoded form, a CID payload is also
+// exposed as link
+func JWSToNode(jws *JWS) datamodel.Node {
+	payload := b64Bytes(jws.Payload)
+	_, link, err := cid.CidFromBytes(payload)
+	entries := int64(3)
+	if err != nil {
+		entries = 2
+	}
+	return fluent.MustBuildMap(basicnode.Prototype.Map, entries, func(na fluent.MapAssembler) {
+		na.AssembleEntry("payload").AssignBytes(payload)
+		if err == nil {
+			na.AssembleEntry("link").AssignLink(cidlink.Link{Cid: link})
+		}
+		na.AssembleEntry("signatures").CreateList(int64(len(jws.Signatures)), func(la fluent.ListAssembler) {
+			for _, s := range jws.Signatures {
+				la.AssembleValue().CreateMap(2, func(ma fluent.MapAssembler) {
+					ma.AssembleEntry("protected").AssignBytes(b64Bytes(s.Protected))
+					ma.AssembleEntry("signature").AssignBytes(b64Bytes(s.Signature))
+				})
+			}
+		})
+	})
+}
+
+// JWSFromNode converts a dag-jose encoded node to a JWS
+func JWSFromNode(n datamodel.Node) (*JWS, error) {
+	signatures, err := n.LookupByString("signatures")
+	if err != nil {
+		return nil, fmt.Errorf("not a dag-jose JWS")
+	}
+	jws := &JWS{Payload: lookupB64(n, "payload")}
+	it := signatures.ListIterator()
+	for it != nil && !it.Done() {
+		_, s, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		jws.Signatures = append(jws.Signatures, JWSSignature{
+			Protected: lookupB64(s, "protected"),
+			Signature: lookupB64(s, "signature"),
+		})
+	}
+	return jws, nil
+}
+
+// JWEToNode converts a JWE to the dag-jose encoded form
+func JWEToNode(jwe *JWE) datamodel.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 5, func(na fluent.MapAssembler) {
+		na.AssembleEntry("protected").AssignBytes(b64Bytes(jwe.Protected))
+		na.AssembleEntry("iv").AssignBytes(b64Bytes(jwe.IV))
+		na.AssembleEntry("ciphertext").AssignBytes(b64Bytes(jwe.Ciphertext))
+		na.AssembleEntry("tag").AssignBytes(b64Bytes(jwe.Tag))
+		na.AssembleEntry("recipients").CreateList(int64(len(jwe.Recipients)), func(la fluent.ListAssembler) {
+			for _, r := range jwe.Recipients {
+				la.AssembleValue().CreateMap(2, func(ma fluent.MapAssembler) {
+					ma.AssembleEntry("header").CreateMap(int64(len(r.Header)), func(ha fluent.MapAssembler) {
+						for k, v := range r.Header {
+							switch value := v.(type) {
+							case string:
+								ha.AssembleEntry(k).AssignString(value)
+							case map[string]string:
+								ha.AssembleEntry(k).CreateMap(int64(len(value)), func(ea fluent.MapAssembler) {
+									for ek, ev := range value {
+										ea.AssembleEntry(ek).AssignString(ev)
+									}
+								})
+							}
+						}
+					})
+					ma.AssembleEntry("encrypted_key").AssignBytes(b64Bytes(r.EncryptedKey))
+				})
+			}
+		})
+	})
+}
+
+// JWEFromNode converts a dag-jose encoded node to a JWE
+func JWEFromNode(n datamodel.Node) (*JWE, error) {
+	recipients, err := n.LookupByString("recipients")
+	if err != nil {
+		return nil, fmt.Errorf("not a dag-jose JWE")
+	}
+	jwe := &JWE{
+		Protected:  lookupB64(n, "protected"),
+		IV:         lookupB64(n, "iv"),
+		Ciphertext: lookupB64(n, "ciphertext"),
+		Tag:        lookupB64(n, "tag"),
+	}
+	it := recipients.ListIterator()
+	for it != nil && !it.Done() {
+		_, r, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		header, err := r.LookupByString("header")
+		if err != nil {
+			return nil, fmt.Errorf("missing recipient header")
+		}
+		data, err := anconsync.Encode(header)
+		if err != nil {
+			return nil, err
+		}
+		var h map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &h); err != nil {
+			return nil, err
+		}
+		jwe.Recipients = append(jwe.Recipients, JWERecipient{
+			Header:       h,
+			EncryptedKey: lookupB64(r, "encrypted_key"),
+		})
+	}
+	return jwe, nil
+}
+
+// ResolveSecp256k1Key returns the secp256k1 key of kid from a DID document in the store
+func (dagctx *AnconSyncContext) ResolveSecp256k1Key(kid string) ([]byte, error) {
+	id := strings.Split(kid, "#")[0]
+	value, err := dagctx.Store.DataStore.Get(context.Background(), id)
+	if err != nil {
+		return nil, fmt.Errorf("did not found %s", id)
+	}
+	data, err := anconsync.ReadFromStore(dagctx.Store, string(value), "")
+	if err != nil {
+		return nil, err
+	}
+	doc, err := did.ParseDocument([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range doc.VerificationMethod {
+		if v.Type == secp256k1VerificationKey2018 && (v.ID == kid || id == kid) {
+			return v.Value, nil
+		}
+	}
+	return nil, fmt.Errorf("no secp256k1 key for %s", kid)
+}
+
+// ResolveX25519Key returns the key agreement key of a did:key or of a DID document in the store
+func (dagctx *AnconSyncContext) ResolveX25519Key(id string) (string, []byte, error) {
+	if codec, pub, err := DecodeDidKey(id); err == nil {
+		if codec != multicodec.X25519Pub {
+			return "", nil, fmt.Errorf("%s is not a X25519 key", id)
+		}
+		return id, pub, nil
+	}
+
+	value, err := dagctx.Store.DataStore.Get(context.Background(), id)
+	if err != nil {
+		return "", nil, fmt.Errorf("did not found %s", id)
+	}
+	data, err := anconsync.ReadFromStore(dagctx.Store, string(value), "")
+	if err != nil {
+		return "", nil, err
+	}
+	doc, err := did.ParseDocument([]byte(data))
+	if err != nil {
+		return "", nil, err
+	}
+	for _, v := range doc.KeyAgreement {
+		if v.VerificationMethod.Type == x25519KeyAgreementKey2019 {
+			return v.VerificationMethod.ID, v.VerificationMethod.Value, nil
+		}
+	}
+	for _, v := range doc.VerificationMethod {
+		if v.Type == x25519KeyAgreementKey2019 {
+			return v.ID, v.Value, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no X25519 key agreement key for %s", id)
+}
+
+// @BasePath /v0
+// DagJoseSign godoc
+// @Summary Signs a CID as dag-jose
+// @Schemes
+// @Description Signs a payload CID with the node did:key (ES256K) and writes a dag-jose JWS block. Returns a CID.
+// @Tags dag-jose
+// @Accept json
+// @Produce json
+// @Success 201 {string} cid
+// @Router /v0/dagjose/sign [post]
+func (dagctx *AnconSyncContext) DagJoseSign(c *gin.Context) {
+	var v map[string]string
+
+	c.BindJSON(&v)
+	if v["cid"] == "" {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("missing cid").Error(),
+		})
+		return
+	}
+
+	payload, err := cid.Parse(v["cid"])
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid cid %v", err).Error(),
+		})
+		return
+	}
+	if _, err := dagctx.Store.Load(ipld.LinkContext{}, cidlink.Link{Cid: payload}); err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("block not found %v", err).Error(),
+		})
+		return
+	}
+
+	jws, err := SignJWS(dagctx.PrivateKey, payload.Bytes())
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("signing failed %v", err).Error(),
+		})
+		return
+	}
+
+	lnk := dagctx.Store.StoreDagJOSE(ipld.LinkContext{}, JWSToNode(jws))
+	c.JSON(201, gin.H{
+		"cid": lnk,
+	})
+	impl.PushBlock(c.Request.Context(), dagctx.Exchange, dagctx.IPFSPeer, lnk)
+}
+
+// @BasePath /v0
+// DagJoseEncrypt godoc
+// @Summary Encrypts a dag-cbor block as dag-jose
+// @Schemes
+// @Description Encrypts a stored block (cid) or base64 dag-cbor data to the X25519 keys of the recipient DIDs and writes a dag-jose JWE block. Returns a CID.
+// @Tags dag-jose
+// @Accept json
+// @Produce json
+// @Success 201 {string} cid
+// @Router /v0/dagjose/encrypt [post]
+func (dagctx *AnconSyncContext) DagJoseEncrypt(c *gin.Context) {
+	var v struct {
+		Cid        string   `json:"cid"`
+		Data       string   `json:"data"`
+		Recipients []string `json:"recipients"`
+	}
+
+	c.BindJSON(&v)
+	if len(v.Recipients) == 0 {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("missing recipients").Error(),
+		})
+		return
+	}
+
+	var cleartext []byte
+	if v.Cid != "" {
+		lnk, err := anconsync.ParseCidLink(v.Cid)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("block not found %v", err).Error(),
+			})
+			return
+		}
+		cleartext, err = anconsync.EncodeCBOR(n)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("%v", err).Error(),
+			})
+			return
+		}
+	} else {
+		bz, err := base64.StdEncoding.DecodeString(v.Data)
+		if err != nil || len(bz) == 0 {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("missing payload data source").Error(),
+			})
+			return
+		}
+		if _, err := anconsync.DecodeCBOR(basicnode.Prototype.Any, bz); err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("decode Error %v", err).Error(),
+			})
+			return
+		}
+		cleartext = bz
+	}
+
+	keys := make(map[string][]byte, len(v.Recipients))
+	for _, r := range v.Recipients {
+		kid, pub, err := dagctx.ResolveX25519Key(r)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		keys[kid] = pub
+	}
+
+	jwe, err := EncryptJWE(cleartext, keys)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("encryption failed %v", err).Error(),
+		})
+		return
+	}
+
+	lnk := dagctx.Store.StoreDagJOSE(ipld.LinkContext{}, JWEToNode(jwe))
+	c.JSON(201, gin.H{
+		"cid": lnk,
+	})
+	impl.PushBlock(c.Request.Context(), dagctx.Exchange, dagctx.IPFSPeer, lnk)
+}
+
+// @BasePath /v0
+// DagJoseRead godoc
+// @Summary Reads a dag-jose block
+// @Schemes
+// @Description Verifies a JWS and returns the payload link with signer DIDs, or decrypts a JWE addressed to the node X25519 did:key and returns the payload
+// @Tags dag-jose
+// @Accept json
+// @Produce json
+// @Success 200
+// @Router /v0/dagjose/{cid} [get]
+func (dagctx *AnconSyncContext) DagJoseRead(c *gin.Context) {
+	lnk, err := cid.Parse(c.Param("cid"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("%v", err).Error(),
+		})
+		return
+	}
+	n, err := dagctx.Store.Load(ipld.LinkContext{}, cidlink.Link{Cid: lnk})
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("block not found %v", err).Error(),
+		})
+		return
+	}
+
+	if jws, err := JWSFromNode(n); err == nil {
+		payload, signers, err := VerifyJWS(jws, dagctx.ResolveSecp256k1Key)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		_, link, err := cid.CidFromBytes(payload)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("payload is not a cid %v", err).Error(),
+			})
+			return
+		}
+		c.JSON(200, gin.H{
+			"link":    link.String(),
+			"signers": signers,
+		})
+		return
+	}
+
+	jwe, err := JWEFromNode(n)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("not a dag-jose block").Error(),
+		})
+		return
+	}
+	priv, pub, err := dagctx.NodeX25519Key()
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	cleartext, err := DecryptJWE(jwe, X25519DidKey(pub), priv)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	payload, err := anconsync.DecodeCBOR(basicnode.Prototype.Any, cleartext)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("decode Error %v", err).Error(),
+		})
+		return
+	}
+	data, err := anconsync.Encode(payload)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("%v", err).Error(),
+		})
+		return
+	}
+	recipients := make([]interface{}, 0, len(jwe.Recipients))
+	for _, r := range jwe.Recipients {
+		recipients = append(recipients, r.Header["kid"])
+	}
+	c.JSON(200, gin.H{
+		"payload":    data,
+		"recipients": recipients,
+	})
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+func TestDagJoseNodes(t *testing.T) {
+	dagctx := newTestIndex(t)
+	payload := dagctx.Store.Store(ipld.LinkContext{}, basicnode.NewString("payload")).(cidlink.Link)
+
+	jws, err := SignJWS(dagctx.PrivateKey, payload.Cid.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnk := dagctx.Store.StoreDagJOSE(ipld.LinkContext{}, JWSToNode(jws))
+	n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := n.LookupByString("link")
+	if err != nil {
+		t.Fatal("missing link of the JWS payload")
+	}
+	if l, _ := link.AsLink(); l.String() != payload.String() {
+		t.Fatalf("unexpected link %v", l)
+	}
+	decoded, err := JWSFromNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz, signers, err := VerifyJWS(decoded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bz, payload.Cid.Bytes()) || signers[0] != dagctx.NodeDid() {
+		t.Fatalf("unexpected JWS %x %v", bz, signers)
+	}
+
+	priv, pub, err := dagctx.NodeX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid := X25519DidKey(pub)
+	jwe, err := EncryptJWE([]byte("secret"), map[string][]byte{kid: pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnk = dagctx.Store.StoreDagJOSE(ipld.LinkContext{}, JWEToNode(jwe))
+	n, err = dagctx.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := JWSFromNode(n); err == nil {
+		t.Fatal("decoded a JWE as JWS")
+	}
+	decodedJWE, err := JWEFromNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleartext, err := DecryptJWE(decodedJWE, kid, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cleartext) != "secret" {
+		t.Fatalf("unexpected cleartext %s", cleartext)
+	}
+
+	other, _ := crypto.GenerateKey()
+	stranger := NewAnconSyncContext(dagctx.Store, nil, nil, other)
+	priv, pub, _ = stranger.NodeX25519Key()
+	if _, err := DecryptJWE(decodedJWE, X25519DidKey(pub), priv); err == nil {
+		t.Fatal("decrypted for a node that is not a recipient")
+	}
+}
@@ -20,7 +20,7 @@ import (
 // DagJsonWrite godoc
 // @Summary Stores JSON as dag-json
 // @Schemes
-// @Description Writes a dag-json block which syncs with IPFS. Returns a CID.
+// @Description Writes a dag-json block which syncs with IPFS. Returns a CID. Signed writes carry the X-Ancon-Signature headers and also return the authorship envelope CID.
 // @Tags dag-json
 // @Accept json
 // @Produce json
@@ -60,10 +60,22 @@ func (dagctx *AnconSyncContext) DagJsonWrite(c *gin.Context) {
 		})
 		return
 	}
+	_, signer, err := dagctx.signedWrite(c, WriteRouteDagJson, n)
+	if err != nil {
+		c.JSON(401, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 	cid := dagctx.Store.Store(ipld.LinkContext{LinkPath: ipld.ParsePath(path)}, n)
-	c.JSON(201, gin.H{
-		"cid": cid,
-	})
+	res, err := dagctx.storeSignedWrite(c, cid, signer)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(201, res)
 	impl.PushBlock(c.Request.Context(), dagctx.Exchange, dagctx.IPFSPeer, cid)
 }
 
@@ -71,7 +83,7 @@ func (dagctx *AnconSyncContext) DagJsonWrite(c *gin.Context) {
 // DagJsonRead godoc
 // @Summary Reads JSON from a dag-json block
 // @Schemes
-// @Description Returns JSON
+// @Description Returns JSON, or the authorship envelope with envelope=true
 // @Tags dag-json
 // @Accept json
 // @Produce json
@@ -85,6 +97,9 @@ func (dagctx *AnconSyncContext) DagJsonRead(c *gin.Context) {
 		})
 		return
 	}
+	if dagctx.readEnvelope(c, cidlink.Link{Cid: lnk}) {
+		return
+	}
 	n, err := dagctx.Store.Load(ipld.LinkContext{LinkPath: ipld.ParsePath(c.Param("path"))}, cidlink.Link{Cid: lnk})
 
 	if err != nil {
@@ -270,6 +270,10 @@ func (dagctx *AnconSyncContext) AddDid(didType AvailableDid, domainName string,
 		if err != nil {
 			return nil, err
 		}
+		// secp256k1 did:web keys may sign writes
+		if err := dagctx.RegisterSigner(ctx, pubbytes, didDoc.ID); err != nil {
+			return nil, fmt.Errorf("failed to register signer %v", err)
+		}
 
 	} else if didType == DidTypeKey {
 		didDoc, err = dagctx.BuildDidKey()
@@ -288,6 +292,9 @@ func (dagctx *AnconSyncContext) AddDid(didType AvailableDid, domainName string,
 	}
 
 	dagctx.Store.DataStore.Put(ctx, didDoc.ID, []byte(lnk.String()))
+	if err := dagctx.IndexKey(ctx, didDoc.ID, lnk); err != nil {
+		return nil, err
+	}
 
 	return lnk, nil
 }
@@ -0,0 +1,232 @@
+package durin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+)
+
+// Builtins returns the built-in handlers: metadata transfer, metadata update and batch mint
+func Builtins() []*Handler {
+	return []*Handler{
+		{Method: TransferURIMethod(), Handle: transferURI},
+		{Method: UpdateURIMethod(), Handle: updateURI},
+		{Method: MintURIsMethod(), Handle: mintURIs},
+	}
+}
+
+// TransferURIMethod is the call XDVNFT.transferURI sends to the gateway, it answers with
+// the TransferURI proof XDVNFT.transferURIWithProof decodes. ownerSignature is a
+// TransferURIRequest signed by fromOwner.
+func TransferURIMethod() abi.Method {
+	return NewMethod("transferURI",
+		arguments("string metadataCid", "string fromOwner", "string toOwner", "string toAddress", "string tokenId", "string prefix", "bytes ownerSignature"),
+		arguments("string metadataCid", "string fromOwner", "string resultCid", "string toOwner", "uint256 nonce", "uint256 deadline", "bytes signature"))
+}
+
+// UpdateURIMethod applies a dag-json patch to metadata owned by owner and answers with an
+// UpdateURI proof. ownerSignature is an UpdateURIRequest signed by owner.
+func UpdateURIMethod() abi.Method {
+	return NewMethod("updateURI",
+		arguments("string metadataCid", "string owner", "string patch", "string tokenId", "string prefix", "bytes ownerSignature"),
+		arguments("string metadataCid", "string owner", "string resultCid", "uint256 nonce", "uint256 deadline", "bytes signature"))
+}
+
+// MintURIsMethod stores a batch of dag-json metadata documents owned by owner and answers
+// with a MintURIs proof. ownerSignature is a MintURIsRequest signed by owner.
+func MintURIsMethod() abi.Method {
+	return NewMethod("mintURIs",
+		arguments("string owner", "string[] documents", "string prefix", "bytes ownerSignature"),
+		arguments("string[] cids", "uint256 nonce", "uint256 deadline", "bytes signature"))
+}
+
+// verifyOwner checks that signature is a request of type t signed by owner in the domain
+// of the calling contract
+func verifyOwner(s *DurinService, sender common.Address, owner string, signature []byte, t ProofType, values ...interface{}) error {
+	digest, err := s.Domain(sender).Digest(t, values...)
+	if err != nil {
+		return err
+	}
+	address, err := handler.RecoverAddress(digest.Bytes(), hexutil.Encode(signature))
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(address.Hex(), owner) {
+		return fmt.Errorf("%s is not signed by %s", t.Name, owner)
+	}
+	return nil
+}
+
+// currentMetadata checks that metadataCid is the indexed metadata of tokenId, a signed
+// request for a version the token no longer points to can not be replayed. Tokens without
+// indexed metadata rely on the contract checking tokenURI.
+func currentMetadata(s *DurinService, tokenId string, metadataCid string) error {
+	if s.AnconSyncContext.Index == nil {
+		return nil
+	}
+	res, err := s.AnconSyncContext.Index.Tree.Get([]byte(handler.TokenIndexKey(tokenId)))
+	if err != nil {
+		return err
+	}
+	if res.Value != nil && string(res.Value) != metadataCid {
+		return fmt.Errorf("%s is not the current metadata of token %s", metadataCid, tokenId)
+	}
+	return nil
+}
+
+// transferURI transfers the metadata ownership in the DAG and returns the signed proof
+func transferURI(ctx context.Context, s *DurinService, sender common.Address, args map[string]interface{}) ([]interface{}, error) {
+	metadataCid := args["metadataCid"].(string)
+	fromOwner := args["fromOwner"].(string)
+	toOwner := args["toOwner"].(string)
+	tokenId := args["tokenId"].(string)
+	if err := verifyOwner(s, sender, fromOwner, args["ownerSignature"].([]byte), TransferURIRequestType,
+		metadataCid, toOwner, args["toAddress"].(string), tokenId); err != nil {
+		return nil, reverted("%v", err)
+	}
+	if err := currentMetadata(s, tokenId, metadataCid); err != nil {
+		return nil, reverted("%v", err)
+	}
+
+	res, err := s.AnconSyncContext.TransferOwnership(ctx, handler.OwnershipTransfer{
+		Path:     "/",
+		Cid:      metadataCid,
+		Owner:    fromOwner,
+		NewOwner: toOwner,
+	})
+	if err != nil {
+		return nil, reverted("transfer ownership reverted: %v", err)
+	}
+
+	resultCid := res.String()
+
+	proof, err := s.IssueProof(ctx, sender, TransferURIType, tokenId,
+		metadataCid, fromOwner, resultCid, toOwner, args["toAddress"].(string), tokenId)
+	if err != nil {
+		return nil, reverted("signing failed: %v", err)
+	}
+	return []interface{}{metadataCid, fromOwner, resultCid, toOwner, proof.nonce(), proof.deadline(), proof.Signature}, nil
+}
+
+// updateURI applies the patch fields to the metadata, except owner and parent, links the
+// previous version as parent and returns the signed proof
+func updateURI(ctx context.Context, s *DurinService, sender common.Address, args map[string]interface{}) ([]interface{}, error) {
+	metadataCid := args["metadataCid"].(string)
+	owner := args["owner"].(string)
+	tokenId := args["tokenId"].(string)
+
+	lnk, err := anconsync.ParseCidLink(metadataCid)
+	if err != nil {
+		return nil, invalidParams("invalid metadataCid %s", metadataCid)
+	}
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(args["patch"].(string)), &patch); err != nil {
+		return nil, invalidParams("patch must be a json object")
+	}
+	if err := verifyOwner(s, sender, owner, args["ownerSignature"].([]byte), UpdateURIRequestType,
+		metadataCid, args["patch"].(string), tokenId); err != nil {
+		return nil, reverted("%v", err)
+	}
+	if err := currentMetadata(s, tokenId, metadataCid); err != nil {
+		return nil, reverted("%v", err)
+	}
+	n, err := s.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, reverted("metadata not found %v", err)
+	}
+	current, err := n.LookupByString("owner")
+	if err != nil {
+		return nil, reverted("metadata has no owner")
+	}
+	if o, _ := current.AsString(); !strings.EqualFold(o, owner) {
+		return nil, reverted("%s is not the metadata owner", owner)
+	}
+
+	for key, value := range patch {
+		path, err := handler.FieldPath(key)
+		if err != nil {
+			return nil, invalidParams("%v", err)
+		}
+		if key == "owner" || key == "parent" {
+			continue
+		}
+		field, err := anconsync.Decode(basicnode.Prototype.Any, string(value))
+		if err != nil {
+			return nil, invalidParams("decode Error %v", err)
+		}
+		n, err = traversal.FocusedTransform(n, path, func(_ traversal.Progress, _ datamodel.Node) (datamodel.Node, error) {
+			return field, nil
+		}, true)
+		if err != nil {
+			return nil, reverted("%v", err)
+		}
+	}
+	// link the previous version
+	n, err = traversal.FocusedTransform(n, datamodel.ParsePath("parent"), func(_ traversal.Progress, _ datamodel.Node) (datamodel.Node, error) {
+		return basicnode.NewLink(cidlink.Link{Cid: lnk.Cid}), nil
+	}, true)
+	if err != nil {
+		return nil, reverted("%v", err)
+	}
+	result := s.Store.Store(ipld.LinkContext{}, n)
+	resultCid := result.String()
+
+	proof, err := s.IssueProof(ctx, sender, UpdateURIType, tokenId, metadataCid, owner, resultCid, tokenId)
+	if err != nil {
+		return nil, reverted("signing failed: %v", err)
+	}
+	return []interface{}{metadataCid, owner, resultCid, proof.nonce(), proof.deadline(), proof.Signature}, nil
+}
+
+// mintURIs stores each document with owner set and answers with a proof of the cids, the
+// nonce is scoped to the owner. With signed dag-json writes the owner must be a registered
+// signer.
+func mintURIs(ctx context.Context, s *DurinService, sender common.Address, args map[string]interface{}) ([]interface{}, error) {
+	owner := args["owner"].(string)
+	documents := args["documents"].([]string)
+	if len(documents) == 0 {
+		return nil, invalidParams("no documents to mint")
+	}
+	if err := verifyOwner(s, sender, owner, args["ownerSignature"].([]byte), MintURIsRequestType, owner, documents); err != nil {
+		return nil, reverted("%v", err)
+	}
+	if s.AnconSyncContext.RequiresSignature(handler.WriteRouteDagJson) {
+		if _, ok := s.AnconSyncContext.IsRegisteredSigner(ctx, common.HexToAddress(owner)); !ok {
+			return nil, reverted("signer %s is not registered", owner)
+		}
+	}
+
+	cids := []string{}
+	for i, doc := range documents {
+		n, err := anconsync.Decode(basicnode.Prototype.Any, doc)
+		if err != nil || n.Kind() != datamodel.Kind_Map {
+			return nil, invalidParams("document %d must be a json object", i)
+		}
+		n, err = traversal.FocusedTransform(n, datamodel.ParsePath("owner"), func(_ traversal.Progress, _ datamodel.Node) (datamodel.Node, error) {
+			return basicnode.NewString(owner), nil
+		}, true)
+		if err != nil {
+			return nil, reverted("%v", err)
+		}
+		lnk := s.Store.Store(ipld.LinkContext{}, n)
+		cids = append(cids, lnk.String())
+	}
+
+	proof, err := s.IssueProof(ctx, sender, MintURIsType, owner, owner, cids)
+	if err != nil {
+		return nil, reverted("signing failed: %v", err)
+	}
+	return []interface{}{cids, proof.nonce(), proof.deadline(), proof.Signature}, nil
+}
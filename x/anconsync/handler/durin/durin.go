@@ -4,93 +4,161 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/anconprotocol/contracts/adapters/ethereum/erc721/transfer"
-	graphqlclient "github.com/anconprotocol/contracts/graphql/client"
-	"github.com/anconprotocol/contracts/hexutil"
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 )
 
+// JSON-RPC error codes returned by durin_call
+const (
+	ErrCodeInvalidParams  = -32602
+	ErrCodeMethodNotFound = -32601
+	ErrCodeRejected       = -32003
+	ErrCodeLimitExceeded  = -32005
+	ErrCodeReverted       = 3
+)
+
+// Error is a gateway error, it carries a JSON-RPC code and maps to an HTTP status for
+// CCIP-read requests
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string  { return e.Message }
+func (e *Error) ErrorCode() int { return e.Code }
+
+// Status returns the HTTP status of the error
+func (e *Error) Status() int {
+	switch e.Code {
+	case ErrCodeMethodNotFound:
+		return 404
+	case ErrCodeInvalidParams:
+		return 400
+	case ErrCodeRejected:
+		return 403
+	case ErrCodeLimitExceeded:
+		return 429
+	default:
+		return 500
+	}
+}
+
+func invalidParams(format string, args ...interface{}) *Error {
+	return &Error{Code: ErrCodeInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+func reverted(format string, args ...interface{}) *Error {
+	return &Error{Code: ErrCodeReverted, Message: fmt.Sprintf(format, args...)}
+}
+
 type DurinAPI struct {
 	Namespace string
 	Version   string
 	Service   *DurinService
-	Public    bool
+	// RPC is registered as the JSON-RPC namespace instead of Service
+	RPC    *DurinRPC
+	Public bool
 }
 
 type DurinService struct {
-	Adapter   *transfer.OnchainAdapter
-	GqlClient *graphqlclient.Client
+	Adapter          *transfer.OnchainAdapter
+	AnconSyncContext *handler.AnconSyncContext
+	Store            anconsync.Storage
+	Registry         *Registry
+	// Relayer submits adapter-signed transactions, nil when relaying is disabled
+	Relayer *Relayer
+
+	// EIP-712 domain and expiry of the issued proofs
+	ChainID       int64
+	DomainName    string
+	DomainVersion string
+	ProofTTL      time.Duration
+
+	// lock serialises the nonce and proof index updates
+	lock sync.Mutex
 }
 
-func NewDurinAPI(evm transfer.OnchainAdapter, gqlClient *graphqlclient.Client) *DurinAPI {
+func NewDurinAPI(evm transfer.OnchainAdapter, dag *handler.AnconSyncContext) *DurinAPI {
+	registry := NewRegistry()
+	for _, h := range Builtins() {
+		if err := registry.Register(h); err != nil {
+			panic(err)
+		}
+	}
+	service := &DurinService{
+		Adapter:          &evm,
+		AnconSyncContext: dag,
+		Store:            dag.Store,
+		Registry:         registry,
+
+		ChainID:       int64(evm.ChainID),
+		DomainName:    "Ancon Protocol",
+		DomainVersion: "1",
+		ProofTTL:      DefaultProofTTL,
+	}
 	return &DurinAPI{
 		Namespace: "durin",
 		Version:   "1.0",
-		Service: &DurinService{
-			Adapter:   &evm,
-			GqlClient: gqlClient,
-		},
-		Public: true,
+		Service:   service,
+		RPC:       &DurinRPC{service: service},
+		Public:    true,
 	}
 }
 
-func msgHandler(ctx *DurinService, to string, name string, args map[string]string) (hexutil.Bytes, string, error) {
-	switch name {
-	default:
-		tokenId := args["tokenId"]
-		input := graphqlclient.MetadataTransactionInput{
-			Path:     "/",
-			Cid:      args["metadataCid"],
-			Owner:    args["fromOwner"],
-			NewOwner: args["toOwner"],
-		}
-		// Send graphql mutation for IPLD DAG computing
-		res, err := ctx.GqlClient.TransferOwnership(context.Background(), input)
-		if err != nil {
-			return nil, "", fmt.Errorf("transfer ownership reverted")
-		}
-		metadataCid := args["metadataCid"]
-		newCid := res.Metadata.Cid
-		newOwner := args["toOwner"]
-		fromOwner := args["fromOwner"]
-		prefix := args["prefix"]
-
-		// Apply signature to create proof
-		txdata, resultCid, err := ctx.Adapter.ApplyRequestWithProof(context.Background(),
-			metadataCid,
-			newCid,
-			fromOwner,
-			newOwner,
-			to,
-			tokenId,
-			prefix)
-		if err != nil {
-			return nil, "", fmt.Errorf("request with proof raw tx failed")
-		}
-		return txdata, resultCid, nil
+func (s *DurinService) run(ctx context.Context, h *Handler, sender common.Address, args map[string]interface{}) ([]byte, error) {
+	values, err := h.Handle(ctx, s, sender, args)
+	if err != nil {
+		return nil, err
+	}
+	data, err := h.encode(values)
+	if err != nil {
+		return nil, reverted("%s response encoding failed: %v", h.Name, err)
 	}
+	return data, nil
 }
 
-func (s *DurinService) Call(to string, from string, data json.RawMessage, abis json.RawMessage) hexutil.Bytes {
-
-	p := []byte(data)
-	var values map[string]string
-	val := make(map[string]string, 2)
-	err := json.Unmarshal(p, &values)
+// Dispatch decodes the selector and arguments of calldata and runs the matching handler
+func (s *DurinService) Dispatch(ctx context.Context, sender common.Address, data []byte) ([]byte, error) {
+	h, args, err := s.Registry.Decode(data)
 	if err != nil {
-		return hexutil.Bytes(hexutil.Encode([]byte(fmt.Errorf("fail unpack data").Error())))
+		return nil, err
 	}
-	// Execute graphql
-	txdata, resultCid, err := msgHandler(s, to, "", values)
-	if err != nil {
-		return hexutil.Bytes(hexutil.Encode([]byte(fmt.Errorf("reverted").Error())))
+	return s.run(ctx, h, sender, args)
+}
+
+// Call runs an offchain call over JSON-RPC, to is the contract that raised OffchainLookup
+// and data its callData
+func (s *DurinService) Call(to string, from string, data hexutil.Bytes) (hexutil.Bytes, error) {
+	if !common.IsHexAddress(to) {
+		return nil, invalidParams("invalid address %s", to)
 	}
+	return s.Dispatch(context.Background(), common.HexToAddress(to), data)
+}
 
-	val["txdata"] = txdata.String()
-	val["resultCid"] = resultCid
-	jsonval, err := json.Marshal(val)
+// Invoke runs the handler registered as name over JSON-RPC with a JSON object of the
+// method inputs
+func (s *DurinService) Invoke(to string, name string, args json.RawMessage) (hexutil.Bytes, error) {
+	if !common.IsHexAddress(to) {
+		return nil, invalidParams("invalid address %s", to)
+	}
+	h := s.Registry.LookupName(name)
+	if h == nil {
+		return nil, &Error{Code: ErrCodeMethodNotFound, Message: fmt.Sprintf("unknown handler %s", name)}
+	}
+	values, err := h.ParseArgs(args)
 	if err != nil {
-		return hexutil.Bytes(hexutil.Encode([]byte(fmt.Errorf("reverted, json marshal").Error())))
+		return nil, err
 	}
-	return jsonval
+	return s.run(context.Background(), h, common.HexToAddress(to), values)
+}
+
+// Handlers lists the registered handler names and selectors
+func (s *DurinService) Handlers() map[string]string {
+	return s.Registry.Handlers()
 }
@@ -0,0 +1,469 @@
+package durin
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anconprotocol/contracts/adapters/ethereum/erc721/transfer"
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/anconprotocol/node/x/anconsync/handler/proofsignature"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	dbm "github.com/tendermint/tm-db"
+)
+
+var testSender = common.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+func newTestService(t *testing.T) *DurinService {
+	key, _ := crypto.GenerateKey()
+	dag := handler.NewAnconSyncContext(anconsync.OpenStorage(t.TempDir()), nil, nil, key)
+	return NewDurinAPI(transfer.NewOnchainAdapter(key), dag).Service
+}
+
+// echo returns the sender and its arguments
+var echo = &Handler{
+	Method: NewMethod("echo", arguments("string name", "uint256 amount", "address[] to"), arguments("string", "address")),
+	Handle: func(ctx context.Context, s *DurinService, sender common.Address, args map[string]interface{}) ([]interface{}, error) {
+		return []interface{}{args["name"], sender}, nil
+	},
+}
+
+func errorCode(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return 0
+}
+
+func TestDispatch(t *testing.T) {
+	s := newTestService(t)
+	if err := s.Registry.Register(echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Registry.Register(echo); err == nil {
+		t.Fatal("registered a selector twice")
+	}
+
+	args, _ := echo.Method.Inputs.Pack("hello", common.Big2, []common.Address{testSender})
+	res, err := s.Dispatch(context.Background(), testSender, append(echo.Method.ID, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := echo.Method.Outputs.Unpack(res)
+	if err != nil || out[0].(string) != "hello" || out[1].(common.Address) != testSender {
+		t.Fatalf("unexpected response %v %v", out, err)
+	}
+
+	res, err = s.Invoke(testSender.Hex(), "echo", []byte(`{"name":"hello","amount":"0x2","to":["`+testSender.Hex()+`"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := echo.Method.Outputs.Unpack(res); out[0].(string) != "hello" {
+		t.Fatalf("unexpected named response %v", out)
+	}
+}
+
+func TestRPC(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	dag := handler.NewAnconSyncContext(anconsync.OpenStorage(t.TempDir()), nil, nil, key)
+	api := NewDurinAPI(transfer.NewOnchainAdapter(key), dag)
+	server := rpc.NewServer()
+	if err := server.RegisterName(api.Namespace, api.RPC); err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.DialInProc(server)
+	defer client.Close()
+
+	var handlers map[string]string
+	if err := client.Call(&handlers, "durin_handlers"); err != nil || handlers["mintURIs"] == "" {
+		t.Fatalf("unexpected handlers %v %v", handlers, err)
+	}
+	for _, method := range []string{"durin_consumeProof", "durin_proofAccepted", "durin_issueProof"} {
+		if err := client.Call(nil, method); err == nil || !strings.Contains(err.Error(), "does not exist") {
+			t.Fatalf("%s is exposed over JSON-RPC", method)
+		}
+	}
+}
+
+func TestUnknownSelector(t *testing.T) {
+	s := newTestService(t)
+	if _, err := s.Call(testSender.Hex(), "", common.FromHex("0xdeadbeef")); errorCode(err) != ErrCodeMethodNotFound {
+		t.Fatalf("expected method not found, got %v", err)
+	}
+	if _, err := s.Invoke(testSender.Hex(), "missing", []byte(`{}`)); errorCode(err) != ErrCodeMethodNotFound {
+		t.Fatalf("expected method not found, got %v", err)
+	}
+}
+
+func TestMalformedArgs(t *testing.T) {
+	s := newTestService(t)
+	s.Registry.Register(echo)
+
+	for _, data := range [][]byte{
+		{0x01},
+		append(common.CopyBytes(echo.Method.ID), 0x01, 0x02),
+	} {
+		if _, err := s.Call(testSender.Hex(), "", data); errorCode(err) != ErrCodeInvalidParams {
+			t.Fatalf("expected invalid params for %x, got %v", data, err)
+		}
+	}
+	for _, args := range []string{
+		`[]`,
+		`{"name":"hello","amount":"2"}`,
+		`{"name":1,"amount":"2","to":[]}`,
+		`{"name":"hello","amount":"two","to":[]}`,
+		`{"name":"hello","amount":"2","to":["0x01"]}`,
+	} {
+		if _, err := s.Invoke(testSender.Hex(), "echo", []byte(args)); errorCode(err) != ErrCodeInvalidParams {
+			t.Fatalf("expected invalid params for %s, got %v", args, err)
+		}
+	}
+	if _, err := s.Invoke("0x01", "echo", []byte(`{}`)); errorCode(err) != ErrCodeInvalidParams {
+		t.Fatalf("expected invalid params for the sender, got %v", err)
+	}
+}
+
+func recoverSigner(digest common.Hash, signature []byte) common.Address {
+	sig := common.CopyBytes(signature)
+	sig[64] -= 27
+	pub, err := crypto.SigToPub(digest.Bytes(), sig)
+	if err != nil {
+		return common.Address{}
+	}
+	return crypto.PubkeyToAddress(*pub)
+}
+
+// signRequest signs an owner request in the domain of testSender
+func signRequest(t *testing.T, s *DurinService, key *ecdsa.PrivateKey, rt ProofType, values ...interface{}) []byte {
+	digest, err := s.Domain(testSender).Digest(rt, values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := SignDigest(key, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// mint mints documents owned by key through durin_invoke
+func mint(t *testing.T, s *DurinService, key *ecdsa.PrivateKey, documents ...string) (hexutil.Bytes, error) {
+	owner := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	args, _ := json.Marshal(map[string]interface{}{
+		"owner":          owner,
+		"documents":      documents,
+		"prefix":         "xdv",
+		"ownerSignature": hexutil.Bytes(signRequest(t, s, key, MintURIsRequestType, owner, documents)),
+	})
+	return s.Invoke(testSender.Hex(), "mintURIs", args)
+}
+
+func TestBuiltinMintAndUpdate(t *testing.T) {
+	s := newTestService(t)
+	ownerKey, _ := crypto.GenerateKey()
+	owner := crypto.PubkeyToAddress(ownerKey.PublicKey).Hex()
+	signer := crypto.PubkeyToAddress(s.Adapter.PrivateKey.PublicKey)
+
+	res, err := mint(t, s, ownerKey, `{"name":"a"}`, `{"name":"b"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := MintURIsMethod().Outputs.Unpack(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cids := out[0].([]string)
+	digest, _ := s.Domain(testSender).Digest(MintURIsType, owner, cids, out[1].(*big.Int), out[2].(*big.Int))
+	if recoverSigner(digest, out[3].([]byte)) != signer {
+		t.Fatal("mint signature does not recover the gateway signer")
+	}
+
+	patch := `{"name":"c","owner":"someone"}`
+	args, _ := UpdateURIMethod().Inputs.Pack(cids[0], owner, patch, "1", "xdv",
+		signRequest(t, s, ownerKey, UpdateURIRequestType, cids[0], patch, "1"))
+	res, err = s.Call(testSender.Hex(), "", append(UpdateURIMethod().ID, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ = UpdateURIMethod().Outputs.Unpack(res)
+	lnk, _ := anconsync.ParseCidLink(out[2].(string))
+	n, err := s.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, _ := n.LookupByString("name")
+	if v, _ := name.AsString(); v != "c" {
+		t.Fatalf("metadata was not updated %s", v)
+	}
+	o, _ := n.LookupByString("owner")
+	if v, _ := o.AsString(); v != owner {
+		t.Fatalf("patch changed the owner to %s", v)
+	}
+	// a path key can't reach the owner through the root
+	for _, patch := range []string{`{"/owner":"someone"}`, `{"/":{"owner":"someone"}}`} {
+		args, _ = UpdateURIMethod().Inputs.Pack(cids[0], owner, patch, "1", "xdv",
+			signRequest(t, s, ownerKey, UpdateURIRequestType, cids[0], patch, "1"))
+		if _, err := s.Call(testSender.Hex(), "", append(UpdateURIMethod().ID, args...)); errorCode(err) != ErrCodeInvalidParams {
+			t.Fatalf("expected invalid params for %s, got %v", patch, err)
+		}
+	}
+
+	other, _ := crypto.GenerateKey()
+	args, _ = UpdateURIMethod().Inputs.Pack(cids[1], crypto.PubkeyToAddress(other.PublicKey).Hex(), `{"name":"c"}`, "2", "xdv",
+		signRequest(t, s, other, UpdateURIRequestType, cids[1], `{"name":"c"}`, "2"))
+	if _, err := s.Call(testSender.Hex(), "", append(UpdateURIMethod().ID, args...)); errorCode(err) != ErrCodeReverted {
+		t.Fatalf("expected a revert for a non owner, got %v", err)
+	}
+	// the owner address without its signature is not enough
+	args, _ = UpdateURIMethod().Inputs.Pack(cids[1], owner, `{"name":"c"}`, "2", "xdv",
+		signRequest(t, s, other, UpdateURIRequestType, cids[1], `{"name":"c"}`, "2"))
+	if _, err := s.Call(testSender.Hex(), "", append(UpdateURIMethod().ID, args...)); errorCode(err) != ErrCodeReverted {
+		t.Fatalf("expected a revert for a request not signed by the owner, got %v", err)
+	}
+	if _, err := mint(t, s, other, `{"name":"d"}`); err != nil {
+		t.Fatal(err)
+	}
+	s.AnconSyncContext.SignedWrites = []string{handler.WriteRouteDagJson}
+	if _, err := mint(t, s, other, `{"name":"d"}`); errorCode(err) != ErrCodeReverted {
+		t.Fatalf("expected a revert for an unregistered signer, got %v", err)
+	}
+}
+
+func TestTokenIndexedOnProofAccepted(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	tree, err := proofsignature.NewIavlAPI(dbm.NewMemDB(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AnconSyncContext.Index = handler.NewAuthenticatedIndex(tree.Service)
+	s.AnconSyncContext.Index.BatchSize = 1
+	ownerKey, _ := crypto.GenerateKey()
+	owner := crypto.PubkeyToAddress(ownerKey.PublicKey).Hex()
+
+	res, err := mint(t, s, ownerKey, `{"name":"a"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := MintURIsMethod().Outputs.Unpack(res)
+	cid := out[0].([]string)[0]
+	args, _ := UpdateURIMethod().Inputs.Pack(cid, owner, `{"name":"b"}`, "1", "xdv",
+		signRequest(t, s, ownerKey, UpdateURIRequestType, cid, `{"name":"b"}`, "1"))
+	res, err = s.Call(testSender.Hex(), "", append(UpdateURIMethod().ID, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ = UpdateURIMethod().Outputs.Unpack(res)
+	if v, _ := tree.Service.Get([]byte(handler.TokenIndexKey("1"))); v != nil && v.Value != nil {
+		t.Fatal("token was indexed before its proof was used on-chain")
+	}
+
+	digests, _ := s.proofDigests(ctx, testSender)
+	data, _ := ProofAcceptedEvent().Inputs.Pack(testSender, [32]byte(common.HexToHash(digests[len(digests)-1])))
+	if err := s.ProofAccepted(ctx, types.Log{Address: testSender, Data: data, TxHash: common.HexToHash("0x01")}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := tree.Service.Get([]byte(handler.TokenIndexKey("1"))); v == nil || string(v.Value) != out[2].(string) {
+		t.Fatalf("token was not indexed %v", v)
+	}
+
+	// the signed requests for the replaced version can not be replayed
+	if _, err := s.Call(testSender.Hex(), "", append(UpdateURIMethod().ID, args...)); errorCode(err) != ErrCodeReverted {
+		t.Fatalf("expected a revert for a replayed update, got %v", err)
+	}
+	to := common.HexToAddress("0x42").Hex()
+	transferArgs, _ := TransferURIMethod().Inputs.Pack(cid, owner, to, to, "1", "xdv",
+		signRequest(t, s, ownerKey, TransferURIRequestType, cid, to, to, "1"))
+	if _, err := s.Call(testSender.Hex(), "", append(TransferURIMethod().ID, transferArgs...)); errorCode(err) != ErrCodeReverted {
+		t.Fatalf("expected a revert for a transfer of replaced metadata, got %v", err)
+	}
+	current := out[2].(string)
+	transferArgs, _ = TransferURIMethod().Inputs.Pack(current, owner, to, to, "1", "xdv",
+		signRequest(t, s, ownerKey, TransferURIRequestType, current, to, to, "1"))
+	if _, err := s.Call(testSender.Hex(), "", append(TransferURIMethod().ID, transferArgs...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProofNonces(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	signer := crypto.PubkeyToAddress(s.Adapter.PrivateKey.PublicKey)
+
+	first, err := s.IssueProof(ctx, testSender, UpdateURIType, "1", "a", "b", "c", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Nonce != 0 || first.Deadline <= uint64(time.Now().Unix()) {
+		t.Fatalf("unexpected nonce %d deadline %d", first.Nonce, first.Deadline)
+	}
+	digest, _ := s.Domain(testSender).Digest(UpdateURIType, "a", "b", "c", "1", first.nonce(), first.deadline())
+	if digest != first.Digest || recoverSigner(digest, first.Signature) != signer {
+		t.Fatal("proof does not recover the gateway signer")
+	}
+
+	// the nonce advances only when a proof is consumed
+	second, _ := s.IssueProof(ctx, testSender, UpdateURIType, "1", "a", "b", "d", "1")
+	if second.Nonce != 0 || second.Digest == first.Digest {
+		t.Fatalf("unexpected outstanding nonce %d", second.Nonce)
+	}
+	data, _ := ProofAcceptedEvent().Inputs.Pack(testSender, [32]byte(first.Digest))
+	// a log of another contract does not consume the proof
+	if err := s.ProofAccepted(ctx, types.Log{Address: common.HexToAddress("0x01"), Data: data, TxHash: common.HexToHash("0x02")}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.Nonce(ctx, testSender, "1"); n != 0 {
+		t.Fatalf("another contract advanced the nonce to %d", n)
+	}
+	if err := s.ProofAccepted(ctx, types.Log{Address: testSender, Data: data, TxHash: common.HexToHash("0x01")}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.Nonce(ctx, testSender, "1"); n != 1 {
+		t.Fatalf("expected nonce 1, got %d", n)
+	}
+	if n, _ := s.Nonce(ctx, testSender, "2"); n != 0 {
+		t.Fatalf("nonce leaked to another token, got %d", n)
+	}
+	r, _ := s.LoadProof(ctx, first.Digest)
+	if r.Status != ProofConsumed || r.TransactionHash != common.HexToHash("0x01") || r.Previous == nil {
+		t.Fatalf("proof was not consumed %+v", r)
+	}
+
+	s.ProofTTL = -time.Minute
+	s.IssueProof(ctx, testSender, UpdateURIType, "2", "a", "b", "c", "2")
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/v0/durin/proofs/"+testSender.Hex(), nil)
+	c.Params = gin.Params{{Key: "contract", Value: testSender.Hex()}}
+	s.ProofsRead(c)
+	var res map[string][]map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if len(res[ProofOutstanding]) != 1 || len(res[ProofConsumed]) != 1 || len(res[ProofExpired]) != 1 {
+		t.Fatalf("unexpected proofs %s", w.Body.String())
+	}
+}
+
+func TestConcurrentProofs(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.IssueProof(ctx, testSender, UpdateURIType, "1", "a", "b", fmt.Sprint(i), "1"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if digests, _ := s.proofDigests(ctx, testSender); len(digests) != 8 {
+		t.Fatalf("proof index lost updates, got %d proofs", len(digests))
+	}
+}
+
+func TestBuiltinTransfer(t *testing.T) {
+	s := newTestService(t)
+	ownerKey, _ := crypto.GenerateKey()
+	owner := crypto.PubkeyToAddress(ownerKey.PublicKey).Hex()
+	toKey, _ := crypto.GenerateKey()
+	to := crypto.PubkeyToAddress(toKey.PublicKey).Hex()
+
+	res, err := mint(t, s, ownerKey, `{"name":"a"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := MintURIsMethod().Outputs.Unpack(res)
+	cid := out[0].([]string)[0]
+
+	args, _ := TransferURIMethod().Inputs.Pack(cid, owner, to, to, "1", "xdv",
+		signRequest(t, s, toKey, TransferURIRequestType, cid, to, to, "1"))
+	if _, err := s.Call(testSender.Hex(), "", append(TransferURIMethod().ID, args...)); errorCode(err) != ErrCodeReverted {
+		t.Fatalf("expected a revert for a transfer not signed by the owner, got %v", err)
+	}
+	args, _ = TransferURIMethod().Inputs.Pack(cid, owner, to, to, "1", "xdv",
+		signRequest(t, s, ownerKey, TransferURIRequestType, cid, to, to, "1"))
+	res, err = s.Call(testSender.Hex(), "", append(TransferURIMethod().ID, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ = TransferURIMethod().Outputs.Unpack(res)
+	lnk, _ := anconsync.ParseCidLink(out[2].(string))
+	n, err := s.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, _ := n.LookupByString("owner")
+	if v, _ := o.AsString(); v != to {
+		t.Fatalf("owner was not transferred, got %s", v)
+	}
+	parent, _ := n.LookupByString("parent")
+	if p, _ := parent.AsLink(); p == nil || p.String() != cid {
+		t.Fatalf("transfer does not link the previous version")
+	}
+	digest, _ := s.Domain(testSender).Digest(TransferURIType, cid, owner, out[2].(string), to, to, "1", out[4].(*big.Int), out[5].(*big.Int))
+	if recoverSigner(digest, out[6].([]byte)) != crypto.PubkeyToAddress(s.Adapter.PrivateKey.PublicKey) {
+		t.Fatal("transfer signature does not recover the gateway signer")
+	}
+
+	args, _ = TransferURIMethod().Inputs.Pack(cid, to, owner, owner, "1", "xdv",
+		signRequest(t, s, toKey, TransferURIRequestType, cid, owner, owner, "1"))
+	if _, err := s.Call(testSender.Hex(), "", append(TransferURIMethod().ID, args...)); errorCode(err) != ErrCodeReverted {
+		t.Fatalf("expected a revert for a non owner, got %v", err)
+	}
+}
+
+// TestXDVNFTTransferCalldata dispatches the calldata XDVNFT.transferURI puts in its
+// OffchainLookup: the selector of its signature string and lower case hex addresses
+func TestXDVNFTTransferCalldata(t *testing.T) {
+	s := newTestService(t)
+	ownerKey, _ := crypto.GenerateKey()
+	owner := strings.ToLower(crypto.PubkeyToAddress(ownerKey.PublicKey).Hex())
+	to := strings.ToLower(common.HexToAddress("0x0000000000000000000000000000000000000042").Hex())
+
+	res, err := mint(t, s, ownerKey, `{"name":"a"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := MintURIsMethod().Outputs.Unpack(res)
+	cid := out[0].([]string)[0]
+
+	selector := crypto.Keccak256([]byte("transferURI(string,string,string,string,string,string,bytes)"))[:4]
+	if !bytes.Equal(selector, TransferURIMethod().ID) {
+		t.Fatalf("XDVNFT selector %x does not match the transferURI handler %x", selector, TransferURIMethod().ID)
+	}
+	args, err := arguments("string", "string", "string", "string", "string", "string", "bytes").Pack(
+		cid, owner, to, to, "1", strings.ToLower(testSender.Hex()),
+		signRequest(t, s, ownerKey, TransferURIRequestType, cid, to, to, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = s.Call(testSender.Hex(), "", append(selector, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = TransferURIMethod().Outputs.Unpack(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out[0].(string) != cid || out[3].(string) != to {
+		t.Fatalf("unexpected transfer proof %v", out)
+	}
+}
@@ -0,0 +1,118 @@
+package durin
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ProofType is an EIP-712 struct type given as "type name" fields. Every proof type
+// ends with the nonce and deadline fields.
+type ProofType struct {
+	Name   string
+	Fields []string
+}
+
+var (
+	EIP712DomainType = ProofType{"EIP712Domain", []string{"string name", "string version", "uint256 chainId", "address verifyingContract"}}
+	TransferURIType  = ProofType{"TransferURI", []string{"string metadataCid", "string fromOwner", "string resultCid", "string toOwner", "string toAddress", "string tokenId", "uint256 nonce", "uint256 deadline"}}
+	UpdateURIType    = ProofType{"UpdateURI", []string{"string metadataCid", "string owner", "string resultCid", "string tokenId", "uint256 nonce", "uint256 deadline"}}
+	MintURIsType     = ProofType{"MintURIs", []string{"string owner", "string[] cids", "uint256 nonce", "uint256 deadline"}}
+)
+
+// Owner request types, signed by the metadata owner in the proof domain to authorize a
+// built-in call. They have no nonce, the transfer and update requests are bound to the
+// current metadata of the token instead: the gateway rejects a metadataCid that is not
+// the indexed token metadata and XDVNFT one that is not its tokenURI.
+var (
+	TransferURIRequestType = ProofType{"TransferURIRequest", []string{"string metadataCid", "string toOwner", "string toAddress", "string tokenId"}}
+	UpdateURIRequestType   = ProofType{"UpdateURIRequest", []string{"string metadataCid", "string patch", "string tokenId"}}
+	MintURIsRequestType    = ProofType{"MintURIsRequest", []string{"string owner", "string[] documents"}}
+)
+
+// EncodeType returns the EIP-712 type encoding, e.g. Mail(address from,string contents)
+func (t ProofType) EncodeType() string {
+	return fmt.Sprintf("%s(%s)", t.Name, strings.Join(t.Fields, ","))
+}
+
+// TypeHash returns the keccak-256 of the type encoding
+func (t ProofType) TypeHash() common.Hash {
+	return crypto.Keccak256Hash([]byte(t.EncodeType()))
+}
+
+// FieldNames returns the field names in order
+func (t ProofType) FieldNames() []string {
+	names := []string{}
+	for _, f := range t.Fields {
+		names = append(names, f[strings.Index(f, " ")+1:])
+	}
+	return names
+}
+
+// HashStruct returns the EIP-712 hashStruct of values given in field order. Supported
+// values are string, []string, *big.Int, uint64 and common.Address.
+func (t ProofType) HashStruct(values ...interface{}) (common.Hash, error) {
+	if len(values) != len(t.Fields) {
+		return common.Hash{}, fmt.Errorf("%s has %d fields, got %d values", t.Name, len(t.Fields), len(values))
+	}
+	enc := [][]byte{t.TypeHash().Bytes()}
+	for i, v := range values {
+		switch v := v.(type) {
+		case string:
+			enc = append(enc, crypto.Keccak256([]byte(v)))
+		case []string:
+			items := [][]byte{}
+			for _, s := range v {
+				items = append(items, crypto.Keccak256([]byte(s)))
+			}
+			enc = append(enc, crypto.Keccak256(items...))
+		case *big.Int:
+			enc = append(enc, math.U256Bytes(new(big.Int).Set(v)))
+		case uint64:
+			enc = append(enc, math.U256Bytes(new(big.Int).SetUint64(v)))
+		case common.Address:
+			enc = append(enc, common.LeftPadBytes(v.Bytes(), 32))
+		default:
+			return common.Hash{}, fmt.Errorf("unsupported %s field %s", t.Name, t.Fields[i])
+		}
+	}
+	return crypto.Keccak256Hash(enc...), nil
+}
+
+// Domain is the EIP-712 domain of the contract verifying a proof
+type Domain struct {
+	Name              string
+	Version           string
+	ChainID           int64
+	VerifyingContract common.Address
+}
+
+// Separator returns the domain separator
+func (d Domain) Separator() common.Hash {
+	h, _ := EIP712DomainType.HashStruct(d.Name, d.Version, big.NewInt(d.ChainID), d.VerifyingContract)
+	return h
+}
+
+// Digest returns the EIP-712 digest of a struct in the domain
+func (d Domain) Digest(t ProofType, values ...interface{}) (common.Hash, error) {
+	structHash, err := t.HashStruct(values...)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash([]byte{0x19, 0x01}, d.Separator().Bytes(), structHash.Bytes()), nil
+}
+
+// SignDigest signs an EIP-712 digest with v as 27 or 28, the form ECDSA.recover expects
+func SignDigest(key *ecdsa.PrivateKey, digest common.Hash) ([]byte, error) {
+	signature, err := crypto.Sign(digest.Bytes(), key)
+	if err != nil {
+		return nil, err
+	}
+	signature[64] += 27
+	return signature, nil
+}
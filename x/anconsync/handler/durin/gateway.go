@@ -0,0 +1,64 @@
+package durin
+
+import (
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gin-gonic/gin"
+)
+
+// GatewayRequest is the EIP-3668 POST body
+type GatewayRequest struct {
+	Sender string `json:"sender"`
+	Data   string `json:"data"`
+}
+
+func gatewayError(c *gin.Context, err error) {
+	status := 500
+	if e, ok := err.(*Error); ok {
+		status = e.Status()
+	}
+	c.JSON(status, gin.H{
+		"message": err.Error(),
+	})
+}
+
+// Gateway godoc
+// @Summary EIP-3668 CCIP-read gateway
+// @Schemes
+// @Description Runs the offchain call a contract requested with OffchainLookup. The sender and callData come from the URL, GET /gateway/{sender}/{data}.json, or from a {"sender", "data"} POST body. Returns {"data"} for the callback function.
+// @Tags durin
+// @Accept json
+// @Produce json
+// @Success 200 {string} data
+// @Router /gateway/{sender}/{data}.json [get]
+func (s *DurinService) Gateway(c *gin.Context) {
+	req := GatewayRequest{
+		Sender: c.Param("sender"),
+		Data:   strings.TrimSuffix(c.Param("data"), ".json"),
+	}
+	if c.Request.Method == "POST" && c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			gatewayError(c, invalidParams("invalid request body"))
+			return
+		}
+	}
+	if !common.IsHexAddress(req.Sender) {
+		gatewayError(c, invalidParams("invalid sender %s", req.Sender))
+		return
+	}
+	data, err := hexutil.Decode(req.Data)
+	if err != nil {
+		gatewayError(c, invalidParams("invalid calldata %v", err))
+		return
+	}
+	res, err := s.Dispatch(c.Request.Context(), common.HexToAddress(req.Sender), data)
+	if err != nil {
+		gatewayError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"data": hexutil.Encode(res),
+	})
+}
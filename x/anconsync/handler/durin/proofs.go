@@ -0,0 +1,395 @@
+package durin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+const (
+	ProofOutstanding = "outstanding"
+	ProofConsumed    = "consumed"
+	ProofExpired     = "expired"
+
+	DefaultProofTTL = time.Hour
+)
+
+// ProofAcceptedEvent is emitted by TrustedOffchainHelper when a proof is used
+func ProofAcceptedEvent() abi.Event {
+	return abi.NewEvent("ProofAccepted", "ProofAccepted", false, arguments("address sender", "bytes32 digest"))
+}
+
+// ProofRecord is an issued proof. Records are immutable, consuming a proof stores a new
+// record linking the previous one.
+type ProofRecord struct {
+	Digest            common.Hash
+	PrimaryType       string
+	ChainID           int64
+	VerifyingContract common.Address
+	// NonceKey scopes the nonce, the token id or the owner for mints
+	NonceKey        string
+	Nonce           uint64
+	Deadline        uint64
+	Message         map[string]interface{}
+	Signature       []byte
+	Status          string
+	TransactionHash common.Hash
+	Previous        datamodel.Link
+	Link            datamodel.Link
+}
+
+func (r *ProofRecord) nonce() *big.Int {
+	return new(big.Int).SetUint64(r.Nonce)
+}
+
+func (r *ProofRecord) deadline() *big.Int {
+	return new(big.Int).SetUint64(r.Deadline)
+}
+
+func (r *ProofRecord) node() datamodel.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 13, func(na fluent.MapAssembler) {
+		na.AssembleEntry("digest").AssignString(r.Digest.Hex())
+		na.AssembleEntry("primaryType").AssignString(r.PrimaryType)
+		na.AssembleEntry("chainId").AssignInt(r.ChainID)
+		na.AssembleEntry("verifyingContract").AssignString(r.VerifyingContract.Hex())
+		na.AssembleEntry("nonceKey").AssignString(r.NonceKey)
+		na.AssembleEntry("nonce").AssignInt(int64(r.Nonce))
+		na.AssembleEntry("deadline").AssignInt(int64(r.Deadline))
+		js, _ := json.Marshal(r.Message)
+		message, _ := anconsync.Decode(basicnode.Prototype.Any, string(js))
+		na.AssembleEntry("message").AssignNode(message)
+		na.AssembleEntry("signature").AssignString(hexutil.Encode(r.Signature))
+		na.AssembleEntry("status").AssignString(r.Status)
+		if r.TransactionHash != (common.Hash{}) {
+			na.AssembleEntry("transactionHash").AssignString(r.TransactionHash.Hex())
+		} else {
+			na.AssembleEntry("transactionHash").AssignNull()
+		}
+		if r.Previous != nil {
+			na.AssembleEntry("previous").AssignLink(r.Previous)
+		} else {
+			na.AssembleEntry("previous").AssignNull()
+		}
+	})
+}
+
+func proofRecordFromNode(n datamodel.Node, lnk datamodel.Link) (*ProofRecord, error) {
+	js, err := anconsync.Encode(n)
+	if err != nil {
+		return nil, err
+	}
+	var v struct {
+		Digest            common.Hash            `json:"digest"`
+		PrimaryType       string                 `json:"primaryType"`
+		ChainID           int64                  `json:"chainId"`
+		VerifyingContract common.Address         `json:"verifyingContract"`
+		NonceKey          string                 `json:"nonceKey"`
+		Nonce             uint64                 `json:"nonce"`
+		Deadline          uint64                 `json:"deadline"`
+		Message           map[string]interface{} `json:"message"`
+		Signature         hexutil.Bytes          `json:"signature"`
+		Status            string                 `json:"status"`
+		TransactionHash   *common.Hash           `json:"transactionHash"`
+	}
+	if err := json.Unmarshal([]byte(js), &v); err != nil {
+		return nil, err
+	}
+	r := &ProofRecord{
+		Digest:            v.Digest,
+		PrimaryType:       v.PrimaryType,
+		ChainID:           v.ChainID,
+		VerifyingContract: v.VerifyingContract,
+		NonceKey:          v.NonceKey,
+		Nonce:             v.Nonce,
+		Deadline:          v.Deadline,
+		Message:           v.Message,
+		Signature:         v.Signature,
+		Status:            v.Status,
+		Link:              lnk,
+	}
+	if v.TransactionHash != nil {
+		r.TransactionHash = *v.TransactionHash
+	}
+	previous, err := n.LookupByString("previous")
+	if err == nil && !previous.IsNull() {
+		r.Previous, _ = previous.AsLink()
+	}
+	return r, nil
+}
+
+func proofKey(digest common.Hash) string {
+	return strings.Join([]string{"durin", "proof", strings.ToLower(digest.Hex())}, ":")
+}
+
+func nonceKey(chainID int64, contract common.Address, key string) string {
+	return strings.Join([]string{"durin", "nonce", fmt.Sprint(chainID), strings.ToLower(contract.Hex()), key}, ":")
+}
+
+func proofsKey(chainID int64, contract common.Address) string {
+	return strings.Join([]string{"durin", "proofs", fmt.Sprint(chainID), strings.ToLower(contract.Hex())}, ":")
+}
+
+func (s *DurinService) loadLink(ctx context.Context, key string) (datamodel.Link, error) {
+	value, err := s.Store.DataStore.Get(ctx, key)
+	if err != nil || len(value) == 0 {
+		return nil, nil
+	}
+	return anconsync.ParseCidLink(string(value))
+}
+
+func (s *DurinService) loadRecord(ctx context.Context, key string) (*ProofRecord, error) {
+	lnk, err := s.loadLink(ctx, key)
+	if err != nil || lnk == nil {
+		return nil, err
+	}
+	n, err := s.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, err
+	}
+	return proofRecordFromNode(n, lnk)
+}
+
+// LoadProof returns the latest record of a proof, nil when the node did not issue it
+func (s *DurinService) LoadProof(ctx context.Context, digest common.Hash) (*ProofRecord, error) {
+	return s.loadRecord(ctx, proofKey(digest))
+}
+
+// Nonce returns the next nonce of a contract nonce scope, the nonce of the last consumed
+// proof plus one
+func (s *DurinService) Nonce(ctx context.Context, contract common.Address, key string) (uint64, error) {
+	last, err := s.loadRecord(ctx, nonceKey(s.ChainID, contract, key))
+	if err != nil || last == nil {
+		return 0, err
+	}
+	return last.Nonce + 1, nil
+}
+
+// Domain returns the EIP-712 domain of a verifying contract
+func (s *DurinService) Domain(contract common.Address) Domain {
+	return Domain{
+		Name:              s.DomainName,
+		Version:           s.DomainVersion,
+		ChainID:           s.ChainID,
+		VerifyingContract: contract,
+	}
+}
+
+func (s *DurinService) storeRecord(ctx context.Context, r *ProofRecord) error {
+	r.Link = s.Store.Store(ipld.LinkContext{}, r.node())
+	return s.Store.DataStore.Put(ctx, proofKey(r.Digest), []byte(r.Link.String()))
+}
+
+// IssueProof signs an EIP-712 proof for contract with the next nonce of key and the
+// service expiry, values are the type fields before nonce and deadline. It records the
+// proof as outstanding.
+func (s *DurinService) IssueProof(ctx context.Context, contract common.Address, t ProofType, key string, values ...interface{}) (*ProofRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	nonce, err := s.Nonce(ctx, contract, key)
+	if err != nil {
+		return nil, err
+	}
+	deadline := uint64(time.Now().Add(s.ProofTTL).Unix())
+	values = append(values, nonce, deadline)
+	digest, err := s.Domain(contract).Digest(t, values...)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := SignDigest(s.Adapter.PrivateKey, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	message := map[string]interface{}{}
+	for i, name := range t.FieldNames() {
+		message[name] = values[i]
+	}
+	message["verifyingContract"] = contract.Hex()
+	r := &ProofRecord{
+		Digest:            digest,
+		PrimaryType:       t.Name,
+		ChainID:           s.ChainID,
+		VerifyingContract: contract,
+		NonceKey:          key,
+		Nonce:             nonce,
+		Deadline:          deadline,
+		Message:           message,
+		Signature:         signature,
+		Status:            ProofOutstanding,
+	}
+	if err := s.storeRecord(ctx, r); err != nil {
+		return nil, err
+	}
+
+	// add the proof to the contract index
+	digests, err := s.proofDigests(ctx, contract)
+	if err != nil {
+		return nil, err
+	}
+	digests = append(digests, digest.Hex())
+	index := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("proofs").CreateList(int64(len(digests)), func(la fluent.ListAssembler) {
+			for _, d := range digests {
+				la.AssembleValue().AssignString(d)
+			}
+		})
+	})
+	lnk := s.Store.Store(ipld.LinkContext{}, index)
+	if err := s.Store.DataStore.Put(ctx, proofsKey(s.ChainID, contract), []byte(lnk.String())); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *DurinService) proofDigests(ctx context.Context, contract common.Address) ([]string, error) {
+	lnk, err := s.loadLink(ctx, proofsKey(s.ChainID, contract))
+	if err != nil || lnk == nil {
+		return []string{}, err
+	}
+	n, err := s.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, err
+	}
+	list, err := n.LookupByString("proofs")
+	if err != nil {
+		return nil, err
+	}
+	digests := []string{}
+	it := list.ListIterator()
+	for it != nil && !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		d, _ := v.AsString()
+		digests = append(digests, d)
+	}
+	return digests, nil
+}
+
+// ConsumeProof marks a proof as consumed by a transaction and advances the nonce of its
+// scope. Proofs the node did not issue are ignored.
+func (s *DurinService) ConsumeProof(ctx context.Context, digest common.Hash, txHash common.Hash) (*ProofRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, err := s.LoadProof(ctx, digest)
+	if err != nil || r == nil || r.Status == ProofConsumed {
+		return r, err
+	}
+	consumed := *r
+	consumed.Status = ProofConsumed
+	consumed.TransactionHash = txHash
+	consumed.Previous = r.Link
+	if err := s.storeRecord(ctx, &consumed); err != nil {
+		return nil, err
+	}
+	key := nonceKey(consumed.ChainID, consumed.VerifyingContract, consumed.NonceKey)
+	last, err := s.loadRecord(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if last == nil || consumed.Nonce >= last.Nonce {
+		if err := s.Store.DataStore.Put(ctx, key, []byte(consumed.Link.String())); err != nil {
+			return nil, err
+		}
+	}
+	return &consumed, nil
+}
+
+// ProofAccepted consumes the proof of a ProofAccepted log, it is fed by the EVM indexer.
+// Logs of a contract other than the proof verifying contract are ignored. The result of
+// a metadata transfer or update is indexed as the token metadata once its proof is used
+// on-chain.
+func (s *DurinService) ProofAccepted(ctx context.Context, log types.Log) error {
+	values, err := ProofAcceptedEvent().Inputs.Unpack(log.Data)
+	if err != nil {
+		return err
+	}
+	digest := common.Hash(values[1].([32]byte))
+	r, err := s.LoadProof(ctx, digest)
+	if err != nil || r == nil || r.VerifyingContract != log.Address || r.Status == ProofConsumed {
+		return err
+	}
+	if _, err := s.ConsumeProof(ctx, digest, log.TxHash); err != nil {
+		return err
+	}
+	if s.AnconSyncContext.Index == nil || (r.PrimaryType != TransferURIType.Name && r.PrimaryType != UpdateURIType.Name) {
+		return nil
+	}
+	tokenId, _ := r.Message["tokenId"].(string)
+	resultCid, _ := r.Message["resultCid"].(string)
+	lnk, err := anconsync.ParseCidLink(resultCid)
+	if err != nil {
+		return err
+	}
+	return s.AnconSyncContext.IndexKey(ctx, handler.TokenIndexKey(tokenId), lnk)
+}
+
+// @BasePath /v0
+// ProofsRead godoc
+// @Summary Lists the offchain proofs issued for a contract
+// @Schemes
+// @Description Returns the EIP-712 proofs issued for a verifying contract grouped as outstanding, consumed (seen in a ProofAccepted event) and expired
+// @Tags durin
+// @Produce json
+// @Success 200 {object} []string
+// @Router /v0/durin/proofs/{contract} [get]
+func (s *DurinService) ProofsRead(c *gin.Context) {
+	contract := c.Param("contract")
+	if !common.IsHexAddress(contract) {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid contract address %s", contract).Error(),
+		})
+		return
+	}
+	ctx := c.Request.Context()
+	digests, err := s.proofDigests(ctx, common.HexToAddress(contract))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	res := map[string][]json.RawMessage{
+		ProofOutstanding: {},
+		ProofConsumed:    {},
+		ProofExpired:     {},
+	}
+	now := uint64(time.Now().Unix())
+	for _, d := range digests {
+		lnk, err := s.loadLink(ctx, proofKey(common.HexToHash(d)))
+		if err != nil || lnk == nil {
+			continue
+		}
+		n, err := s.Store.Load(ipld.LinkContext{}, lnk)
+		if err != nil {
+			continue
+		}
+		r, err := proofRecordFromNode(n, lnk)
+		if err != nil {
+			continue
+		}
+		status := r.Status
+		if status == ProofOutstanding && r.Deadline < now {
+			status = ProofExpired
+		}
+		js, _ := anconsync.Encode(n)
+		res[status] = append(res[status], json.RawMessage(js))
+	}
+	c.JSON(200, res)
+}
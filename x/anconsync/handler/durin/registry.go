@@ -0,0 +1,226 @@
+package durin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// HandlerFunc runs an offchain call, sender is the contract that raised OffchainLookup
+// and args the call arguments keyed by ABI input name. It returns the values the
+// response encoder packs.
+type HandlerFunc func(ctx context.Context, s *DurinService, sender common.Address, args map[string]interface{}) ([]interface{}, error)
+
+// Handler is an offchain DAG contract. Calldata is routed by the selector of Method and
+// JSON-RPC calls by Name. The method inputs are the request schema and its outputs
+// encode the response unless Encode is set.
+type Handler struct {
+	Name   string
+	Method abi.Method
+	Handle HandlerFunc
+	Encode func(values []interface{}) ([]byte, error)
+}
+
+func (h *Handler) encode(values []interface{}) ([]byte, error) {
+	if h.Encode != nil {
+		return h.Encode(values)
+	}
+	return h.Method.Outputs.Pack(values...)
+}
+
+// ParseArgs converts the JSON object of a named call into the Go values of the method
+// inputs, the same values a decoded calldata yields
+func (h *Handler) ParseArgs(raw json.RawMessage) (map[string]interface{}, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, invalidParams("%s arguments must be an object", h.Name)
+	}
+	args := map[string]interface{}{}
+	for _, input := range h.Method.Inputs {
+		value, ok := fields[input.Name]
+		if !ok {
+			return nil, invalidParams("missing %s argument %s", h.Name, input.Name)
+		}
+		v, err := jsonValue(input.Type, value)
+		if err != nil {
+			return nil, invalidParams("invalid %s argument %s: %v", h.Name, input.Name, err)
+		}
+		args[input.Name] = v
+	}
+	return args, nil
+}
+
+// jsonValue converts a JSON value into the Go type the ABI packs for t
+func jsonValue(t abi.Type, raw json.RawMessage) (interface{}, error) {
+	switch t.T {
+	case abi.StringTy:
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case abi.BoolTy:
+		var b bool
+		err := json.Unmarshal(raw, &b)
+		return b, err
+	case abi.AddressTy:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil || !common.IsHexAddress(s) {
+			return nil, fmt.Errorf("not an address")
+		}
+		return common.HexToAddress(s), nil
+	case abi.BytesTy:
+		var b hexutil.Bytes
+		err := json.Unmarshal(raw, &b)
+		return []byte(b), err
+	case abi.IntTy, abi.UintTy:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			s = string(raw)
+		}
+		n, ok := new(big.Int).SetString(s, 0)
+		if !ok {
+			return nil, fmt.Errorf("not a number")
+		}
+		if t.GetType() == reflect.TypeOf(n) {
+			return n, nil
+		}
+		if t.T == abi.UintTy {
+			return reflect.ValueOf(n.Uint64()).Convert(t.GetType()).Interface(), nil
+		}
+		return reflect.ValueOf(n.Int64()).Convert(t.GetType()).Interface(), nil
+	case abi.SliceTy, abi.ArrayTy:
+		var elems []json.RawMessage
+		if err := json.Unmarshal(raw, &elems); err != nil {
+			return nil, err
+		}
+		var v reflect.Value
+		if t.T == abi.SliceTy {
+			v = reflect.MakeSlice(t.GetType(), len(elems), len(elems))
+		} else if len(elems) != t.Size {
+			return nil, fmt.Errorf("expected %d elements", t.Size)
+		} else {
+			v = reflect.New(t.GetType()).Elem()
+		}
+		for i, elem := range elems {
+			e, err := jsonValue(*t.Elem, elem)
+			if err != nil {
+				return nil, err
+			}
+			v.Index(i).Set(reflect.ValueOf(e))
+		}
+		return v.Interface(), nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+}
+
+// Registry routes offchain calls to handlers
+type Registry struct {
+	lock      sync.RWMutex
+	selectors map[[4]byte]*Handler
+	names     map[string]*Handler
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		selectors: map[[4]byte]*Handler{},
+		names:     map[string]*Handler{},
+	}
+}
+
+// Register adds a handler, the name defaults to the method name
+func (r *Registry) Register(h *Handler) error {
+	if h.Handle == nil {
+		return fmt.Errorf("handler %s has no Handle function", h.Method.Name)
+	}
+	if h.Name == "" {
+		h.Name = h.Method.Name
+	}
+	var selector [4]byte
+	copy(selector[:], h.Method.ID)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.selectors[selector]; ok {
+		return fmt.Errorf("selector %s already registered", hexutil.Encode(selector[:]))
+	}
+	if _, ok := r.names[h.Name]; ok {
+		return fmt.Errorf("handler %s already registered", h.Name)
+	}
+	r.selectors[selector] = h
+	r.names[h.Name] = h
+	return nil
+}
+
+// Lookup returns the handler of a function selector
+func (r *Registry) Lookup(selector []byte) *Handler {
+	var key [4]byte
+	copy(key[:], selector)
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.selectors[key]
+}
+
+// LookupName returns the handler registered as name
+func (r *Registry) LookupName(name string) *Handler {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.names[name]
+}
+
+// Handlers returns the registered handler names and selectors
+func (r *Registry) Handlers() map[string]string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	res := map[string]string{}
+	for name, h := range r.names {
+		res[name] = hexutil.Encode(h.Method.ID)
+	}
+	return res
+}
+
+// Decode returns the handler of calldata and its arguments keyed by input name
+func (r *Registry) Decode(data []byte) (*Handler, map[string]interface{}, error) {
+	if len(data) < 4 {
+		return nil, nil, invalidParams("calldata too short")
+	}
+	h := r.Lookup(data[:4])
+	if h == nil {
+		return nil, nil, &Error{Code: ErrCodeMethodNotFound, Message: fmt.Sprintf("unknown selector %s", hexutil.Encode(data[:4]))}
+	}
+	args := map[string]interface{}{}
+	if err := h.Method.Inputs.UnpackIntoMap(args, data[4:]); err != nil {
+		return nil, nil, invalidParams("invalid %s arguments: %v", h.Name, err)
+	}
+	return h, args, nil
+}
+
+// arguments builds ABI arguments from "type name" pairs
+func arguments(fields ...string) abi.Arguments {
+	args := abi.Arguments{}
+	for _, field := range fields {
+		parts := strings.SplitN(field, " ", 2)
+		t, err := abi.NewType(parts[0], "", nil)
+		if err != nil {
+			panic(err)
+		}
+		arg := abi.Argument{Type: t}
+		if len(parts) > 1 {
+			arg.Name = parts[1]
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+// NewMethod builds the ABI method of a handler
+func NewMethod(name string, inputs abi.Arguments, outputs abi.Arguments) abi.Method {
+	return abi.NewMethod(name, name, abi.Function, "view", false, false, inputs, outputs)
+}
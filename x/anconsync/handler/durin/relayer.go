@@ -0,0 +1,651 @@
+package durin
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+const (
+	RelayPending  = "pending"
+	RelayMined    = "mined"
+	RelayReverted = "reverted"
+
+	DefaultGasBump           = 20
+	DefaultStuckAfter        = 2 * time.Minute
+	DefaultRelayPollInterval = 15 * time.Second
+	DefaultRelayQuota        = 60
+	DefaultRelayQuotaWindow  = time.Hour
+)
+
+// RelayBackend is the subset of an Ethereum client the relayer needs, ethclient.Client
+// implements it
+type RelayBackend interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// Relay is a transaction submitted by the relayer. Records are immutable, every
+// resubmission and the outcome store a new record linking the previous one.
+type Relay struct {
+	ID       string
+	From     common.Address
+	To       common.Address
+	Data     []byte
+	Nonce    uint64
+	GasLimit uint64
+	GasPrice *big.Int
+	// Transactions lists the hashes of every submission, replacements bump the gas price
+	Transactions    []common.Hash
+	Status          string
+	TransactionHash common.Hash
+	BlockNumber     uint64
+	BlockHash       common.Hash
+	GasUsed         uint64
+	SubmittedAt     int64
+	// Source is the DAG block the transaction originates from
+	Source   datamodel.Link
+	Previous datamodel.Link
+	Link     datamodel.Link
+}
+
+func (r *Relay) node() datamodel.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 16, func(na fluent.MapAssembler) {
+		na.AssembleEntry("id").AssignString(r.ID)
+		na.AssembleEntry("from").AssignString(r.From.Hex())
+		na.AssembleEntry("to").AssignString(r.To.Hex())
+		na.AssembleEntry("data").AssignString(hexutil.Encode(r.Data))
+		na.AssembleEntry("nonce").AssignInt(int64(r.Nonce))
+		na.AssembleEntry("gasLimit").AssignInt(int64(r.GasLimit))
+		na.AssembleEntry("gasPrice").AssignString(r.GasPrice.String())
+		na.AssembleEntry("transactions").CreateList(int64(len(r.Transactions)), func(la fluent.ListAssembler) {
+			for _, h := range r.Transactions {
+				la.AssembleValue().AssignString(h.Hex())
+			}
+		})
+		na.AssembleEntry("status").AssignString(r.Status)
+		if r.Status == RelayPending {
+			na.AssembleEntry("transactionHash").AssignNull()
+			na.AssembleEntry("blockNumber").AssignNull()
+			na.AssembleEntry("blockHash").AssignNull()
+			na.AssembleEntry("gasUsed").AssignNull()
+		} else {
+			na.AssembleEntry("transactionHash").AssignString(r.TransactionHash.Hex())
+			na.AssembleEntry("blockNumber").AssignInt(int64(r.BlockNumber))
+			na.AssembleEntry("blockHash").AssignString(r.BlockHash.Hex())
+			na.AssembleEntry("gasUsed").AssignInt(int64(r.GasUsed))
+		}
+		na.AssembleEntry("submittedAt").AssignInt(r.SubmittedAt)
+		if r.Source != nil {
+			na.AssembleEntry("source").AssignLink(r.Source)
+		} else {
+			na.AssembleEntry("source").AssignNull()
+		}
+		if r.Previous != nil {
+			na.AssembleEntry("previous").AssignLink(r.Previous)
+		} else {
+			na.AssembleEntry("previous").AssignNull()
+		}
+	})
+}
+
+func relayFromNode(n datamodel.Node, lnk datamodel.Link) (*Relay, error) {
+	js, err := anconsync.Encode(n)
+	if err != nil {
+		return nil, err
+	}
+	var v struct {
+		ID           string         `json:"id"`
+		From         common.Address `json:"from"`
+		To           common.Address `json:"to"`
+		Data         hexutil.Bytes  `json:"data"`
+		Nonce        uint64         `json:"nonce"`
+		GasLimit     uint64         `json:"gasLimit"`
+		GasPrice     string         `json:"gasPrice"`
+		Transactions []common.Hash  `json:"transactions"`
+		Status       string         `json:"status"`
+		SubmittedAt  int64          `json:"submittedAt"`
+	}
+	if err := json.Unmarshal([]byte(js), &v); err != nil {
+		return nil, err
+	}
+	gasPrice, ok := new(big.Int).SetString(v.GasPrice, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid gas price %s", v.GasPrice)
+	}
+	relay := &Relay{
+		ID:           v.ID,
+		From:         v.From,
+		To:           v.To,
+		Data:         v.Data,
+		Nonce:        v.Nonce,
+		GasLimit:     v.GasLimit,
+		GasPrice:     gasPrice,
+		Transactions: v.Transactions,
+		Status:       v.Status,
+		SubmittedAt:  v.SubmittedAt,
+		Link:         lnk,
+	}
+	source, err := n.LookupByString("source")
+	if err == nil && !source.IsNull() {
+		relay.Source, _ = source.AsLink()
+	}
+	return relay, nil
+}
+
+func relayKey(id string) string {
+	return strings.Join([]string{"relay", id}, ":")
+}
+
+// relayPendingKey lists the ids of the pending relays, reloaded at Start
+func relayPendingKey() string {
+	return strings.Join([]string{"relay", "pending"}, ":")
+}
+
+func isNonceTooLow(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "nonce too low")
+}
+
+// Relayer submits transactions signed by the adapter key, it manages the key nonce,
+// replaces stuck transactions with a higher gas price and records the outcome
+type Relayer struct {
+	Client  RelayBackend
+	Store   anconsync.Storage
+	Key     *ecdsa.PrivateKey
+	ChainID *big.Int
+	// GasBump is the gas price increase of a replacement in percent
+	GasBump int64
+	// MaxGasPrice caps replacements, no cap when nil
+	MaxGasPrice  *big.Int
+	StuckAfter   time.Duration
+	PollInterval time.Duration
+	// Targets lists the contracts and function selectors clients may relay to, e.g. the
+	// CCIP-read callbacks. Submit itself is not restricted.
+	Targets map[common.Address][][]byte
+	// Quota is the number of relays a caller may request per QuotaWindow, no quota when 0
+	Quota       int64
+	QuotaWindow time.Duration
+
+	// lock guards the targets, quotas and pending relays, it is not held across client
+	// calls
+	lock    sync.Mutex
+	pending map[string]*Relay
+	quotas  map[string]*relayQuota
+	// sendLock orders the nonce allocation and first submission of relays
+	sendLock sync.Mutex
+	nonce    uint64
+	// checkLock runs one Check at a time
+	checkLock sync.Mutex
+}
+
+type relayQuota struct {
+	start time.Time
+	count int64
+}
+
+func NewRelayer(client RelayBackend, s anconsync.Storage, key *ecdsa.PrivateKey, chainID *big.Int) *Relayer {
+	return &Relayer{
+		Client:       client,
+		Store:        s,
+		Key:          key,
+		ChainID:      chainID,
+		GasBump:      DefaultGasBump,
+		StuckAfter:   DefaultStuckAfter,
+		PollInterval: DefaultRelayPollInterval,
+		Targets:      map[common.Address][][]byte{},
+		Quota:        DefaultRelayQuota,
+		QuotaWindow:  DefaultRelayQuotaWindow,
+		pending:      map[string]*Relay{},
+		quotas:       map[string]*relayQuota{},
+	}
+}
+
+// AllowTarget lets clients relay calls of selector to contract
+func (r *Relayer) AllowTarget(contract common.Address, selector []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Targets[contract] = append(r.Targets[contract], common.CopyBytes(selector))
+}
+
+// Authorize checks that a client relay of data to contract is allowed and counts it in
+// the quota of caller
+func (r *Relayer) Authorize(caller string, to common.Address, data []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	allowed := false
+	for _, selector := range r.Targets[to] {
+		if len(data) >= 4 && bytes.Equal(data[:4], selector) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return &Error{Code: ErrCodeRejected, Message: fmt.Sprintf("relaying this call to %s is not allowed", to.Hex())}
+	}
+	if r.Quota <= 0 {
+		return nil
+	}
+	now := time.Now()
+	q, ok := r.quotas[caller]
+	if !ok || now.Sub(q.start) >= r.QuotaWindow {
+		q = &relayQuota{start: now}
+		r.quotas[caller] = q
+	}
+	if q.count >= r.Quota {
+		return &Error{Code: ErrCodeLimitExceeded, Message: fmt.Sprintf("relay quota of %s exceeded", caller)}
+	}
+	q.count++
+	return nil
+}
+
+// From returns the relayer address
+func (r *Relayer) From() common.Address {
+	return crypto.PubkeyToAddress(r.Key.PublicKey)
+}
+
+// nextNonce returns the next nonce of the key, the local counter unless the node pending
+// nonce is ahead of it because of transactions sent elsewhere
+func (r *Relayer) nextNonce(ctx context.Context) (uint64, error) {
+	pending, err := r.Client.PendingNonceAt(ctx, r.From())
+	if err != nil {
+		return 0, err
+	}
+	if pending > r.nonce {
+		r.nonce = pending
+	}
+	return r.nonce, nil
+}
+
+func (r *Relayer) send(ctx context.Context, relay *Relay, gasPrice *big.Int) error {
+	tx, err := types.SignTx(types.NewTransaction(relay.Nonce, relay.To, common.Big0, relay.GasLimit, gasPrice, relay.Data),
+		types.LatestSignerForChainID(r.ChainID), r.Key)
+	if err != nil {
+		return err
+	}
+	if err := r.Client.SendTransaction(ctx, tx); err != nil {
+		return err
+	}
+	relay.GasPrice = gasPrice
+	relay.Transactions = append(relay.Transactions, tx.Hash())
+	relay.SubmittedAt = time.Now().Unix()
+	return nil
+}
+
+func (r *Relayer) store(ctx context.Context, relay *Relay) error {
+	relay.Previous = relay.Link
+	relay.Link = r.Store.Store(ipld.LinkContext{}, relay.node())
+	return r.Store.DataStore.Put(ctx, relayKey(relay.ID), []byte(relay.Link.String()))
+}
+
+// storePending records the ids of the pending relays
+func (r *Relayer) storePending(ctx context.Context) error {
+	ids := []string{}
+	for id := range r.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("relays").CreateList(int64(len(ids)), func(la fluent.ListAssembler) {
+			for _, id := range ids {
+				la.AssembleValue().AssignString(id)
+			}
+		})
+	})
+	lnk := r.Store.Store(ipld.LinkContext{}, n)
+	return r.Store.DataStore.Put(ctx, relayPendingKey(), []byte(lnk.String()))
+}
+
+// Reload restores the relays that were pending when the node stopped, so they are
+// checked again. Relays that can not be loaded are skipped.
+func (r *Relayer) Reload(ctx context.Context) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	value, err := r.Store.DataStore.Get(ctx, relayPendingKey())
+	if err != nil || len(value) == 0 {
+		return nil
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return err
+	}
+	n, err := r.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return err
+	}
+	list, err := n.LookupByString("relays")
+	if err != nil {
+		return err
+	}
+	it := list.ListIterator()
+	for it != nil && !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return err
+		}
+		id, _ := v.AsString()
+		n, lnk, err := r.Load(ctx, id)
+		if err != nil {
+			fmt.Printf("relay: skipping pending relay %s %v\n", id, err)
+			continue
+		}
+		relay, err := relayFromNode(n, lnk)
+		if err != nil {
+			fmt.Printf("relay: skipping pending relay %s %v\n", id, err)
+			continue
+		}
+		if relay.Status == RelayPending {
+			r.pending[id] = relay
+		}
+	}
+	return nil
+}
+
+// Submit signs and sends a call to contract to, source is the DAG block the call
+// originates from. The call is estimated first so reverting calls are not relayed.
+func (r *Relayer) Submit(ctx context.Context, to common.Address, data []byte, source datamodel.Link) (*Relay, error) {
+	gas, err := r.Client.EstimateGas(ctx, ethereum.CallMsg{From: r.From(), To: &to, Data: data})
+	if err != nil {
+		return nil, fmt.Errorf("gas estimation failed: %v", err)
+	}
+	gasPrice, err := r.Client.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	relay := &Relay{
+		ID:       hex.EncodeToString(id),
+		From:     r.From(),
+		To:       to,
+		Data:     data,
+		GasLimit: gas,
+		Status:   RelayPending,
+		Source:   source,
+	}
+	if err := r.submit(ctx, relay, gasPrice); err != nil {
+		return nil, err
+	}
+	if err := r.store(ctx, relay); err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pending[relay.ID] = relay
+	if err := r.storePending(ctx); err != nil {
+		return nil, err
+	}
+	return relay, nil
+}
+
+// submit assigns the next nonce to relay and sends it, submissions are serialized so
+// nonces are used in order
+func (r *Relayer) submit(ctx context.Context, relay *Relay, gasPrice *big.Int) error {
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+
+	nonce, err := r.nextNonce(ctx)
+	if err != nil {
+		return err
+	}
+	relay.Nonce = nonce
+	err = r.send(ctx, relay, gasPrice)
+	if isNonceTooLow(err) {
+		// the local counter is behind, resync with the node once
+		r.nonce = 0
+		if relay.Nonce, err = r.nextNonce(ctx); err == nil {
+			err = r.send(ctx, relay, gasPrice)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	r.nonce = relay.Nonce + 1
+	return nil
+}
+
+// receipt looks up the receipt of every submission of relay
+func (r *Relayer) receipt(ctx context.Context, relay *Relay) *types.Receipt {
+	for i := len(relay.Transactions) - 1; i >= 0; i-- {
+		receipt, err := r.Client.TransactionReceipt(ctx, relay.Transactions[i])
+		if err == nil && receipt != nil {
+			return receipt
+		}
+	}
+	return nil
+}
+
+// bump resends a stuck relay with the gas price raised by GasBump, or to the suggested
+// price when it is higher
+func (r *Relayer) bump(ctx context.Context, relay *Relay) error {
+	gasPrice := new(big.Int).Mul(relay.GasPrice, big.NewInt(100+r.GasBump))
+	gasPrice.Div(gasPrice, big.NewInt(100))
+	if suggested, err := r.Client.SuggestGasPrice(ctx); err == nil && suggested.Cmp(gasPrice) > 0 {
+		gasPrice = suggested
+	}
+	if r.MaxGasPrice != nil && gasPrice.Cmp(r.MaxGasPrice) > 0 {
+		return fmt.Errorf("gas price %s above the maximum", gasPrice)
+	}
+	if err := r.send(ctx, relay, gasPrice); err != nil {
+		return err
+	}
+	return r.store(ctx, relay)
+}
+
+// Check records the receipts of pending relays and replaces the ones pending for longer
+// than StuckAfter
+func (r *Relayer) Check(ctx context.Context) error {
+	r.checkLock.Lock()
+	defer r.checkLock.Unlock()
+
+	r.lock.Lock()
+	relays := []*Relay{}
+	for _, relay := range r.pending {
+		relays = append(relays, relay)
+	}
+	r.lock.Unlock()
+
+	for _, relay := range relays {
+		id := relay.ID
+		if receipt := r.receipt(ctx, relay); receipt != nil {
+			relay.Status = RelayMined
+			if receipt.Status == types.ReceiptStatusFailed {
+				relay.Status = RelayReverted
+			}
+			relay.TransactionHash = receipt.TxHash
+			relay.BlockNumber = receipt.BlockNumber.Uint64()
+			relay.BlockHash = receipt.BlockHash
+			relay.GasUsed = receipt.GasUsed
+			if err := r.store(ctx, relay); err != nil {
+				return err
+			}
+			r.lock.Lock()
+			delete(r.pending, id)
+			err := r.storePending(ctx)
+			r.lock.Unlock()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if time.Since(time.Unix(relay.SubmittedAt, 0)) < r.StuckAfter {
+			continue
+		}
+		// nonce too low means a previous submission was mined, the receipt shows up
+		// on the next check
+		if err := r.bump(ctx, relay); err != nil && !isNonceTooLow(err) {
+			fmt.Printf("relay: %s replacement failed %v\n", id, err)
+		}
+	}
+	return nil
+}
+
+// Start reloads the stored pending relays and checks them every PollInterval
+func (r *Relayer) Start(ctx context.Context) {
+	if err := r.Reload(ctx); err != nil {
+		fmt.Printf("relay: reload error %v\n", err)
+	}
+	ticker := time.NewTicker(r.PollInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.Check(ctx); err != nil {
+					fmt.Printf("relay: check error %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// Load returns the latest record of a relay
+func (r *Relayer) Load(ctx context.Context, id string) (datamodel.Node, datamodel.Link, error) {
+	value, err := r.Store.DataStore.Get(ctx, relayKey(id))
+	if err != nil || len(value) == 0 {
+		return nil, nil, fmt.Errorf("relay %s not found", id)
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := r.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return n, lnk, nil
+}
+
+// Relay submits a call of caller through the relayer, cid is the originating DAG block
+// and may be empty. The call must target an allowed contract and selector and is counted
+// in the caller quota. It returns the relay id.
+func (s *DurinService) Relay(caller string, to string, data hexutil.Bytes, cid string) (string, error) {
+	if s.Relayer == nil {
+		return "", &Error{Code: ErrCodeMethodNotFound, Message: "relayer is not enabled"}
+	}
+	if !common.IsHexAddress(to) {
+		return "", invalidParams("invalid address %s", to)
+	}
+	var source datamodel.Link
+	if cid != "" {
+		lnk, err := anconsync.ParseCidLink(cid)
+		if err != nil {
+			return "", invalidParams("invalid cid %s", cid)
+		}
+		source = lnk
+	}
+	if err := s.Relayer.Authorize(caller, common.HexToAddress(to), data); err != nil {
+		return "", err
+	}
+	relay, err := s.Relayer.Submit(context.Background(), common.HexToAddress(to), data, source)
+	if err != nil {
+		return "", reverted("%v", err)
+	}
+	return relay.ID, nil
+}
+
+// @BasePath /v0
+// RelayWrite godoc
+// @Summary Relays a call signed by the node adapter key
+// @Schemes
+// @Description Submits a call to a contract with the node paying gas, e.g. a CCIP-read callback with the gateway response. Only the configured contracts and selectors are relayed, within a per-caller quota. cid links the originating DAG block. Returns the relay id.
+// @Tags durin
+// @Accept json
+// @Produce json
+// @Success 201 {string} id
+// @Router /v0/relay [post]
+func (s *DurinService) RelayWrite(c *gin.Context) {
+	var v struct {
+		To   string        `json:"to"`
+		Data hexutil.Bytes `json:"data"`
+		Cid  string        `json:"cid"`
+	}
+	if err := c.ShouldBindJSON(&v); err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid relay request %v", err).Error(),
+		})
+		return
+	}
+	id, err := s.Relay(handler.Caller(c), v.To, v.Data, v.Cid)
+	if err != nil {
+		status := 500
+		var relayErr *Error
+		if errors.As(err, &relayErr) {
+			status = relayErr.Status()
+		}
+		c.JSON(status, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(201, gin.H{
+		"id": id,
+	})
+}
+
+// @BasePath /v0
+// RelayRead godoc
+// @Summary Reads the status of a relayed transaction
+// @Schemes
+// @Description Returns the latest record of a relay: pending, mined or reverted, the submitted transaction hashes and the receipt block
+// @Tags durin
+// @Produce json
+// @Success 200 {object} []string
+// @Router /v0/relay/{id} [get]
+func (s *DurinService) RelayRead(c *gin.Context) {
+	if s.Relayer == nil {
+		c.JSON(404, gin.H{
+			"error": fmt.Errorf("relayer is not enabled").Error(),
+		})
+		return
+	}
+	n, lnk, err := s.Relayer.Load(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	js, err := anconsync.Encode(n)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"cid":   lnk.String(),
+		"relay": json.RawMessage(js),
+	})
+}
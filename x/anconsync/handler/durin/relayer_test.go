@@ -0,0 +1,279 @@
+package durin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// fakeRelayBackend records sent transactions and returns receipts for the mined ones
+type fakeRelayBackend struct {
+	pendingNonce uint64
+	gasPrice     *big.Int
+	estimateErr  error
+	sendErrs     []error
+	sent         []*types.Transaction
+	mined        map[common.Hash]*types.Receipt
+	// hold blocks receipt lookups until it is closed
+	hold chan struct{}
+}
+
+func (b *fakeRelayBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return b.pendingNonce, nil
+}
+
+func (b *fakeRelayBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return b.gasPrice, nil
+}
+
+func (b *fakeRelayBackend) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return 50000, b.estimateErr
+}
+
+func (b *fakeRelayBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if len(b.sendErrs) > 0 {
+		err := b.sendErrs[0]
+		b.sendErrs = b.sendErrs[1:]
+		return err
+	}
+	b.sent = append(b.sent, tx)
+	return nil
+}
+
+func (b *fakeRelayBackend) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	if b.hold != nil {
+		<-b.hold
+	}
+	if r, ok := b.mined[txHash]; ok {
+		return r, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func (b *fakeRelayBackend) mine(tx *types.Transaction, status uint64) {
+	b.mined[tx.Hash()] = &types.Receipt{
+		Status:      status,
+		TxHash:      tx.Hash(),
+		BlockNumber: big.NewInt(7),
+		BlockHash:   common.HexToHash("0x07"),
+		GasUsed:     21000,
+	}
+}
+
+func newTestRelayer(t *testing.T) (*DurinService, *fakeRelayBackend) {
+	s := newTestService(t)
+	backend := &fakeRelayBackend{pendingNonce: 5, gasPrice: big.NewInt(100), mined: map[common.Hash]*types.Receipt{}}
+	s.Relayer = NewRelayer(backend, s.Store, s.Adapter.PrivateKey, big.NewInt(1337))
+	return s, backend
+}
+
+func TestRelayNonces(t *testing.T) {
+	s, backend := newTestRelayer(t)
+	ctx := context.Background()
+	contract := common.HexToAddress("0x00000000000000000000000000000000000000dd")
+
+	first, err := s.Relayer.Submit(ctx, contract, []byte{0x01}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Relayer.Submit(ctx, contract, []byte{0x02}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Nonce != 5 || second.Nonce != 6 {
+		t.Fatalf("unexpected nonces %d %d", first.Nonce, second.Nonce)
+	}
+	signer := types.LatestSignerForChainID(big.NewInt(1337))
+	if from, _ := types.Sender(signer, backend.sent[1]); from != s.Relayer.From() || backend.sent[1].Nonce() != 6 {
+		t.Fatal("relayed transaction is not signed by the adapter key")
+	}
+
+	// the local counter is behind the node
+	backend.pendingNonce = 9
+	backend.sendErrs = []error{errors.New("nonce too low")}
+	third, err := s.Relayer.Submit(ctx, contract, []byte{0x03}, nil)
+	if err != nil || third.Nonce != 9 {
+		t.Fatalf("nonce was not resynced %v", err)
+	}
+
+	backend.estimateErr = errors.New("execution reverted")
+	if _, err := s.Relayer.Submit(ctx, contract, []byte{0x04}, nil); err == nil {
+		t.Fatal("relayed a reverting call")
+	}
+}
+
+func TestRelayGasBump(t *testing.T) {
+	s, backend := newTestRelayer(t)
+	ctx := context.Background()
+	contract := common.HexToAddress("0x00000000000000000000000000000000000000dd")
+	source := s.Store.Store(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("name").AssignString("a")
+	}))
+
+	s.Relayer.AllowTarget(contract, []byte{0x01, 0x02, 0x03, 0x04})
+	id, err := s.Relay("apikey:1", contract.Hex(), []byte{0x01, 0x02, 0x03, 0x04}, source.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Relayer.StuckAfter = 0
+	if err := s.Relayer.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.sent) != 2 || backend.sent[1].Nonce() != backend.sent[0].Nonce() || backend.sent[1].GasPrice().Int64() != 120 {
+		t.Fatalf("stuck transaction was not replaced")
+	}
+
+	backend.mine(backend.sent[1], types.ReceiptStatusSuccessful)
+	if err := s.Relayer.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Relayer.pending) != 0 {
+		t.Fatal("mined relay is still pending")
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/v0/relay/"+id, nil)
+	c.Params = gin.Params{{Key: "id", Value: id}}
+	s.RelayRead(c)
+	var res struct {
+		Relay struct {
+			Status          string            `json:"status"`
+			TransactionHash string            `json:"transactionHash"`
+			Transactions    []string          `json:"transactions"`
+			Source          map[string]string `json:"source"`
+			Previous        map[string]string `json:"previous"`
+		} `json:"relay"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if w.Code != 200 || res.Relay.Status != RelayMined || res.Relay.TransactionHash != backend.sent[1].Hash().Hex() {
+		t.Fatalf("unexpected relay %s", w.Body.String())
+	}
+	if len(res.Relay.Transactions) != 2 || res.Relay.Source["/"] != source.String() || res.Relay.Previous["/"] == "" {
+		t.Fatalf("relay record does not link its history %s", w.Body.String())
+	}
+
+	lnk, _ := anconsync.ParseCidLink(res.Relay.Previous["/"])
+	n, err := s.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ := n.LookupByString("status")
+	if v, _ := status.AsString(); v != RelayPending {
+		t.Fatalf("previous record is %s", v)
+	}
+}
+
+func TestRelayPolicy(t *testing.T) {
+	s, backend := newTestRelayer(t)
+	contract := common.HexToAddress("0x00000000000000000000000000000000000000dd")
+	callback := []byte{0x01, 0x02, 0x03, 0x04}
+	s.Relayer.AllowTarget(contract, callback)
+	s.Relayer.Quota = 1
+
+	other := common.HexToAddress("0x00000000000000000000000000000000000000ee")
+	if _, err := s.Relay("apikey:1", other.Hex(), callback, ""); errorCode(err) != ErrCodeRejected {
+		t.Fatalf("relayed to a contract off the allow-list %v", err)
+	}
+	if _, err := s.Relay("apikey:1", contract.Hex(), []byte{0x05, 0x06, 0x07, 0x08}, ""); errorCode(err) != ErrCodeRejected {
+		t.Fatalf("relayed a selector off the allow-list %v", err)
+	}
+	if _, err := s.Relay("apikey:1", contract.Hex(), callback, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Relay("apikey:1", contract.Hex(), callback, ""); errorCode(err) != ErrCodeLimitExceeded {
+		t.Fatalf("relayed over the caller quota %v", err)
+	}
+	if _, err := s.Relay("apikey:2", contract.Hex(), callback, ""); err != nil {
+		t.Fatalf("quota leaked to another caller %v", err)
+	}
+	if len(backend.sent) != 2 {
+		t.Fatalf("unexpected relayed transactions %d", len(backend.sent))
+	}
+}
+
+func TestRelayReload(t *testing.T) {
+	s, backend := newTestRelayer(t)
+	ctx := context.Background()
+	contract := common.HexToAddress("0x00000000000000000000000000000000000000dd")
+	if _, err := s.Relayer.Submit(ctx, contract, []byte{0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Relayer.Submit(ctx, contract, []byte{0x02}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.mine(backend.sent[0], types.ReceiptStatusSuccessful)
+	if err := s.Relayer.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a pending id without a record does not stop the reload
+	s.Relayer.lock.Lock()
+	s.Relayer.pending["missing"] = &Relay{ID: "missing"}
+	s.Relayer.storePending(ctx)
+	s.Relayer.lock.Unlock()
+
+	// a restarted relayer picks up the relay still pending
+	restarted := NewRelayer(backend, s.Store, s.Adapter.PrivateKey, big.NewInt(1337))
+	if err := restarted.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.pending) != 1 || restarted.pending[second.ID] == nil {
+		t.Fatalf("unexpected reloaded relays %v", restarted.pending)
+	}
+	relay := restarted.pending[second.ID]
+	if relay.Nonce != second.Nonce || relay.GasPrice.Cmp(second.GasPrice) != 0 || len(relay.Transactions) != 1 {
+		t.Fatalf("unexpected reloaded relay %+v", relay)
+	}
+	backend.mine(backend.sent[1], types.ReceiptStatusSuccessful)
+	if err := restarted.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := restarted.Load(ctx, second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ := n.LookupByString("status")
+	if v, _ := status.AsString(); v != RelayMined {
+		t.Fatalf("reloaded relay was not checked, %s", v)
+	}
+}
+
+func TestRelayCheckDoesNotBlock(t *testing.T) {
+	s, backend := newTestRelayer(t)
+	ctx := context.Background()
+	contract := common.HexToAddress("0x00000000000000000000000000000000000000dd")
+	callback := []byte{0x01, 0x02, 0x03, 0x04}
+	s.Relayer.AllowTarget(contract, callback)
+	if _, err := s.Relayer.Submit(ctx, contract, callback, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.hold = make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- s.Relayer.Check(ctx)
+	}()
+	// the relayer serves callers while the check waits on the client
+	if err := s.Relayer.Authorize("apikey:1", contract, callback); err != nil {
+		t.Fatal(err)
+	}
+	close(backend.hold)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,44 @@
+package durin
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// DurinRPC is the durin JSON-RPC namespace. It only exposes the offchain calls and
+// relaying, proof bookkeeping such as ConsumeProof stays internal to the service.
+type DurinRPC struct {
+	service *DurinService
+}
+
+// Call runs an offchain call, to is the contract that raised OffchainLookup and data its
+// callData
+func (api *DurinRPC) Call(to string, from string, data hexutil.Bytes) (hexutil.Bytes, error) {
+	return api.service.Call(to, from, data)
+}
+
+// Invoke runs the handler registered as name with a JSON object of the method inputs
+func (api *DurinRPC) Invoke(to string, name string, args json.RawMessage) (hexutil.Bytes, error) {
+	return api.service.Invoke(to, name, args)
+}
+
+// Handlers lists the registered handler names and selectors
+func (api *DurinRPC) Handlers() map[string]string {
+	return api.service.Handlers()
+}
+
+// Relay submits a call through the relayer and returns the relay id, the quota is the one
+// of the caller WithCaller set on the request context
+func (api *DurinRPC) Relay(ctx context.Context, to string, data hexutil.Bytes, cid string) (string, error) {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return api.service.Relay(caller, to, data, cid)
+}
+
+type callerKey struct{}
+
+// WithCaller sets the caller identity of a JSON-RPC request, see handler.Caller
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/impl"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// @BasePath /v0
+// EvmTransactionRead godoc
+// @Summary Reads the blocks produced by an EVM transaction
+// @Schemes
+// @Description Returns the provenance envelopes (data link, transaction hash, log index, contract address, block number and chain id) of the blocks derived from a transaction's events
+// @Tags evm
+// @Produce json
+// @Success 200 {object} []string
+// @Router /v0/evm/tx/{hash} [get]
+func (dagctx *AnconSyncContext) EvmTransactionRead(c *gin.Context) {
+	hash := c.Param("hash")
+	if len(common.FromHex(hash)) != common.HashLength {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid transaction hash %s", hash).Error(),
+		})
+		return
+	}
+	envelopes, index, err := impl.LoadTxProvenance(c.Request.Context(), dagctx.Store, common.HexToHash(hash))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if index == nil {
+		c.JSON(404, gin.H{
+			"error": fmt.Errorf("no blocks found for transaction %s", hash).Error(),
+		})
+		return
+	}
+
+	res := []json.RawMessage{}
+	for _, lnk := range envelopes {
+		n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("%v", err).Error(),
+			})
+			return
+		}
+		data, err := anconsync.Encode(n)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("%v", err).Error(),
+			})
+			return
+		}
+		res = append(res, json.RawMessage(data))
+	}
+	c.JSON(200, gin.H{
+		"cid":       index,
+		"envelopes": res,
+	})
+}
+
+// @BasePath /v0
+// EvmRegistryWrite godoc
+// @Summary Registers an ABI event mapping
+// @Schemes
+// @Description Stores a dag-json mapping document with an ABI and the events to index: {"name", "abi", "contracts", "events": [{"event", "codec", "fields", "links"}]}. Returns a CID.
+// @Tags evm
+// @Accept json
+// @Produce json
+// @Success 201 {string} cid
+// @Router /v0/evm/registry [post]
+func (dagctx *AnconSyncContext) EvmRegistryWrite(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("missing payload data source").Error(),
+		})
+		return
+	}
+	doc, err := anconsync.Decode(basicnode.Prototype.Any, string(body))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("decode Error %v", err).Error(),
+		})
+		return
+	}
+	lnk, err := impl.RegisterEventMappings(c.Request.Context(), dagctx.Store, doc)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(201, gin.H{
+		"cid": lnk,
+	})
+}
+
+// @BasePath /v0
+// EvmRegistryRead godoc
+// @Summary Lists the ABI event mappings
+// @Schemes
+// @Description Returns the CIDs of the registered mapping documents and the topics they index
+// @Tags evm
+// @Produce json
+// @Success 200 {object} []string
+// @Router /v0/evm/registry [get]
+func (dagctx *AnconSyncContext) EvmRegistryRead(c *gin.Context) {
+	registry, docs, err := impl.LoadEventRegistry(c.Request.Context(), dagctx.Store)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"mappings": docs,
+		"topics":   registry.Topics(),
+	})
+}
+
+// @BasePath /v0
+// EvmReceiptProofVerify godoc
+// @Summary Verifies a receipt proof against a block header
+// @Schemes
+// @Description Checks a receipt inclusion proof given only the block header: {"header": {eth header json}, "proof": {proof}} or {"header", "cid"} for a stored proof. Returns the proven receipt, its index in the block and the hash of the transaction at that index.
+// @Tags evm
+// @Accept json
+// @Produce json
+// @Success 200 {object} types.Receipt
+// @Router /v0/evm/proof/verify [post]
+func (dagctx *AnconSyncContext) EvmReceiptProofVerify(c *gin.Context) {
+	var v struct {
+		Header *types.Header      `json:"header"`
+		Proof  *impl.ReceiptProof `json:"proof"`
+		Cid    string             `json:"cid"`
+	}
+	if err := c.BindJSON(&v); err != nil || v.Header == nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("missing header %v", err).Error(),
+		})
+		return
+	}
+	proof := v.Proof
+	if proof == nil {
+		lnk, err := anconsync.ParseCidLink(v.Cid)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("missing proof or cid").Error(),
+			})
+			return
+		}
+		proof, err = impl.LoadReceiptProof(dagctx.Store, lnk)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+	receipt, err := impl.VerifyReceiptProof(v.Header, proof)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"verified": false,
+			"error":    err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"verified":         true,
+		"blockHash":        v.Header.Hash(),
+		"transactionHash":  proof.TransactionHash,
+		"transactionIndex": proof.TransactionIndex,
+		"receipt":          receipt,
+	})
+}
@@ -22,7 +22,7 @@ import (
 // FileWrite godoc
 // @Summary Stores files
 // @Schemes
-// @Description Writes a raw block which syncs with IPFS. Returns a CID.
+// @Description Writes a raw block which syncs with IPFS. Returns a CID. Signed writes carry the X-Ancon-Signature headers and also return the authorship envelope CID.
 // @Tags file
 // @Accept json
 // @Produce json
@@ -56,19 +56,32 @@ func (dagctx *AnconSyncContext) FileWrite(c *gin.Context) {
 	}
 
 	n, err := DecodeNode(w.Bytes())
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("cid error. %v", err).Error(),
+		})
+		return
+	}
+	_, signer, err := dagctx.signedWrite(c, WriteRouteFile, n)
+	if err != nil {
+		c.JSON(401, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 	lnk := dagctx.Store.Store(ipld.LinkContext{
 		LinkPath: ipld.ParsePath(strings.Join([]string{"/", file.Filename}, "/")),
 	}, n)
 
+	res, err := dagctx.storeSignedWrite(c, lnk, signer)
 	if err != nil {
 		c.JSON(400, gin.H{
-			"error": fmt.Errorf("cid error. %v", err).Error(),
+			"error": err.Error(),
 		})
 		return
 	}
-	c.JSON(201, gin.H{
-		"cid": lnk.String(),
-	})
+	res["cid"] = lnk.String()
+	c.JSON(201, res)
 	impl.PushBlock(c.Request.Context(), dagctx.Exchange, dagctx.IPFSPeer, lnk)
 }
 
@@ -90,6 +103,9 @@ func (dagctx *AnconSyncContext) FileRead(c *gin.Context) {
 		})
 		return
 	}
+	if dagctx.readEnvelope(c, cidlink.Link{Cid: lnk}) {
+		return
+	}
 	n, err := dagctx.Store.Load(ipld.LinkContext{LinkPath: ipld.ParsePath(c.Param("path"))}, cidlink.Link{Cid: lnk})
 
 	if err != nil {
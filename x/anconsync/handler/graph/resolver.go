@@ -0,0 +1,58 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/anconprotocol/contracts/graphql/server/graph/generated"
+	"github.com/anconprotocol/contracts/graphql/server/graph/model"
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler"
+)
+
+// Resolver implements the metadata GraphQL schema against the node store, DAG operations
+// run in-process through the AnconSyncContext
+type Resolver struct {
+	AnconSyncContext *handler.AnconSyncContext
+}
+
+func NewResolver(dag *handler.AnconSyncContext) *Resolver {
+	return &Resolver{AnconSyncContext: dag}
+}
+
+// Query returns generated.QueryResolver implementation.
+func (r *Resolver) Query() generated.QueryResolver { return &queryResolver{r} }
+
+// Transaction returns generated.TransactionResolver implementation.
+func (r *Resolver) Transaction() generated.TransactionResolver { return &transactionResolver{r} }
+
+type queryResolver struct{ *Resolver }
+type transactionResolver struct{ *Resolver }
+
+func (r *queryResolver) Metadata(ctx context.Context, cid string, path string) (*model.Ancon721Metadata, error) {
+	jsonmodel, err := anconsync.ReadFromStore(r.AnconSyncContext.Store, cid, path)
+	if err != nil {
+		return nil, err
+	}
+	var metadata model.Ancon721Metadata
+	if err := json.Unmarshal([]byte(jsonmodel), &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+func (r *transactionResolver) Metadata(ctx context.Context, tx model.MetadataTransactionInput) (*model.DagLink, error) {
+	lnk, err := r.AnconSyncContext.TransferOwnership(ctx, handler.OwnershipTransfer{
+		Path:     tx.Path,
+		Cid:      tx.Cid,
+		Owner:    tx.Owner,
+		NewOwner: tx.NewOwner,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &model.DagLink{
+		Path: "/",
+		Cid:  lnk.String(),
+	}, nil
+}
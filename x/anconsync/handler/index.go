@@ -0,0 +1,400 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler/proofsignature"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/spf13/cast"
+)
+
+// DefaultIndexBatchSize is the number of index writes saved as one tree version
+const DefaultIndexBatchSize = 100
+
+// AuthenticatedIndex commits the key → CID writes of the node into an IAVL tree, each
+// batch of writes is saved as a tree version and its root hash is signed in a
+// checkpoint block
+type AuthenticatedIndex struct {
+	Tree *proofsignature.IavlProofService
+	// BatchSize is the number of writes saved as one version
+	BatchSize int
+
+	lock    sync.Mutex
+	pending []indexWrite
+	writes  int64
+}
+
+// indexWrite is a write of the working tree not saved in a version yet, each pending
+// write is journaled in the store so a restart can replay them
+type indexWrite struct {
+	Key string
+	Cid string
+}
+
+func NewAuthenticatedIndex(tree *proofsignature.IavlProofService) *AuthenticatedIndex {
+	return &AuthenticatedIndex{
+		Tree:      tree,
+		BatchSize: DefaultIndexBatchSize,
+	}
+}
+
+// Writes returns the number of index writes since the node started
+func (index *AuthenticatedIndex) Writes() int64 {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	return index.writes
+}
+
+// IndexCheckpoint is a signed root hash of an index version
+type IndexCheckpoint struct {
+	Version   int64
+	RootHash  []byte
+	Timestamp int64
+	Signer    common.Address
+	Signature []byte
+	Previous  datamodel.Link
+	Link      datamodel.Link
+}
+
+// TokenIndexKey is the index key of the metadata of a token
+func TokenIndexKey(tokenId string) string {
+	return strings.Join([]string{"token", tokenId}, ":")
+}
+
+// indexPendingKey is the journal entry of the nth write after the saved version
+func indexPendingKey(version int64, n int) string {
+	return strings.Join([]string{"index", "pending", fmt.Sprint(version), fmt.Sprint(n)}, ":")
+}
+
+func indexCheckpointKey(version int64) string {
+	if version == 0 {
+		return strings.Join([]string{"index", "checkpoint"}, ":")
+	}
+	return strings.Join([]string{"index", "checkpoint", fmt.Sprint(version)}, ":")
+}
+
+// IndexCheckpointHash returns the EIP-712 digest of
+// AnconCheckpoint(bytes32 rootHash,uint256 version,uint256 timestamp)
+func IndexCheckpointHash(rootHash []byte, version int64, timestamp int64) []byte {
+	structHash := crypto.Keccak256(
+		crypto.Keccak256([]byte("AnconCheckpoint(bytes32 rootHash,uint256 version,uint256 timestamp)")),
+		common.BytesToHash(rootHash).Bytes(),
+		common.BigToHash(big.NewInt(version)).Bytes(),
+		common.BigToHash(big.NewInt(timestamp)).Bytes(),
+	)
+	return AnconWriteDomain.TypedDataHash(structHash)
+}
+
+func (cp *IndexCheckpoint) node() datamodel.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 6, func(na fluent.MapAssembler) {
+		na.AssembleEntry("version").AssignInt(cp.Version)
+		na.AssembleEntry("rootHash").AssignString(hexutil.Encode(cp.RootHash))
+		na.AssembleEntry("timestamp").AssignInt(cp.Timestamp)
+		na.AssembleEntry("signer").AssignString(cp.Signer.Hex())
+		na.AssembleEntry("signature").AssignString(hexutil.Encode(cp.Signature))
+		if cp.Previous != nil {
+			na.AssembleEntry("previous").AssignLink(cp.Previous)
+		} else {
+			na.AssembleEntry("previous").AssignNull()
+		}
+	})
+}
+
+// VerifyIndexCheckpoint checks the signature of a checkpoint block was made by one of the
+// trusted signers
+func VerifyIndexCheckpoint(n datamodel.Node, trusted []common.Address) (*IndexCheckpoint, error) {
+	field := func(name string) string {
+		v, err := n.LookupByString(name)
+		if err != nil {
+			return ""
+		}
+		s, _ := v.AsString()
+		return s
+	}
+	cp := &IndexCheckpoint{Signer: common.HexToAddress(field("signer"))}
+	for name, v := range map[string]*int64{"version": &cp.Version, "timestamp": &cp.Timestamp} {
+		f, err := n.LookupByString(name)
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint has no %s", name)
+		}
+		if *v, err = f.AsInt(); err != nil {
+			return nil, fmt.Errorf("invalid checkpoint %s", name)
+		}
+	}
+	rootHash, err := hexutil.Decode(field("rootHash"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint root hash %v", err)
+	}
+	cp.RootHash = rootHash
+	if previous, err := n.LookupByString("previous"); err == nil && !previous.IsNull() {
+		cp.Previous, _ = previous.AsLink()
+	}
+	address, err := RecoverAddress(IndexCheckpointHash(cp.RootHash, cp.Version, cp.Timestamp), field("signature"))
+	if err != nil {
+		return nil, err
+	}
+	if address != cp.Signer {
+		return nil, fmt.Errorf("checkpoint signature mismatch")
+	}
+	signed := false
+	for _, signer := range trusted {
+		signed = signed || signer == address
+	}
+	if !signed {
+		return nil, fmt.Errorf("checkpoint signer %s is not trusted", address.Hex())
+	}
+	cp.Signature, _ = hexutil.Decode(field("signature"))
+	return cp, nil
+}
+
+// IndexKey writes key → lnk to the authenticated index, the pending writes are committed
+// once they fill a batch. It does nothing when the index is disabled
+func (dagctx *AnconSyncContext) IndexKey(ctx context.Context, key string, lnk datamodel.Link) error {
+	index := dagctx.Index
+	if index == nil {
+		return nil
+	}
+	index.lock.Lock()
+	if _, err := index.Tree.Set([]byte(key), []byte(lnk.String())); err != nil {
+		index.lock.Unlock()
+		return err
+	}
+	write := indexWrite{Key: key, Cid: lnk.String()}
+	if err := dagctx.journalIndexWrite(ctx, len(index.pending), write); err != nil {
+		index.lock.Unlock()
+		return err
+	}
+	index.pending = append(index.pending, write)
+	index.writes++
+	full := index.BatchSize > 0 && len(index.pending) >= index.BatchSize
+	index.lock.Unlock()
+	if full {
+		_, err := dagctx.CommitIndex(ctx)
+		return err
+	}
+	return nil
+}
+
+// journalIndexWrite stores the nth pending write of the index under the saved version it
+// applies to
+func (dagctx *AnconSyncContext) journalIndexWrite(ctx context.Context, n int, w indexWrite) error {
+	version, _ := dagctx.Index.Tree.Version()
+	lnk := dagctx.Store.Store(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("key").AssignString(w.Key)
+		na.AssembleEntry("cid").AssignString(w.Cid)
+	}))
+	return dagctx.Store.DataStore.Put(ctx, indexPendingKey(version, n), []byte(lnk.String()))
+}
+
+// clearIndexJournal empties the journal entries of the n writes saved on top of version
+func (dagctx *AnconSyncContext) clearIndexJournal(ctx context.Context, version int64, n int) error {
+	for i := 0; i < n; i++ {
+		if err := dagctx.Store.DataStore.Put(ctx, indexPendingKey(version, i), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecoverIndex replays the journaled writes that were not saved in a version before the
+// node stopped into the working tree, they are committed with the next batch. It returns
+// the number of replayed writes.
+func (dagctx *AnconSyncContext) RecoverIndex(ctx context.Context) (int, error) {
+	index := dagctx.Index
+	if index == nil {
+		return 0, fmt.Errorf("authenticated index is disabled")
+	}
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	// entries of older versions were saved with them
+	version, _ := index.Tree.Version()
+	replayed := 0
+	for {
+		value, err := dagctx.Store.DataStore.Get(ctx, indexPendingKey(version, len(index.pending)))
+		if err != nil || len(value) == 0 {
+			return replayed, nil
+		}
+		lnk, err := anconsync.ParseCidLink(string(value))
+		if err != nil {
+			return replayed, err
+		}
+		n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+		if err != nil {
+			return replayed, err
+		}
+		write := indexWrite{}
+		if k, err := n.LookupByString("key"); err == nil {
+			write.Key, _ = k.AsString()
+		}
+		if c, err := n.LookupByString("cid"); err == nil {
+			write.Cid, _ = c.AsString()
+		}
+		if _, err := index.Tree.Set([]byte(write.Key), []byte(write.Cid)); err != nil {
+			return replayed, err
+		}
+		index.pending = append(index.pending, write)
+		replayed++
+	}
+}
+
+// CommitIndex saves the pending writes as a new index version and stores its signed
+// checkpoint, it returns nil when there is nothing to commit
+func (dagctx *AnconSyncContext) CommitIndex(ctx context.Context) (*IndexCheckpoint, error) {
+	index := dagctx.Index
+	if index == nil {
+		return nil, fmt.Errorf("authenticated index is disabled")
+	}
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	if len(index.pending) == 0 {
+		return nil, nil
+	}
+	previous, _ := index.Tree.Version()
+	saved, err := index.Tree.SaveVersion()
+	if err != nil {
+		return nil, err
+	}
+	saves := len(index.pending)
+	index.pending = nil
+	// the journal of the saved writes is obsolete once the version moved on
+	if err := dagctx.clearIndexJournal(ctx, previous, saves); err != nil {
+		return nil, err
+	}
+
+	cp := &IndexCheckpoint{
+		Version:   saved.Version,
+		RootHash:  saved.RootHash,
+		Timestamp: time.Now().Unix(),
+		Signer:    crypto.PubkeyToAddress(dagctx.PrivateKey.PublicKey),
+	}
+	cp.Signature, err = crypto.Sign(IndexCheckpointHash(cp.RootHash, cp.Version, cp.Timestamp), dagctx.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing failed %v", err)
+	}
+	if value, err := dagctx.Store.DataStore.Get(ctx, indexCheckpointKey(0)); err == nil {
+		cp.Previous, _ = anconsync.ParseCidLink(string(value))
+	}
+	cp.Link = dagctx.Store.Store(ipld.LinkContext{}, cp.node())
+	if err := dagctx.Store.DataStore.Put(ctx, indexCheckpointKey(cp.Version), []byte(cp.Link.String())); err != nil {
+		return nil, err
+	}
+	if err := dagctx.Store.DataStore.Put(ctx, indexCheckpointKey(0), []byte(cp.Link.String())); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// LoadIndexCheckpoint loads the checkpoint of an index version, the latest one when 0,
+// and verifies it was signed by the node key
+func (dagctx *AnconSyncContext) LoadIndexCheckpoint(ctx context.Context, version int64) (*IndexCheckpoint, error) {
+	value, err := dagctx.Store.DataStore.Get(ctx, indexCheckpointKey(version))
+	if err != nil || len(value) == 0 {
+		return nil, fmt.Errorf("checkpoint %d not found", version)
+	}
+	lnk, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil, err
+	}
+	n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, err
+	}
+	cp, err := VerifyIndexCheckpoint(n, []common.Address{crypto.PubkeyToAddress(dagctx.PrivateKey.PublicKey)})
+	if err != nil {
+		return nil, err
+	}
+	cp.Link = lnk
+	return cp, nil
+}
+
+// RunIndex commits the pending index writes every interval until ctx is done
+func (dagctx *AnconSyncContext) RunIndex(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := dagctx.CommitIndex(ctx); err != nil {
+					fmt.Printf("index: checkpoint failed %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// @BasePath /v0
+// IndexRead godoc
+// @Summary Reads the CID of an index key
+// @Schemes
+// @Description Returns the CID of key, with prove=true the ICS23 membership proof, or non-membership proof, of key at the last checkpoint
+// @Tags index
+// @Produce json
+// @Success 200
+// @Router /v0/index/{key} [get]
+func (dagctx *AnconSyncContext) IndexRead(c *gin.Context) {
+	if dagctx.Index == nil {
+		c.JSON(404, gin.H{
+			"error": fmt.Errorf("authenticated index is disabled").Error(),
+		})
+		return
+	}
+	key := c.Param("key")
+	if !cast.ToBool(c.Query("prove")) {
+		res, _ := dagctx.Index.Tree.Get([]byte(key))
+		if res.Value == nil {
+			c.JSON(404, gin.H{
+				"error": fmt.Errorf("key %s not found", key).Error(),
+			})
+			return
+		}
+		c.JSON(200, gin.H{
+			"key": key,
+			"cid": string(res.Value),
+		})
+		return
+	}
+
+	proof, err := dagctx.Index.Tree.Prove(0, []byte(key))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": fmt.Errorf("no checkpoint to prove %s %v", key, err).Error(),
+		})
+		return
+	}
+	checkpoint, err := dagctx.LoadIndexCheckpoint(c.Request.Context(), proof.Version)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	var cid interface{}
+	if proof.Exists {
+		cid = string(proof.Value)
+	}
+	c.JSON(200, gin.H{
+		"key":        key,
+		"cid":        cid,
+		"exists":     proof.Exists,
+		"version":    proof.Version,
+		"rootHash":   proof.RootHash,
+		"checkpoint": checkpoint.Link.String(),
+		"proof":      proof.Proof,
+	})
+}
@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/anconprotocol/node/x/anconsync/handler/proofsignature"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	dbm "github.com/tendermint/tm-db"
+)
+
+func newTestIndex(t *testing.T) *AnconSyncContext {
+	key, _ := crypto.GenerateKey()
+	dagctx := NewAnconSyncContext(anconsync.OpenStorage(t.TempDir()), nil, nil, key)
+	tree, err := proofsignature.NewIavlAPI(dbm.NewMemDB(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dagctx.Index = NewAuthenticatedIndex(tree.Service)
+	dagctx.Index.BatchSize = 2
+	return dagctx
+}
+
+type indexProof struct {
+	Key        string        `json:"key"`
+	Cid        *string       `json:"cid"`
+	Exists     bool          `json:"exists"`
+	Version    int64         `json:"version"`
+	RootHash   hexutil.Bytes `json:"rootHash"`
+	Checkpoint string        `json:"checkpoint"`
+	Proof      hexutil.Bytes `json:"proof"`
+}
+
+func readIndex(t *testing.T, dagctx *AnconSyncContext, key string) (int, *indexProof) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/v0/index/"+key+"?prove=true", nil)
+	c.Params = gin.Params{{Key: "key", Value: key}}
+	dagctx.IndexRead(c)
+	res := &indexProof{}
+	json.Unmarshal(w.Body.Bytes(), res)
+	return w.Code, res
+}
+
+func TestAuthenticatedIndex(t *testing.T) {
+	ctx := context.Background()
+	dagctx := newTestIndex(t)
+	doc := func(name string) ipld.Link {
+		return dagctx.Store.Store(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("name").AssignString(name)
+		}))
+	}
+
+	alice := doc("alice")
+	dagctx.IndexKey(ctx, "did:web:ipfs:user:alice", alice)
+	if code, _ := readIndex(t, dagctx, "did:web:ipfs:user:alice"); code != 404 {
+		t.Fatal("proved a key before the batch was committed")
+	}
+	// the second write fills the batch
+	dagctx.IndexKey(ctx, TokenIndexKey("1"), doc("token"))
+	code, res := readIndex(t, dagctx, "did:web:ipfs:user:alice")
+	if code != 200 || !res.Exists || res.Cid == nil || *res.Cid != alice.String() || res.Version != 1 {
+		t.Fatalf("unexpected proof %v", res)
+	}
+	if ok, err := dagctx.Index.Tree.VerifyMembership(res.RootHash, res.Proof, []byte(res.Key), []byte(*res.Cid)); !ok {
+		t.Fatalf("membership proof does not verify %v", err)
+	}
+
+	lnk, _ := anconsync.ParseCidLink(res.Checkpoint)
+	n, err := dagctx.Store.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := crypto.GenerateKey()
+	if _, err := VerifyIndexCheckpoint(n, []common.Address{crypto.PubkeyToAddress(other.PublicKey)}); err == nil {
+		t.Fatal("verified a checkpoint of an untrusted signer")
+	}
+	if _, err := VerifyIndexCheckpoint(n, nil); err == nil {
+		t.Fatal("verified a checkpoint without trusted signers")
+	}
+	cp, err := VerifyIndexCheckpoint(n, []common.Address{crypto.PubkeyToAddress(other.PublicKey), crypto.PubkeyToAddress(dagctx.PrivateKey.PublicKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Version != 1 || hexutil.Encode(cp.RootHash) != res.RootHash.String() || cp.Signer != crypto.PubkeyToAddress(dagctx.PrivateKey.PublicKey) {
+		t.Fatalf("unexpected checkpoint %v", cp)
+	}
+
+	code, res = readIndex(t, dagctx, "did:web:ipfs:user:bob")
+	if code != 200 || res.Exists || res.Cid != nil {
+		t.Fatalf("unexpected proof of a missing key %v", res)
+	}
+	if ok, err := dagctx.Index.Tree.VerifyNonMembership(res.RootHash, res.Proof, []byte(res.Key)); !ok {
+		t.Fatalf("non-membership proof does not verify %v", err)
+	}
+
+	// a checkpoint of pending writes links the previous one
+	bob := doc("bob")
+	dagctx.IndexKey(ctx, "did:web:ipfs:user:bob", bob)
+	next, err := dagctx.CommitIndex(ctx)
+	if err != nil || next.Version != 2 || next.Previous.String() != lnk.String() {
+		t.Fatalf("unexpected checkpoint %v %v", next, err)
+	}
+	if empty, _ := dagctx.CommitIndex(ctx); empty != nil {
+		t.Fatal("committed an empty batch")
+	}
+	if code, res := readIndex(t, dagctx, "did:web:ipfs:user:bob"); code != 200 || !res.Exists || *res.Cid != bob.String() || res.Checkpoint != next.Link.String() {
+		t.Fatalf("unexpected proof %v", res)
+	}
+}
+
+func TestIndexRecovery(t *testing.T) {
+	ctx := context.Background()
+	db := dbm.NewMemDB()
+	key, _ := crypto.GenerateKey()
+	open := func(store anconsync.Storage) *AnconSyncContext {
+		dagctx := NewAnconSyncContext(store, nil, nil, key)
+		tree, err := proofsignature.NewIavlAPI(db, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dagctx.Index = NewAuthenticatedIndex(tree.Service)
+		dagctx.Index.BatchSize = 2
+		return dagctx
+	}
+	dagctx := open(anconsync.OpenStorage(t.TempDir()))
+	lnk := dagctx.Store.Store(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("name").AssignString("token")
+	}))
+	dagctx.IndexKey(ctx, "saved", lnk)
+	dagctx.IndexKey(ctx, TokenIndexKey("1"), lnk)
+	// the saved writes are no longer journaled
+	for n := 0; n < 2; n++ {
+		if value, _ := dagctx.Store.DataStore.Get(ctx, indexPendingKey(0, n)); len(value) != 0 {
+			t.Fatalf("journal entry %d of a saved write was kept", n)
+		}
+	}
+	// the node stops before the next batch is committed
+	dagctx.IndexKey(ctx, TokenIndexKey("2"), lnk)
+	if value, _ := dagctx.Store.DataStore.Get(ctx, indexPendingKey(1, 0)); len(value) == 0 {
+		t.Fatal("pending write was not journaled")
+	}
+
+	restarted := open(dagctx.Store)
+	if replayed, err := restarted.RecoverIndex(ctx); err != nil || replayed != 1 {
+		t.Fatalf("unexpected replay %d %v", replayed, err)
+	}
+	if cp, err := restarted.CommitIndex(ctx); err != nil || cp == nil || cp.Version != 2 {
+		t.Fatalf("unexpected checkpoint %v %v", cp, err)
+	}
+	if code, res := readIndex(t, restarted, TokenIndexKey("2")); code != 200 || !res.Exists || *res.Cid != lnk.String() {
+		t.Fatalf("journaled write was lost %v", res)
+	}
+	// the journal is cleared once committed
+	if replayed, _ := open(dagctx.Store).RecoverIndex(ctx); replayed != 0 {
+		t.Fatalf("replayed %d committed writes", replayed)
+	}
+	if value, _ := dagctx.Store.DataStore.Get(ctx, indexPendingKey(1, 0)); len(value) != 0 {
+		t.Fatal("journal entry of a committed write was kept")
+	}
+}
@@ -0,0 +1,361 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-varint"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	JWSAlgES256K     = "ES256K"
+	JWEAlgECDHESXC20 = "ECDH-ES+XC20PKW"
+	JWEEncXC20P      = "XC20P"
+)
+
+var b64 = base64.RawURLEncoding
+
+// JWSSignature is a single signature of a general serialization JWS
+type JWSSignature struct {
+	Protected string `json:"protected"`
+	Signature string `json:"signature"`
+}
+
+// JWS general serialization
+type JWS struct {
+	Payload    string         `json:"payload"`
+	Signatures []JWSSignature `json:"signatures"`
+}
+
+// JWERecipient holds the wrapped content encryption key of a recipient
+type JWERecipient struct {
+	Header       map[string]interface{} `json:"header"`
+	EncryptedKey string                 `json:"encrypted_key"`
+}
+
+// JWE general serialization
+type JWE struct {
+	Protected  string         `json:"protected"`
+	IV         string         `json:"iv"`
+	Ciphertext string         `json:"ciphertext"`
+	Tag        string         `json:"tag"`
+	Recipients []JWERecipient `json:"recipients"`
+}
+
+func encodeDidKey(codec multicodec.Code, pub []byte) string {
+	bz := append(varint.ToUvarint(uint64(codec)), pub...)
+	code, _ := multibase.Encode(multibase.Base58BTC, bz)
+	return "did:key:" + code
+}
+
+// DecodeDidKey returns the multicodec and raw public key of a did:key, fragments are ignored
+func DecodeDidKey(did string) (multicodec.Code, []byte, error) {
+	id := strings.Split(strings.TrimPrefix(did, "did:key:"), "#")[0]
+	if id == did {
+		return 0, nil, fmt.Errorf("not a did:key %s", did)
+	}
+	_, bz, err := multibase.Decode(id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid did:key %v", err)
+	}
+	codec, n, err := varint.FromUvarint(bz)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid did:key %v", err)
+	}
+	return multicodec.Code(codec), bz[n:], nil
+}
+
+// Secp256k1DidKey returns the did:key of a secp256k1 public key
+func Secp256k1DidKey(pub *ecdsa.PublicKey) string {
+	return encodeDidKey(multicodec.Secp256k1Pub, crypto.CompressPubkey(pub))
+}
+
+// X25519DidKey returns the did:key of a X25519 public key
+func X25519DidKey(pub []byte) string {
+	return encodeDidKey(multicodec.X25519Pub, pub)
+}
+
+// NodeDid is the did:key of the node signing key
+func (dagctx *AnconSyncContext) NodeDid() string {
+	return Secp256k1DidKey(&dagctx.PrivateKey.PublicKey)
+}
+
+// NodeX25519Key derives the node key agreement key pair from the node signing key
+func (dagctx *AnconSyncContext) NodeX25519Key() ([]byte, []byte, error) {
+	priv := crypto.Keccak256([]byte("x25519"), crypto.FromECDSA(dagctx.PrivateKey))
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+// SignJWS signs payload with ES256K and kid set to the signer did:key
+func SignJWS(key *ecdsa.PrivateKey, payload []byte) (*JWS, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": JWSAlgES256K,
+		"kid": Secp256k1DidKey(&key.PublicKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+	protected := b64.EncodeToString(header)
+	encodedPayload := b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(protected + "." + encodedPayload))
+	sig, err := crypto.Sign(digest[:], key)
+	if err != nil {
+		return nil, err
+	}
+	return &JWS{
+		Payload: encodedPayload,
+		Signatures: []JWSSignature{{
+			Protected: protected,
+			// drop recovery id, ES256K signatures are R || S
+			Signature: b64.EncodeToString(sig[:64]),
+		}},
+	}, nil
+}
+
+// KeyResolver returns the secp256k1 public key of a signer kid
+type KeyResolver func(kid string) ([]byte, error)
+
+// ParseCompactJWS parses a JWS in compact serialization
+func ParseCompactJWS(compact string) (*JWS, error) {
+	parts := strings.Split(compact, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid compact JWS")
+	}
+	return &JWS{
+		Payload: parts[1],
+		Signatures: []JWSSignature{{
+			Protected: parts[0],
+			Signature: parts[2],
+		}},
+	}, nil
+}
+
+// VerifyJWS checks every signature of jws and returns the payload and signer DIDs,
+// did:key signers are self-certifying, other kids go through resolve
+func VerifyJWS(jws *JWS, resolve KeyResolver) ([]byte, []string, error) {
+	payload, err := b64.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid payload %v", err)
+	}
+	if len(jws.Signatures) == 0 {
+		return nil, nil, fmt.Errorf("missing signatures")
+	}
+	signers := make([]string, 0, len(jws.Signatures))
+	for _, s := range jws.Signatures {
+		bz, err := b64.DecodeString(s.Protected)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid protected header %v", err)
+		}
+		var header map[string]string
+		if err := json.Unmarshal(bz, &header); err != nil {
+			return nil, nil, fmt.Errorf("invalid protected header %v", err)
+		}
+		if header["alg"] != JWSAlgES256K {
+			return nil, nil, fmt.Errorf("unsupported alg %s", header["alg"])
+		}
+		var pub []byte
+		if codec, key, err := DecodeDidKey(header["kid"]); err == nil {
+			if codec != multicodec.Secp256k1Pub {
+				return nil, nil, fmt.Errorf("unsupported key type %s", codec)
+			}
+			pub = key
+		} else if resolve != nil {
+			pub, err = resolve(header["kid"])
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			return nil, nil, err
+		}
+		sig, err := b64.DecodeString(s.Signature)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid signature %v", err)
+		}
+		digest := sha256.Sum256([]byte(s.Protected + "." + jws.Payload))
+		if !crypto.VerifySignature(pub, digest[:], sig) {
+			return nil, nil, fmt.Errorf("invalid signature for %s", header["kid"])
+		}
+		signers = append(signers, strings.Split(header["kid"], "#")[0])
+	}
+	return payload, signers, nil
+}
+
+// concatKDF implements the single round NIST SP 800-56A Concat KDF used by ECDH-ES
+func concatKDF(z []byte, alg string, keyLen int) []byte {
+	lengthPrefixed := func(b []byte) []byte {
+		out := make([]byte, 4, 4+len(b))
+		binary.BigEndian.PutUint32(out, uint32(len(b)))
+		return append(out, b...)
+	}
+	h := sha256.New()
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(z)
+	h.Write(lengthPrefixed([]byte(alg)))
+	// empty apu and apv
+	h.Write(lengthPrefixed(nil))
+	h.Write(lengthPrefixed(nil))
+	bits := make([]byte, 4)
+	binary.BigEndian.PutUint32(bits, uint32(keyLen*8))
+	h.Write(bits)
+	return h.Sum(nil)[:keyLen]
+}
+
+func sealXC20P(key, plaintext, aad []byte) ([]byte, []byte, []byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	iv := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, nil, nil, err
+	}
+	sealed := aead.Seal(nil, iv, plaintext, aad)
+	tagStart := len(sealed) - aead.Overhead()
+	return iv, sealed[:tagStart], sealed[tagStart:], nil
+}
+
+func openXC20P(key, iv, ciphertext, tag, aad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, iv, append(append([]byte{}, ciphertext...), tag...), aad)
+}
+
+// EncryptJWE encrypts cleartext with XC20P to each recipient X25519 public key
+func EncryptJWE(cleartext []byte, recipients map[string][]byte) (*JWE, error) {
+	header, err := json.Marshal(map[string]string{"enc": JWEEncXC20P})
+	if err != nil {
+		return nil, err
+	}
+	protected := b64.EncodeToString(header)
+
+	cek := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, err
+	}
+	iv, ciphertext, tag, err := sealXC20P(cek, cleartext, []byte(protected))
+	if err != nil {
+		return nil, err
+	}
+
+	jwe := &JWE{
+		Protected:  protected,
+		IV:         b64.EncodeToString(iv),
+		Ciphertext: b64.EncodeToString(ciphertext),
+		Tag:        b64.EncodeToString(tag),
+	}
+	for kid, pub := range recipients {
+		ephemeral := make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(ephemeral); err != nil {
+			return nil, err
+		}
+		epk, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		z, err := curve25519.X25519(ephemeral, pub)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient key for %s", kid)
+		}
+		kek := concatKDF(z, JWEAlgECDHESXC20, chacha20poly1305.KeySize)
+		kiv, wrapped, ktag, err := sealXC20P(kek, cek, nil)
+		if err != nil {
+			return nil, err
+		}
+		jwe.Recipients = append(jwe.Recipients, JWERecipient{
+			Header: map[string]interface{}{
+				"alg": JWEAlgECDHESXC20,
+				"kid": kid,
+				"epk": map[string]string{
+					"kty": "OKP",
+					"crv": "X25519",
+					"x":   b64.EncodeToString(epk),
+				},
+				"iv":  b64.EncodeToString(kiv),
+				"tag": b64.EncodeToString(ktag),
+			},
+			EncryptedKey: b64.EncodeToString(wrapped),
+		})
+	}
+	return jwe, nil
+}
+
+// DecryptJWE opens jwe with the private key of recipient kid
+func DecryptJWE(jwe *JWE, kid string, priv []byte) ([]byte, error) {
+	for _, r := range jwe.Recipients {
+		if r.Header["kid"] != kid {
+			continue
+		}
+		if r.Header["alg"] != JWEAlgECDHESXC20 {
+			return nil, fmt.Errorf("unsupported alg %v", r.Header["alg"])
+		}
+		// headers built by EncryptJWE hold a string map, decoded ones a generic map
+		var x string
+		switch epk := r.Header["epk"].(type) {
+		case map[string]string:
+			x = epk["x"]
+		case map[string]interface{}:
+			x, _ = epk["x"].(string)
+		default:
+			return nil, fmt.Errorf("missing epk")
+		}
+		kivStr, _ := r.Header["iv"].(string)
+		ktagStr, _ := r.Header["tag"].(string)
+		pub, err := b64.DecodeString(x)
+		if err != nil {
+			return nil, fmt.Errorf("invalid epk %v", err)
+		}
+		z, err := curve25519.X25519(priv, pub)
+		if err != nil {
+			return nil, err
+		}
+		kiv, err := b64.DecodeString(kivStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient iv %v", err)
+		}
+		ktag, err := b64.DecodeString(ktagStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient tag %v", err)
+		}
+		wrapped, err := b64.DecodeString(r.EncryptedKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encrypted key %v", err)
+		}
+		kek := concatKDF(z, JWEAlgECDHESXC20, chacha20poly1305.KeySize)
+		cek, err := openXC20P(kek, kiv, wrapped, ktag, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap content key %v", err)
+		}
+
+		iv, err := b64.DecodeString(jwe.IV)
+		if err != nil {
+			return nil, fmt.Errorf("invalid iv %v", err)
+		}
+		ciphertext, err := b64.DecodeString(jwe.Ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ciphertext %v", err)
+		}
+		tag, err := b64.DecodeString(jwe.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %v", err)
+		}
+		return openXC20P(cek, iv, ciphertext, tag, []byte(jwe.Protected))
+	}
+	return nil, fmt.Errorf("not a recipient %s", kid)
+}
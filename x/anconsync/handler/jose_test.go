@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestJWSRoundTrip(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	jws, err := SignJWS(key, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signers, err := VerifyJWS(jws, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "hello" {
+		t.Fatalf("unexpected payload %s", payload)
+	}
+	if len(signers) != 1 || signers[0] != Secp256k1DidKey(&key.PublicKey) {
+		t.Fatalf("unexpected signers %v", signers)
+	}
+
+	compact := jws.Signatures[0].Protected + "." + jws.Payload + "." + jws.Signatures[0].Signature
+	parsed, err := ParseCompactJWS(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := VerifyJWS(parsed, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := *jws
+	tampered.Payload = b64.EncodeToString([]byte("hellO"))
+	if _, _, err := VerifyJWS(&tampered, nil); err == nil {
+		t.Fatal("verified a tampered payload")
+	}
+
+	// the signature of another key under the first kid
+	other, _ := crypto.GenerateKey()
+	forged, err := SignJWS(other, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Signatures[0].Protected = jws.Signatures[0].Protected
+	if _, _, err := VerifyJWS(forged, nil); err == nil {
+		t.Fatal("verified a signature of another key")
+	}
+}
+
+func TestJWERoundTrip(t *testing.T) {
+	newRecipient := func() ([]byte, []byte) {
+		priv := make([]byte, curve25519.ScalarSize)
+		rand.Read(priv)
+		pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return priv, pub
+	}
+	alicePriv, alicePub := newRecipient()
+	bobPriv, bobPub := newRecipient()
+	alice, bob := X25519DidKey(alicePub), X25519DidKey(bobPub)
+
+	jwe, err := EncryptJWE([]byte("secret"), map[string][]byte{alice: alicePub, bob: bobPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kid, priv := range map[string][]byte{alice: alicePriv, bob: bobPriv} {
+		cleartext, err := DecryptJWE(jwe, kid, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cleartext, []byte("secret")) {
+			t.Fatalf("unexpected cleartext %s", cleartext)
+		}
+	}
+
+	if _, err := DecryptJWE(jwe, alice, bobPriv); err == nil {
+		t.Fatal("decrypted with the wrong key")
+	}
+	evePriv, evePub := newRecipient()
+	if _, err := DecryptJWE(jwe, X25519DidKey(evePub), evePriv); err == nil {
+		t.Fatal("decrypted for a key that is not a recipient")
+	}
+
+	tampered := *jwe
+	ciphertext, _ := b64.DecodeString(jwe.Ciphertext)
+	ciphertext[0] ^= 1
+	tampered.Ciphertext = b64.EncodeToString(ciphertext)
+	if _, err := DecryptJWE(&tampered, alice, alicePriv); err == nil {
+		t.Fatal("decrypted a tampered ciphertext")
+	}
+
+	tampered = *jwe
+	tampered.IV = "not base64!"
+	if _, err := DecryptJWE(&tampered, alice, alicePriv); err == nil {
+		t.Fatal("decrypted an invalid iv")
+	}
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+)
+
+// OwnershipTransfer moves the metadata at Cid from Owner to NewOwner, Path is the
+// metadata root within the block
+type OwnershipTransfer struct {
+	Path     string
+	Cid      string
+	Owner    string
+	NewOwner string
+}
+
+// TransferOwnership sets the metadata owner to NewOwner when Owner is the current owner,
+// links the previous version as parent and stores the result. It backs the GraphQL
+// metadata mutation and the durin transferURI handler.
+func (dagctx *AnconSyncContext) TransferOwnership(ctx context.Context, tx OwnershipTransfer) (datamodel.Link, error) {
+	lnk, err := anconsync.ParseCidLink(tx.Cid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cid %s", tx.Cid)
+	}
+	root, err := dagctx.Store.Load(ipld.LinkContext{Ctx: ctx}, lnk)
+	if err != nil {
+		return nil, err
+	}
+	path := strings.Trim(tx.Path, "/")
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+
+	n, err := traversal.FocusedTransform(root, datamodel.ParsePath(prefix+"owner"), func(_ traversal.Progress, prev datamodel.Node) (datamodel.Node, error) {
+		if prev == nil {
+			return nil, fmt.Errorf("owner not found")
+		}
+		if owner, _ := prev.AsString(); !strings.EqualFold(owner, tx.Owner) {
+			return nil, fmt.Errorf("%s is not the metadata owner", tx.Owner)
+		}
+		return basicnode.NewString(tx.NewOwner), nil
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// link the previous version
+	n, err = traversal.FocusedTransform(n, datamodel.ParsePath(prefix+"parent"), func(_ traversal.Progress, _ datamodel.Node) (datamodel.Node, error) {
+		return basicnode.NewLink(cidlink.Link{Cid: lnk.Cid}), nil
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	return dagctx.Store.Store(ipld.LinkContext{Ctx: ctx}, n), nil
+}
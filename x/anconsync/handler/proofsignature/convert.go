@@ -4,9 +4,73 @@ import (
 	"fmt"
 
 	ics23 "github.com/confio/ics23/go"
-	"github.com/tendermint/iavl"
+	"github.com/cosmos/iavl"
+	tmcrypto "github.com/tendermint/tendermint/proto/tendermint/crypto"
 )
 
+// Proof op types returned by abci_query with prove=true, ICS23 ops carry a marshalled
+// CommitmentProof and iavl:v ops a range proof of chains before the ICS23 stores
+const (
+	ProofOpIAVLCommitment         = "ics23:iavl"
+	ProofOpSimpleMerkleCommitment = "ics23:simple"
+	ProofOpIAVLValue              = "iavl:v"
+)
+
+// ConvertProofOps converts the proof ops of an abci_query response into ICS23 commitment
+// proofs, ordered from the store up to the app hash. value is the queried value.
+func ConvertProofOps(ops []tmcrypto.ProofOp, value []byte) ([]*ics23.CommitmentProof, error) {
+	proofs := make([]*ics23.CommitmentProof, 0, len(ops))
+	for _, op := range ops {
+		switch op.Type {
+		case ProofOpIAVLCommitment, ProofOpSimpleMerkleCommitment:
+			proof := &ics23.CommitmentProof{}
+			if err := proof.Unmarshal(op.Data); err != nil {
+				return nil, fmt.Errorf("invalid %s proof %v", op.Type, err)
+			}
+			proofs = append(proofs, proof)
+		case ProofOpIAVLValue:
+			decoded, err := iavl.ValueOpDecoder(op)
+			if err != nil {
+				return nil, err
+			}
+			exist, err := convertExistenceProof(decoded.(iavl.ValueOp).Proof, op.Key, value)
+			if err != nil {
+				return nil, err
+			}
+			proofs = append(proofs, &ics23.CommitmentProof{
+				Proof: &ics23.CommitmentProof_Exist{Exist: exist},
+			})
+		default:
+			return nil, fmt.Errorf("unsupported proof op %s", op.Type)
+		}
+	}
+	return proofs, nil
+}
+
+// VerifyStateProof verifies that key maps to value in the IAVL store storeKey, or that key
+// is absent from the store when value is empty, and that the store root is committed in
+// appHash
+func VerifyStateProof(proofs []*ics23.CommitmentProof, appHash []byte, storeKey string, key, value []byte) error {
+	if len(proofs) != 2 {
+		return fmt.Errorf("state proof requires a store and a commit proof, got %d", len(proofs))
+	}
+	root, err := proofs[0].Calculate()
+	if err != nil {
+		return err
+	}
+	if len(value) == 0 {
+		if !ics23.VerifyNonMembership(ics23.IavlSpec, root, proofs[0], key) {
+			return fmt.Errorf("key is not proven absent from store %s", storeKey)
+		}
+	} else if !ics23.VerifyMembership(ics23.IavlSpec, root, proofs[0], key, value) {
+		return fmt.Errorf("key is not proven in store %s", storeKey)
+	}
+	if !ics23.VerifyMembership(ics23.TendermintSpec, appHash, proofs[1], []byte(storeKey), root) {
+		return fmt.Errorf("store %s is not proven in app hash %X", storeKey, appHash)
+	}
+	return nil
+}
+
 // convertExistenceProof will convert the given proof into a valid
 // existence proof, if that's what it is.
 //
@@ -24,6 +88,40 @@ func convertExistenceProof(p *iavl.RangeProof, key, value []byte) (*ics23.Existe
 	}, nil
 }
 
+// convertNonExistenceProof proves that key is absent from tree with the existence proofs
+// of its neighbour leaves, a missing neighbour means key is left or right of all keys
+func convertNonExistenceProof(tree *iavl.ImmutableTree, key []byte) (*ics23.NonExistenceProof, error) {
+	// index is the one of the first key right of key
+	index, value := tree.Get(key)
+	if value != nil {
+		return nil, fmt.Errorf("Non-existence proof requires the key to be absent")
+	}
+
+	neighbour := func(index int64) (*ics23.ExistenceProof, error) {
+		k, _ := tree.GetByIndex(index)
+		if k == nil {
+			return nil, nil
+		}
+		v, p, err := tree.GetWithProof(k)
+		if err != nil {
+			return nil, err
+		}
+		return convertExistenceProof(p, k, v)
+	}
+
+	var err error
+	nonexist := &ics23.NonExistenceProof{Key: key}
+	if index > 0 {
+		if nonexist.Left, err = neighbour(index - 1); err != nil {
+			return nil, err
+		}
+	}
+	if nonexist.Right, err = neighbour(index); err != nil {
+		return nil, err
+	}
+	return nonexist, nil
+}
+
 func convertLeafOp(version int64) *ics23.LeafOp {
 	// this is adapted from iavl/proof.go:proofLeafNode.Hash()
 	prefix := aminoVarInt(0)
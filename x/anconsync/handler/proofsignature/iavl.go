@@ -1,14 +1,13 @@
 package proofsignature
 
 import (
-	"encoding/json"
 	"fmt"
 	"sync"
 
-	"github.com/anconprotocol/contracts/hexutil"
+	"github.com/anconprotocol/node/x/anconsync/handler/proofsignature/verify"
 	ics23 "github.com/confio/ics23/go"
 	"github.com/cosmos/iavl"
-	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/pkg/errors"
 	dbm "github.com/tendermint/tm-db"
 )
@@ -17,7 +16,9 @@ type IavlProofAPI struct {
 	Namespace string
 	Version   string
 	Service   *IavlProofService
-	Public    bool
+	// Query serves the reads and proofs of Service, without the methods changing the tree
+	Query  *IavlQueryService
+	Public bool
 }
 
 type IavlProofService struct {
@@ -25,6 +26,7 @@ type IavlProofService struct {
 	tree   *iavl.MutableTree
 }
 
+// NewIavlAPI loads version of the tree stored in db, the latest version when 0
 func NewIavlAPI(db dbm.DB, cacheSize, version int64) (*IavlProofAPI, error) {
 
 	tree, err := iavl.NewMutableTree(db, int(cacheSize))
@@ -36,201 +38,233 @@ func NewIavlAPI(db dbm.DB, cacheSize, version int64) (*IavlProofAPI, error) {
 		return nil, errors.Wrapf(err, "unable to load version %d", version)
 	}
 
+	service := &IavlProofService{
+		rwLock: sync.RWMutex{},
+		tree:   tree,
+	}
 	return &IavlProofAPI{
 		Namespace: "iavl",
 		Version:   "1.0",
-		Service: &IavlProofService{
-			rwLock: sync.RWMutex{},
-			tree:   tree,
-		},
-		Public: false,
+		Service:   service,
+		Query:     &IavlQueryService{service: service},
+		Public:    false,
 	}, nil
+}
 
-	// return &DurinAPI{
-	// 	Namespace: "durin",
-	// 	Version:   "1.0",
-	// 	Service: &DurinService{
-	// 		Adapter:   &evm,
-	// 		GqlClient: gqlClient,
-	// 	},
-	// 	Public: true,
-	// }
+// GetResult is the index and value of a key, the value is null and the index is the
+// one of the next key when the key does not exist
+type GetResult struct {
+	Index   int64         `json:"index"`
+	Value   hexutil.Bytes `json:"value"`
+	Version int64         `json:"version"`
 }
 
-func GetArguments(req hexutil.Bytes) (map[string]interface{}, error) {
-	var values map[string]interface{}
-	dec, err := hexutil.Decode(req.String())
-	if err != nil {
-		return nil, err
-	}
-	err = json.Unmarshal(dec, values)
-	return values, err
+// KeyValue is a key and value of the tree
+type KeyValue struct {
+	Key   hexutil.Bytes `json:"key"`
+	Value hexutil.Bytes `json:"value"`
 }
 
-func ToHex(v interface{}) (hexutil.Bytes, error) {
-	jsonval, err := json.Marshal(v)
-	if err != nil {
-		return hexutil.Bytes(hexutil.Encode([]byte(fmt.Errorf("reverted, json marshal").Error()))), err
-	}
-	valenc := hexutil.Encode(jsonval)
-	return hexutil.Bytes(valenc), err
+// ProofResult is a value with the ICS23 commitment proof of its key against the root
+// hash of a saved version, the proof is a non-membership proof when the key does not
+// exist
+type ProofResult struct {
+	Key      hexutil.Bytes `json:"key"`
+	Value    hexutil.Bytes `json:"value"`
+	Exists   bool          `json:"exists"`
+	Version  int64         `json:"version"`
+	RootHash hexutil.Bytes `json:"rootHash"`
+	// Proof is a protobuf encoded ics23.CommitmentProof
+	Proof hexutil.Bytes `json:"proof"`
+}
+
+// VersionResult is a version of the tree and its root hash
+type VersionResult struct {
+	RootHash hexutil.Bytes `json:"rootHash"`
+	Version  int64         `json:"version"`
 }
 
-// HasVersioned returns a result containing a boolean on whether or not the IAVL tree
-// has a given key at a specific tree version.
-func (s *IavlProofService) HasVersioned(version int64) (hexutil.Bytes, error) {
+// RemoveResult is the value of a removed key
+type RemoveResult struct {
+	Value   hexutil.Bytes `json:"value"`
+	Removed bool          `json:"removed"`
+}
+
+// HasVersioned returns whether or not the IAVL tree has a given version.
+func (s *IavlProofService) HasVersioned(version int64) (bool, error) {
 
 	s.rwLock.RLock()
 	defer s.rwLock.RUnlock()
 
 	if !s.tree.VersionExists(version) {
-		return nil, iavl.ErrVersionDoesNotExist
+		return false, nil
 	}
 
-	_, err := s.tree.GetImmutable(version)
-	if err != nil {
-		return nil, err
-	}
-
-	var res map[string]interface{}
-	res["hasVersion"] = true
-
-	hexres, err := ToHex(res)
-	if err != nil {
-		return nil, err
+	if _, err := s.tree.GetImmutable(version); err != nil {
+		return false, err
 	}
 
-	return hexres, nil
+	return true, nil
 }
 
-// Has returns a result containing a boolean on whether or not the IAVL tree
-// has a given key in the current version
-func (s *IavlProofService) Has(key []byte) (hexutil.Bytes, error) {
+// Has returns whether or not the IAVL tree has a given key in the current version
+func (s *IavlProofService) Has(key hexutil.Bytes) (bool, error) {
 
 	s.rwLock.RLock()
 	defer s.rwLock.RUnlock()
 
-	var res map[string]interface{}
-	res["has"] = s.tree.Has(key)
-
-	hexres, err := ToHex(res)
-	if err != nil {
-		return nil, err
-	}
-
-	return hexres, nil
+	return s.tree.Has(key), nil
 }
 
-// Get returns a result containing the index and value for a given
-// key based on the current state (version) of the tree.
+// Get returns the index and value for a given key based on the current state (version)
+// of the tree.
 // If the key does not exist, Get returns the index of the next value.
-func (s *IavlProofService) Get(key []byte) (hexutil.Bytes, error) {
+func (s *IavlProofService) Get(key hexutil.Bytes) (*GetResult, error) {
 
 	s.rwLock.RLock()
 	defer s.rwLock.RUnlock()
 
-	var res map[string]interface{}
-	res["index"], res["value"] = s.tree.Get(key)
-	if res["index"] == nil {
-		e := fmt.Errorf("The index requested does not exist")
-		return nil, e
-	}
-
-	hexres, err := ToHex(res)
-	if err != nil {
-		return nil, err
-	}
-
-	return hexres, nil
+	index, value := s.tree.Get(key)
+	return &GetResult{Index: index, Value: value, Version: s.tree.Version()}, nil
 }
 
-// GetByIndex returns a result containing the key and value for a given
-// index based on the current state (version) of the tree.
-func (s *IavlProofService) GetByIndex(index int64) (hexutil.Bytes, error) {
+// GetByIndex returns the key and value for a given index based on the current state
+// (version) of the tree.
+func (s *IavlProofService) GetByIndex(index int64) (*KeyValue, error) {
 
 	s.rwLock.RLock()
 	defer s.rwLock.RUnlock()
 
-	var res map[string]interface{}
-
-	res["key"], res["value"] = s.tree.GetByIndex(index)
-	if res["key"] == nil {
-		e := fmt.Errorf("The key requested does not exist")
-		return nil, e
-	}
-
-	hexres, err := ToHex(res)
-	if err != nil {
-		return nil, err
+	key, value := s.tree.GetByIndex(index)
+	if key == nil {
+		return nil, fmt.Errorf("The key requested does not exist")
 	}
 
-	return hexres, nil
+	return &KeyValue{Key: key, Value: value}, nil
 }
 
 /*
 CreateMembershipProof will produce a CommitmentProof that the given key (and queries value) exists in the iavl tree.
 If the key doesn't exist in the tree, this will return an error.
 */
-func createMembershipProof(tree *iavl.MutableTree, key []byte, exist *ics23.ExistenceProof) (*ics23.CommitmentProof, error) {
-	// exist, err := createExistenceProof(tree, key)
-	proof := &ics23.CommitmentProof{
-		Proof: &ics23.CommitmentProof_Exist{
-			Exist: exist,
-		},
+func createMembershipProof(tree *iavl.ImmutableTree, key []byte) (*ics23.CommitmentProof, []byte, error) {
+	value, proof, err := tree.GetWithProof(key)
+	if err != nil {
+		return nil, nil, err
 	}
-	return proof, nil
-}
 
-// GetWithProof returns a result containing the IAVL tree version and value for
-// a given key based on the current state (version) of the tree including a
-// verifiable Merkle proof.
-func (s *IavlProofService) GetWithProof(key []byte) (hexutil.Bytes, error) {
+	if value == nil {
+		return nil, nil, fmt.Errorf("The key requested does not exist")
+	}
 
-	s.rwLock.RLock()
-	defer s.rwLock.RUnlock()
+	exist, err := convertExistenceProof(proof, key, value)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	var res map[string]interface{}
-	var err error
-	var proof *iavl.RangeProof
+	return &ics23.CommitmentProof{
+		Proof: &ics23.CommitmentProof_Exist{
+			Exist: exist,
+		},
+	}, value, nil
+}
 
-	res["value"], proof, err = s.tree.GetWithProof(key)
+/*
+CreateNonMembershipProof will produce a CommitmentProof that the given key doesn't exist in the iavl tree.
+If the key exists in the tree, this will return an error.
+*/
+func createNonMembershipProof(tree *iavl.ImmutableTree, key []byte) (*ics23.CommitmentProof, error) {
+	nonexist, err := convertNonExistenceProof(tree, key)
 	if err != nil {
 		return nil, err
 	}
 
-	if res["value"] == nil {
-		s := fmt.Errorf("The key requested does not exist")
-		return nil, s
+	return &ics23.CommitmentProof{
+		Proof: &ics23.CommitmentProof_Nonexist{
+			Nonexist: nonexist,
+		},
+	}, nil
+}
+
+// commitmentProof returns the membership proof of key and its value, or its
+// non-membership proof when it does not exist
+func commitmentProof(tree *iavl.ImmutableTree, key []byte) (*ics23.CommitmentProof, []byte, error) {
+	if tree.Has(key) {
+		return createMembershipProof(tree, key)
+	}
+	proof, err := createNonMembershipProof(tree, key)
+	return proof, nil, err
+}
+
+// immutable returns the saved version of the tree, the latest one when 0
+func (s *IavlProofService) immutable(version int64) (*iavl.ImmutableTree, error) {
+	if version == 0 {
+		version = s.tree.Version()
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("the tree has no saved version")
+	}
+	if !s.tree.VersionExists(version) {
+		return nil, iavl.ErrVersionDoesNotExist
 	}
+	return s.tree.GetImmutable(version)
+}
 
-	exp, err := convertExistenceProof(proof, key, res["value"].([]byte))
+func (s *IavlProofService) proof(key []byte, version int64) (*ProofResult, error) {
+	tree, err := s.immutable(version)
 	if err != nil {
 		return nil, err
 	}
 
-	memproof, err := createMembershipProof(s.tree, key, exp)
+	proof, value, err := commitmentProof(tree, key)
 	if err != nil {
 		return nil, err
 	}
 
-	memproofbyte, err := json.Marshal(memproof)
+	proofbyte, err := proof.Marshal()
 	if err != nil {
 		return nil, err
 	}
 
-	res["membershipproof"] = memproofbyte
+	return &ProofResult{
+		Key:      key,
+		Value:    value,
+		Exists:   value != nil,
+		Version:  tree.Version(),
+		RootHash: tree.Hash(),
+		Proof:    proofbyte,
+	}, nil
+}
 
-	hexres, err := ToHex(res)
-	if err != nil {
-		return nil, err
+// GetWithProof returns the value for a given key in the latest saved version of the
+// tree including a verifiable ICS23 membership proof, or a non-membership proof when the
+// key does not exist.
+func (s *IavlProofService) GetWithProof(key hexutil.Bytes) (*ProofResult, error) {
+
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
+
+	return s.proof(key, s.tree.Version())
+}
+
+// GetVersioned returns the index and value for a given key at a specific tree version.
+func (s *IavlProofService) GetVersioned(version int64, key hexutil.Bytes) (*GetResult, error) {
+
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
+
+	if !s.tree.VersionExists(version) {
+		return nil, iavl.ErrVersionDoesNotExist
 	}
 
-	return hexres, nil
+	index, value := s.tree.GetVersioned(key, version)
+	return &GetResult{Index: index, Value: value, Version: version}, nil
 }
 
-// GetVersioned returns a result containing the IAVL tree version and value
-// for a given key at a specific tree version.
-func (s *IavlProofService) GetVersioned(version int64, key []byte) (hexutil.Bytes, error) {
+// GetVersionedWithProof returns the value for a given key at a specific tree version
+// including a verifiable ICS23 membership proof, or a non-membership proof when the key
+// does not exist.
+func (s *IavlProofService) GetVersionedWithProof(version int64, key hexutil.Bytes) (*ProofResult, error) {
 
 	s.rwLock.RLock()
 	defer s.rwLock.RUnlock()
@@ -239,384 +273,398 @@ func (s *IavlProofService) GetVersioned(version int64, key []byte) (hexutil.Byte
 		return nil, iavl.ErrVersionDoesNotExist
 	}
 
-	_, err := s.tree.GetImmutable(version)
+	return s.proof(key, version)
+}
+
+// BatchEntry is a key proven by a batch proof, the value is null when the key does not
+// exist
+type BatchEntry struct {
+	Key    hexutil.Bytes `json:"key"`
+	Value  hexutil.Bytes `json:"value"`
+	Exists bool          `json:"exists"`
+}
+
+// BatchProofResult is a compressed ICS23 batch proof of the membership or non-membership
+// of many keys against the root hash of a saved version
+type BatchProofResult struct {
+	Entries  []BatchEntry  `json:"entries"`
+	Version  int64         `json:"version"`
+	RootHash hexutil.Bytes `json:"rootHash"`
+	// Proof is a protobuf encoded compressed ics23.CommitmentProof
+	Proof hexutil.Bytes `json:"proof"`
+}
+
+// GetBatchProof returns the values of keys at a specific tree version, the latest saved
+// one when 0, with a single compressed proof of the existing and missing keys.
+func (s *IavlProofService) GetBatchProof(version int64, keys []hexutil.Bytes) (*BatchProofResult, error) {
+
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys to prove")
+	}
+
+	tree, err := s.immutable(version)
 	if err != nil {
 		return nil, err
 	}
 
-	var res map[string]interface{}
-	res["index"], res["value"] = s.tree.Get(key)
-	res["version"] = version
+	res := &BatchProofResult{Version: tree.Version(), RootHash: tree.Hash()}
+	proofs := make([]*ics23.CommitmentProof, 0, len(keys))
+	for _, key := range keys {
+		proof, value, err := commitmentProof(tree, key)
+		if err != nil {
+			return nil, err
+		}
+		proofs = append(proofs, proof)
+		res.Entries = append(res.Entries, BatchEntry{Key: key, Value: value, Exists: value != nil})
+	}
 
-	hexres, err := ToHex(res)
+	batch, err := ics23.CombineProofs(proofs)
 	if err != nil {
 		return nil, err
 	}
 
-	return hexres, nil
-}
-
-// GetVersionedWithProof returns a result containing the IAVL tree version and
-// value for a given key at a specific tree version including a verifiable Merkle
-// proof.
-// func (s *IavlProofService) GetVersionedWithProof(req *pb.GetVersionedRequest) (*pb.GetWithProofResponse, error) {
-
-// 	s.rwLock.RLock()
-// 	defer s.rwLock.RUnlock()
+	res.Proof, err = batch.Marshal()
+	if err != nil {
+		return nil, err
+	}
 
-// 	value, proof, err := s.tree.GetVersionedWithProof(req.Key, req.Version)
-// 	if err != nil {
-// 		return nil, err
-// 	}
+	return res, nil
+}
 
-// 	if value == nil {
-// 		s := status.New(codes.NotFound, "the key requested does not exist")
-// 		return nil, s.Err()
-// 	}
+// Prove returns the value for a given key at a specific tree version, the latest saved
+// one when 0, with an ICS23 membership proof, or a non-membership proof when the key
+// does not exist.
+func (s *IavlProofService) Prove(version int64, key hexutil.Bytes) (*ProofResult, error) {
 
-// 	proofPb := proof.ToProto()
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
 
-// 	return &pb.GetWithProofResponse{Value: value, Proof: proofPb}, nil
-// }
+	return s.proof(key, version)
+}
 
-// Set returns a result after inserting a key/value pair into the IAVL tree
-// based on the current state (version) of the tree.
-func (s *IavlProofService) Set(key []byte, value []byte) (hexutil.Bytes, error) {
+// Set inserts a key/value pair into the working tree, it returns whether an existing
+// value was updated.
+func (s *IavlProofService) Set(key hexutil.Bytes, value hexutil.Bytes) (bool, error) {
 
 	s.rwLock.Lock()
 	defer s.rwLock.Unlock()
 
 	if key == nil {
-		return nil, errors.New("key cannot be nil")
+		return false, errors.New("key cannot be nil")
 	}
 
 	if value == nil {
-		return nil, errors.New("value cannot be nil")
+		return false, errors.New("value cannot be nil")
 	}
 
-	var res map[string]interface{}
-	res["updated"] = s.tree.Set(key, value)
 	//TODO
 	//emits a graphsync event kv commited
 	//the message propagates through the graphsync network & gets stored
 	//Get proof with graphsync, verify if the proof is replicated elsewhere
 	//that proof wil be validated with
 	//will be necessary to make 2 or 3 extension data & 2 agents
+	return s.tree.Set(key, value), nil
+}
 
-	hexres, err := ToHex(res)
-	if err != nil {
-		return nil, err
-	}
+// Remove removes a key from the working tree.
+func (s *IavlProofService) Remove(key hexutil.Bytes) (*RemoveResult, error) {
+
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
 
-	return hexres, nil
+	value, removed := s.tree.Remove(key)
+	return &RemoveResult{Value: value, Removed: removed}, nil
 }
 
 // SaveVersion saves a new IAVL tree version to the DB based on the current
-// state (version) of the tree. It returns a result containing the hash and
-// new version number.
-// func (s *IavlProofService) saveVersion(_ *empty.Empty) (*pb.SaveVersionResponse, error) {
+// state (version) of the tree. It returns the hash and new version number.
+func (s *IavlProofService) SaveVersion() (*VersionResult, error) {
 
-// 	s.rwLock.Lock()
-// 	defer s.rwLock.Unlock()
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
 
-// 	root, version, err := s.tree.SaveVersion()
-// 	if err != nil {
-// 		return nil, err
-// 	}
+	root, version, err := s.tree.SaveVersion()
+	if err != nil {
+		return nil, err
+	}
 
-// 	return &pb.SaveVersionResponse{RootHash: root, Version: version}, nil
-// }
+	return &VersionResult{RootHash: root, Version: version}, nil
+}
 
 // DeleteVersion deletes an IAVL tree version from the DB. The version can then
-// no longer be accessed. It returns a result containing the version and root
-// hash of the versioned tree that was deleted.
-// func (s *IavlProofService) deleteVersion(req *pb.DeleteVersionRequest) (*pb.DeleteVersionResponse, error) {
-
-// 	s.rwLock.Lock()
-// 	defer s.rwLock.Unlock()
-
-// 	iTree, err := s.tree.GetImmutable(req.Version)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	if err := s.tree.DeleteVersion(req.Version); err != nil {
-// 		return nil, err
-// 	}
-
-// 	return &pb.DeleteVersionResponse{RootHash: iTree.Hash(), Version: req.Version}, nil
-// }
-
-// Version returns the IAVL tree version based on the current state.
-// func (s *IavlProofService) Version(_ *empty.Empty) (*pb.VersionResponse, error) {
-
-// 	s.rwLock.RLock()
-// 	defer s.rwLock.RUnlock()
-
-// 	return &pb.VersionResponse{Version: s.tree.Version()}, nil
-// }
-
-// Hash returns the IAVL tree root hash based on the current state.
-func (s *IavlProofService) Hash(_ *empty.Empty) (hexutil.Bytes, error) {
+// no longer be accessed. It returns the version and root hash of the versioned
+// tree that was deleted.
+func (s *IavlProofService) DeleteVersion(version int64) (*VersionResult, error) {
 
-	var res map[string]interface{}
-	res["hash"] = s.tree.Hash()
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
 
-	hexres, err := ToHex(res)
+	iTree, err := s.tree.GetImmutable(version)
 	if err != nil {
 		return nil, err
 	}
 
-	return hexres, nil
-}
+	if err := s.tree.DeleteVersion(version); err != nil {
+		return nil, err
+	}
 
-// VersionExists returns a result containing a boolean on whether or not a given
-// version exists in the IAVL tree.
-// func (s *IavlProofService) VersionExists(req *pb.VersionExistsRequest) (*pb.VersionExistsResponse, error) {
+	return &VersionResult{RootHash: iTree.Hash(), Version: version}, nil
+}
 
-// 	s.rwLock.RLock()
-// 	defer s.rwLock.RUnlock()
+// Version returns the IAVL tree version based on the current state.
+func (s *IavlProofService) Version() (int64, error) {
 
-// 	return &pb.VersionExistsResponse{Result: s.tree.VersionExists(req.Version)}, nil
-// }
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
 
-// Verify verifies an IAVL range proof returning an error if the proof is invalid.
-// func (*IavlProofService) Verify(ctx context.Context, req *pb.VerifyRequest) (*empty.Empty, error) {
+	return s.tree.Version(), nil
+}
 
-// 	proof, err := iavl.RangeProofFromProto(req.Proof)
+// Hash returns the IAVL tree root hash of the latest saved version.
+func (s *IavlProofService) Hash() (hexutil.Bytes, error) {
 
-// 	if err != nil {
-// 		return nil, err
-// 	}
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
 
-// 	if err := proof.Verify(req.RootHash); err != nil {
-// 		return nil, err
-// 	}
+	return s.tree.Hash(), nil
+}
 
-// 	return &empty.Empty{}, nil
-// }
+// VersionExists returns whether or not a given version exists in the IAVL tree.
+func (s *IavlProofService) VersionExists(version int64) (bool, error) {
 
-// VerifyItem verifies if a given key/value pair in an IAVL range proof returning
-// an error if the proof or key is invalid.
-// func (*IavlProofService) VerifyItem(ctx context.Context, req *pb.VerifyItemRequest) (*empty.Empty, error) {
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
 
-// 	proof, err := iavl.RangeProofFromProto(req.Proof)
+	return s.tree.VersionExists(version), nil
+}
 
-// 	if err != nil {
-// 		return nil, err
-// 	}
+// VerifyMembership verifies an ICS23 membership proof of a key/value pair against a
+// root hash, returning an error if the proof is invalid.
+func (*IavlProofService) VerifyMembership(rootHash, proof, key, value hexutil.Bytes) (bool, error) {
 
-// 	if err := proof.Verify(req.RootHash); err != nil {
-// 		return nil, err
-// 	}
+	if err := verify.VerifyMembership(rootHash, proof, key, value); err != nil {
+		return false, err
+	}
 
-// 	if err := proof.VerifyItem(req.Key, req.Value); err != nil {
-// 		return nil, err
-// 	}
+	return true, nil
+}
 
-// 	return &empty.Empty{}, nil
-// }
+// VerifyNonMembership verifies an ICS23 non-membership proof of a key against a root
+// hash, returning an error if the proof is invalid.
+func (*IavlProofService) VerifyNonMembership(rootHash, proof, key hexutil.Bytes) (bool, error) {
 
-// VerifyAbsence verifies the absence of a given key in an IAVL range proof
-// returning an error if the proof or key is invalid.
-// func (*IavlProofService) VerifyAbsence(ctx context.Context, req *pb.VerifyAbsenceRequest) (*empty.Empty, error) {
+	if err := verify.VerifyNonMembership(rootHash, proof, key); err != nil {
+		return false, err
+	}
 
-// 	proof, err := iavl.RangeProofFromProto(req.Proof)
+	return true, nil
+}
 
-// 	if err != nil {
-// 		return nil, err
-// 	}
+// VerifyBatch verifies a batch proof of the entries of a GetBatchProof result against a
+// root hash, returning an error if the proof is invalid.
+func (*IavlProofService) VerifyBatch(rootHash, proof hexutil.Bytes, entries []BatchEntry) (bool, error) {
 
-// 	if err := proof.Verify(req.RootHash); err != nil {
-// 		return nil, err
-// 	}
+	items := map[string][]byte{}
+	absent := [][]byte{}
+	for _, entry := range entries {
+		if entry.Exists {
+			items[string(entry.Key)] = entry.Value
+		} else {
+			absent = append(absent, entry.Key)
+		}
+	}
 
-// 	if err := proof.VerifyAbsence(req.Key); err != nil {
-// 		return nil, err
-// 	}
+	if err := verify.VerifyBatch(rootHash, proof, items, absent); err != nil {
+		return false, err
+	}
 
-// 	return &empty.Empty{}, nil
-// }
+	return true, nil
+}
 
 // Rollback resets the working tree to the latest saved version, discarding
 // any unsaved modifications.
-// func (s *IavlProofService) rollback(ctx context.Context, req *empty.Empty) (*empty.Empty, error) {
-
-// 	s.rwLock.Lock()
-// 	defer s.rwLock.Unlock()
+func (s *IavlProofService) Rollback() error {
 
-// 	s.tree.Rollback()
-// 	return &empty.Empty{}, nil
-// }
-
-// func (s *IavlProofService) GetAvailableVersions(ctx context.Context, req *empty.Empty) (*pb.GetAvailableVersionsResponse, error) {
-
-// 	s.rwLock.RLock()
-// 	defer s.rwLock.RUnlock()
-
-// 	versionsInts := s.tree.AvailableVersions()
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
 
-// 	versions := make([]int64, len(versionsInts))
+	s.tree.Rollback()
+	return nil
+}
 
-// 	for i, version := range versionsInts {
-// 		versions[i] = int64(version)
-// 	}
+// GetAvailableVersions returns the saved versions of the tree
+func (s *IavlProofService) GetAvailableVersions() ([]int64, error) {
 
-// 	return &pb.GetAvailableVersionsResponse{Versions: versions}, nil
-// }
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
 
-// func (s *IavlProofService) load(ctx context.Context, req *empty.Empty) (*empty.Empty, error) {
+	versionsInts := s.tree.AvailableVersions()
 
-// 	s.rwLock.Lock()
-// 	defer s.rwLock.Unlock()
+	versions := make([]int64, len(versionsInts))
 
-// 	_, err := s.tree.Load()
+	for i, version := range versionsInts {
+		versions[i] = int64(version)
+	}
 
-// 	return &empty.Empty{}, err
+	return versions, nil
+}
 
-// }
+// Load loads the latest version of the tree, it returns the loaded version
+func (s *IavlProofService) Load() (int64, error) {
 
-// func (s *IavlProofService) loadVersion(ctx context.Context, req *pb.LoadVersionRequest) (*empty.Empty, error) {
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
 
-// 	s.rwLock.Lock()
-// 	defer s.rwLock.Unlock()
+	return s.tree.Load()
+}
 
-// 	_, err := s.tree.LoadVersion(req.Version)
+// LoadVersion loads a specific version of the tree, the latest one when 0
+func (s *IavlProofService) LoadVersion(version int64) (int64, error) {
 
-// 	return &empty.Empty{}, err
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
 
-// }
+	return s.tree.LoadVersion(version)
+}
 
-// func (s *IavlProofService) loadVersionForOverwriting(ctx context.Context, req *pb.LoadVersionForOverwritingRequest) (*empty.Empty, error) {
+// LoadVersionForOverwriting loads a version of the tree and deletes the newer ones
+func (s *IavlProofService) LoadVersionForOverwriting(version int64) (int64, error) {
 
-// 	s.rwLock.Lock()
-// 	defer s.rwLock.Unlock()
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
 
-// 	_, err := s.tree.LoadVersionForOverwriting(req.Version)
+	return s.tree.LoadVersionForOverwriting(version)
+}
 
-// 	return &empty.Empty{}, err
+// Size returns the number of leaves of the working tree
+func (s *IavlProofService) Size() (int64, error) {
 
-// }
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
 
-// func (s *IavlProofService) Size(ctx context.Context, req *empty.Empty) (*pb.SizeResponse, error) {
+	return s.tree.Size(), nil
+}
 
-// 	s.rwLock.RLock()
-// 	defer s.rwLock.RUnlock()
+// List returns the key/value pairs of the working tree in [fromKey, toKey), all keys
+// when nil
+func (s *IavlProofService) List(fromKey, toKey hexutil.Bytes, descending bool) ([]KeyValue, error) {
 
-// 	return &pb.SizeResponse{Size_: s.tree.Size()}, nil
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
 
-// }
+	res := []KeyValue{}
+	s.tree.IterateRange(fromKey, toKey, !descending, func(k []byte, v []byte) bool {
+		res = append(res, KeyValue{Key: k, Value: v})
+		return false
+	})
 
-// func (s *IavlProofService) List(req *pb.ListRequest, stream pb.IAVLService_ListServer) error {
+	return res, nil
+}
 
-// 	s.rwLock.RLock()
-// 	defer s.rwLock.RUnlock()
+// IavlQueryService serves the reads, proofs and proof verification of an
+// IavlProofService, the working tree and its saved versions can't be changed through it
+type IavlQueryService struct {
+	service *IavlProofService
+}
 
-// 	var err error
+// HasVersioned returns whether or not the IAVL tree has a given version.
+func (q *IavlQueryService) HasVersioned(version int64) (bool, error) {
+	return q.service.HasVersioned(version)
+}
 
-// 	_ = s.tree.IterateRange(req.FromKey, req.ToKey, req.Descending, func(k []byte, v []byte) bool {
+// Has returns whether or not the IAVL tree has a given key in the current version
+func (q *IavlQueryService) Has(key hexutil.Bytes) (bool, error) {
+	return q.service.Has(key)
+}
 
-// 		res := &pb.ListResponse{Key: k, Value: v}
-// 		err = stream.Send(res)
-// 		return err != nil
-// 	})
+// Get returns the index and value for a given key based on the current state (version)
+// of the tree.
+func (q *IavlQueryService) Get(key hexutil.Bytes) (*GetResult, error) {
+	return q.service.Get(key)
+}
 
-// 	return err
+// GetByIndex returns the key and value for a given index based on the current state
+// (version) of the tree.
+func (q *IavlQueryService) GetByIndex(index int64) (*KeyValue, error) {
+	return q.service.GetByIndex(index)
+}
 
-// }
+// GetWithProof returns the value for a given key in the latest saved version of the
+// tree with its ICS23 proof.
+func (q *IavlQueryService) GetWithProof(key hexutil.Bytes) (*ProofResult, error) {
+	return q.service.GetWithProof(key)
+}
 
-// func msgHandler(ctx *IavlProofService, to string, name string, args map[string]string) (hexutil.Bytes, string, error) {
-// 	switch name {
+// GetVersioned returns the index and value for a given key at a specific tree version.
+func (q *IavlQueryService) GetVersioned(version int64, key hexutil.Bytes) (*GetResult, error) {
+	return q.service.GetVersioned(version, key)
+}
 
-// 	}
-// }
+// GetVersionedWithProof returns the value for a given key at a specific tree version
+// with its ICS23 proof.
+func (q *IavlQueryService) GetVersionedWithProof(version int64, key hexutil.Bytes) (*ProofResult, error) {
+	return q.service.GetVersionedWithProof(version, key)
+}
 
-// convertExistenceProof will convert the given proof into a valid
-// existence proof, if that's what it is.
-//
-// This is the simplest case of the range proof and we will focus on
-// demoing compatibility here
-func convertExistenceProof(p *iavl.RangeProof, key, value []byte) (*ics23.ExistenceProof, error) {
-	if len(p.Leaves) != 1 {
-		return nil, fmt.Errorf("Existence proof requires RangeProof to have exactly one leaf")
-	}
-	return &ics23.ExistenceProof{
-		Key:   key,
-		Value: value,
-		Leaf:  convertLeafOp(p.Leaves[0].Version),
-		Path:  convertInnerOps(p.LeftPath),
-	}, nil
+// GetBatchProof returns the values of keys at a specific tree version with a single
+// compressed proof.
+func (q *IavlQueryService) GetBatchProof(version int64, keys []hexutil.Bytes) (*BatchProofResult, error) {
+	return q.service.GetBatchProof(version, keys)
 }
 
-func convertLeafOp(version int64) *ics23.LeafOp {
-	// this is adapted from iavl/proof.go:proofLeafNode.Hash()
-	prefix := aminoVarInt(0)
-	prefix = append(prefix, aminoVarInt(1)...)
-	prefix = append(prefix, aminoVarInt(version)...)
+// Prove returns the value for a given key at a specific tree version with its ICS23
+// proof.
+func (q *IavlQueryService) Prove(version int64, key hexutil.Bytes) (*ProofResult, error) {
+	return q.service.Prove(version, key)
+}
 
-	return &ics23.LeafOp{
-		Hash:         ics23.HashOp_SHA256,
-		PrehashValue: ics23.HashOp_SHA256,
-		Length:       ics23.LengthOp_VAR_PROTO,
-		Prefix:       prefix,
-	}
+// Version returns the IAVL tree version based on the current state.
+func (q *IavlQueryService) Version() (int64, error) {
+	return q.service.Version()
 }
 
-// we cannot get the proofInnerNode type, so we need to do the whole path in one function
-func convertInnerOps(path iavl.PathToLeaf) []*ics23.InnerOp {
-	steps := make([]*ics23.InnerOp, 0, len(path))
+// Hash returns the IAVL tree root hash of the latest saved version.
+func (q *IavlQueryService) Hash() (hexutil.Bytes, error) {
+	return q.service.Hash()
+}
 
-	// lengthByte is the length prefix prepended to each of the sha256 sub-hashes
-	var lengthByte byte = 0x20
+// VersionExists returns whether or not a given version exists in the IAVL tree.
+func (q *IavlQueryService) VersionExists(version int64) (bool, error) {
+	return q.service.VersionExists(version)
+}
 
-	// we need to go in reverse order, iavl starts from root to leaf,
-	// we want to go up from the leaf to the root
-	for i := len(path) - 1; i >= 0; i-- {
-		// this is adapted from iavl/proof.go:proofInnerNode.Hash()
-		prefix := aminoVarInt(int64(path[i].Height))
-		prefix = append(prefix, aminoVarInt(path[i].Size)...)
-		prefix = append(prefix, aminoVarInt(path[i].Version)...)
+// VerifyMembership verifies an ICS23 membership proof of a key/value pair against a
+// root hash.
+func (q *IavlQueryService) VerifyMembership(rootHash, proof, key, value hexutil.Bytes) (bool, error) {
+	return q.service.VerifyMembership(rootHash, proof, key, value)
+}
 
-		var suffix []byte
-		if len(path[i].Left) > 0 {
-			// length prefixed left side
-			prefix = append(prefix, lengthByte)
-			prefix = append(prefix, path[i].Left...)
-			// prepend the length prefix for child
-			prefix = append(prefix, lengthByte)
-		} else {
-			// prepend the length prefix for child
-			prefix = append(prefix, lengthByte)
-			// length-prefixed right side
-			suffix = []byte{lengthByte}
-			suffix = append(suffix, path[i].Right...)
-		}
+// VerifyNonMembership verifies an ICS23 non-membership proof of a key against a root
+// hash.
+func (q *IavlQueryService) VerifyNonMembership(rootHash, proof, key hexutil.Bytes) (bool, error) {
+	return q.service.VerifyNonMembership(rootHash, proof, key)
+}
 
-		op := &ics23.InnerOp{
-			Hash:   ics23.HashOp_SHA256,
-			Prefix: prefix,
-			Suffix: suffix,
-		}
-		steps = append(steps, op)
-	}
-	return steps
+// VerifyBatch verifies a batch proof of the entries of a GetBatchProof result against a
+// root hash.
+func (q *IavlQueryService) VerifyBatch(rootHash, proof hexutil.Bytes, entries []BatchEntry) (bool, error) {
+	return q.service.VerifyBatch(rootHash, proof, entries)
 }
 
-func aminoVarInt(orig int64) []byte {
-	// amino-specific byte swizzling
-	i := uint64(orig) << 1
-	if orig < 0 {
-		i = ^i
-	}
+// GetAvailableVersions returns the saved versions of the tree
+func (q *IavlQueryService) GetAvailableVersions() ([]int64, error) {
+	return q.service.GetAvailableVersions()
+}
 
-	// avoid multiple allocs for normal case
-	res := make([]byte, 0, 8)
+// Size returns the number of leaves of the working tree
+func (q *IavlQueryService) Size() (int64, error) {
+	return q.service.Size()
+}
 
-	// standard protobuf encoding
-	for i >= 1<<7 {
-		res = append(res, uint8(i&0x7f|0x80))
-		i >>= 7
-	}
-	res = append(res, uint8(i))
-	return res
+// List returns the key/value pairs of the working tree in [fromKey, toKey)
+func (q *IavlQueryService) List(fromKey, toKey hexutil.Bytes, descending bool) ([]KeyValue, error) {
+	return q.service.List(fromKey, toKey, descending)
 }
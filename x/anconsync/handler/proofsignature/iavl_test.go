@@ -0,0 +1,230 @@
+package proofsignature
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/anconprotocol/node/x/anconsync/handler/proofsignature/verify"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	dbm "github.com/tendermint/tm-db"
+)
+
+func newTestIavl(t *testing.T, db dbm.DB) *IavlProofService {
+	api, err := NewIavlAPI(db, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api.Service
+}
+
+func TestIavlProofs(t *testing.T) {
+	s := newTestIavl(t, dbm.NewMemDB())
+	if _, err := s.GetWithProof([]byte("a")); err == nil {
+		t.Fatal("proved a key without saved version")
+	}
+	s.Set([]byte("a"), []byte("1"))
+	s.Set([]byte("b"), []byte("2"))
+	v1, err := s.SaveVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set([]byte("b"), []byte("3"))
+	s.Set([]byte("c"), []byte("4"))
+	v2, _ := s.SaveVersion()
+	if v1.Version != 1 || v2.Version != 2 || bytes.Equal(v1.RootHash, v2.RootHash) {
+		t.Fatalf("unexpected versions %v %v", v1, v2)
+	}
+
+	p, err := s.GetWithProof([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Value) != "3" || p.Version != 2 || !bytes.Equal(p.RootHash, v2.RootHash) {
+		t.Fatalf("unexpected proof %v", p)
+	}
+	if ok, err := s.VerifyMembership(p.RootHash, p.Proof, p.Key, p.Value); !ok || err != nil {
+		t.Fatalf("proof does not verify %v", err)
+	}
+	if ok, _ := s.VerifyMembership(p.RootHash, p.Proof, p.Key, []byte("2")); ok {
+		t.Fatal("proof verifies another value")
+	}
+
+	// a proof of an older version verifies against its own root only
+	p, err = s.GetVersionedWithProof(1, []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Value) != "2" || !bytes.Equal(p.RootHash, v1.RootHash) {
+		t.Fatalf("unexpected versioned proof %v", p)
+	}
+	if ok, _ := s.VerifyMembership(v1.RootHash, p.Proof, p.Key, p.Value); !ok {
+		t.Fatal("versioned proof does not verify")
+	}
+	if ok, _ := s.VerifyMembership(v2.RootHash, p.Proof, p.Key, p.Value); ok {
+		t.Fatal("versioned proof verifies against the latest root")
+	}
+	p, err = s.GetVersionedWithProof(1, []byte("c"))
+	if err != nil || p.Exists || p.Value != nil {
+		t.Fatalf("unexpected proof of a key missing from the version %v %v", p, err)
+	}
+	if ok, _ := s.VerifyNonMembership(v1.RootHash, p.Proof, p.Key); !ok {
+		t.Fatal("non-membership proof does not verify")
+	}
+	if ok, _ := s.VerifyNonMembership(v2.RootHash, p.Proof, p.Key); ok {
+		t.Fatal("non-membership proof verifies against the latest root")
+	}
+
+	deleted, err := s.DeleteVersion(1)
+	if err != nil || !bytes.Equal(deleted.RootHash, v1.RootHash) {
+		t.Fatalf("version was not deleted %v", err)
+	}
+	if ok, _ := s.VersionExists(1); ok {
+		t.Fatal("deleted version exists")
+	}
+	if _, err := s.GetVersionedWithProof(1, []byte("b")); err == nil {
+		t.Fatal("proved a key of a deleted version")
+	}
+	if versions, _ := s.GetAvailableVersions(); len(versions) != 1 || versions[0] != 2 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+}
+
+func TestIavlNonMembershipAndBatchProofs(t *testing.T) {
+	s := newTestIavl(t, dbm.NewMemDB())
+	for _, k := range []string{"did:web:b", "did:web:d", "did:web:f"} {
+		s.Set([]byte(k), []byte("cid:"+k))
+	}
+	saved, _ := s.SaveVersion()
+
+	// missing keys left of, between and right of the existing keys
+	for _, k := range []string{"did:web:a", "did:web:c", "did:web:e", "did:web:g"} {
+		p, err := s.Prove(0, []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Exists {
+			t.Fatalf("%s exists", k)
+		}
+		if err := verify.VerifyNonMembership(saved.RootHash, p.Proof, []byte(k)); err != nil {
+			t.Fatalf("%s %v", k, err)
+		}
+		if err := verify.VerifyNonMembership(saved.RootHash, p.Proof, []byte("did:web:d")); err == nil {
+			t.Fatalf("proof of %s proves an existing key is absent", k)
+		}
+	}
+
+	keys := []hexutil.Bytes{[]byte("did:web:b"), []byte("did:web:c"), []byte("did:web:f"), []byte("did:web:z")}
+	batch, err := s.GetBatchProof(0, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Entries) != 4 || !batch.Entries[0].Exists || batch.Entries[1].Exists || string(batch.Entries[2].Value) != "cid:did:web:f" {
+		t.Fatalf("unexpected batch %v", batch.Entries)
+	}
+	if ok, err := s.VerifyBatch(batch.RootHash, batch.Proof, batch.Entries); !ok {
+		t.Fatalf("batch proof does not verify %v", err)
+	}
+	batch.Entries[2].Value = []byte("forged")
+	if ok, _ := s.VerifyBatch(batch.RootHash, batch.Proof, batch.Entries); ok {
+		t.Fatal("batch proof verifies a forged value")
+	}
+	err = verify.VerifyBatch(batch.RootHash, batch.Proof, nil, [][]byte{[]byte("did:web:d")})
+	if err == nil {
+		t.Fatal("batch proof proves a key it does not cover")
+	}
+	if _, err := s.GetBatchProof(2, keys); err == nil {
+		t.Fatal("proved keys of a missing version")
+	}
+}
+
+func TestIavlWorkingTree(t *testing.T) {
+	db := dbm.NewMemDB()
+	s := newTestIavl(t, db)
+	s.Set([]byte("a"), []byte("1"))
+	s.Set([]byte("b"), []byte("2"))
+	s.SaveVersion()
+
+	s.Set([]byte("c"), []byte("3"))
+	if removed, _ := s.Remove([]byte("a")); !removed.Removed || string(removed.Value) != "1" {
+		t.Fatalf("key was not removed %v", removed)
+	}
+	if list, _ := s.List(nil, nil, true); len(list) != 2 || string(list[0].Key) != "c" {
+		t.Fatalf("unexpected working tree %v", list)
+	}
+	s.Rollback()
+	if has, _ := s.Has([]byte("a")); !has {
+		t.Fatal("rollback did not restore the saved version")
+	}
+	if res, _ := s.Get([]byte("c")); res.Value != nil || res.Index != 2 {
+		t.Fatalf("unexpected missing key %v", res)
+	}
+	if kv, err := s.GetByIndex(1); err != nil || string(kv.Key) != "b" {
+		t.Fatalf("unexpected key at index 1 %v", kv)
+	}
+
+	// the saved versions are loaded from the db
+	reopened := newTestIavl(t, db)
+	if v, _ := reopened.Version(); v != 1 {
+		t.Fatalf("unexpected loaded version %d", v)
+	}
+	if res, _ := reopened.GetVersioned(1, []byte("b")); string(res.Value) != "2" {
+		t.Fatalf("unexpected loaded value %v", res)
+	}
+}
+
+func TestIavlRPC(t *testing.T) {
+	api, err := NewIavlAPI(dbm.NewMemDB(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := rpc.NewServer()
+	if err := admin.RegisterName(api.Namespace, api.Service); err != nil {
+		t.Fatal(err)
+	}
+	adminClient := rpc.DialInProc(admin)
+	defer adminClient.Close()
+	server := rpc.NewServer()
+	if err := server.RegisterName(api.Namespace, api.Query); err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.DialInProc(server)
+	defer client.Close()
+
+	var updated bool
+	if err := adminClient.Call(&updated, "iavl_set", hexutil.Bytes("key"), hexutil.Bytes("value")); err != nil {
+		t.Fatal(err)
+	}
+	var saved VersionResult
+	if err := adminClient.Call(&saved, "iavl_saveVersion"); err != nil {
+		t.Fatal(err)
+	}
+	for method, args := range map[string][]interface{}{
+		"iavl_set":                       {hexutil.Bytes("key"), hexutil.Bytes("other")},
+		"iavl_remove":                    {hexutil.Bytes("key")},
+		"iavl_saveVersion":               {},
+		"iavl_deleteVersion":             {int64(1)},
+		"iavl_rollback":                  {},
+		"iavl_loadVersion":               {int64(1)},
+		"iavl_loadVersionForOverwriting": {int64(1)},
+	} {
+		if err := client.Call(nil, method, args...); err == nil {
+			t.Fatalf("%s is served by the query namespace", method)
+		}
+	}
+	var p ProofResult
+	if err := client.Call(&p, "iavl_getWithProof", hexutil.Bytes("key")); err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Value) != "value" || !bytes.Equal(p.RootHash, saved.RootHash) {
+		t.Fatalf("unexpected proof %v", p)
+	}
+	var ok bool
+	if err := client.Call(&ok, "iavl_verifyMembership", p.RootHash, p.Proof, p.Key, p.Value); err != nil || !ok {
+		t.Fatalf("proof does not verify over rpc %v", err)
+	}
+	var version int64
+	if err := client.Call(&version, "iavl_version"); err != nil || version != 1 {
+		t.Fatalf("unexpected version %d %v", version, err)
+	}
+}
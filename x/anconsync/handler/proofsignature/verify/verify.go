@@ -0,0 +1,65 @@
+// Package verify checks the ICS23 proofs served by the node against an IAVL root hash.
+// It only depends on the ICS23 library and can be used by clients.
+package verify
+
+import (
+	"fmt"
+
+	ics23 "github.com/confio/ics23/go"
+)
+
+// Decode unmarshals a protobuf encoded commitment proof, compressed batch proofs are
+// decompressed
+func Decode(proof []byte) (*ics23.CommitmentProof, error) {
+	p := &ics23.CommitmentProof{}
+	if err := p.Unmarshal(proof); err != nil {
+		return nil, fmt.Errorf("invalid commitment proof %v", err)
+	}
+	return ics23.Decompress(p), nil
+}
+
+// VerifyMembership verifies that proof, a single or batch proof, proves key maps to
+// value under root
+func VerifyMembership(root, proof, key, value []byte) error {
+	p, err := Decode(proof)
+	if err != nil {
+		return err
+	}
+	if !ics23.VerifyMembership(ics23.IavlSpec, root, p, key, value) {
+		return fmt.Errorf("invalid membership proof of %x", key)
+	}
+	return nil
+}
+
+// VerifyNonMembership verifies that proof, a single or batch proof, proves key is absent
+// under root
+func VerifyNonMembership(root, proof, key []byte) error {
+	p, err := Decode(proof)
+	if err != nil {
+		return err
+	}
+	if !ics23.VerifyNonMembership(ics23.IavlSpec, root, p, key) {
+		return fmt.Errorf("invalid non-membership proof of %x", key)
+	}
+	return nil
+}
+
+// VerifyBatch verifies that a batch proof proves each key of items maps to its value and
+// each of absent keys is absent under root
+func VerifyBatch(root, proof []byte, items map[string][]byte, absent [][]byte) error {
+	p, err := Decode(proof)
+	if err != nil {
+		return err
+	}
+	for k, v := range items {
+		if !ics23.VerifyMembership(ics23.IavlSpec, root, p, []byte(k), v) {
+			return fmt.Errorf("invalid membership proof of %x", k)
+		}
+	}
+	for _, k := range absent {
+		if !ics23.VerifyNonMembership(ics23.IavlSpec, root, p, k) {
+			return fmt.Errorf("invalid non-membership proof of %x", k)
+		}
+	}
+	return nil
+}
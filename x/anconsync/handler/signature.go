@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// EIP712Domain is the subset of the EIP-712 domain used by the node
+type EIP712Domain struct {
+	Name              string
+	Version           string
+	ChainID           int64
+	VerifyingContract common.Address
+}
+
+// Separator returns the EIP-712 domain separator, chainId and verifyingContract are
+// only part of the domain type when set
+func (d EIP712Domain) Separator() []byte {
+	domainType := "EIP712Domain(string name,string version"
+	fields := [][]byte{
+		crypto.Keccak256([]byte(d.Name)),
+		crypto.Keccak256([]byte(d.Version)),
+	}
+	if d.ChainID != 0 {
+		domainType += ",uint256 chainId"
+		fields = append(fields, common.BigToHash(big.NewInt(d.ChainID)).Bytes())
+	}
+	if d.VerifyingContract != (common.Address{}) {
+		domainType += ",address verifyingContract"
+		fields = append(fields, common.LeftPadBytes(d.VerifyingContract.Bytes(), 32))
+	}
+	domainType += ")"
+	return crypto.Keccak256(append([][]byte{crypto.Keccak256([]byte(domainType))}, fields...)...)
+}
+
+// TypedDataHash returns the EIP-712 digest for an already encoded struct hash
+func (d EIP712Domain) TypedDataHash(structHash []byte) []byte {
+	return crypto.Keccak256([]byte("\x19\x01"), d.Separator(), structHash)
+}
+
+// normalizeSignature returns a copy of sig with the recovery id in 0/1 form
+func normalizeSignature(sig []byte) ([]byte, error) {
+	if len(sig) != crypto.SignatureLength {
+		return nil, fmt.Errorf("invalid signature length %d", len(sig))
+	}
+	out := make([]byte, len(sig))
+	copy(out, sig)
+	if out[crypto.RecoveryIDOffset] >= 27 {
+		out[crypto.RecoveryIDOffset] -= 27
+	}
+	return out, nil
+}
+
+// RecoverAddress returns the signer address of a 65 byte hex signature over digest
+func RecoverAddress(digest []byte, signature string) (common.Address, error) {
+	bz, err := hexutil.Decode(signature)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid signature %v", err)
+	}
+	sig, err := normalizeSignature(bz)
+	if err != nil {
+		return common.Address{}, err
+	}
+	pub, err := crypto.SigToPub(digest, sig)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid signature %v", err)
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+// RecoverPersonalSign returns the signer of an EIP-191 personal_sign message
+func RecoverPersonalSign(message []byte, signature string) (common.Address, error) {
+	return RecoverAddress(accounts.TextHash(message), signature)
+}
@@ -0,0 +1,298 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+const (
+	SignatureTypeJWS    = "jws"
+	SignatureTypeEIP191 = "eip191"
+	SignatureTypeEIP712 = "eip712"
+
+	SignatureHeader     = "X-Ancon-Signature"
+	SignatureTypeHeader = "X-Ancon-Signature-Type"
+	SignerHeader        = "X-Ancon-Signer"
+)
+
+// Write routes that can require a signature
+const (
+	WriteRouteDagJson = "dagjson"
+	WriteRouteDagCbor = "dagcbor"
+	WriteRouteFile    = "file"
+)
+
+// AnconWriteDomain is the EIP-712 domain for signed writes
+var AnconWriteDomain = EIP712Domain{
+	Name:    "Ancon Protocol",
+	Version: "1",
+}
+
+// AnconWriteHash returns the EIP-712 digest of AnconWrite(string cid)
+func AnconWriteHash(cid string) []byte {
+	structHash := crypto.Keccak256(
+		crypto.Keccak256([]byte("AnconWrite(string cid)")),
+		crypto.Keccak256([]byte(cid)),
+	)
+	return AnconWriteDomain.TypedDataHash(structHash)
+}
+
+func signerKey(address common.Address) string {
+	return strings.Join([]string{"signer", strings.ToLower(address.Hex())}, ":")
+}
+
+// envelopeKey is the key of the first envelope of a block, or of the envelope of signer
+// when set
+func envelopeKey(lnk datamodel.Link, signer string) string {
+	if signer == "" {
+		return strings.Join([]string{"envelope", lnk.String()}, ":")
+	}
+	return strings.Join([]string{"envelope", lnk.String(), strings.ToLower(signer)}, ":")
+}
+
+// RegisterAddress records an Ethereum address as an allowed writer, did is the identity
+// it signs for and may be empty
+func (dagctx *AnconSyncContext) RegisterAddress(ctx context.Context, address common.Address, did string) error {
+	return dagctx.Store.DataStore.Put(ctx, signerKey(address), []byte(did))
+}
+
+// RegisterSigner records the Ethereum address of a secp256k1 DID key as an allowed writer
+func (dagctx *AnconSyncContext) RegisterSigner(ctx context.Context, pub []byte, did string) error {
+	var key []byte
+	switch len(pub) {
+	case 33:
+		pk, err := crypto.DecompressPubkey(pub)
+		if err != nil {
+			return err
+		}
+		key = crypto.FromECDSAPub(pk)
+	case 65:
+		key = pub
+	default:
+		return fmt.Errorf("not a secp256k1 public key")
+	}
+	pk, err := crypto.UnmarshalPubkey(key)
+	if err != nil {
+		return err
+	}
+	return dagctx.RegisterAddress(ctx, crypto.PubkeyToAddress(*pk), did)
+}
+
+// IsRegisteredSigner returns the DID an Ethereum address was registered with
+func (dagctx *AnconSyncContext) IsRegisteredSigner(ctx context.Context, address common.Address) (string, bool) {
+	value, err := dagctx.Store.DataStore.Get(ctx, signerKey(address))
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+// RequiresSignature returns true when route is configured for signed writes
+func (dagctx *AnconSyncContext) RequiresSignature(route string) bool {
+	for _, r := range dagctx.SignedWrites {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyWriteSignature checks a signature over the CID of a write and returns the signer
+func (dagctx *AnconSyncContext) VerifyWriteSignature(ctx context.Context, sigType string, signature string, signer string, lnk datamodel.Link) (string, error) {
+	switch sigType {
+	case SignatureTypeJWS:
+		jws, err := ParseCompactJWS(signature)
+		if err != nil {
+			return "", err
+		}
+		payload, signers, err := VerifyJWS(jws, dagctx.ResolveSecp256k1Key)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(payload, []byte(lnk.Binary())) {
+			return "", fmt.Errorf("JWS payload does not match %s", lnk)
+		}
+		// did:key signers carry their key, other DIDs resolve from the store
+		_, pub, err := DecodeDidKey(signers[0])
+		if err != nil {
+			pub, err = dagctx.ResolveSecp256k1Key(signers[0])
+			if err != nil {
+				return "", err
+			}
+		}
+		pk, err := crypto.DecompressPubkey(pub)
+		if err != nil {
+			pk, err = crypto.UnmarshalPubkey(pub)
+			if err != nil {
+				return "", err
+			}
+		}
+		address := crypto.PubkeyToAddress(*pk)
+		if signer != "" && !strings.EqualFold(signer, signers[0]) && !strings.EqualFold(signer, address.Hex()) {
+			return "", fmt.Errorf("signature does not match signer %s", signer)
+		}
+		if _, ok := dagctx.IsRegisteredSigner(ctx, address); !ok {
+			return "", fmt.Errorf("signer %s is not registered", signers[0])
+		}
+		return signers[0], nil
+	case SignatureTypeEIP191, SignatureTypeEIP712:
+		var digest []byte
+		if sigType == SignatureTypeEIP191 {
+			digest = accounts.TextHash([]byte(lnk.String()))
+		} else {
+			digest = AnconWriteHash(lnk.String())
+		}
+		address, err := RecoverAddress(digest, signature)
+		if err != nil {
+			return "", err
+		}
+		if signer != "" && !strings.EqualFold(signer, address.Hex()) {
+			return "", fmt.Errorf("signature does not match signer %s", signer)
+		}
+		if _, ok := dagctx.IsRegisteredSigner(ctx, address); !ok {
+			return "", fmt.Errorf("signer %s is not registered", address.Hex())
+		}
+		return address.Hex(), nil
+	default:
+		return "", fmt.Errorf("unsupported signature type %s", sigType)
+	}
+}
+
+// StoreWriteEnvelope stores the authorship envelope of a signed write. The first envelope
+// of a block and of each signer is kept, a later signature of the same CID does not
+// replace the original authorship.
+func (dagctx *AnconSyncContext) StoreWriteEnvelope(ctx context.Context, lnk datamodel.Link, signer string, sigType string, signature string) (datamodel.Link, error) {
+	if value, err := dagctx.Store.DataStore.Get(ctx, envelopeKey(lnk, signer)); err == nil {
+		if existing, err := anconsync.ParseCidLink(string(value)); err == nil {
+			return existing, nil
+		}
+	}
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, 5, func(na fluent.MapAssembler) {
+		na.AssembleEntry("data").AssignLink(lnk)
+		na.AssembleEntry("signer").AssignString(signer)
+		na.AssembleEntry("signatureType").AssignString(sigType)
+		na.AssembleEntry("signature").AssignString(signature)
+		na.AssembleEntry("timestamp").AssignInt(time.Now().Unix())
+	})
+	envelope := dagctx.Store.Store(ipld.LinkContext{}, n)
+	if err := dagctx.Store.DataStore.Put(ctx, envelopeKey(lnk, signer), []byte(envelope.String())); err != nil {
+		return nil, err
+	}
+	exists, err := dagctx.Store.DataStore.Has(ctx, envelopeKey(lnk, ""))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := dagctx.Store.DataStore.Put(ctx, envelopeKey(lnk, ""), []byte(envelope.String())); err != nil {
+			return nil, err
+		}
+	}
+	return envelope, nil
+}
+
+// signedWrite verifies the signature headers for a node about to be written on route.
+// It returns the CID the node will be stored under and the verified signer, signer is
+// empty for unsigned writes on routes that do not require a signature.
+func (dagctx *AnconSyncContext) signedWrite(c *gin.Context, route string, n datamodel.Node) (datamodel.Link, string, error) {
+	lnk, err := dagctx.Store.LinkSystem.ComputeLink(anconsync.GetDagJSONLinkPrototype(), n)
+	if err != nil {
+		return nil, "", err
+	}
+	signature := c.GetHeader(SignatureHeader)
+	if signature == "" {
+		if dagctx.RequiresSignature(route) {
+			return nil, "", fmt.Errorf("missing %s header", SignatureHeader)
+		}
+		return lnk, "", nil
+	}
+	signer, err := dagctx.VerifyWriteSignature(c.Request.Context(), c.GetHeader(SignatureTypeHeader), signature, c.GetHeader(SignerHeader), lnk)
+	if err != nil {
+		return nil, "", err
+	}
+	return lnk, signer, nil
+}
+
+// storeSignedWrite stores the envelope when signer is set and returns the response body
+func (dagctx *AnconSyncContext) storeSignedWrite(c *gin.Context, lnk datamodel.Link, signer string) (gin.H, error) {
+	res := gin.H{
+		"cid": lnk,
+	}
+	if signer != "" {
+		envelope, err := dagctx.StoreWriteEnvelope(c.Request.Context(), lnk, signer, c.GetHeader(SignatureTypeHeader), c.GetHeader(SignatureHeader))
+		if err != nil {
+			return nil, fmt.Errorf("failed to store envelope %v", err)
+		}
+		res["envelope"] = envelope
+	}
+	return res, nil
+}
+
+// readEnvelope writes the authorship envelope of a block when requested with
+// ?envelope=true, the first one or the one of ?signer=
+func (dagctx *AnconSyncContext) readEnvelope(c *gin.Context, lnk datamodel.Link) bool {
+	if c.Query("envelope") != "true" {
+		return false
+	}
+	value, err := dagctx.Store.DataStore.Get(c.Request.Context(), envelopeKey(lnk, c.Query("signer")))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"error": fmt.Errorf("envelope not found for %s", lnk).Error(),
+		})
+		return true
+	}
+	data, err := anconsync.ReadFromStore(dagctx.Store, string(value), "")
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("%v", err).Error(),
+		})
+		return true
+	}
+	c.JSON(200, data)
+	return true
+}
+
+// @BasePath /v0
+// CreateSigner godoc
+// @Summary Registers a signer
+// @Schemes
+// @Description Allows an Ethereum address to sign writes. The optional did is returned as the identity of the signer.
+// @Tags signed-writes
+// @Accept json
+// @Produce json
+// @Success 201
+// @Router /v0/signers [post]
+func (dagctx *AnconSyncContext) CreateSigner(c *gin.Context) {
+	var v map[string]string
+
+	c.BindJSON(&v)
+	if !common.IsHexAddress(v["address"]) {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("invalid address %s", v["address"]).Error(),
+		})
+		return
+	}
+	address := common.HexToAddress(v["address"])
+	if err := dagctx.RegisterAddress(c.Request.Context(), address, v["did"]); err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("failed to register signer %v", err).Error(),
+		})
+		return
+	}
+	c.JSON(201, gin.H{
+		"address": address.Hex(),
+		"did":     v["did"],
+	})
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+func TestWriteEnvelopeKeepsAuthorship(t *testing.T) {
+	ctx := context.Background()
+	dagctx := newTestIndex(t)
+	lnk := dagctx.Store.Store(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("name").AssignString("doc")
+	}))
+
+	first, err := dagctx.StoreWriteEnvelope(ctx, lnk, "0xAaaa", SignatureTypeEIP712, "0x01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := dagctx.StoreWriteEnvelope(ctx, lnk, "0xAaaa", SignatureTypeEIP712, "0x02"); again.String() != first.String() {
+		t.Fatal("envelope of a signer was replaced")
+	}
+	second, err := dagctx.StoreWriteEnvelope(ctx, lnk, "0xBbbb", SignatureTypeEIP712, "0x03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.String() == first.String() {
+		t.Fatal("another signer got the first envelope")
+	}
+	value, err := dagctx.Store.DataStore.Get(ctx, envelopeKey(lnk, ""))
+	if err != nil || string(value) != first.String() {
+		t.Fatalf("first envelope was replaced %s", value)
+	}
+	value, err = dagctx.Store.DataStore.Get(ctx, envelopeKey(lnk, "0xbbbb"))
+	if err != nil || string(value) != second.String() {
+		t.Fatalf("unexpected envelope of the second signer %s", value)
+	}
+}
+
+func TestVerifyWriteSignature(t *testing.T) {
+	ctx := context.Background()
+	dagctx := newTestIndex(t)
+	lnk := dagctx.Store.Store(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("name").AssignString("doc")
+	}))
+	other := dagctx.Store.Store(ipld.LinkContext{}, basicnode.NewString("other"))
+
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	did := Secp256k1DidKey(&key.PublicKey)
+	sign := func(digest []byte) string {
+		sig, err := crypto.Sign(digest, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hexutil.Encode(sig)
+	}
+	jws, err := SignJWS(key, []byte(lnk.Binary()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := strings.Join([]string{jws.Signatures[0].Protected, jws.Payload, jws.Signatures[0].Signature}, ".")
+	signatures := map[string]string{
+		SignatureTypeJWS:    compact,
+		SignatureTypeEIP191: sign(accounts.TextHash([]byte(lnk.String()))),
+		SignatureTypeEIP712: sign(AnconWriteHash(lnk.String())),
+	}
+
+	for sigType, signature := range signatures {
+		if _, err := dagctx.VerifyWriteSignature(ctx, sigType, signature, "", lnk); err == nil {
+			t.Fatalf("%s: accepted an unregistered signer", sigType)
+		}
+	}
+	if err := dagctx.RegisterAddress(ctx, address, ""); err != nil {
+		t.Fatal(err)
+	}
+	for sigType, signature := range signatures {
+		signer, err := dagctx.VerifyWriteSignature(ctx, sigType, signature, "", lnk)
+		if err != nil {
+			t.Fatalf("%s: %v", sigType, err)
+		}
+		if signer != address.Hex() && signer != did {
+			t.Fatalf("%s: unexpected signer %s", sigType, signer)
+		}
+		if _, err := dagctx.VerifyWriteSignature(ctx, sigType, signature, address.Hex(), lnk); err != nil {
+			t.Fatalf("%s: rejected the signer header %v", sigType, err)
+		}
+		if _, err := dagctx.VerifyWriteSignature(ctx, sigType, signature, "0x000000000000000000000000000000000000dEaD", lnk); err == nil {
+			t.Fatalf("%s: accepted another signer header", sigType)
+		}
+		if _, err := dagctx.VerifyWriteSignature(ctx, sigType, signature, "", other); err == nil {
+			t.Fatalf("%s: accepted a signature of another CID", sigType)
+		}
+	}
+	if _, err := dagctx.VerifyWriteSignature(ctx, SignatureTypeJWS, compact, did, lnk); err != nil {
+		t.Fatalf("rejected the signer DID %v", err)
+	}
+	if _, err := dagctx.VerifyWriteSignature(ctx, "pgp", "0x01", "", lnk); err == nil {
+		t.Fatal("accepted an unsupported signature type")
+	}
+}
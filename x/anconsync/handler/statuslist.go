@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// StatusList2021 recommends a minimum of 16KB (131,072 entries) for herd privacy
+	StatusListLength = 131072
+)
+
+// StatusList is an uncompressed StatusList2021 bitstring
+type StatusList []byte
+
+func NewStatusList() StatusList {
+	return make(StatusList, StatusListLength/8)
+}
+
+// Set flips the bit for index, the left-most bit of the first byte is index 0
+func (l StatusList) Set(index int, value bool) error {
+	if index < 0 || index >= len(l)*8 {
+		return fmt.Errorf("status list index %d out of range", index)
+	}
+	mask := byte(1 << (7 - uint(index%8)))
+	if value {
+		l[index/8] |= mask
+	} else {
+		l[index/8] &^= mask
+	}
+	return nil
+}
+
+// Get returns the bit for index
+func (l StatusList) Get(index int) (bool, error) {
+	if index < 0 || index >= len(l)*8 {
+		return false, fmt.Errorf("status list index %d out of range", index)
+	}
+	mask := byte(1 << (7 - uint(index%8)))
+	return l[index/8]&mask != 0, nil
+}
+
+// Encode gzip compresses and base64url encodes the bitstring, as used by encodedList
+func (l StatusList) Encode() (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(l); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// DecodeStatusList expands an encodedList value into a bitstring
+func DecodeStatusList(encoded string) (StatusList, error) {
+	bz, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoded list %v", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(bz))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoded list %v", err)
+	}
+	defer zr.Close()
+	list, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoded list %v", err)
+	}
+	return StatusList(list), nil
+}
@@ -0,0 +1,378 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// MaxTimestampBatch is the maximum number of CIDs timestamped by one request
+const MaxTimestampBatch = 1000
+
+// TimestampProof is the signed attestation that a CID existed at a time, the CID is a
+// leaf of a Merkle tree whose root hash and timestamp are signed by the node key
+type TimestampProof struct {
+	Cid       string         `json:"cid"`
+	Index     int64          `json:"index"`
+	Path      []common.Hash  `json:"path"`
+	Root      common.Hash    `json:"root"`
+	Timestamp int64          `json:"timestamp"`
+	Signer    common.Address `json:"signer"`
+	Signature hexutil.Bytes  `json:"signature"`
+	Batch     string         `json:"batch"`
+}
+
+// TimestampIndexKey is the index key of the batch block of a timestamp root
+func TimestampIndexKey(root common.Hash) string {
+	return strings.Join([]string{"timestamp", root.Hex()}, ":")
+}
+
+// TimestampHash returns the EIP-712 digest of AnconTimestamp(bytes32 root,uint256 timestamp)
+func TimestampHash(root common.Hash, timestamp int64) []byte {
+	structHash := crypto.Keccak256(
+		crypto.Keccak256([]byte("AnconTimestamp(bytes32 root,uint256 timestamp)")),
+		root.Bytes(),
+		common.BigToHash(big.NewInt(timestamp)).Bytes(),
+	)
+	return AnconWriteDomain.TypedDataHash(structHash)
+}
+
+// timestampLeaf is the Merkle leaf of a CID, the keccak256 of its binary form
+func timestampLeaf(cid string) (common.Hash, error) {
+	lnk, err := anconsync.ParseCidLink(cid)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("invalid cid %s", cid)
+	}
+	return crypto.Keccak256Hash(lnk.Cid.Bytes()), nil
+}
+
+// hashTimestampPair hashes two nodes in sorted order, so a path needs no left or right
+// flags and can be checked with OpenZeppelin MerkleProof
+func hashTimestampPair(a, b common.Hash) common.Hash {
+	if bytes.Compare(a.Bytes(), b.Bytes()) > 0 {
+		a, b = b, a
+	}
+	return crypto.Keccak256Hash(a.Bytes(), b.Bytes())
+}
+
+// timestampTree returns the Merkle root of leaves and the path of each leaf, the last
+// node of an odd level is carried to the next level
+func timestampTree(leaves []common.Hash) (common.Hash, [][]common.Hash) {
+	paths := make([][]common.Hash, len(leaves))
+	// positions of each leaf in the current level
+	positions := make([]int, len(leaves))
+	for i := range positions {
+		positions[i] = i
+	}
+	level := leaves
+	for len(level) > 1 {
+		next := []common.Hash{}
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, hashTimestampPair(level[i], level[i+1]))
+			}
+		}
+		for leaf, p := range positions {
+			if sibling := p ^ 1; sibling < len(level) {
+				paths[leaf] = append(paths[leaf], level[sibling])
+			}
+			positions[leaf] = p / 2
+		}
+		level = next
+	}
+	return level[0], paths
+}
+
+// VerifyTimestampProof checks that the CID of p is a leaf of the signed root
+func VerifyTimestampProof(p *TimestampProof) error {
+	node, err := timestampLeaf(p.Cid)
+	if err != nil {
+		return err
+	}
+	for _, sibling := range p.Path {
+		node = hashTimestampPair(node, sibling)
+	}
+	if node != p.Root {
+		return fmt.Errorf("%s is not included in root %s", p.Cid, p.Root.Hex())
+	}
+	address, err := RecoverAddress(TimestampHash(p.Root, p.Timestamp), hexutil.Encode(p.Signature))
+	if err != nil {
+		return err
+	}
+	if address != p.Signer {
+		return fmt.Errorf("timestamp signature mismatch")
+	}
+	return nil
+}
+
+func (p *TimestampProof) node(cid datamodel.Link, batch datamodel.Link) datamodel.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 8, func(na fluent.MapAssembler) {
+		na.AssembleEntry("cid").AssignLink(cid)
+		na.AssembleEntry("index").AssignInt(p.Index)
+		na.AssembleEntry("path").CreateList(int64(len(p.Path)), func(la fluent.ListAssembler) {
+			for _, h := range p.Path {
+				la.AssembleValue().AssignString(h.Hex())
+			}
+		})
+		na.AssembleEntry("root").AssignString(p.Root.Hex())
+		na.AssembleEntry("timestamp").AssignInt(p.Timestamp)
+		na.AssembleEntry("signer").AssignString(p.Signer.Hex())
+		na.AssembleEntry("signature").AssignString(p.Signature.String())
+		na.AssembleEntry("batch").AssignLink(batch)
+	})
+}
+
+// LoadTimestampProof loads a timestamp proof block
+func LoadTimestampProof(s anconsync.Storage, lnk datamodel.Link) (*TimestampProof, error) {
+	n, err := s.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, err
+	}
+	p := &TimestampProof{}
+	links := map[string]*string{"cid": &p.Cid, "batch": &p.Batch}
+	for name, v := range links {
+		f, err := n.LookupByString(name)
+		if err != nil {
+			return nil, fmt.Errorf("timestamp proof has no %s", name)
+		}
+		l, err := f.AsLink()
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp proof %s", name)
+		}
+		*v = l.String()
+	}
+	ints := map[string]*int64{"index": &p.Index, "timestamp": &p.Timestamp}
+	for name, v := range ints {
+		f, err := n.LookupByString(name)
+		if err != nil {
+			return nil, fmt.Errorf("timestamp proof has no %s", name)
+		}
+		*v, _ = f.AsInt()
+	}
+	field := func(name string) string {
+		v, err := n.LookupByString(name)
+		if err != nil {
+			return ""
+		}
+		s, _ := v.AsString()
+		return s
+	}
+	p.Root = common.HexToHash(field("root"))
+	p.Signer = common.HexToAddress(field("signer"))
+	p.Signature = common.FromHex(field("signature"))
+	path, err := n.LookupByString("path")
+	if err != nil {
+		return nil, fmt.Errorf("timestamp proof has no path")
+	}
+	it := path.ListIterator()
+	for it != nil && !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		h, _ := v.AsString()
+		p.Path = append(p.Path, common.HexToHash(h))
+	}
+	return p, nil
+}
+
+// Timestamp signs the Merkle root of cids with the current time and stores a batch
+// block and a dag-cbor proof block per CID. The root is written to the authenticated
+// index, so on-chain anchors of the index cover it.
+func (dagctx *AnconSyncContext) Timestamp(ctx context.Context, cids []string) (datamodel.Link, map[string]datamodel.Link, []*TimestampProof, error) {
+	if len(cids) == 0 || len(cids) > MaxTimestampBatch {
+		return nil, nil, nil, fmt.Errorf("timestamp requires 1 to %d cids", MaxTimestampBatch)
+	}
+	leaves := []common.Hash{}
+	links := []datamodel.Link{}
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, cid := range cids {
+		lnk, err := anconsync.ParseCidLink(cid)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid cid %s", cid)
+		}
+		if seen[lnk.String()] {
+			continue
+		}
+		seen[lnk.String()] = true
+		leaf, _ := timestampLeaf(lnk.String())
+		leaves = append(leaves, leaf)
+		links = append(links, lnk)
+		unique = append(unique, lnk.String())
+	}
+	root, paths := timestampTree(leaves)
+	timestamp := time.Now().Unix()
+	signature, err := crypto.Sign(TimestampHash(root, timestamp), dagctx.PrivateKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("signing failed %v", err)
+	}
+	signer := crypto.PubkeyToAddress(dagctx.PrivateKey.PublicKey)
+
+	batch := dagctx.Store.StoreDagCBOR(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 5, func(na fluent.MapAssembler) {
+		na.AssembleEntry("root").AssignString(root.Hex())
+		na.AssembleEntry("timestamp").AssignInt(timestamp)
+		na.AssembleEntry("signer").AssignString(signer.Hex())
+		na.AssembleEntry("signature").AssignString(hexutil.Encode(signature))
+		na.AssembleEntry("cids").CreateList(int64(len(links)), func(la fluent.ListAssembler) {
+			for _, lnk := range links {
+				la.AssembleValue().AssignLink(lnk)
+			}
+		})
+	}))
+	if err := dagctx.IndexKey(ctx, TimestampIndexKey(root), batch); err != nil {
+		return nil, nil, nil, err
+	}
+
+	proofLinks := map[string]datamodel.Link{}
+	proofs := []*TimestampProof{}
+	for i, cid := range unique {
+		p := &TimestampProof{
+			Cid:       cid,
+			Index:     int64(i),
+			Path:      paths[i],
+			Root:      root,
+			Timestamp: timestamp,
+			Signer:    signer,
+			Signature: signature,
+			Batch:     batch.String(),
+		}
+		proofLinks[cid] = dagctx.Store.StoreDagCBOR(ipld.LinkContext{}, p.node(links[i], batch))
+		proofs = append(proofs, p)
+	}
+	return batch, proofLinks, proofs, nil
+}
+
+// @BasePath /v0
+// TimestampWrite godoc
+// @Summary Timestamps CIDs
+// @Schemes
+// @Description Signs the Merkle root of one or many CIDs with the current time and returns a dag-cbor inclusion proof per CID, the root is written to the authenticated index under timestamp:{root}
+// @Tags timestamp
+// @Produce json
+// @Success 201
+// @Router /v0/timestamp [post]
+func (dagctx *AnconSyncContext) TimestampWrite(c *gin.Context) {
+	var v struct {
+		Cid  string   `json:"cid"`
+		Cids []string `json:"cids"`
+	}
+	if err := c.BindJSON(&v); err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("missing cids %v", err).Error(),
+		})
+		return
+	}
+	if v.Cid != "" {
+		v.Cids = append(v.Cids, v.Cid)
+	}
+	batch, links, proofs, err := dagctx.Timestamp(c.Request.Context(), v.Cids)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	res := []gin.H{}
+	for _, p := range proofs {
+		res = append(res, gin.H{
+			"cid":   p.Cid,
+			"proof": links[p.Cid].String(),
+			"index": p.Index,
+			"path":  p.Path,
+		})
+	}
+	c.JSON(201, gin.H{
+		"batch":     batch.String(),
+		"root":      proofs[0].Root,
+		"timestamp": proofs[0].Timestamp,
+		"signer":    proofs[0].Signer,
+		"signature": proofs[0].Signature,
+		"proofs":    res,
+	})
+}
+
+// @BasePath /v0
+// TimestampVerify godoc
+// @Summary Verifies a timestamp proof
+// @Schemes
+// @Description Verifies the inclusion of a CID in a signed timestamp root, from an inline proof or the CID of a proof block. The root must be signed by the node key or one of the trusted addresses given in the request.
+// @Tags timestamp
+// @Produce json
+// @Success 200
+// @Router /v0/timestamp/verify [post]
+func (dagctx *AnconSyncContext) TimestampVerify(c *gin.Context) {
+	var v struct {
+		Proof   *TimestampProof `json:"proof"`
+		Cid     string          `json:"cid"`
+		Trusted []string        `json:"trusted"`
+	}
+	if err := c.BindJSON(&v); err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Errorf("missing proof %v", err).Error(),
+		})
+		return
+	}
+	proof := v.Proof
+	if proof == nil {
+		lnk, err := anconsync.ParseCidLink(v.Cid)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Errorf("missing proof or cid").Error(),
+			})
+			return
+		}
+		proof, err = LoadTimestampProof(dagctx.Store, lnk)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+	if err := VerifyTimestampProof(proof); err != nil {
+		c.JSON(400, gin.H{
+			"verified": false,
+			"error":    err.Error(),
+		})
+		return
+	}
+	// a valid signature only shows who signed the root, the signer has to be trusted
+	node := proof.Signer == crypto.PubkeyToAddress(dagctx.PrivateKey.PublicKey)
+	trusted := node
+	for _, address := range v.Trusted {
+		if common.IsHexAddress(address) && common.HexToAddress(address) == proof.Signer {
+			trusted = true
+		}
+	}
+	if !trusted {
+		c.JSON(400, gin.H{
+			"verified": false,
+			"error":    fmt.Errorf("timestamp is signed by %s, not by the node or a trusted key", proof.Signer.Hex()).Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"verified":  true,
+		"cid":       proof.Cid,
+		"root":      proof.Root,
+		"timestamp": proof.Timestamp,
+		"signer":    proof.Signer,
+		"node":      node,
+	})
+}
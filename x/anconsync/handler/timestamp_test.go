@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+func verifyTimestamp(dagctx *AnconSyncContext, body interface{}) (int, map[string]interface{}) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	bz, _ := json.Marshal(body)
+	c.Request = httptest.NewRequest("POST", "/v0/timestamp/verify", bytes.NewReader(bz))
+	dagctx.TimestampVerify(c)
+	res := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res
+}
+
+func TestTimestamp(t *testing.T) {
+	ctx := context.Background()
+	dagctx := newTestIndex(t)
+	cids := []string{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		lnk := dagctx.Store.Store(ipld.LinkContext{}, fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry("name").AssignString(name)
+		}))
+		cids = append(cids, lnk.String())
+	}
+
+	// an odd number of leaves, a duplicate is timestamped once
+	batch, links, proofs, err := dagctx.Timestamp(ctx, append(cids, cids[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proofs) != 5 || len(links) != 5 {
+		t.Fatalf("unexpected proofs %v", proofs)
+	}
+	for _, p := range proofs {
+		if err := VerifyTimestampProof(p); err != nil {
+			t.Fatalf("%s %v", p.Cid, err)
+		}
+		lnk := links[p.Cid]
+		if lnk.(cidlink.Link).Cid.Prefix().Codec != cid.DagCBOR {
+			t.Fatalf("proof of %s is not dag-cbor", p.Cid)
+		}
+		stored, err := LoadTimestampProof(dagctx.Store, lnk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Batch != batch.String() || stored.Root != p.Root || stored.Index != p.Index {
+			t.Fatalf("unexpected stored proof %v", stored)
+		}
+		if err := VerifyTimestampProof(stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	forged := *proofs[1]
+	forged.Cid = proofs[2].Cid
+	if err := VerifyTimestampProof(&forged); err == nil {
+		t.Fatal("verified the path of another cid")
+	}
+	forged = *proofs[1]
+	forged.Timestamp--
+	if err := VerifyTimestampProof(&forged); err == nil {
+		t.Fatal("verified another timestamp")
+	}
+
+	// the root is written to the authenticated index
+	dagctx.CommitIndex(ctx)
+	if res, _ := dagctx.Index.Tree.Get([]byte(TimestampIndexKey(proofs[0].Root))); string(res.Value) != batch.String() {
+		t.Fatalf("timestamp root was not indexed %v", res)
+	}
+
+	code, res := verifyTimestamp(dagctx, gin.H{"cid": links[cids[3]].String()})
+	if code != 200 || res["verified"] != true || res["cid"] != cids[3] || res["node"] != true {
+		t.Fatalf("unexpected verification %d %v", code, res)
+	}
+	other, _ := crypto.GenerateKey()
+	forged = *proofs[0]
+	forged.Signature, _ = crypto.Sign(TimestampHash(forged.Root, forged.Timestamp), other)
+	if code, _ := verifyTimestamp(dagctx, gin.H{"proof": forged}); code != 400 {
+		t.Fatal("verified a proof signed by another key")
+	}
+	// a self-consistent proof of another key is only verified when that key is trusted
+	forged.Signer = crypto.PubkeyToAddress(other.PublicKey)
+	if code, res := verifyTimestamp(dagctx, gin.H{"proof": forged}); code != 400 || res["verified"] != false {
+		t.Fatalf("verified a proof of an untrusted key %v", res)
+	}
+	code, res = verifyTimestamp(dagctx, gin.H{"proof": forged, "trusted": []string{forged.Signer.Hex()}})
+	if code != 200 || res["verified"] != true || res["node"] != false {
+		t.Fatalf("proof of a trusted key was not verified %d %v", code, res)
+	}
+
+	// a single cid is its own root
+	_, _, proofs, err = dagctx.Timestamp(ctx, cids[:1])
+	if err != nil || len(proofs[0].Path) != 0 || VerifyTimestampProof(proofs[0]) != nil {
+		t.Fatalf("unexpected single cid proof %v %v", proofs, err)
+	}
+	if _, _, _, err := dagctx.Timestamp(ctx, []string{"not a cid"}); err == nil {
+		t.Fatal("timestamped an invalid cid")
+	}
+	if _, _, _, err := dagctx.Timestamp(ctx, nil); err == nil {
+		t.Fatal("timestamped an empty batch")
+	}
+}
@@ -1,7 +1,9 @@
 package impl
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/ipfs/go-cid"
@@ -14,7 +16,6 @@ import (
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 
 	"github.com/0xPolygon/polygon-sdk/state"
-	"github.com/0xPolygon/polygon-sdk/types"
 	"github.com/anconprotocol/node/x/anconsync"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
@@ -97,7 +98,7 @@ func StoreDagBlockDoneEvent() abi.Event {
 	)
 }
 
-func encodeDagCborBlock(s anconsync.Storage, inputs abi.Arguments, data []byte, txHash types.Hash, blockHash types.Hash, chainID int64) (datamodel.Node, datamodel.Link, error) {
+func encodeDagCborBlock(s anconsync.Storage, inputs abi.Arguments, data []byte) (datamodel.Node, datamodel.Link, error) {
 
 	props, err := inputs.Unpack(data)
 	if err != nil {
@@ -108,13 +109,10 @@ func encodeDagCborBlock(s anconsync.Storage, inputs abi.Arguments, data []byte,
 	values := props[1].(string)
 	bz := common.Hex2Bytes(values)
 
-	n, _ := ipldutil.DecodeNode(bz)
-	transactionBlock := fluent.MustBuildMap(basicnode.Prototype.Any, 3, func(ma fluent.MapAssembler) {
-		// ma.AssembleEntry("dagblock").AssignLink(nodelink)
-		ma.AssembleEntry("transactionHash").AssignBytes(txHash[:])
-		ma.AssembleEntry("blockHash").AssignBytes(blockHash.Bytes())
-		ma.AssembleEntry("chainId").AssignInt(chainID)
-	})
+	n, err := ipldutil.DecodeNode(bz)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid dag-cbor data %v", err)
+	}
 
 	p := cidlink.LinkPrototype{cid.Prefix{
 		Version:  1,
@@ -123,9 +121,7 @@ func encodeDagCborBlock(s anconsync.Storage, inputs abi.Arguments, data []byte,
 		MhLength: 32,   // sha2-256 hash has a 32-byte sum.
 	}}
 
-	lnk, err := s.LinkSystem.Store(ipld.LinkContext{
-		LinkNode: transactionBlock,
-	}, p, n)
+	lnk, err := s.LinkSystem.Store(ipld.LinkContext{}, p, n)
 
 	// lnk := p.BuildLink(data)
 
@@ -136,9 +132,12 @@ func encodeDagCborBlock(s anconsync.Storage, inputs abi.Arguments, data []byte,
 	return n, lnk, nil
 }
 
-func encodeAnconMetadata(s anconsync.Storage, inputs abi.Arguments, data []byte, txHash types.Hash, blockHash types.Hash, chainID int64) (datamodel.Node, datamodel.Link, error) {
+func encodeAnconMetadata(s anconsync.Storage, inputs abi.Arguments, data []byte) (datamodel.Node, datamodel.Link, error) {
 
 	props, err := inputs.Unpack(data)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	bz := props[5].([]byte)
 	// bz := common.Hex2Bytes(values)
@@ -188,12 +187,6 @@ func encodeAnconMetadata(s anconsync.Storage, inputs abi.Arguments, data []byte,
 
 	})
 
-	transactionBlock := fluent.MustBuildMap(basicnode.Prototype.Any, 3, func(ma fluent.MapAssembler) {
-		ma.AssembleEntry("transactionHash").AssignBytes(txHash[:])
-		ma.AssembleEntry("blockHash").AssignBytes(blockHash.Bytes())
-		ma.AssembleEntry("chainId").AssignInt(chainID)
-	})
-
 	p := cidlink.LinkPrototype{cid.Prefix{
 		Version:  1,
 		Codec:    cid.DagCBOR,
@@ -201,9 +194,7 @@ func encodeAnconMetadata(s anconsync.Storage, inputs abi.Arguments, data []byte,
 		MhLength: 32,   // sha2-256 hash has a 32-byte sum.
 	}}
 
-	lnk, err := s.LinkSystem.Store(ipld.LinkContext{
-		LinkNode: transactionBlock,
-	}, p, n)
+	lnk, err := s.LinkSystem.Store(ipld.LinkContext{}, p, n)
 
 	if err != nil {
 		return nil, nil, err
@@ -230,7 +221,7 @@ func EncodeDagJsonEvent() abi.Event {
 		}},
 	)
 }
-func encodeDagJsonBlock(s anconsync.Storage, inputs abi.Arguments, data []byte, txHash, blockHash types.Hash, chainID int64) (datamodel.Node, datamodel.Link, error) {
+func encodeDagJsonBlock(s anconsync.Storage, inputs abi.Arguments, data []byte) (datamodel.Node, datamodel.Link, error) {
 
 	props, err := inputs.Unpack(data)
 	if err != nil {
@@ -242,18 +233,14 @@ func encodeDagJsonBlock(s anconsync.Storage, inputs abi.Arguments, data []byte,
 	bz := common.Hex2Bytes(values)
 
 	js := hexutil.Bytes{}
-	js.UnmarshalJSON(bz)
-
-	n, _ := anconsync.Decode(basicnode.Prototype.Any, string(js))
-
-	// var nodelink datamodel.Link
+	if err := js.UnmarshalJSON(bz); err != nil {
+		return nil, nil, fmt.Errorf("invalid dag-json data %v", err)
+	}
 
-	transactionBlock := fluent.MustBuildMap(basicnode.Prototype.Any, 3, func(ma fluent.MapAssembler) {
-		// ma.AssembleEntry("dagblock").AssignLink(nodelink)
-		ma.AssembleEntry("transactionHash").AssignBytes(txHash[:])
-		ma.AssembleEntry("blockHash").AssignBytes(blockHash.Bytes())
-		ma.AssembleEntry("chainId").AssignInt(chainID)
-	})
+	n, err := anconsync.Decode(basicnode.Prototype.Any, string(js))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid dag-json data %v", err)
+	}
 
 	p := cidlink.LinkPrototype{cid.Prefix{
 		Version:  1,
@@ -262,9 +249,7 @@ func encodeDagJsonBlock(s anconsync.Storage, inputs abi.Arguments, data []byte,
 		MhLength: 32,   // sha2-256 hash has a 32-byte sum.
 	}}
 
-	lnk, err := s.LinkSystem.Store(ipld.LinkContext{
-		LinkNode: transactionBlock,
-	}, p, n)
+	lnk, err := s.LinkSystem.Store(ipld.LinkContext{}, p, n)
 
 	if err != nil {
 		return nil, nil, err
@@ -273,56 +258,101 @@ func encodeDagJsonBlock(s anconsync.Storage, inputs abi.Arguments, data []byte,
 	return n, lnk, nil
 }
 
-func PostTxProcessing(s anconsync.Storage, t *state.Transition) error {
-	for _, log := range t.Txn().Logs() {
-		for _, topic := range log.Topics {
-
-			if len(log.Topics) == 0 {
-				continue
-			}
-			blockHash := t.GetBlockHash(t.GetTxContext().Number)
-			txHash := blockHash
-
-			var node datamodel.Node
-			var lnk datamodel.Link
-			var err error
-			switch {
-			case common.Hash(topic) == AddOnchainMetadataEvent().ID:
-				node, lnk, err = encodeAnconMetadata(s, AddOnchainMetadataEvent().Inputs, log.Data, txHash, blockHash, t.GetTxContext().ChainID)
-
-			case common.Hash(topic) == EncodeDagJsonEvent().ID:
-				node, lnk, err = encodeDagJsonBlock(s, EncodeDagJsonEvent().Inputs, log.Data, txHash, blockHash, t.GetTxContext().ChainID)
-
-			case common.Hash(topic) == EncodeDagCborEvent().ID:
-				node, lnk, err = encodeDagCborBlock(s, EncodeDagCborEvent().Inputs, log.Data, txHash, blockHash, t.GetTxContext().ChainID)
-
-			default:
-				return fmt.Errorf("failed to decode")
-			}
-			// if !ContractAllowed(log.Address) {
-			// 	// Check the contract whitelist to prevent accidental native call.
-			// 	continue
-			// }
-			if err != nil {
-				return err
-			}
-
-			fmt.Println(lnk.String())
-			fmt.Println(node)
-			StoreDagBlockDoneEvent().Inputs.Pack()
-			t.EmitLog(log.Address, log.Topics, []byte(lnk.String()))
-
-			if err != nil {
-				return err
-			}
-			return nil
+// ErrUnknownEvent is returned by DecodeLog for logs that are not Ancon events
+var ErrUnknownEvent = errors.New("unknown event")
+
+// AnconEventTopics returns the topics of the events DecodeLog handles
+func AnconEventTopics() []common.Hash {
+	return []common.Hash{
+		AddOnchainMetadataEvent().ID,
+		EncodeDagJsonEvent().ID,
+		EncodeDagCborEvent().ID,
+	}
+}
+
+// DecodeLog runs the encoder matching the first topic of an event log, stores the block
+// and wraps it in a provenance envelope. Built-in Ancon events are tried first, then the
+// mappings of registry, which may be nil. It returns the block, its link and the envelope link.
+func DecodeLog(ctx context.Context, s anconsync.Storage, registry *EventRegistry, topics []common.Hash, data []byte, p Provenance) (datamodel.Node, datamodel.Link, datamodel.Link, error) {
+	if len(topics) == 0 {
+		return nil, nil, nil, ErrUnknownEvent
+	}
+	var node datamodel.Node
+	var lnk datamodel.Link
+	var err error
+	switch topics[0] {
+	case AddOnchainMetadataEvent().ID:
+		node, lnk, err = encodeAnconMetadata(s, AddOnchainMetadataEvent().Inputs, data)
+	case EncodeDagJsonEvent().ID:
+		node, lnk, err = encodeDagJsonBlock(s, EncodeDagJsonEvent().Inputs, data)
+	case EncodeDagCborEvent().ID:
+		node, lnk, err = encodeDagCborBlock(s, EncodeDagCborEvent().Inputs, data)
+	default:
+		m := registry.Lookup(topics[0], p.ContractAddress)
+		if m == nil {
+			return nil, nil, nil, ErrUnknownEvent
+		}
+		node, lnk, err = m.Encode(s, topics, data)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	envelope, err := StoreProvenance(ctx, s, lnk, p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return node, lnk, envelope, nil
+}
+
+func PostTxProcessing(s anconsync.Storage, registry *EventRegistry, t *state.Transition) error {
+	// the receipts of the transactions before this one hold the earlier logs of the
+	// block, log indexes are block level like the ones of the EVM indexer
+	offset := 0
+	for _, receipt := range t.Receipts() {
+		offset += len(receipt.Logs)
+	}
+	for logIndex, log := range t.Txn().Logs() {
+		if len(log.Topics) == 0 {
+			continue
 		}
+		topics := make([]common.Hash, len(log.Topics))
+		for i, topic := range log.Topics {
+			topics[i] = common.Hash(topic)
+		}
+		blockHash := t.GetBlockHash(t.GetTxContext().Number)
+		txHash := t.GetTxnHash()
+
+		_, lnk, _, err := DecodeLog(context.Background(), s, registry, topics, log.Data, Provenance{
+			TransactionHash: common.Hash(txHash),
+			BlockHash:       common.Hash(blockHash),
+			BlockNumber:     uint64(t.GetTxContext().Number),
+			LogIndex:        uint(offset + logIndex),
+			ContractAddress: common.Address(log.Address),
+			ChainID:         t.GetTxContext().ChainID,
+		})
+		if err == ErrUnknownEvent {
+			// not an Ancon or registered event
+			continue
+		}
+		// if !ContractAllowed(log.Address) {
+		// 	// Check the contract whitelist to prevent accidental native call.
+		// 	continue
+		// }
+		if err != nil {
+			return err
+		}
+		t.EmitLog(log.Address, log.Topics, []byte(lnk.String()))
 	}
 	return nil
 }
 
 func GetHooks(s anconsync.Storage) func(t *state.Transition) {
+	registries := &EventRegistryCache{}
 	return func(t *state.Transition) {
-		PostTxProcessing(s, t)
+		registry, err := registries.Load(context.Background(), s)
+		if err != nil {
+			return
+		}
+		PostTxProcessing(s, registry, t)
 	}
 }
@@ -0,0 +1,138 @@
+package impl
+
+import (
+	"context"
+	"strings"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// Provenance identifies the on-chain event an EVM-derived block was produced from
+type Provenance struct {
+	TransactionHash common.Hash
+	BlockHash       common.Hash
+	BlockNumber     uint64
+	LogIndex        uint
+	ContractAddress common.Address
+	ChainID         int64
+}
+
+// EvmTxKey is the index key of the provenance envelopes of a transaction
+func EvmTxKey(txHash common.Hash) string {
+	return strings.Join([]string{"evm", "tx", strings.ToLower(txHash.Hex())}, ":")
+}
+
+// StoreProvenance wraps lnk in a provenance envelope block and appends the envelope to
+// the index of its transaction
+func StoreProvenance(ctx context.Context, s anconsync.Storage, lnk datamodel.Link, p Provenance) (datamodel.Link, error) {
+	envelope := fluent.MustBuildMap(basicnode.Prototype.Map, 7, func(na fluent.MapAssembler) {
+		na.AssembleEntry("data").AssignLink(lnk)
+		na.AssembleEntry("transactionHash").AssignString(p.TransactionHash.Hex())
+		na.AssembleEntry("logIndex").AssignInt(int64(p.LogIndex))
+		na.AssembleEntry("contractAddress").AssignString(p.ContractAddress.Hex())
+		na.AssembleEntry("blockNumber").AssignInt(int64(p.BlockNumber))
+		na.AssembleEntry("blockHash").AssignString(p.BlockHash.Hex())
+		na.AssembleEntry("chainId").AssignInt(p.ChainID)
+	})
+	envelopeLink := s.Store(ipld.LinkContext{}, envelope)
+
+	envelopes, _, err := LoadTxProvenance(ctx, s, p.TransactionHash)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range envelopes {
+		if e.String() == envelopeLink.String() {
+			return envelopeLink, nil
+		}
+	}
+	if err := storeTxProvenance(ctx, s, p.TransactionHash, append(envelopes, envelopeLink)); err != nil {
+		return nil, err
+	}
+	return envelopeLink, nil
+}
+
+func storeTxProvenance(ctx context.Context, s anconsync.Storage, txHash common.Hash, envelopes []datamodel.Link) error {
+	if len(envelopes) == 0 {
+		return s.DataStore.Put(ctx, EvmTxKey(txHash), []byte{})
+	}
+	index := fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("transactionHash").AssignString(txHash.Hex())
+		na.AssembleEntry("envelopes").CreateList(int64(len(envelopes)), func(la fluent.ListAssembler) {
+			for _, e := range envelopes {
+				la.AssembleValue().AssignLink(e)
+			}
+		})
+	})
+	indexLink := s.Store(ipld.LinkContext{}, index)
+	return s.DataStore.Put(ctx, EvmTxKey(txHash), []byte(indexLink.String()))
+}
+
+// RemoveProvenance drops an envelope from the index of its transaction, the index is
+// emptied with its last envelope. It is used when the block of the envelope was
+// reorganized out of the chain.
+func RemoveProvenance(ctx context.Context, s anconsync.Storage, envelope datamodel.Link) error {
+	n, err := s.Load(ipld.LinkContext{}, envelope)
+	if err != nil {
+		return err
+	}
+	hash, err := n.LookupByString("transactionHash")
+	if err != nil {
+		return err
+	}
+	h, _ := hash.AsString()
+	txHash := common.HexToHash(h)
+	envelopes, _, err := LoadTxProvenance(ctx, s, txHash)
+	if err != nil {
+		return err
+	}
+	kept := []datamodel.Link{}
+	for _, e := range envelopes {
+		if e.String() != envelope.String() {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(envelopes) {
+		return nil
+	}
+	return storeTxProvenance(ctx, s, txHash, kept)
+}
+
+// LoadTxProvenance returns the provenance envelopes stored for a transaction and the
+// link of its index block, the index link is nil when nothing was indexed
+func LoadTxProvenance(ctx context.Context, s anconsync.Storage, txHash common.Hash) ([]datamodel.Link, datamodel.Link, error) {
+	value, err := s.DataStore.Get(ctx, EvmTxKey(txHash))
+	if err != nil || len(value) == 0 {
+		return nil, nil, nil
+	}
+	indexLink, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := s.Load(ipld.LinkContext{}, indexLink)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, err := n.LookupByString("envelopes")
+	if err != nil {
+		return nil, nil, err
+	}
+	envelopes := []datamodel.Link{}
+	it := list.ListIterator()
+	for it != nil && !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		l, err := v.AsLink()
+		if err != nil {
+			return nil, nil, err
+		}
+		envelopes = append(envelopes, l)
+	}
+	return envelopes, indexLink, nil
+}
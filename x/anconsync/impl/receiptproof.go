@@ -0,0 +1,307 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// ReceiptProof is a Merkle-Patricia inclusion proof of a receipt in the receipt trie of
+// a block. Proof holds the trie nodes from the root to the leaf. TransactionProof proves
+// the transaction at the same index in the transaction trie, binding TransactionHash to
+// the receipt.
+type ReceiptProof struct {
+	TransactionHash  common.Hash     `json:"transactionHash"`
+	TransactionIndex uint            `json:"transactionIndex"`
+	BlockHash        common.Hash     `json:"blockHash"`
+	BlockNumber      uint64          `json:"blockNumber"`
+	ReceiptsRoot     common.Hash     `json:"receiptsRoot"`
+	Proof            []hexutil.Bytes `json:"proof"`
+	Receipt          hexutil.Bytes   `json:"receipt"`
+	TransactionsRoot common.Hash     `json:"transactionsRoot"`
+	TransactionProof []hexutil.Bytes `json:"transactionProof"`
+	Transaction      hexutil.Bytes   `json:"transaction"`
+}
+
+// proofList collects the nodes written by trie.Prove in root to leaf order
+type proofList [][]byte
+
+func (l *proofList) Put(key []byte, value []byte) error {
+	*l = append(*l, common.CopyBytes(value))
+	return nil
+}
+
+func (l *proofList) Delete(key []byte) error {
+	return nil
+}
+
+func receiptKey(index uint) []byte {
+	key, _ := rlp.EncodeToBytes(index)
+	return key
+}
+
+// proveIndex builds the trie of list, checks its root and returns the proof nodes of the
+// item at index
+func proveIndex(list types.DerivableList, root common.Hash, index uint) ([]hexutil.Bytes, error) {
+	tr, err := trie.New(common.Hash{}, trie.NewDatabase(memorydb.New()))
+	if err != nil {
+		return nil, err
+	}
+	if h := types.DeriveSha(list, tr); h != root {
+		return nil, fmt.Errorf("root mismatch %s != %s", h.Hex(), root.Hex())
+	}
+	nodes := proofList{}
+	if err := tr.Prove(receiptKey(index), 0, &nodes); err != nil {
+		return nil, err
+	}
+	proof := []hexutil.Bytes{}
+	for _, n := range nodes {
+		proof = append(proof, n)
+	}
+	return proof, nil
+}
+
+// verifyIndex returns the value at index of the trie with root
+func verifyIndex(root common.Hash, proof []hexutil.Bytes, index uint) ([]byte, error) {
+	db := memorydb.New()
+	for _, n := range proof {
+		db.Put(crypto.Keccak256(n), n)
+	}
+	return trie.VerifyProof(root, receiptKey(index), db)
+}
+
+// ProveReceipt builds the transaction and receipt tries of a block and returns the
+// inclusion proofs of the transaction and receipt at index
+func ProveReceipt(header *types.Header, txs types.Transactions, receipts types.Receipts, index uint) (*ReceiptProof, error) {
+	if int(index) >= len(receipts) || int(index) >= len(txs) {
+		return nil, fmt.Errorf("receipt index %d out of range", index)
+	}
+	proof, err := proveIndex(receipts, header.ReceiptHash, index)
+	if err != nil {
+		return nil, fmt.Errorf("receipt trie: %v", err)
+	}
+	txProof, err := proveIndex(txs, header.TxHash, index)
+	if err != nil {
+		return nil, fmt.Errorf("transaction trie: %v", err)
+	}
+	raw, err := receipts[index].MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := txs[index].MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &ReceiptProof{
+		TransactionHash:  txs[index].Hash(),
+		TransactionIndex: index,
+		BlockHash:        header.Hash(),
+		BlockNumber:      header.Number.Uint64(),
+		ReceiptsRoot:     header.ReceiptHash,
+		Proof:            proof,
+		Receipt:          raw,
+		TransactionsRoot: header.TxHash,
+		TransactionProof: txProof,
+		Transaction:      tx,
+	}, nil
+}
+
+// VerifyReceiptProof checks a receipt proof against a block header, including that the
+// transaction at the receipt index hashes to the proof transactionHash, and returns the
+// proven receipt
+func VerifyReceiptProof(header *types.Header, p *ReceiptProof) (*types.Receipt, error) {
+	if p.BlockHash != (common.Hash{}) && p.BlockHash != header.Hash() {
+		return nil, fmt.Errorf("proof is for block %s, not %s", p.BlockHash.Hex(), header.Hash().Hex())
+	}
+	value, err := verifyIndex(header.ReceiptHash, p.Proof, p.TransactionIndex)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("receipt %d is not in the receipt trie", p.TransactionIndex)
+	}
+	if len(p.Receipt) > 0 && !bytes.Equal(value, p.Receipt) {
+		return nil, fmt.Errorf("proven receipt does not match the proof receipt")
+	}
+	tx, err := verifyIndex(header.TxHash, p.TransactionProof, p.TransactionIndex)
+	if err != nil {
+		return nil, fmt.Errorf("transaction trie: %v", err)
+	}
+	if tx == nil {
+		return nil, fmt.Errorf("transaction %d is not in the transaction trie", p.TransactionIndex)
+	}
+	if crypto.Keccak256Hash(tx) != p.TransactionHash {
+		return nil, fmt.Errorf("transaction %d is not %s", p.TransactionIndex, p.TransactionHash.Hex())
+	}
+	if len(p.Transaction) > 0 && !bytes.Equal(tx, p.Transaction) {
+		return nil, fmt.Errorf("proven transaction does not match the proof transaction")
+	}
+	receipt := &types.Receipt{}
+	if err := receipt.UnmarshalBinary(value); err != nil {
+		return nil, err
+	}
+	receipt.TxHash = p.TransactionHash
+	receipt.TransactionIndex = p.TransactionIndex
+	return receipt, nil
+}
+
+// storeRawList stores every node of list as codec
+func storeRawList(s anconsync.Storage, codec string, list []hexutil.Bytes) ([]datamodel.Link, error) {
+	links := []datamodel.Link{}
+	for _, n := range list {
+		lnk, err := s.StoreDagEthRaw(codec, n)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, lnk)
+	}
+	return links, nil
+}
+
+// StoreReceiptProof stores the proof nodes, the receipt and the transaction as dag-eth
+// blocks and links them from a dag-json proof block
+func StoreReceiptProof(s anconsync.Storage, p *ReceiptProof) (datamodel.Link, error) {
+	nodes, err := storeRawList(s, "eth-tx-receipt-trie", p.Proof)
+	if err != nil {
+		return nil, err
+	}
+	txNodes, err := storeRawList(s, "eth-tx-trie", p.TransactionProof)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := s.StoreDagEthRaw("eth-tx-receipt", p.Receipt)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.StoreDagEthRaw("eth-tx", p.Transaction)
+	if err != nil {
+		return nil, err
+	}
+	assignLinks := func(na fluent.NodeAssembler, links []datamodel.Link) {
+		na.CreateList(int64(len(links)), func(la fluent.ListAssembler) {
+			for _, l := range links {
+				la.AssembleValue().AssignLink(l)
+			}
+		})
+	}
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, 10, func(na fluent.MapAssembler) {
+		na.AssembleEntry("transactionHash").AssignString(p.TransactionHash.Hex())
+		na.AssembleEntry("transactionIndex").AssignInt(int64(p.TransactionIndex))
+		na.AssembleEntry("blockHash").AssignString(p.BlockHash.Hex())
+		na.AssembleEntry("blockNumber").AssignInt(int64(p.BlockNumber))
+		na.AssembleEntry("receiptsRoot").AssignString(p.ReceiptsRoot.Hex())
+		assignLinks(na.AssembleEntry("proof"), nodes)
+		na.AssembleEntry("receipt").AssignLink(receipt)
+		na.AssembleEntry("transactionsRoot").AssignString(p.TransactionsRoot.Hex())
+		assignLinks(na.AssembleEntry("transactionProof"), txNodes)
+		na.AssembleEntry("transaction").AssignLink(tx)
+	})
+	return s.Store(ipld.LinkContext{}, n), nil
+}
+
+// readRaw returns the stored bytes of a block
+func readRaw(s anconsync.Storage, lnk datamodel.Link) ([]byte, error) {
+	r, err := s.LinkSystem.StorageReadOpener(ipld.LinkContext{Ctx: context.Background()}, lnk)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// loadRaw returns the stored bytes of the block linked by the name field of n
+func loadRaw(s anconsync.Storage, n datamodel.Node, name string) ([]byte, error) {
+	v, err := n.LookupByString(name)
+	if err != nil {
+		return nil, err
+	}
+	l, err := v.AsLink()
+	if err != nil {
+		return nil, err
+	}
+	return readRaw(s, l)
+}
+
+// loadRawList returns the stored bytes of the blocks linked by the name list of n
+func loadRawList(s anconsync.Storage, n datamodel.Node, name string) ([]hexutil.Bytes, error) {
+	list, err := n.LookupByString(name)
+	if err != nil {
+		return nil, err
+	}
+	raws := []hexutil.Bytes{}
+	it := list.ListIterator()
+	for it != nil && !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		l, err := v.AsLink()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := readRaw(s, l)
+		if err != nil {
+			return nil, err
+		}
+		raws = append(raws, raw)
+	}
+	return raws, nil
+}
+
+// LoadReceiptProof loads a proof stored by StoreReceiptProof
+func LoadReceiptProof(s anconsync.Storage, lnk datamodel.Link) (*ReceiptProof, error) {
+	n, err := s.Load(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, err
+	}
+	str := func(name string) string {
+		v, err := n.LookupByString(name)
+		if err != nil {
+			return ""
+		}
+		s, _ := v.AsString()
+		return s
+	}
+	num := func(name string) int64 {
+		v, err := n.LookupByString(name)
+		if err != nil {
+			return 0
+		}
+		i, _ := v.AsInt()
+		return i
+	}
+	p := &ReceiptProof{
+		TransactionHash:  common.HexToHash(str("transactionHash")),
+		TransactionIndex: uint(num("transactionIndex")),
+		BlockHash:        common.HexToHash(str("blockHash")),
+		BlockNumber:      uint64(num("blockNumber")),
+		ReceiptsRoot:     common.HexToHash(str("receiptsRoot")),
+		TransactionsRoot: common.HexToHash(str("transactionsRoot")),
+	}
+	if p.Proof, err = loadRawList(s, n, "proof"); err != nil {
+		return nil, err
+	}
+	if p.Receipt, err = loadRaw(s, n, "receipt"); err != nil {
+		return nil, err
+	}
+	if p.TransactionProof, err = loadRawList(s, n, "transactionProof"); err != nil {
+		return nil, err
+	}
+	if p.Transaction, err = loadRaw(s, n, "transaction"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,462 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anconprotocol/node/x/anconsync"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+const (
+	CodecDagJson = "dag-json"
+	CodecDagCbor = "dag-cbor"
+
+	eventRegistryKey = "evm:registry"
+)
+
+// EventMapping maps the arguments of an ABI event to the fields of an IPLD block
+type EventMapping struct {
+	Name  string
+	Event abi.Event
+	Codec string
+	// Fields maps block fields to event arguments, all arguments are used when empty
+	Fields map[string]string
+	// Links lists the block fields holding a CID that are stored as links
+	Links     map[string]bool
+	Contracts []common.Address
+}
+
+// EventRegistry holds the event mappings uploaded by users, keyed by topic
+type EventRegistry struct {
+	mappings map[common.Hash][]*EventMapping
+}
+
+func NewEventRegistry() *EventRegistry {
+	return &EventRegistry{
+		mappings: make(map[common.Hash][]*EventMapping),
+	}
+}
+
+func stringList(n datamodel.Node, name string) ([]string, error) {
+	v, err := n.LookupByString(name)
+	if err != nil || v.IsNull() {
+		return nil, nil
+	}
+	values := []string{}
+	it := v.ListIterator()
+	if it == nil {
+		return nil, fmt.Errorf("%s must be a list", name)
+	}
+	for !it.Done() {
+		_, item, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		s, err := item.AsString()
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a list of strings", name)
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// ParseEventMappings parses a mapping document:
+//
+//	{"name": "...", "abi": [...], "contracts": ["0x..."],
+//	 "events": [{"event": "Name", "codec": "dag-json", "fields": {"field": "arg"}, "links": ["field"]}]}
+func ParseEventMappings(doc datamodel.Node) ([]*EventMapping, error) {
+	nameNode, err := doc.LookupByString("name")
+	if err != nil {
+		return nil, fmt.Errorf("missing name")
+	}
+	name, _ := nameNode.AsString()
+	abiNode, err := doc.LookupByString("abi")
+	if err != nil {
+		return nil, fmt.Errorf("missing abi")
+	}
+	abiJson, err := anconsync.Encode(abiNode)
+	if err != nil {
+		return nil, err
+	}
+	contractABI, err := abi.JSON(strings.NewReader(abiJson))
+	if err != nil {
+		return nil, fmt.Errorf("invalid abi %v", err)
+	}
+	addresses, err := stringList(doc, "contracts")
+	if err != nil {
+		return nil, err
+	}
+	contracts := []common.Address{}
+	for _, a := range addresses {
+		if !common.IsHexAddress(a) {
+			return nil, fmt.Errorf("invalid contract address %s", a)
+		}
+		contracts = append(contracts, common.HexToAddress(a))
+	}
+
+	events, err := doc.LookupByString("events")
+	if err != nil {
+		return nil, fmt.Errorf("missing events")
+	}
+	mappings := []*EventMapping{}
+	it := events.ListIterator()
+	if it == nil {
+		return nil, fmt.Errorf("events must be a list")
+	}
+	for !it.Done() {
+		_, e, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		eventNode, err := e.LookupByString("event")
+		if err != nil {
+			return nil, fmt.Errorf("missing event name")
+		}
+		eventName, _ := eventNode.AsString()
+		event, ok := contractABI.Events[eventName]
+		if !ok {
+			return nil, fmt.Errorf("event %s not found in abi", eventName)
+		}
+		m := &EventMapping{
+			Name:      name,
+			Event:     event,
+			Codec:     CodecDagJson,
+			Fields:    make(map[string]string),
+			Links:     make(map[string]bool),
+			Contracts: contracts,
+		}
+		if codec, err := e.LookupByString("codec"); err == nil {
+			m.Codec, _ = codec.AsString()
+		}
+		if m.Codec != CodecDagJson && m.Codec != CodecDagCbor {
+			return nil, fmt.Errorf("unsupported codec %s", m.Codec)
+		}
+		if fields, err := e.LookupByString("fields"); err == nil && !fields.IsNull() {
+			fit := fields.MapIterator()
+			if fit == nil {
+				return nil, fmt.Errorf("fields must be a map")
+			}
+			for !fit.Done() {
+				k, v, err := fit.Next()
+				if err != nil {
+					return nil, err
+				}
+				field, _ := k.AsString()
+				arg, _ := v.AsString()
+				if !hasArgument(event.Inputs, arg) {
+					return nil, fmt.Errorf("event %s has no argument %s", eventName, arg)
+				}
+				m.Fields[field] = arg
+			}
+		}
+		links, err := stringList(e, "links")
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range links {
+			m.Links[l] = true
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+func hasArgument(args abi.Arguments, name string) bool {
+	for _, a := range args {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Add registers the mappings of a mapping document
+func (r *EventRegistry) Add(doc datamodel.Node) error {
+	mappings, err := ParseEventMappings(doc)
+	if err != nil {
+		return err
+	}
+	for _, m := range mappings {
+		r.mappings[m.Event.ID] = append(r.mappings[m.Event.ID], m)
+	}
+	return nil
+}
+
+// Topics returns the topics of all registered events
+func (r *EventRegistry) Topics() []common.Hash {
+	topics := []common.Hash{}
+	for t := range r.mappings {
+		topics = append(topics, t)
+	}
+	return topics
+}
+
+// Lookup returns the mapping for a topic emitted by contract, or nil
+func (r *EventRegistry) Lookup(topic common.Hash, contract common.Address) *EventMapping {
+	if r == nil {
+		return nil
+	}
+	for _, m := range r.mappings[topic] {
+		if len(m.Contracts) == 0 {
+			return m
+		}
+		for _, c := range m.Contracts {
+			if c == contract {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// Encode decodes a log with the event ABI and stores the mapped block
+func (m *EventMapping) Encode(s anconsync.Storage, topics []common.Hash, data []byte) (datamodel.Node, datamodel.Link, error) {
+	values := make(map[string]interface{})
+	if err := m.Event.Inputs.UnpackIntoMap(values, data); err != nil {
+		return nil, nil, err
+	}
+	indexed := abi.Arguments{}
+	for _, arg := range m.Event.Inputs {
+		if arg.Indexed {
+			indexed = append(indexed, arg)
+		}
+	}
+	if len(indexed) > 0 {
+		if len(topics) < len(indexed)+1 {
+			return nil, nil, fmt.Errorf("missing indexed topics")
+		}
+		if err := abi.ParseTopicsIntoMap(values, indexed, topics[1:]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fields := m.Fields
+	if len(fields) == 0 {
+		fields = make(map[string]string)
+		for _, arg := range m.Event.Inputs {
+			fields[arg.Name] = arg.Name
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	var buildErr error
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, int64(len(fields)), func(na fluent.MapAssembler) {
+		for _, field := range names {
+			if err := assignValue(na.AssembleEntry(field), values[fields[field]], m.Links[field]); err != nil && buildErr == nil {
+				buildErr = fmt.Errorf("field %s: %v", field, err)
+			}
+		}
+	})
+	if buildErr != nil {
+		return nil, nil, buildErr
+	}
+
+	p := anconsync.GetDagJSONLinkPrototype()
+	if m.Codec == CodecDagCbor {
+		p = anconsync.GetDagCBORLinkPrototype()
+	}
+	lnk, err := s.LinkSystem.Store(ipld.LinkContext{}, p, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return n, lnk, nil
+}
+
+// assignValue assigns an ABI decoded value, integers that do not fit an int64 are stored
+// as decimal strings and fixed byte arrays as bytes
+func assignValue(na fluent.NodeAssembler, v interface{}, link bool) error {
+	if link {
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("link field must be a string")
+		}
+		lnk, err := anconsync.ParseCidLink(s)
+		if err != nil {
+			return err
+		}
+		na.AssignLink(lnk)
+		return nil
+	}
+	switch value := v.(type) {
+	case nil:
+		na.AssignNull()
+	case string:
+		na.AssignString(value)
+	case bool:
+		na.AssignBool(value)
+	case []byte:
+		na.AssignBytes(value)
+	case common.Address:
+		na.AssignString(value.Hex())
+	case common.Hash:
+		na.AssignString(value.Hex())
+	case *big.Int:
+		if value.IsInt64() {
+			na.AssignInt(value.Int64())
+		} else {
+			na.AssignString(value.String())
+		}
+	default:
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			na.AssignInt(rv.Int())
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			// like *big.Int, values above int64 are decimal strings
+			if u := rv.Uint(); u <= math.MaxInt64 {
+				na.AssignInt(int64(u))
+			} else {
+				na.AssignString(strconv.FormatUint(u, 10))
+			}
+		case reflect.Array:
+			if rv.Type().Elem().Kind() == reflect.Uint8 {
+				bz := make([]byte, rv.Len())
+				reflect.Copy(reflect.ValueOf(bz), rv)
+				na.AssignBytes(bz)
+				return nil
+			}
+			fallthrough
+		case reflect.Slice:
+			var err error
+			na.CreateList(int64(rv.Len()), func(la fluent.ListAssembler) {
+				for i := 0; i < rv.Len(); i++ {
+					if e := assignValue(la.AssembleValue(), rv.Index(i).Interface(), false); e != nil && err == nil {
+						err = e
+					}
+				}
+			})
+			return err
+		default:
+			na.AssignString(fmt.Sprint(v))
+		}
+	}
+	return nil
+}
+
+// LoadEventRegistry loads the registered mapping documents from the store
+func LoadEventRegistry(ctx context.Context, s anconsync.Storage) (*EventRegistry, []datamodel.Link, error) {
+	r := NewEventRegistry()
+	docs, err := eventRegistryDocs(ctx, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, lnk := range docs {
+		doc, err := s.Load(ipld.LinkContext{}, lnk)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := r.Add(doc); err != nil {
+			return nil, nil, fmt.Errorf("invalid event mapping %s %v", lnk, err)
+		}
+	}
+	return r, docs, nil
+}
+
+// EventRegistryCache keeps the loaded registry until the registered mappings change
+type EventRegistryCache struct {
+	lock     sync.Mutex
+	index    string
+	registry *EventRegistry
+}
+
+// Load returns the cached registry, it is reloaded when a mapping document was registered
+func (c *EventRegistryCache) Load(ctx context.Context, s anconsync.Storage) (*EventRegistry, error) {
+	index := ""
+	if value, err := s.DataStore.Get(ctx, eventRegistryKey); err == nil {
+		index = string(value)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.registry != nil && c.index == index {
+		return c.registry, nil
+	}
+	registry, _, err := LoadEventRegistry(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	c.index = index
+	c.registry = registry
+	return registry, nil
+}
+
+func eventRegistryDocs(ctx context.Context, s anconsync.Storage) ([]datamodel.Link, error) {
+	value, err := s.DataStore.Get(ctx, eventRegistryKey)
+	if err != nil {
+		return []datamodel.Link{}, nil
+	}
+	indexLink, err := anconsync.ParseCidLink(string(value))
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.Load(ipld.LinkContext{}, indexLink)
+	if err != nil {
+		return nil, err
+	}
+	list, err := n.LookupByString("mappings")
+	if err != nil {
+		return nil, err
+	}
+	docs := []datamodel.Link{}
+	it := list.ListIterator()
+	for it != nil && !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		l, err := v.AsLink()
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, l)
+	}
+	return docs, nil
+}
+
+// RegisterEventMappings validates and stores a mapping document and adds it to the registry
+func RegisterEventMappings(ctx context.Context, s anconsync.Storage, doc datamodel.Node) (datamodel.Link, error) {
+	if _, err := ParseEventMappings(doc); err != nil {
+		return nil, err
+	}
+	docs, err := eventRegistryDocs(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	lnk := s.Store(ipld.LinkContext{}, doc)
+	for _, d := range docs {
+		if d.String() == lnk.String() {
+			return lnk, nil
+		}
+	}
+	docs = append(docs, lnk)
+	index := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("mappings").CreateList(int64(len(docs)), func(la fluent.ListAssembler) {
+			for _, d := range docs {
+				la.AssembleValue().AssignLink(d)
+			}
+		})
+	})
+	indexLink := s.Store(ipld.LinkContext{}, index)
+	if err := s.DataStore.Put(ctx, eventRegistryKey, []byte(indexLink.String())); err != nil {
+		return nil, err
+	}
+	return lnk, nil
+}
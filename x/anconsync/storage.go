@@ -19,6 +19,7 @@ import (
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/linking"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/multicodec"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/storage/fsstore"
 	"github.com/multiformats/go-multihash"
@@ -60,6 +61,7 @@ func (s *Storage) LoadGenesis(cid string) {
 	s.RootHash = r
 }
 
+// NewStorage opens the storage in folder under the user home directory
 func NewStorage(folder string) Storage {
 
 	userHomeDir, err := os.UserHomeDir()
@@ -67,9 +69,13 @@ func NewStorage(folder string) Storage {
 		panic(err)
 	}
 
-	DefaultNodeHome := filepath.Join(userHomeDir, folder)
+	return OpenStorage(filepath.Join(userHomeDir, folder))
+}
+
+// OpenStorage opens the storage in the directory at path
+func OpenStorage(path string) Storage {
 	store := fsstore.Store{}
-	store.InitDefaults(DefaultNodeHome)
+	store.InitDefaults(path)
 	lsys := cidlink.DefaultLinkSystem()
 	//   you just need a function that conforms to the ipld.BlockWriteOpener interface.
 	lsys.StorageWriteOpener = func(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
@@ -131,15 +137,17 @@ var (
 )
 
 func init() {
-	DagEthCodecs["eth-block"] = 0x90
+	// dag-jose blocks are the dag-cbor encoding of the JOSE general serialization
+	multicodec.RegisterEncoder(cid.DagJOSE, dagcbor.Encode)
+	multicodec.RegisterDecoder(cid.DagJOSE, dagcbor.Decode)
 }
 
 func GetDagEthereumLinkPrototype(codec string) ipld.LinkPrototype {
 	return cidlink.LinkPrototype{cid.Prefix{
 		Version:  LINK_PROTO_VERSION,
 		Codec:    DagEthCodecs[codec],
-		MhType:   multihash.SHA2_256, // sha2-256
-		MhLength: 32,                 // sha2-256 hash has a 32-byte sum.
+		MhType:   multihash.KECCAK_256, // keccak-256, the hash Ethereum uses
+		MhLength: 32,                   // keccak-256 hash has a 32-byte sum.
 	}}
 }
 
@@ -164,7 +172,7 @@ func GetDagJSONLinkPrototype() ipld.LinkPrototype {
 func GetDagJOSELinkPrototype() ipld.LinkPrototype {
 	return cidlink.LinkPrototype{cid.Prefix{
 		Version:  LINK_PROTO_VERSION,
-		Codec:    cid.DagJOSE,        // dag-json
+		Codec:    cid.DagJOSE,        // dag-jose
 		MhType:   multihash.SHA2_256, // sha2-256
 		MhLength: 32,                 // sha2-256 hash has a 32-byte sum.
 	}}
@@ -200,6 +208,11 @@ func (k *Storage) StoreDagCBOR(linkCtx ipld.LinkContext, node datamodel.Node) da
 	return k.LinkSystem.MustStore(linkCtx, GetDagCBORLinkPrototype(), node)
 }
 
+// Store node as  dag-jose
+func (k *Storage) StoreDagJOSE(linkCtx ipld.LinkContext, node datamodel.Node) datamodel.Link {
+	return k.LinkSystem.MustStore(linkCtx, GetDagJOSELinkPrototype(), node)
+}
+
 // Store node as  raw
 func (k *Storage) StoreRaw(linkCtx ipld.LinkContext, node datamodel.Node) datamodel.Link {
 	return k.LinkSystem.MustStore(linkCtx, GetRawLinkPrototype(), node)
@@ -218,8 +231,11 @@ func Encode(n datamodel.Node) (string, error) {
 
 func Decode(proto datamodel.NodePrototype, src string) (datamodel.Node, error) {
 	nb := proto.NewBuilder()
-	err := dagjson.Decode(nb, strings.NewReader(src))
-	return nb.Build(), err
+	// Build panics on a partially assembled node
+	if err := dagjson.Decode(nb, strings.NewReader(src)); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
 }
 
 func EncodeCBOR(n datamodel.Node) ([]byte, error) {
@@ -230,6 +246,8 @@ func EncodeCBOR(n datamodel.Node) ([]byte, error) {
 
 func DecodeCBOR(proto datamodel.NodePrototype, src []byte) (datamodel.Node, error) {
 	nb := proto.NewBuilder()
-	err := dagcbor.Decode(nb, bytes.NewReader(src))
-	return nb.Build(), err
+	if err := dagcbor.Decode(nb, bytes.NewReader(src)); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
 }